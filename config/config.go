@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -32,3 +33,49 @@ func ConnectDB() (*sql.DB, error) {
 	fmt.Println("Successfully connected to the database!")
 	return db, nil
 }
+
+// Timeouts bound individual outbound operations. Each one applies on top of
+// the deadline already carried by the request context, which Request sets
+// for every incoming request.
+type Timeouts struct {
+	Request  time.Duration
+	Database time.Duration
+	Stripe   time.Duration
+}
+
+// LoadTimeouts reads REQUEST_TIMEOUT, DB_TIMEOUT and STRIPE_TIMEOUT (Go
+// durations such as "3s" or "500ms"), falling back to defaults when they are
+// unset.
+func LoadTimeouts() (Timeouts, error) {
+	t := Timeouts{
+		Request:  60 * time.Second,
+		Database: 5 * time.Second,
+		Stripe:   30 * time.Second,
+	}
+
+	if err := durationFromEnv("REQUEST_TIMEOUT", &t.Request); err != nil {
+		return t, err
+	}
+	if err := durationFromEnv("DB_TIMEOUT", &t.Database); err != nil {
+		return t, err
+	}
+	if err := durationFromEnv("STRIPE_TIMEOUT", &t.Stripe); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+func durationFromEnv(key string, dst *time.Duration) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	*dst = d
+	return nil
+}
@@ -1,18 +1,173 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/Faizan2005/payment-gateway-stripe/config"
+	"github.com/Faizan2005/payment-gateway-stripe/migrations"
 	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
 	"github.com/Faizan2005/payment-gateway-stripe/routes"
 )
 
 func main() {
 
-	db, _ := config.ConnectDB()
+	db, err := config.ConnectDB()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := runMigrate(db, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+		case "webhooks":
+			if err := runWebhooks(db, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("Unknown command %q (expected: migrate, webhooks)", os.Args[1])
+		}
+		return
+	}
+
+	timeouts, err := config.LoadTimeouts()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	store := models.NewPostgresStorage(db)
+	store := models.NewPostgresStorage(db, timeouts.Database)
+	stripeProvider := provider.NewStripeProvider(os.Getenv("STRIPE_SECRET_KEY"), timeouts.Stripe)
 
 	listenAddr := ":3000"
-	server := routes.NewAPIServer(listenAddr, store)
+	server := routes.NewAPIServer(listenAddr, store, stripeProvider)
+	server.SetRequestTimeout(timeouts.Request)
 	server.Run()
 }
+
+// runMigrate handles `payment migrate up|down [n]|status`.
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: payment migrate up|down [n]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		ran, err := migrations.Up(db)
+		for _, m := range ran {
+			fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(ran) == 0 {
+			fmt.Println("schema is up to date")
+		}
+
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+			n = v
+		}
+		reverted, err := migrations.Down(db, n)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			fmt.Println("nothing to revert")
+		}
+
+	case "status":
+		statuses, err := migrations.List(db)
+		if err != nil {
+			return err
+		}
+		for _, st := range statuses {
+			state := "pending"
+			if st.Applied {
+				state = "applied " + st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", st.Version, st.Name, state)
+		}
+
+	default:
+		return fmt.Errorf("unknown migrate command %q (expected up, down or status)", args[0])
+	}
+
+	return nil
+}
+
+// runWebhooks handles `payment webhooks replay [flags]`, printing the replay
+// report as JSON.
+func runWebhooks(db *sql.DB, args []string) error {
+	if len(args) == 0 || args[0] != "replay" {
+		return fmt.Errorf("usage: payment webhooks replay [-id evt_...] [-type t] [-from RFC3339] [-to RFC3339] [-limit n] [-dry-run]")
+	}
+
+	fs := flag.NewFlagSet("webhooks replay", flag.ContinueOnError)
+	id := fs.String("id", "", "replay only the event with this ID")
+	eventType := fs.String("type", "", "replay only events of this type")
+	from := fs.String("from", "", "replay events created at or after this time (RFC3339)")
+	to := fs.String("to", "", "replay events created at or before this time (RFC3339)")
+	limit := fs.Int("limit", 0, "replay at most this many events (0 for no limit)")
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	f := models.WebhookEventFilter{ID: *id, Type: *eventType, Limit: *limit}
+	if err := parseTimeFlag("from", *from, &f.From); err != nil {
+		return err
+	}
+	if err := parseTimeFlag("to", *to, &f.To); err != nil {
+		return err
+	}
+
+	timeouts, err := config.LoadTimeouts()
+	if err != nil {
+		return err
+	}
+
+	store := models.NewPostgresStorage(db, timeouts.Database)
+	stripeProvider := provider.NewStripeProvider(os.Getenv("STRIPE_SECRET_KEY"), timeouts.Stripe)
+	server := routes.NewAPIServer("", store, stripeProvider)
+
+	report, err := server.ReplayWebhookEvents(context.Background(), f, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func parseTimeFlag(name, value string, dst *time.Time) error {
+	if value == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid -%s %q: %w", name, value, err)
+	}
+	*dst = t
+	return nil
+}
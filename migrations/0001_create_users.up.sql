@@ -0,0 +1,9 @@
+CREATE TABLE users (
+    id         SERIAL PRIMARY KEY,
+    name       TEXT        NOT NULL,
+    email      TEXT        NOT NULL,
+    stripe_id  TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX users_name_email_idx ON users (name, email);
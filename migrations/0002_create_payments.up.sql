@@ -0,0 +1,17 @@
+-- Column order matters: PostgresStorage scans SELECT * in this order.
+CREATE TABLE payments (
+    id                       SERIAL PRIMARY KEY,
+    user_id                  INTEGER     NOT NULL REFERENCES users (id),
+    name                     TEXT        NOT NULL DEFAULT '',
+    email                    TEXT        NOT NULL DEFAULT '',
+    subscription_id          INTEGER     NOT NULL DEFAULT 0,
+    transaction_id           INTEGER     NOT NULL DEFAULT 0,
+    stripe_payment_intent_id TEXT        NOT NULL UNIQUE,
+    amount                   BIGINT      NOT NULL,
+    currency                 TEXT        NOT NULL,
+    payment_method           TEXT        NOT NULL DEFAULT '',
+    status                   TEXT        NOT NULL DEFAULT 'pending',
+    created_at               TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payments_user_id_idx ON payments (user_id);
@@ -0,0 +1,11 @@
+CREATE TABLE refunds (
+    id               SERIAL PRIMARY KEY,
+    payment_id       INTEGER     NOT NULL REFERENCES payments (id),
+    transaction_id   INTEGER     NOT NULL DEFAULT 0,
+    stripe_refund_id TEXT        NOT NULL UNIQUE,
+    amount           BIGINT      NOT NULL,
+    status           TEXT        NOT NULL,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX refunds_payment_id_idx ON refunds (payment_id);
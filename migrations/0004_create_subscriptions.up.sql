@@ -0,0 +1,14 @@
+-- Column order matters: PostgresStorage scans SELECT * in this order.
+CREATE TABLE subscriptions (
+    id                     SERIAL PRIMARY KEY,
+    user_id                INTEGER     NOT NULL REFERENCES users (id),
+    payment_id             INTEGER     NOT NULL DEFAULT 0,
+    amount                 BIGINT      NOT NULL,
+    currency               TEXT        NOT NULL,
+    stripe_subscription_id TEXT        NOT NULL UNIQUE,
+    status                 TEXT        NOT NULL,
+    start_date             TIMESTAMPTZ NOT NULL DEFAULT now(),
+    end_date               TIMESTAMPTZ
+);
+
+CREATE INDEX subscriptions_user_id_idx ON subscriptions (user_id);
@@ -0,0 +1,15 @@
+-- Column order matters: PostgresStorage scans SELECT * in this order.
+-- payment_id and refund_id are 0 when the row is of the other type.
+CREATE TABLE transactions (
+    id               SERIAL PRIMARY KEY,
+    user_id          INTEGER     NOT NULL REFERENCES users (id),
+    payment_id       INTEGER     NOT NULL DEFAULT 0,
+    refund_id        INTEGER     NOT NULL DEFAULT 0,
+    amount           BIGINT      NOT NULL,
+    currency         TEXT        NOT NULL,
+    transaction_type TEXT        NOT NULL,
+    status           TEXT        NOT NULL DEFAULT 'pending',
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX transactions_user_id_idx ON transactions (user_id);
@@ -0,0 +1,15 @@
+-- One row per remote Stripe object whose local rows have not been confirmed
+-- yet. The outbox worker retries persistence or compensates stuck entries.
+CREATE TABLE outbox (
+    id         SERIAL PRIMARY KEY,
+    kind       TEXT        NOT NULL,
+    stripe_id  TEXT        NOT NULL,
+    payload    JSONB       NOT NULL,
+    status     TEXT        NOT NULL DEFAULT 'pending',
+    attempts   INTEGER     NOT NULL DEFAULT 0,
+    last_error TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX outbox_status_updated_at_idx ON outbox (status, updated_at);
@@ -0,0 +1,12 @@
+-- One row per client Idempotency-Key. status_code stays 0 while the first
+-- request is still running; afterwards the response is kept for replay.
+CREATE TABLE idempotency_keys (
+    key          TEXT PRIMARY KEY,
+    fingerprint  TEXT        NOT NULL,
+    status_code  INTEGER     NOT NULL DEFAULT 0,
+    response     BYTEA,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
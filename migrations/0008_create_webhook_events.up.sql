@@ -0,0 +1,16 @@
+-- One row per Stripe event received, keyed by the event ID so redeliveries
+-- can be recognized. object_id and created let late events be detected.
+CREATE TABLE webhook_events (
+    id           TEXT PRIMARY KEY,
+    type         TEXT        NOT NULL,
+    object_id    TEXT        NOT NULL DEFAULT '',
+    payload      JSONB       NOT NULL,
+    created      TIMESTAMPTZ NOT NULL,
+    attempts     INTEGER     NOT NULL DEFAULT 1,
+    outcome      TEXT        NOT NULL DEFAULT 'pending',
+    error        TEXT        NOT NULL DEFAULT '',
+    received_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    processed_at TIMESTAMPTZ
+);
+
+CREATE INDEX webhook_events_object_id_created_idx ON webhook_events (object_id, created);
@@ -0,0 +1,10 @@
+DROP TABLE webhook_dead_letters;
+
+DROP INDEX webhook_events_outcome_next_attempt_at_idx;
+
+UPDATE webhook_events SET outcome = 'failed' WHERE outcome IN ('processing', 'dead_lettered');
+
+ALTER TABLE webhook_events
+    DROP COLUMN locked_until,
+    DROP COLUMN next_attempt_at,
+    ALTER COLUMN attempts SET DEFAULT 1;
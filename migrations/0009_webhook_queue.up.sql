@@ -0,0 +1,20 @@
+-- webhook_events doubles as the processing queue: workers claim due rows,
+-- retry failures with backoff and move exhausted ones to the dead letters.
+ALTER TABLE webhook_events
+    ALTER COLUMN attempts SET DEFAULT 0,
+    ADD COLUMN next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN locked_until    TIMESTAMPTZ;
+
+UPDATE webhook_events SET outcome = 'pending' WHERE outcome = 'failed';
+
+CREATE INDEX webhook_events_outcome_next_attempt_at_idx ON webhook_events (outcome, next_attempt_at);
+
+CREATE TABLE webhook_dead_letters (
+    id        SERIAL PRIMARY KEY,
+    event_id  TEXT        NOT NULL REFERENCES webhook_events (id),
+    type      TEXT        NOT NULL,
+    payload   JSONB       NOT NULL,
+    attempts  INTEGER     NOT NULL,
+    error     TEXT        NOT NULL DEFAULT '',
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
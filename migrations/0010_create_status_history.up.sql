@@ -0,0 +1,12 @@
+-- Every status a payment or subscription has been in, starting with the one
+-- it was created with (from_status is empty for that first row).
+CREATE TABLE status_history (
+    id          SERIAL PRIMARY KEY,
+    entity      TEXT        NOT NULL,
+    stripe_id   TEXT        NOT NULL,
+    from_status TEXT        NOT NULL DEFAULT '',
+    to_status   TEXT        NOT NULL,
+    changed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX status_history_entity_stripe_id_idx ON status_history (entity, stripe_id);
@@ -0,0 +1,7 @@
+ALTER TABLE refunds
+    DROP COLUMN metadata,
+    DROP COLUMN reason;
+
+UPDATE payments SET status = 'refunded' WHERE status = 'partially_refunded';
+
+ALTER TABLE payments DROP COLUMN amount_refunded;
@@ -0,0 +1,12 @@
+-- Payments track the cumulative amount refunded so several partial refunds
+-- can be checked against the remaining balance.
+ALTER TABLE payments ADD COLUMN amount_refunded BIGINT NOT NULL DEFAULT 0;
+
+UPDATE payments SET amount_refunded = amount WHERE status = 'refunded';
+
+ALTER TABLE payments ADD CONSTRAINT payments_amount_refunded_check
+    CHECK (amount_refunded >= 0 AND amount_refunded <= amount);
+
+ALTER TABLE refunds
+    ADD COLUMN reason   TEXT  NOT NULL DEFAULT '',
+    ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,4 @@
+DROP INDEX refunds_status_idx;
+
+-- Completed refunds go back to Stripe's 'succeeded'.
+UPDATE refunds SET status = 'succeeded' WHERE status = 'refunded';
@@ -0,0 +1,5 @@
+-- Refund statuses now follow the refund lifecycle; completed refunds are
+-- stored as 'refunded'.
+UPDATE refunds SET status = 'refunded' WHERE status = 'succeeded';
+
+CREATE INDEX refunds_status_idx ON refunds (status);
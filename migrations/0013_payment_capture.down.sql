@@ -0,0 +1,12 @@
+ALTER TABLE payments DROP CONSTRAINT payments_amount_refunded_check;
+
+UPDATE payments SET status = 'pending' WHERE status = 'authorized';
+
+ALTER TABLE payments
+    DROP COLUMN authorization_expires_at,
+    DROP COLUMN amount_captured,
+    DROP COLUMN amount_authorized,
+    DROP COLUMN capture_method;
+
+ALTER TABLE payments ADD CONSTRAINT payments_amount_refunded_check
+    CHECK (amount_refunded >= 0 AND amount_refunded <= amount);
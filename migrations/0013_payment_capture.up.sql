@@ -0,0 +1,12 @@
+-- Manual-capture payments are authorized first and captured later, possibly
+-- for less than was authorized. Only the captured amount can be refunded.
+ALTER TABLE payments
+    ADD COLUMN capture_method           TEXT   NOT NULL DEFAULT 'automatic',
+    ADD COLUMN amount_authorized        BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN amount_captured          BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN authorization_expires_at TIMESTAMPTZ;
+
+ALTER TABLE payments DROP CONSTRAINT payments_amount_refunded_check;
+
+ALTER TABLE payments ADD CONSTRAINT payments_amount_refunded_check
+    CHECK (amount_refunded >= 0 AND amount_refunded <= CASE capture_method WHEN 'manual' THEN amount_captured ELSE amount END);
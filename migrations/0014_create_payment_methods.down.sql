@@ -0,0 +1,3 @@
+DROP INDEX users_stripe_id_idx;
+
+DROP TABLE payment_methods;
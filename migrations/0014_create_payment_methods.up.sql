@@ -0,0 +1,23 @@
+-- Cards saved to a customer through SetupIntents. The card details are the
+-- display fields Stripe returns; the card number itself never reaches us.
+CREATE TABLE payment_methods (
+    id                       SERIAL PRIMARY KEY,
+    user_id                  INTEGER     NOT NULL REFERENCES users (id),
+    stripe_payment_method_id TEXT        NOT NULL UNIQUE,
+    type                     TEXT        NOT NULL DEFAULT 'card',
+    brand                    TEXT        NOT NULL DEFAULT '',
+    last4                    TEXT        NOT NULL DEFAULT '',
+    exp_month                INTEGER     NOT NULL DEFAULT 0,
+    exp_year                 INTEGER     NOT NULL DEFAULT 0,
+    fingerprint              TEXT        NOT NULL DEFAULT '',
+    is_default               BOOLEAN     NOT NULL DEFAULT false,
+    created_at               TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payment_methods_user_id_idx ON payment_methods (user_id);
+
+-- At most one default payment method per customer.
+CREATE UNIQUE INDEX payment_methods_default_idx ON payment_methods (user_id) WHERE is_default;
+
+-- Webhooks identify customers by their Stripe ID.
+CREATE INDEX users_stripe_id_idx ON users (stripe_id);
@@ -0,0 +1,16 @@
+-- Hosted Checkout Sessions started by the gateway. Stripe only creates the
+-- PaymentIntent once the customer pays, so the payment row, and payment_id,
+-- follow with the checkout.session.completed webhook.
+CREATE TABLE checkout_sessions (
+    id                         SERIAL PRIMARY KEY,
+    user_id                    INTEGER     NOT NULL REFERENCES users (id),
+    stripe_checkout_session_id TEXT        NOT NULL UNIQUE,
+    payment_id                 INTEGER     REFERENCES payments (id),
+    amount_total               BIGINT      NOT NULL,
+    currency                   TEXT        NOT NULL,
+    status                     TEXT        NOT NULL DEFAULT 'open',
+    url                        TEXT        NOT NULL DEFAULT '',
+    created_at                 TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX checkout_sessions_user_id_idx ON checkout_sessions (user_id);
@@ -0,0 +1,3 @@
+ALTER TABLE checkout_sessions DROP COLUMN payment_link_id;
+
+DROP TABLE payment_links;
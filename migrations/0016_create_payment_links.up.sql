@@ -0,0 +1,24 @@
+-- Shareable Stripe Payment Links. Stripe links never expire on their own, so
+-- expires_at is enforced here by deactivating the link once it has passed.
+-- max_payments is 0 when the link can be paid any number of times.
+CREATE TABLE payment_links (
+    id                     SERIAL PRIMARY KEY,
+    stripe_payment_link_id TEXT        NOT NULL UNIQUE,
+    stripe_price_id        TEXT        NOT NULL,
+    url                    TEXT        NOT NULL,
+    amount                 BIGINT      NOT NULL,
+    currency               TEXT        NOT NULL,
+    description            TEXT        NOT NULL DEFAULT '',
+    max_payments           INTEGER     NOT NULL DEFAULT 0,
+    expires_at             TIMESTAMPTZ,
+    active                 BOOLEAN     NOT NULL DEFAULT true,
+    created_at             TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payment_links_expires_at_idx ON payment_links (expires_at) WHERE active;
+
+-- Every payment made through a link arrives as a Checkout Session opened from
+-- it, which ties the payment and its ledger entry back to the link.
+ALTER TABLE checkout_sessions ADD COLUMN payment_link_id INTEGER REFERENCES payment_links (id);
+
+CREATE INDEX checkout_sessions_payment_link_id_idx ON checkout_sessions (payment_link_id);
@@ -0,0 +1,5 @@
+ALTER TABLE subscriptions DROP COLUMN price_id;
+
+DROP TABLE prices;
+
+DROP TABLE products;
@@ -0,0 +1,31 @@
+-- The local product and price catalog, each row mirroring a Stripe Product or
+-- Price. Prices are looked up by code, a name the gateway controls (such as
+-- "pro-monthly") that is also the Stripe lookup_key. Stripe prices cannot
+-- change their amount, so neither can a row here; archive it and add another.
+CREATE TABLE products (
+    id                SERIAL PRIMARY KEY,
+    stripe_product_id TEXT        NOT NULL UNIQUE,
+    name              TEXT        NOT NULL,
+    description       TEXT        NOT NULL DEFAULT '',
+    active            BOOLEAN     NOT NULL DEFAULT true,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- recurring_interval is '' for one-time prices.
+CREATE TABLE prices (
+    id                 SERIAL PRIMARY KEY,
+    product_id         INTEGER     NOT NULL REFERENCES products (id),
+    stripe_price_id    TEXT        NOT NULL UNIQUE,
+    code               TEXT        NOT NULL UNIQUE,
+    unit_amount        BIGINT      NOT NULL,
+    currency           TEXT        NOT NULL,
+    recurring_interval TEXT        NOT NULL DEFAULT '',
+    interval_count     INTEGER     NOT NULL DEFAULT 0,
+    active             BOOLEAN     NOT NULL DEFAULT true,
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX prices_product_id_idx ON prices (product_id);
+
+-- The price a subscription was created from; 0 for older subscriptions.
+ALTER TABLE subscriptions ADD COLUMN price_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+DROP TABLE notifications;
+
+ALTER TABLE subscriptions
+    DROP COLUMN trial_end,
+    DROP COLUMN coupon_id,
+    DROP COLUMN promotion_code_id,
+    DROP COLUMN percent_off,
+    DROP COLUMN amount_off,
+    DROP COLUMN discount_duration,
+    DROP COLUMN discount_ends_at;
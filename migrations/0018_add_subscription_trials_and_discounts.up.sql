@@ -0,0 +1,29 @@
+-- Free trials and the discount a subscription was created with. The discount
+-- columns describe the coupon applied, directly or through a promotion code;
+-- coupon_id is '' when there is none. discount_ends_at is NULL for discounts
+-- that last forever.
+ALTER TABLE subscriptions
+    ADD COLUMN trial_end         TIMESTAMPTZ,
+    ADD COLUMN coupon_id         TEXT             NOT NULL DEFAULT '',
+    ADD COLUMN promotion_code_id TEXT             NOT NULL DEFAULT '',
+    ADD COLUMN percent_off       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    ADD COLUMN amount_off        BIGINT           NOT NULL DEFAULT 0,
+    ADD COLUMN discount_duration TEXT             NOT NULL DEFAULT '',
+    ADD COLUMN discount_ends_at  TIMESTAMPTZ;
+
+-- Messages owed to customers, such as the reminder that a trial is ending.
+-- Rows are written by the webhook that triggers them, keyed by its event so
+-- a redelivery or replay does not notify twice, and picked up by whatever
+-- sends them, which sets sent_at.
+CREATE TABLE notifications (
+    id                     SERIAL PRIMARY KEY,
+    user_id                INTEGER     NOT NULL REFERENCES users (id),
+    kind                   TEXT        NOT NULL,
+    event_id               TEXT        NOT NULL UNIQUE,
+    stripe_subscription_id TEXT        NOT NULL DEFAULT '',
+    payload                JSONB       NOT NULL DEFAULT '{}',
+    created_at             TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at                TIMESTAMPTZ
+);
+
+CREATE INDEX notifications_pending_idx ON notifications (id) WHERE sent_at IS NULL;
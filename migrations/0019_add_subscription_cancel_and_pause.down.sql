@@ -0,0 +1,4 @@
+ALTER TABLE subscriptions
+    DROP COLUMN cancel_at_period_end,
+    DROP COLUMN pause_behavior,
+    DROP COLUMN pause_resumes_at;
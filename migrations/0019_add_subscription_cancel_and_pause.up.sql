@@ -0,0 +1,8 @@
+-- Scheduled cancellation and paused collection, as Stripe reports them.
+-- end_date is when the subscription ended or, while cancel_at_period_end is
+-- set, when it will end. pause_behavior is '' unless collection is paused;
+-- pause_resumes_at is NULL for a pause without a resume date.
+ALTER TABLE subscriptions
+    ADD COLUMN cancel_at_period_end BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN pause_behavior       TEXT    NOT NULL DEFAULT '',
+    ADD COLUMN pause_resumes_at     TIMESTAMPTZ;
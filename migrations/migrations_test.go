@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func TestLoad(t *testing.T) {
+	ms, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, m := range ms {
+		if m.Version != i+1 {
+			t.Fatalf("migration %04d_%s found where version %d was expected", m.Version, m.Name, i+1)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %04d_%s has an empty up or down file", m.Version, m.Name)
+		}
+	}
+
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2*len(ms) {
+		t.Fatalf("%d .sql files for %d migrations, want an up and a down file each", len(names), len(ms))
+	}
+}
+
+// TestUpDownUp applies every migration, rolls all of them back and applies
+// them again against the database named by TEST_DATABASE_URL. It works in a
+// schema of its own so it cannot disturb other tests sharing the database.
+func TestUpDownUp(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// One connection, so the search_path set below applies to every
+	// statement the migrator runs.
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("connecting to TEST_DATABASE_URL: %v", err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+	if _, err := db.Exec(`SET search_path TO ` + schema); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ran, err := Up(db); err != nil || len(ran) != len(ms) {
+		t.Fatalf("Up ran %d of %d migrations: %v", len(ran), len(ms), err)
+	}
+	if reverted, err := Down(db, len(ms)); err != nil || len(reverted) != len(ms) {
+		t.Fatalf("Down reverted %d of %d migrations: %v", len(reverted), len(ms), err)
+	}
+
+	var tables []string
+	rows, err := db.Query(`SELECT table_name FROM information_schema.tables WHERE table_schema = $1 AND table_name <> 'schema_migrations'`, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if len(tables) != 0 {
+		t.Fatalf("tables left after rolling everything back: %v", tables)
+	}
+
+	if ran, err := Up(db); err != nil || len(ran) != len(ms) {
+		t.Fatalf("Up after Down ran %d of %d migrations: %v", len(ran), len(ms), err)
+	}
+	st, err := List(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range st {
+		if !s.Applied {
+			t.Fatalf("migration %04d_%s not applied after the round trip", s.Version, s.Name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Capture methods a payment can be created with.
+const (
+	CaptureAutomatic = "automatic"
+	CaptureManual    = "manual"
+)
+
+// CapturedAmount is how much of the payment was actually taken, and so how
+// much can be refunded. Automatic payments are captured in full.
+func (p *Payment) CapturedAmount() int64 {
+	if p.CaptureMethod == CaptureManual {
+		return p.AmountCaptured
+	}
+	return p.Amount
+}
+
+func (s *PostgresStorage) RecordAuthorization(ctx context.Context, paymentIntentID string, amount int64, expiresAt *time.Time) error {
+	query := `UPDATE payments SET amount_authorized=$1, authorization_expires_at=$2 WHERE stripe_payment_intent_id=$3`
+
+	return s.execOne(ctx, "payment", query, amount, expiresAt, paymentIntentID)
+}
+
+func (s *PostgresStorage) RecordCapture(ctx context.Context, paymentIntentID string, amount int64) error {
+	query := `UPDATE payments SET amount_captured=$1 WHERE stripe_payment_intent_id=$2`
+
+	return s.execOne(ctx, "payment", query, amount, paymentIntentID)
+}
+
+func (s *MemoryStorage) RecordAuthorization(ctx context.Context, paymentIntentID string, amount int64, expiresAt *time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.paymentByIntent(paymentIntentID)
+	if p == nil {
+		return fmt.Errorf("no payment found: %w", ErrNotFound)
+	}
+	p.AmountAuthorized = amount
+	p.AuthorizationExpiresAt = expiresAt
+	return nil
+}
+
+func (s *MemoryStorage) RecordCapture(ctx context.Context, paymentIntentID string, amount int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.paymentByIntent(paymentIntentID)
+	if p == nil {
+		return fmt.Errorf("no payment found: %w", ErrNotFound)
+	}
+	p.AmountCaptured = amount
+	return nil
+}
@@ -0,0 +1,353 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Product is a catalog entry mirroring a Stripe Product.
+type Product struct {
+	ID              uint      `json:"id" db:"id"`
+	StripeProductID string    `json:"stripe_product_id" db:"stripe_product_id"`
+	Name            string    `json:"name" db:"name"`
+	Description     string    `json:"description,omitempty" db:"description"`
+	Active          bool      `json:"active" db:"active"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+}
+
+// Price is a catalog price mirroring a Stripe Price, found by its Code.
+// Interval is empty for one-time prices and otherwise day, week, month or
+// year, billed every IntervalCount intervals.
+type Price struct {
+	ID            uint      `json:"id" db:"id"`
+	ProductID     uint      `json:"product_id" db:"product_id"`
+	StripePriceID string    `json:"stripe_price_id" db:"stripe_price_id"`
+	Code          string    `json:"code" db:"code"`
+	UnitAmount    int64     `json:"unit_amount" db:"unit_amount"`
+	Currency      string    `json:"currency" db:"currency"`
+	Interval      string    `json:"interval,omitempty" db:"recurring_interval"`
+	IntervalCount int64     `json:"interval_count,omitempty" db:"interval_count"`
+	Active        bool      `json:"active" db:"active"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+// Recurring reports whether the price bills repeatedly, as subscriptions
+// need.
+func (p *Price) Recurring() bool {
+	return p.Interval != ""
+}
+
+const productColumns = `id, stripe_product_id, name, description, active, created_at`
+
+const priceColumns = `id, product_id, stripe_price_id, code, unit_amount, currency, recurring_interval, interval_count, active, created_at`
+
+func scanProduct(row interface{ Scan(...interface{}) error }) (*Product, error) {
+	var p Product
+	err := row.Scan(&p.ID, &p.StripeProductID, &p.Name, &p.Description, &p.Active, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func scanPrice(row interface{ Scan(...interface{}) error }) (*Price, error) {
+	var p Price
+	err := row.Scan(&p.ID, &p.ProductID, &p.StripePriceID, &p.Code, &p.UnitAmount, &p.Currency, &p.Interval, &p.IntervalCount, &p.Active, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *PostgresStorage) CreateProduct(ctx context.Context, p *Product) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO products (stripe_product_id, name, description)
+VALUES ($1, $2, $3)
+RETURNING id, active, created_at`
+
+	return s.q.QueryRowContext(ctx, query, p.StripeProductID, p.Name, p.Description).
+		Scan(&p.ID, &p.Active, &p.CreatedAt)
+}
+
+func (s *PostgresStorage) getProduct(ctx context.Context, where string, arg interface{}) (*Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + productColumns + ` FROM products WHERE ` + where
+
+	p, err := scanProduct(s.q.QueryRowContext(ctx, query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no product found for %v: %w", arg, ErrNotFound)
+	}
+	return p, err
+}
+
+func (s *PostgresStorage) GetProduct(ctx context.Context, id uint) (*Product, error) {
+	return s.getProduct(ctx, `id=$1`, id)
+}
+
+func (s *PostgresStorage) GetProductByStripeID(ctx context.Context, stripeID string) (*Product, error) {
+	return s.getProduct(ctx, `stripe_product_id=$1`, stripeID)
+}
+
+func (s *PostgresStorage) ListProducts(ctx context.Context) ([]*Product, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, `SELECT `+productColumns+` FROM products ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ps []*Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+
+	return ps, rows.Err()
+}
+
+func (s *PostgresStorage) UpdateProduct(ctx context.Context, p *Product) error {
+	query := `UPDATE products SET name=$2, description=$3, active=$4 WHERE id=$1`
+
+	return s.execOne(ctx, "product", query, p.ID, p.Name, p.Description, p.Active)
+}
+
+func (s *PostgresStorage) CreatePrice(ctx context.Context, p *Price) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO prices (product_id, stripe_price_id, code, unit_amount, currency, recurring_interval, interval_count)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, active, created_at`
+
+	return s.q.QueryRowContext(ctx, query, p.ProductID, p.StripePriceID, p.Code, p.UnitAmount, p.Currency, p.Interval, p.IntervalCount).
+		Scan(&p.ID, &p.Active, &p.CreatedAt)
+}
+
+func (s *PostgresStorage) getPrice(ctx context.Context, where string, arg interface{}) (*Price, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + priceColumns + ` FROM prices WHERE ` + where
+
+	p, err := scanPrice(s.q.QueryRowContext(ctx, query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no price found for %v: %w", arg, ErrNotFound)
+	}
+	return p, err
+}
+
+func (s *PostgresStorage) GetPrice(ctx context.Context, id uint) (*Price, error) {
+	return s.getPrice(ctx, `id=$1`, id)
+}
+
+func (s *PostgresStorage) GetPriceByCode(ctx context.Context, code string) (*Price, error) {
+	return s.getPrice(ctx, `code=$1`, code)
+}
+
+func (s *PostgresStorage) GetPriceByStripeID(ctx context.Context, stripeID string) (*Price, error) {
+	return s.getPrice(ctx, `stripe_price_id=$1`, stripeID)
+}
+
+func (s *PostgresStorage) ListPrices(ctx context.Context, productID uint) ([]*Price, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + priceColumns + ` FROM prices WHERE $1 = 0 OR product_id=$1 ORDER BY id`
+
+	rows, err := s.q.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ps []*Price
+	for rows.Next() {
+		p, err := scanPrice(rows)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+
+	return ps, rows.Err()
+}
+
+func (s *PostgresStorage) SetPriceActive(ctx context.Context, stripeID string, active bool) error {
+	query := `UPDATE prices SET active=$2 WHERE stripe_price_id=$1`
+
+	return s.execOne(ctx, "price", query, stripeID, active)
+}
+
+func (s *MemoryStorage) CreateProduct(ctx context.Context, p *Product) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := *p
+	row.ID = s.nextID("products")
+	row.Active = true
+	row.CreatedAt = time.Now()
+	s.products[row.ID] = &row
+
+	p.ID, p.Active, p.CreatedAt = row.ID, row.Active, row.CreatedAt
+	return nil
+}
+
+func (s *MemoryStorage) findProduct(ctx context.Context, match func(*Product) bool, what interface{}) (*Product, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.products {
+		if match(p) {
+			out := *p
+			return &out, nil
+		}
+	}
+	return nil, fmt.Errorf("no product found for %v: %w", what, ErrNotFound)
+}
+
+func (s *MemoryStorage) GetProduct(ctx context.Context, id uint) (*Product, error) {
+	return s.findProduct(ctx, func(p *Product) bool { return p.ID == id }, id)
+}
+
+func (s *MemoryStorage) GetProductByStripeID(ctx context.Context, stripeID string) (*Product, error) {
+	return s.findProduct(ctx, func(p *Product) bool { return p.StripeProductID == stripeID }, stripeID)
+}
+
+func (s *MemoryStorage) ListProducts(ctx context.Context) ([]*Product, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ps []*Product
+	for _, p := range s.products {
+		out := *p
+		ps = append(ps, &out)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+
+	return ps, nil
+}
+
+func (s *MemoryStorage) UpdateProduct(ctx context.Context, p *Product) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.products[p.ID]
+	if !ok {
+		return fmt.Errorf("no product found: %w", ErrNotFound)
+	}
+	row.Name, row.Description, row.Active = p.Name, p.Description, p.Active
+	return nil
+}
+
+func (s *MemoryStorage) CreatePrice(ctx context.Context, p *Price) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := *p
+	row.ID = s.nextID("prices")
+	row.Active = true
+	row.CreatedAt = time.Now()
+	s.prices[row.ID] = &row
+
+	p.ID, p.Active, p.CreatedAt = row.ID, row.Active, row.CreatedAt
+	return nil
+}
+
+func (s *MemoryStorage) findPrice(ctx context.Context, match func(*Price) bool, what interface{}) (*Price, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.prices {
+		if match(p) {
+			out := *p
+			return &out, nil
+		}
+	}
+	return nil, fmt.Errorf("no price found for %v: %w", what, ErrNotFound)
+}
+
+func (s *MemoryStorage) GetPrice(ctx context.Context, id uint) (*Price, error) {
+	return s.findPrice(ctx, func(p *Price) bool { return p.ID == id }, id)
+}
+
+func (s *MemoryStorage) GetPriceByCode(ctx context.Context, code string) (*Price, error) {
+	return s.findPrice(ctx, func(p *Price) bool { return p.Code == code }, code)
+}
+
+func (s *MemoryStorage) GetPriceByStripeID(ctx context.Context, stripeID string) (*Price, error) {
+	return s.findPrice(ctx, func(p *Price) bool { return p.StripePriceID == stripeID }, stripeID)
+}
+
+func (s *MemoryStorage) ListPrices(ctx context.Context, productID uint) ([]*Price, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ps []*Price
+	for _, p := range s.prices {
+		if productID == 0 || p.ProductID == productID {
+			out := *p
+			ps = append(ps, &out)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+
+	return ps, nil
+}
+
+func (s *MemoryStorage) SetPriceActive(ctx context.Context, stripeID string, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.prices {
+		if p.StripePriceID == stripeID {
+			p.Active = active
+			return nil
+		}
+	}
+	return fmt.Errorf("no price found: %w", ErrNotFound)
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CheckoutSession is a hosted Stripe Checkout page started for a customer.
+// PaymentID is set once the customer has paid and the payment row exists, and
+// PaymentLinkID for sessions opened from a payment link.
+type CheckoutSession struct {
+	ID                      uint                  `json:"id" db:"id"`
+	UserID                  uint                  `json:"user_id" db:"user_id"`
+	StripeCheckoutSessionID string                `json:"stripe_checkout_session_id" db:"stripe_checkout_session_id"`
+	PaymentID               *uint                 `json:"payment_id,omitempty" db:"payment_id"`
+	PaymentLinkID           *uint                 `json:"payment_link_id,omitempty" db:"payment_link_id"`
+	AmountTotal             int64                 `json:"amount_total" db:"amount_total"`
+	Currency                string                `json:"currency" db:"currency"`
+	Status                  CheckoutSessionStatus `json:"status" db:"status"`
+	URL                     string                `json:"url" db:"url"`
+	CreatedAt               time.Time             `json:"created_at" db:"created_at"`
+}
+
+const checkoutSessionColumns = `id, user_id, stripe_checkout_session_id, payment_id, payment_link_id, amount_total, currency, status, url, created_at`
+
+func scanCheckoutSession(row interface{ Scan(...interface{}) error }) (*CheckoutSession, error) {
+	var cs CheckoutSession
+	var paymentID, paymentLinkID sql.NullInt64
+	err := row.Scan(&cs.ID, &cs.UserID, &cs.StripeCheckoutSessionID, &paymentID, &paymentLinkID, &cs.AmountTotal, &cs.Currency, &cs.Status, &cs.URL, &cs.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	cs.PaymentID = nullableID(paymentID)
+	cs.PaymentLinkID = nullableID(paymentLinkID)
+	return &cs, nil
+}
+
+func nullableID(id sql.NullInt64) *uint {
+	if !id.Valid {
+		return nil
+	}
+	out := uint(id.Int64)
+	return &out
+}
+
+// copyID returns a copy of id so stored rows never share it with callers.
+func copyID(id *uint) *uint {
+	if id == nil {
+		return nil
+	}
+	out := *id
+	return &out
+}
+
+func (s *PostgresStorage) CreateCheckoutSession(ctx context.Context, cs *CheckoutSession) error {
+	return s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		err := func() error {
+			ctx, cancel := t.withTimeout(ctx)
+			defer cancel()
+
+			query := `INSERT INTO checkout_sessions (user_id, stripe_checkout_session_id, payment_link_id, amount_total, currency, url)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, status, created_at`
+
+			return t.q.QueryRowContext(ctx, query, cs.UserID, cs.StripeCheckoutSessionID, cs.PaymentLinkID, cs.AmountTotal, cs.Currency, cs.URL).
+				Scan(&cs.ID, &cs.Status, &cs.CreatedAt)
+		}()
+		if err != nil {
+			return err
+		}
+		return t.recordStatus(ctx, EntityCheckoutSession, cs.StripeCheckoutSessionID, "", string(cs.Status))
+	})
+}
+
+func (s *PostgresStorage) GetCheckoutSession(ctx context.Context, stripeID string) (*CheckoutSession, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + checkoutSessionColumns + ` FROM checkout_sessions WHERE stripe_checkout_session_id=$1`
+
+	cs, err := scanCheckoutSession(s.q.QueryRowContext(ctx, query, stripeID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no checkout session found for %s: %w", stripeID, ErrNotFound)
+	}
+	return cs, err
+}
+
+func (s *PostgresStorage) UpdateCheckoutSession(ctx context.Context, stripeID string, status CheckoutSessionStatus, paymentID *uint) error {
+	return s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		if err := t.transitionCheckoutSession(ctx, `stripe_checkout_session_id=$1`, status, stripeID); err != nil {
+			return err
+		}
+		if paymentID == nil {
+			return nil
+		}
+
+		query := `UPDATE checkout_sessions SET payment_id=$2 WHERE stripe_checkout_session_id=$1`
+		return t.execOne(ctx, "checkout session", query, stripeID, *paymentID)
+	})
+}
+
+func (s *MemoryStorage) checkoutSessionByStripeID(stripeID string) *CheckoutSession {
+	for _, cs := range s.checkoutSessions {
+		if cs.StripeCheckoutSessionID == stripeID {
+			return cs
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) CreateCheckoutSession(ctx context.Context, cs *CheckoutSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := &CheckoutSession{
+		ID:                      s.nextID("checkout_sessions"),
+		UserID:                  cs.UserID,
+		StripeCheckoutSessionID: cs.StripeCheckoutSessionID,
+		PaymentLinkID:           copyID(cs.PaymentLinkID),
+		AmountTotal:             cs.AmountTotal,
+		Currency:                cs.Currency,
+		Status:                  CheckoutSessionOpen,
+		URL:                     cs.URL,
+		CreatedAt:               time.Now(),
+	}
+	s.checkoutSessions[row.ID] = row
+	s.recordStatus(EntityCheckoutSession, row.StripeCheckoutSessionID, "", string(row.Status))
+
+	cs.ID, cs.Status, cs.CreatedAt = row.ID, row.Status, row.CreatedAt
+	return nil
+}
+
+func (s *MemoryStorage) GetCheckoutSession(ctx context.Context, stripeID string) (*CheckoutSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cs := s.checkoutSessionByStripeID(stripeID)
+	if cs == nil {
+		return nil, fmt.Errorf("no checkout session found for %s: %w", stripeID, ErrNotFound)
+	}
+	out := *cs
+	out.PaymentID, out.PaymentLinkID = copyID(cs.PaymentID), copyID(cs.PaymentLinkID)
+	return &out, nil
+}
+
+func (s *MemoryStorage) UpdateCheckoutSession(ctx context.Context, stripeID string, status CheckoutSessionStatus, paymentID *uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := s.checkoutSessionByStripeID(stripeID)
+	if cs == nil {
+		return fmt.Errorf("no checkout session found: %w", ErrNotFound)
+	}
+	if cs.Status != status {
+		if !cs.Status.CanTransitionTo(status) {
+			return fmt.Errorf("%s %s: %s -> %s: %w", EntityCheckoutSession, stripeID, cs.Status, status, ErrInvalidTransition)
+		}
+		s.recordStatus(EntityCheckoutSession, stripeID, string(cs.Status), string(status))
+		cs.Status = status
+	}
+	if paymentID != nil {
+		cs.PaymentID = copyID(paymentID)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IdempotencyKey is a client-supplied Idempotency-Key together with the
+// fingerprint of the request that first used it and, once that request has
+// finished, the response to replay on retries.
+type IdempotencyKey struct {
+	Key         string     `json:"key" db:"key"`
+	Fingerprint string     `json:"fingerprint" db:"fingerprint"`
+	StatusCode  int        `json:"status_code" db:"status_code"`
+	Response    []byte     `json:"response" db:"response"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
+}
+
+// Completed reports whether the first request has stored its response.
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
+
+func (s *PostgresStorage) ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, expiredBefore, staleBefore time.Time) (*IdempotencyKey, bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// Take over the row if its response has expired or its request was
+	// abandoned mid-flight; otherwise leave it alone and report it.
+	query := `INSERT INTO idempotency_keys (key, fingerprint) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE
+SET fingerprint=EXCLUDED.fingerprint, status_code=0, response=NULL, created_at=now(), completed_at=NULL
+WHERE idempotency_keys.created_at < $3 OR (idempotency_keys.status_code = 0 AND idempotency_keys.created_at < $4)
+RETURNING key`
+
+	var reserved string
+	err := s.q.QueryRowContext(ctx, query, key, fingerprint, expiredBefore, staleBefore).Scan(&reserved)
+	if err == nil {
+		return nil, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	query = `SELECT key, fingerprint, status_code, response, created_at, completed_at FROM idempotency_keys WHERE key=$1`
+
+	var k IdempotencyKey
+	err = s.q.QueryRowContext(ctx, query, key).Scan(&k.Key, &k.Fingerprint, &k.StatusCode, &k.Response, &k.CreatedAt, &k.CompletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, fmt.Errorf("idempotency key %s released concurrently: %w", key, ErrNotFound)
+		}
+		return nil, false, err
+	}
+	return &k, false, nil
+}
+
+func (s *PostgresStorage) CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, response []byte) error {
+	query := `UPDATE idempotency_keys SET status_code=$1, response=$2, completed_at=now() WHERE key=$3`
+
+	return s.execOne(ctx, "idempotency key", query, statusCode, response, key)
+}
+
+func (s *PostgresStorage) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE key=$1`
+
+	return s.execOne(ctx, "idempotency key", query, key)
+}
+
+func (s *MemoryStorage) ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, expiredBefore, staleBefore time.Time) (*IdempotencyKey, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.idempotencyKeys[key]; ok {
+		expired := k.CreatedAt.Before(expiredBefore)
+		stale := !k.Completed() && k.CreatedAt.Before(staleBefore)
+		if !expired && !stale {
+			out := *k
+			out.Response = append([]byte(nil), k.Response...)
+			return &out, false, nil
+		}
+	}
+
+	s.idempotencyKeys[key] = &IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   time.Now(),
+	}
+	return nil, true, nil
+}
+
+func (s *MemoryStorage) CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, response []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.idempotencyKeys[key]
+	if !ok {
+		return fmt.Errorf("no idempotency key found: %w", ErrNotFound)
+	}
+	now := time.Now()
+	k.StatusCode = statusCode
+	k.Response = append([]byte(nil), response...)
+	k.CompletedAt = &now
+	return nil
+}
+
+func (s *MemoryStorage) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.idempotencyKeys[key]; !ok {
+		return fmt.Errorf("no idempotency key found: %w", ErrNotFound)
+	}
+	delete(s.idempotencyKeys, key)
+	return nil
+}
@@ -0,0 +1,796 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a thread-safe, in-memory Storage. It follows the same
+// semantics as PostgresStorage (per-table sequential IDs, column defaults,
+// ErrNotFound on misses and the schema's unique and foreign key constraints)
+// so handlers can be exercised without a database.
+type MemoryStorage struct {
+	mu sync.RWMutex
+	// txMu serializes units of work; see WithTx.
+	txMu sync.Mutex
+
+	users              map[uint]*Users
+	payments           map[uint]*Payment
+	refunds            map[uint]*Refund
+	subscriptions      map[uint]*Subscription
+	transactions       map[uint]*Transaction
+	outbox             map[uint]*OutboxEntry
+	idempotencyKeys    map[string]*IdempotencyKey
+	webhookEvents      map[string]*WebhookEvent
+	webhookDeadLetters map[uint]*WebhookDeadLetter
+	statusHistory      []*StatusHistoryEntry
+	paymentMethods     map[uint]*PaymentMethod
+	checkoutSessions   map[uint]*CheckoutSession
+	paymentLinks       map[uint]*PaymentLink
+	products           map[uint]*Product
+	prices             map[uint]*Price
+	notifications      map[uint]*Notification
+
+	seq map[string]uint
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:              make(map[uint]*Users),
+		payments:           make(map[uint]*Payment),
+		refunds:            make(map[uint]*Refund),
+		subscriptions:      make(map[uint]*Subscription),
+		transactions:       make(map[uint]*Transaction),
+		outbox:             make(map[uint]*OutboxEntry),
+		idempotencyKeys:    make(map[string]*IdempotencyKey),
+		webhookEvents:      make(map[string]*WebhookEvent),
+		webhookDeadLetters: make(map[uint]*WebhookDeadLetter),
+		paymentMethods:     make(map[uint]*PaymentMethod),
+		checkoutSessions:   make(map[uint]*CheckoutSession),
+		paymentLinks:       make(map[uint]*PaymentLink),
+		products:           make(map[uint]*Product),
+		prices:             make(map[uint]*Price),
+		notifications:      make(map[uint]*Notification),
+		seq:                make(map[string]uint),
+	}
+}
+
+// WithTx runs fn against a private copy of the data and swaps the copy in
+// only if fn succeeds. Units of work are serialized, and plain writes block
+// until the running one finishes, which is stricter than Postgres but keeps
+// the commit from clobbering concurrent changes.
+func (s *MemoryStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.clone()
+	if err := fn(tx); err != nil {
+		// Like Postgres sequences, IDs handed out inside a rolled back
+		// unit of work are not reused.
+		s.seq = tx.seq
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.users, s.payments, s.refunds = tx.users, tx.payments, tx.refunds
+	s.subscriptions, s.transactions, s.outbox = tx.subscriptions, tx.transactions, tx.outbox
+	s.idempotencyKeys, s.webhookEvents, s.webhookDeadLetters = tx.idempotencyKeys, tx.webhookEvents, tx.webhookDeadLetters
+	s.statusHistory, s.paymentMethods, s.checkoutSessions = tx.statusHistory, tx.paymentMethods, tx.checkoutSessions
+	s.paymentLinks, s.products, s.prices = tx.paymentLinks, tx.products, tx.prices
+	s.notifications = tx.notifications
+	s.seq = tx.seq
+	return nil
+}
+
+// clone deep-copies the stored rows. The caller must hold s.mu.
+func (s *MemoryStorage) clone() *MemoryStorage {
+	c := NewMemoryStorage()
+	for id, u := range s.users {
+		row := *u
+		c.users[id] = &row
+	}
+	for id, p := range s.payments {
+		row := *p
+		c.payments[id] = &row
+	}
+	for id, r := range s.refunds {
+		row := *r
+		c.refunds[id] = &row
+	}
+	for id, sub := range s.subscriptions {
+		c.subscriptions[id] = copySubscription(sub)
+	}
+	for id, t := range s.transactions {
+		row := *t
+		c.transactions[id] = &row
+	}
+	for id, e := range s.outbox {
+		row := *e
+		c.outbox[id] = &row
+	}
+	for key, k := range s.idempotencyKeys {
+		row := *k
+		row.Response = append([]byte(nil), k.Response...)
+		c.idempotencyKeys[key] = &row
+	}
+	for id, e := range s.webhookEvents {
+		row := *e
+		c.webhookEvents[id] = &row
+	}
+	for id, d := range s.webhookDeadLetters {
+		row := *d
+		c.webhookDeadLetters[id] = &row
+	}
+	for id, pm := range s.paymentMethods {
+		row := *pm
+		c.paymentMethods[id] = &row
+	}
+	for id, cs := range s.checkoutSessions {
+		row := *cs
+		row.PaymentID, row.PaymentLinkID = copyID(cs.PaymentID), copyID(cs.PaymentLinkID)
+		c.checkoutSessions[id] = &row
+	}
+	for id, pl := range s.paymentLinks {
+		c.paymentLinks[id] = copyPaymentLink(pl)
+	}
+	for id, p := range s.products {
+		row := *p
+		c.products[id] = &row
+	}
+	for id, p := range s.prices {
+		row := *p
+		c.prices[id] = &row
+	}
+	for id, n := range s.notifications {
+		c.notifications[id] = copyNotification(n)
+	}
+	// History entries are never modified, so sharing them is safe.
+	c.statusHistory = append([]*StatusHistoryEntry(nil), s.statusHistory...)
+	for table, n := range s.seq {
+		c.seq[table] = n
+	}
+	return c
+}
+
+// nextID mimics a per-table SERIAL column.
+func (s *MemoryStorage) nextID(table string) uint {
+	s.seq[table]++
+	return s.seq[table]
+}
+
+func (s *MemoryStorage) CreatePayment(ctx context.Context, userID uint, name, email string, amount int64, currency string, method string, stripeID string, captureMethod string) (uint, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if captureMethod == "" {
+		captureMethod = CaptureAutomatic
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return 0, fmt.Errorf("payment %s: no user %d: %w", stripeID, userID, ErrInvalidReference)
+	}
+	if s.paymentByIntent(stripeID) != nil {
+		return 0, fmt.Errorf("payment %s: %w", stripeID, ErrDuplicate)
+	}
+
+	p := &Payment{
+		ID:              s.nextID("payments"),
+		UserID:          userID,
+		Name:            name,
+		Email:           email,
+		StripePaymentID: stripeID,
+		Amount:          amount,
+		Currency:        currency,
+		PaymentMethod:   method,
+		Status:          PaymentPending,
+		CreatedAt:       time.Now(),
+		CaptureMethod:   captureMethod,
+	}
+	s.payments[p.ID] = p
+	s.recordStatus(EntityPayment, stripeID, "", string(p.Status))
+
+	return p.ID, nil
+}
+
+func (s *MemoryStorage) GetPaymentDetails(ctx context.Context, paymentintentID string) (*Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := s.paymentByIntent(paymentintentID)
+	if p == nil {
+		return nil, fmt.Errorf("no payment found for payment intent ID %s: %w", paymentintentID, ErrNotFound)
+	}
+
+	out := *p
+	return &out, nil
+}
+
+func (s *MemoryStorage) paymentByIntent(paymentintentID string) *Payment {
+	for _, p := range s.payments {
+		if p.StripePaymentID == paymentintentID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) UpdatePaymentStatus(ctx context.Context, stripe_payment_intent_id string, status PaymentStatus) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.paymentByIntent(stripe_payment_intent_id)
+	if p == nil {
+		return fmt.Errorf("no payment found: %w", ErrNotFound)
+	}
+	return s.transitionPayment(p, status)
+}
+
+// transitionPayment applies the payment transition table and records the
+// change. The caller must hold s.mu.
+func (s *MemoryStorage) transitionPayment(p *Payment, status PaymentStatus) error {
+	if p.Status == status {
+		return nil
+	}
+	if !p.Status.CanTransitionTo(status) {
+		return fmt.Errorf("%s %s: %s -> %s: %w", EntityPayment, p.StripePaymentID, p.Status, status, ErrInvalidTransition)
+	}
+
+	s.recordStatus(EntityPayment, p.StripePaymentID, string(p.Status), string(status))
+	p.Status = status
+	return nil
+}
+
+func (s *MemoryStorage) CreateRefund(ctx context.Context, paymentID uint, amount int64, status RefundStatus, stripeID, reason string, metadata map[string]string) (uint, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !status.Valid() {
+		return 0, fmt.Errorf("refund %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.payments[paymentID]; !ok {
+		return 0, fmt.Errorf("refund %s: no payment %d: %w", stripeID, paymentID, ErrInvalidReference)
+	}
+	if s.refundByStripeID(stripeID) != nil {
+		return 0, fmt.Errorf("refund %s: %w", stripeID, ErrDuplicate)
+	}
+
+	r := &Refund{
+		ID:             s.nextID("refunds"),
+		PaymentID:      paymentID,
+		StripeRefundID: stripeID,
+		Amount:         amount,
+		Status:         status,
+		CreatedAt:      time.Now(),
+		Reason:         reason,
+		Metadata:       maps.Clone(metadata),
+	}
+	s.refunds[r.ID] = r
+	s.recordStatus(EntityRefund, stripeID, "", string(status))
+
+	return r.ID, nil
+}
+
+func (s *MemoryStorage) AddRefundedAmount(ctx context.Context, paymentID uint, amount int64) (*Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[paymentID]
+	if !ok {
+		return nil, fmt.Errorf("no payment found for ID %d: %w", paymentID, ErrNotFound)
+	}
+	total := p.AmountRefunded + amount
+	if total < 0 || total > p.CapturedAmount() {
+		return nil, fmt.Errorf("payment %d: refunding %d with %d of %d already refunded: %w", paymentID, amount, p.AmountRefunded, p.CapturedAmount(), ErrOverRefund)
+	}
+
+	p.AmountRefunded = total
+	out := *p
+	return &out, nil
+}
+
+func (s *MemoryStorage) UpdateRefundStatus(ctx context.Context, stripeRefundID string, status RefundStatus) (RefundStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.refundByStripeID(stripeRefundID)
+	if r == nil {
+		return "", fmt.Errorf("no refund found: %w", ErrNotFound)
+	}
+	return s.transitionRefund(r, status)
+}
+
+func (s *MemoryStorage) refundByStripeID(stripeRefundID string) *Refund {
+	for _, r := range s.refunds {
+		if r.StripeRefundID == stripeRefundID {
+			return r
+		}
+	}
+	return nil
+}
+
+// transitionRefund applies the refund transition table, records the change
+// and returns the previous status. The caller must hold s.mu.
+func (s *MemoryStorage) transitionRefund(r *Refund, status RefundStatus) (RefundStatus, error) {
+	from := r.Status
+	if from == status {
+		return from, nil
+	}
+	if !from.CanTransitionTo(status) {
+		return from, fmt.Errorf("%s %s: %s -> %s: %w", EntityRefund, r.StripeRefundID, from, status, ErrInvalidTransition)
+	}
+
+	s.recordStatus(EntityRefund, r.StripeRefundID, string(from), string(status))
+	r.Status = status
+	return from, nil
+}
+
+func (s *MemoryStorage) GetRefundDetails(ctx context.Context, stripeRefundID string) (*Refund, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.refunds {
+		if r.StripeRefundID == stripeRefundID {
+			out := *r
+			return &out, nil
+		}
+	}
+	return nil, fmt.Errorf("no refund found for refund ID %s: %w", stripeRefundID, ErrNotFound)
+}
+
+func (s *MemoryStorage) GetFailedRefunds(ctx context.Context, limit int) ([]*Refund, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rs []*Refund
+	for _, r := range s.refunds {
+		if r.Status == RefundFailed {
+			out := *r
+			rs = append(rs, &out)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ID > rs[j].ID })
+	if len(rs) > limit {
+		rs = rs[:limit]
+	}
+
+	return rs, nil
+}
+
+func (s *MemoryStorage) CancelPayment(ctx context.Context, paymentID, userID uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[paymentID]
+	if !ok || p.UserID != userID {
+		return fmt.Errorf("no payment found: %w", ErrNotFound)
+	}
+	return s.transitionPayment(p, PaymentCanceled)
+}
+
+func (s *MemoryStorage) CreateSubscription(ctx context.Context, userID, paymentID, priceID uint, amount int64, currency, stripeID string, status SubscriptionStatus) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !status.Valid() {
+		return fmt.Errorf("subscription %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("subscription %s: no user %d: %w", stripeID, userID, ErrInvalidReference)
+	}
+	if s.subscriptionByStripeID(stripeID) != nil {
+		return fmt.Errorf("subscription %s: %w", stripeID, ErrDuplicate)
+	}
+
+	sub := &Subscription{
+		ID:                   s.nextID("subscriptions"),
+		UserID:               userID,
+		PaymentID:            paymentID,
+		PriceID:              priceID,
+		Amount:               amount,
+		Currency:             currency,
+		StripeSubscriptionID: stripeID,
+		Status:               status,
+		StartDate:            time.Now(),
+	}
+	s.subscriptions[sub.ID] = sub
+	s.recordStatus(EntitySubscription, stripeID, "", string(status))
+
+	return nil
+}
+
+func (s *MemoryStorage) UpdateSubscriptionStatus(ctx context.Context, stripe_subscription_id string, status SubscriptionStatus) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subscriptions {
+		if sub.StripeSubscriptionID == stripe_subscription_id {
+			return s.transitionSubscription(sub, status)
+		}
+	}
+	return fmt.Errorf("no subscription found: %w", ErrNotFound)
+}
+
+// transitionSubscription applies the subscription transition table and
+// records the change. The caller must hold s.mu.
+func (s *MemoryStorage) transitionSubscription(sub *Subscription, status SubscriptionStatus) error {
+	if sub.Status == status {
+		return nil
+	}
+	if !sub.Status.CanTransitionTo(status) {
+		return fmt.Errorf("%s %s: %s -> %s: %w", EntitySubscription, sub.StripeSubscriptionID, sub.Status, status, ErrInvalidTransition)
+	}
+
+	s.recordStatus(EntitySubscription, sub.StripeSubscriptionID, string(sub.Status), string(status))
+	sub.Status = status
+	return nil
+}
+
+func (s *MemoryStorage) GetSubscriptionDetails(ctx context.Context, subID string) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sub := s.subscriptionByStripeID(subID)
+	if sub == nil {
+		return nil, fmt.Errorf("no subscription found for subscription ID %s: %w", subID, ErrNotFound)
+	}
+	return copySubscription(sub), nil
+}
+
+// copySubscription returns a copy of sub that shares no pointers with it.
+func copySubscription(sub *Subscription) *Subscription {
+	out := *sub
+	out.EndDate, out.TrialEnd = copyTime(sub.EndDate), copyTime(sub.TrialEnd)
+	out.Discount = copyDiscount(sub.Discount)
+	out.Pause = copyPause(sub.Pause)
+	return &out
+}
+
+func copyPause(p *PauseCollection) *PauseCollection {
+	if p == nil {
+		return nil
+	}
+	out := *p
+	out.ResumesAt = copyTime(p.ResumesAt)
+	return &out
+}
+
+func copyDiscount(d *Discount) *Discount {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	out.EndsAt = copyTime(d.EndsAt)
+	return &out
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	out := *t
+	return &out
+}
+
+func (s *MemoryStorage) subscriptionByStripeID(stripeID string) *Subscription {
+	for _, sub := range s.subscriptions {
+		if sub.StripeSubscriptionID == stripeID {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) UpdateSubscriptionTrial(ctx context.Context, stripeID string, trialEnd *time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionByStripeID(stripeID)
+	if sub == nil {
+		return fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	sub.TrialEnd = copyTime(trialEnd)
+	return nil
+}
+
+func (s *MemoryStorage) UpdateSubscriptionDiscount(ctx context.Context, stripeID string, d *Discount) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionByStripeID(stripeID)
+	if sub == nil {
+		return fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	if d != nil && d.CouponID == "" {
+		d = nil
+	}
+	sub.Discount = copyDiscount(d)
+	return nil
+}
+
+func (s *MemoryStorage) UpdateSubscriptionPrice(ctx context.Context, stripeID string, priceID uint, amount int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionByStripeID(stripeID)
+	if sub == nil {
+		return fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	sub.PriceID, sub.Amount = priceID, amount
+	return nil
+}
+
+func (s *MemoryStorage) UpdateSubscriptionCancellation(ctx context.Context, stripeID string, atPeriodEnd bool, endDate *time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionByStripeID(stripeID)
+	if sub == nil {
+		return fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	sub.CancelAtPeriodEnd, sub.EndDate = atPeriodEnd, copyTime(endDate)
+	return nil
+}
+
+func (s *MemoryStorage) UpdateSubscriptionPause(ctx context.Context, stripeID string, p *PauseCollection) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionByStripeID(stripeID)
+	if sub == nil {
+		return fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	sub.Pause = copyPause(p)
+	return nil
+}
+
+func (s *MemoryStorage) CancelSubscription(ctx context.Context, subID, userID uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[subID]
+	if !ok || sub.UserID != userID {
+		return fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	return s.transitionSubscription(sub, SubscriptionCanceled)
+}
+
+func (s *MemoryStorage) LogTransaction(ctx context.Context, userID uint, txnType string, amount int64, currency string, refID *uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := &Transaction{
+		UserID:          userID,
+		Amount:          amount,
+		Currency:        currency,
+		TransactionType: txnType,
+		Status:          "pending",
+		CreatedAt:       time.Now(),
+	}
+
+	switch txnType {
+	case "payment":
+		if refID != nil {
+			t.PaymentID = *refID
+		}
+	case "refund", "refund_reversal":
+		if refID != nil {
+			t.RefundID = *refID
+		}
+	default:
+		return nil
+	}
+
+	t.ID = s.nextID("transactions")
+	s.transactions[t.ID] = t
+	return nil
+}
+
+func (s *MemoryStorage) GetUserTransactions(ctx context.Context, userID uint) ([]*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.listTransactions(func(t *Transaction) bool { return t.UserID == userID }), nil
+}
+
+// listTransactions returns copies of the transactions matching keep, with
+// their payment link filled in, in ID order.
+func (s *MemoryStorage) listTransactions(keep func(*Transaction) bool) []*Transaction {
+	var ts []*Transaction
+	for _, t := range s.transactions {
+		out := *t
+		out.PaymentLinkID = s.transactionPaymentLink(t)
+		if keep(&out) {
+			ts = append(ts, &out)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].ID < ts[j].ID })
+
+	return ts
+}
+
+func (s *MemoryStorage) transactionPaymentLink(t *Transaction) uint {
+	paymentID := t.PaymentID
+	if r, ok := s.refunds[t.RefundID]; ok && t.RefundID != 0 {
+		paymentID = r.PaymentID
+	}
+	if paymentID == 0 {
+		return 0
+	}
+	for _, cs := range s.checkoutSessions {
+		if cs.PaymentID != nil && *cs.PaymentID == paymentID && cs.PaymentLinkID != nil {
+			return *cs.PaymentLinkID
+		}
+	}
+	return 0
+}
+
+func (s *MemoryStorage) CreateCustomer(ctx context.Context, name, email, stripeID string) (string, uint, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := &Users{
+		ID:        s.nextID("users"),
+		Name:      name,
+		Email:     email,
+		StripeID:  stripeID,
+		CreatedAt: time.Now(),
+	}
+	s.users[u.ID] = u
+
+	return stripeID, u.ID, nil
+}
+
+func (s *MemoryStorage) GetCustomer(ctx context.Context, userID uint) (*Users, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("no customer found for user %d: %w", userID, ErrNotFound)
+	}
+	out := *u
+	return &out, nil
+}
+
+func (s *MemoryStorage) GetCustomerByStripeID(ctx context.Context, stripeID string) (*Users, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var match *Users
+	for _, u := range s.users {
+		if u.StripeID == stripeID && (match == nil || u.ID < match.ID) {
+			match = u
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no customer found for %s: %w", stripeID, ErrNotFound)
+	}
+	out := *match
+	return &out, nil
+}
+
+func (s *MemoryStorage) CheckCustomer(ctx context.Context, name, email string) (string, uint, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Lowest ID wins, like the first row of an unordered scan on a fresh table.
+	var match *Users
+	for _, u := range s.users {
+		if u.Name == name && u.Email == email && (match == nil || u.ID < match.ID) {
+			match = u
+		}
+	}
+	if match == nil {
+		return "", 0, fmt.Errorf("no customer found for %s <%s>: %w", name, email, ErrNotFound)
+	}
+
+	return match.StripeID, match.ID, nil
+}
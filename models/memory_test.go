@@ -0,0 +1,14 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/models/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(*testing.T) models.Storage {
+		return models.NewMemoryStorage()
+	})
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Notification kinds.
+const (
+	// NotificationTrialWillEnd reminds a customer that their trial ends
+	// soon, so they can add a payment method or cancel.
+	NotificationTrialWillEnd = "trial_will_end"
+)
+
+// Notification is a message owed to a customer, written by the webhook event
+// EventID that called for it. SentAt is set once it has been delivered.
+type Notification struct {
+	ID                   uint            `json:"id" db:"id"`
+	UserID               uint            `json:"user_id" db:"user_id"`
+	Kind                 string          `json:"kind" db:"kind"`
+	EventID              string          `json:"event_id" db:"event_id"`
+	StripeSubscriptionID string          `json:"stripe_subscription_id,omitempty" db:"stripe_subscription_id"`
+	Payload              json.RawMessage `json:"payload" db:"payload"`
+	CreatedAt            time.Time       `json:"created_at" db:"created_at"`
+	SentAt               *time.Time      `json:"sent_at,omitempty" db:"sent_at"`
+}
+
+const notificationColumns = `id, user_id, kind, event_id, stripe_subscription_id, payload, created_at, sent_at`
+
+func (s *PostgresStorage) CreateNotification(ctx context.Context, n *Notification) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	payload := n.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage(`{}`)
+	}
+
+	query := `INSERT INTO notifications (user_id, kind, event_id, stripe_subscription_id, payload)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (event_id) DO NOTHING
+RETURNING id, created_at`
+
+	err := s.q.QueryRowContext(ctx, query, n.UserID, n.Kind, n.EventID, n.StripeSubscriptionID, []byte(payload)).
+		Scan(&n.ID, &n.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (s *PostgresStorage) GetPendingNotifications(ctx context.Context, limit int) ([]*Notification, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + notificationColumns + ` FROM notifications WHERE sent_at IS NULL ORDER BY id LIMIT $1`
+
+	rows, err := s.q.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ns []*Notification
+	for rows.Next() {
+		var n Notification
+		var payload []byte
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.EventID, &n.StripeSubscriptionID, &payload, &n.CreatedAt, &n.SentAt); err != nil {
+			return nil, err
+		}
+		n.Payload = payload
+		ns = append(ns, &n)
+	}
+
+	return ns, rows.Err()
+}
+
+// MarkNotificationSent records delivery of a notification. Marking one that
+// was already sent keeps the first time.
+func (s *PostgresStorage) MarkNotificationSent(ctx context.Context, id uint) error {
+	query := `UPDATE notifications SET sent_at=COALESCE(sent_at, now()) WHERE id=$1`
+
+	return s.execOne(ctx, "notification", query, id)
+}
+
+func copyNotification(n *Notification) *Notification {
+	out := *n
+	out.Payload = append(json.RawMessage(nil), n.Payload...)
+	out.SentAt = copyTime(n.SentAt)
+	return &out
+}
+
+func (s *MemoryStorage) CreateNotification(ctx context.Context, n *Notification) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.notifications {
+		if other.EventID == n.EventID {
+			return nil
+		}
+	}
+
+	row := copyNotification(n)
+	if len(row.Payload) == 0 {
+		row.Payload = json.RawMessage(`{}`)
+	}
+	row.ID = s.nextID("notifications")
+	row.CreatedAt = time.Now()
+	row.SentAt = nil
+	s.notifications[row.ID] = row
+
+	n.ID, n.CreatedAt = row.ID, row.CreatedAt
+	return nil
+}
+
+func (s *MemoryStorage) GetPendingNotifications(ctx context.Context, limit int) ([]*Notification, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ns []*Notification
+	for _, n := range s.notifications {
+		if n.SentAt == nil {
+			ns = append(ns, copyNotification(n))
+		}
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].ID < ns[j].ID })
+	if len(ns) > limit {
+		ns = ns[:limit]
+	}
+
+	return ns, nil
+}
+
+func (s *MemoryStorage) MarkNotificationSent(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notifications[id]
+	if !ok {
+		return fmt.Errorf("no notification found: %w", ErrNotFound)
+	}
+	if n.SentAt == nil {
+		now := time.Now()
+		n.SentAt = &now
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Outbox entry kinds, one per remote object the gateway creates.
+const (
+	OutboxPaymentIntent   = "payment_intent"
+	OutboxRefund          = "refund"
+	OutboxSubscription    = "subscription"
+	OutboxCheckoutSession = "checkout_session"
+	OutboxPaymentLink     = "payment_link"
+	OutboxProduct         = "product"
+	OutboxPrice           = "price"
+)
+
+// Outbox entry statuses.
+const (
+	OutboxPending     = "pending"
+	OutboxCompleted   = "completed"
+	OutboxCompensated = "compensated"
+	OutboxFailed      = "failed"
+)
+
+// OutboxEntry records a Stripe object created by the gateway together with
+// everything needed to write its local rows, so persistence can be retried
+// or the remote object compensated if the original request could not finish.
+type OutboxEntry struct {
+	ID        uint            `json:"id" db:"id"`
+	Kind      string          `json:"kind" db:"kind"`
+	StripeID  string          `json:"stripe_id" db:"stripe_id"`
+	Payload   json.RawMessage `json:"payload" db:"payload"`
+	Status    string          `json:"status" db:"status"`
+	Attempts  int             `json:"attempts" db:"attempts"`
+	LastError string          `json:"last_error" db:"last_error"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+func (s *PostgresStorage) CreateOutboxEntry(ctx context.Context, kind, stripeID string, payload []byte) (uint, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO outbox (kind, stripe_id, payload) VALUES ($1, $2, $3) RETURNING id`
+
+	var id uint
+	err := s.q.QueryRowContext(ctx, query, kind, stripeID, payload).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *PostgresStorage) UpdateOutboxEntry(ctx context.Context, id uint, status, lastError string) error {
+	query := `UPDATE outbox SET status=$1, last_error=$2, attempts=attempts+1, updated_at=now() WHERE id=$3`
+
+	return s.execOne(ctx, "outbox entry", query, status, lastError, id)
+}
+
+func (s *PostgresStorage) GetPendingOutboxEntries(ctx context.Context, before time.Time, limit int) ([]*OutboxEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, kind, stripe_id, payload, status, attempts, last_error, created_at, updated_at
+FROM outbox WHERE status=$1 AND updated_at < $2 ORDER BY id LIMIT $3`
+
+	rows, err := s.q.QueryContext(ctx, query, OutboxPending, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var es []*OutboxEntry
+	for rows.Next() {
+		var e OutboxEntry
+		err := rows.Scan(&e.ID, &e.Kind, &e.StripeID, &e.Payload, &e.Status, &e.Attempts, &e.LastError, &e.CreatedAt, &e.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, &e)
+	}
+
+	return es, rows.Err()
+}
+
+func (s *MemoryStorage) CreateOutboxEntry(ctx context.Context, kind, stripeID string, payload []byte) (uint, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e := &OutboxEntry{
+		ID:        s.nextID("outbox"),
+		Kind:      kind,
+		StripeID:  stripeID,
+		Payload:   append(json.RawMessage(nil), payload...),
+		Status:    OutboxPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.outbox[e.ID] = e
+
+	return e.ID, nil
+}
+
+func (s *MemoryStorage) UpdateOutboxEntry(ctx context.Context, id uint, status, lastError string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.outbox[id]
+	if !ok {
+		return fmt.Errorf("no outbox entry found: %w", ErrNotFound)
+	}
+	e.Status = status
+	e.LastError = lastError
+	e.Attempts++
+	e.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStorage) GetPendingOutboxEntries(ctx context.Context, before time.Time, limit int) ([]*OutboxEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var es []*OutboxEntry
+	for _, e := range s.outbox {
+		if e.Status == OutboxPending && e.UpdatedAt.Before(before) {
+			out := *e
+			es = append(es, &out)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].ID < es[j].ID })
+	if len(es) > limit {
+		es = es[:limit]
+	}
+
+	return es, nil
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PaymentLink is a shareable Stripe Payment Link for a single price.
+// MaxPayments is 0 when the link can be paid any number of times, and
+// ExpiresAt is nil when it never expires.
+type PaymentLink struct {
+	ID                  uint       `json:"id" db:"id"`
+	StripePaymentLinkID string     `json:"stripe_payment_link_id" db:"stripe_payment_link_id"`
+	StripePriceID       string     `json:"stripe_price_id" db:"stripe_price_id"`
+	URL                 string     `json:"url" db:"url"`
+	Amount              int64      `json:"amount" db:"amount"`
+	Currency            string     `json:"currency" db:"currency"`
+	Description         string     `json:"description,omitempty" db:"description"`
+	MaxPayments         int64      `json:"max_payments" db:"max_payments"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	Active              bool       `json:"active" db:"active"`
+	CreatedAt           time.Time  `json:"created_at" db:"created_at"`
+}
+
+const paymentLinkColumns = `id, stripe_payment_link_id, stripe_price_id, url, amount, currency, description, max_payments, expires_at, active, created_at`
+
+func scanPaymentLink(row interface{ Scan(...interface{}) error }) (*PaymentLink, error) {
+	var pl PaymentLink
+	var expiresAt sql.NullTime
+	err := row.Scan(&pl.ID, &pl.StripePaymentLinkID, &pl.StripePriceID, &pl.URL, &pl.Amount, &pl.Currency, &pl.Description, &pl.MaxPayments, &expiresAt, &pl.Active, &pl.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		pl.ExpiresAt = &expiresAt.Time
+	}
+	return &pl, nil
+}
+
+func (s *PostgresStorage) CreatePaymentLink(ctx context.Context, pl *PaymentLink) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO payment_links (stripe_payment_link_id, stripe_price_id, url, amount, currency, description, max_payments, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING id, active, created_at`
+
+	return s.q.QueryRowContext(ctx, query, pl.StripePaymentLinkID, pl.StripePriceID, pl.URL, pl.Amount, pl.Currency, pl.Description, pl.MaxPayments, pl.ExpiresAt).
+		Scan(&pl.ID, &pl.Active, &pl.CreatedAt)
+}
+
+func (s *PostgresStorage) GetPaymentLink(ctx context.Context, stripeID string) (*PaymentLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + paymentLinkColumns + ` FROM payment_links WHERE stripe_payment_link_id=$1`
+
+	pl, err := scanPaymentLink(s.q.QueryRowContext(ctx, query, stripeID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no payment link found for %s: %w", stripeID, ErrNotFound)
+	}
+	return pl, err
+}
+
+func (s *PostgresStorage) DeactivatePaymentLink(ctx context.Context, stripeID string) error {
+	query := `UPDATE payment_links SET active=false WHERE stripe_payment_link_id=$1`
+
+	return s.execOne(ctx, "payment link", query, stripeID)
+}
+
+func (s *PostgresStorage) GetExpiredPaymentLinks(ctx context.Context, now time.Time, limit int) ([]*PaymentLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + paymentLinkColumns + ` FROM payment_links WHERE active AND expires_at <= $1 ORDER BY expires_at LIMIT $2`
+
+	rows, err := s.q.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pls []*PaymentLink
+	for rows.Next() {
+		pl, err := scanPaymentLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		pls = append(pls, pl)
+	}
+
+	return pls, rows.Err()
+}
+
+func (s *PostgresStorage) GetPaymentLinkTransactions(ctx context.Context, linkID uint) ([]*Transaction, error) {
+	return s.queryTransactions(ctx, `cs.payment_link_id=$1`, linkID)
+}
+
+func (s *MemoryStorage) paymentLinkByStripeID(stripeID string) *PaymentLink {
+	for _, pl := range s.paymentLinks {
+		if pl.StripePaymentLinkID == stripeID {
+			return pl
+		}
+	}
+	return nil
+}
+
+func copyPaymentLink(pl *PaymentLink) *PaymentLink {
+	out := *pl
+	out.ExpiresAt = copyTime(pl.ExpiresAt)
+	return &out
+}
+
+func (s *MemoryStorage) CreatePaymentLink(ctx context.Context, pl *PaymentLink) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := copyPaymentLink(pl)
+	row.ID = s.nextID("payment_links")
+	row.Active = true
+	row.CreatedAt = time.Now()
+	s.paymentLinks[row.ID] = row
+
+	pl.ID, pl.Active, pl.CreatedAt = row.ID, row.Active, row.CreatedAt
+	return nil
+}
+
+func (s *MemoryStorage) GetPaymentLink(ctx context.Context, stripeID string) (*PaymentLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pl := s.paymentLinkByStripeID(stripeID)
+	if pl == nil {
+		return nil, fmt.Errorf("no payment link found for %s: %w", stripeID, ErrNotFound)
+	}
+	return copyPaymentLink(pl), nil
+}
+
+func (s *MemoryStorage) DeactivatePaymentLink(ctx context.Context, stripeID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pl := s.paymentLinkByStripeID(stripeID)
+	if pl == nil {
+		return fmt.Errorf("no payment link found: %w", ErrNotFound)
+	}
+	pl.Active = false
+	return nil
+}
+
+func (s *MemoryStorage) GetExpiredPaymentLinks(ctx context.Context, now time.Time, limit int) ([]*PaymentLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pls []*PaymentLink
+	for _, pl := range s.paymentLinks {
+		if pl.Active && pl.ExpiresAt != nil && !pl.ExpiresAt.After(now) {
+			pls = append(pls, copyPaymentLink(pl))
+		}
+	}
+	sort.Slice(pls, func(i, j int) bool {
+		if !pls[i].ExpiresAt.Equal(*pls[j].ExpiresAt) {
+			return pls[i].ExpiresAt.Before(*pls[j].ExpiresAt)
+		}
+		return pls[i].ID < pls[j].ID
+	})
+	if len(pls) > limit {
+		pls = pls[:limit]
+	}
+
+	return pls, nil
+}
+
+func (s *MemoryStorage) GetPaymentLinkTransactions(ctx context.Context, linkID uint) ([]*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.listTransactions(func(t *Transaction) bool { return t.PaymentLinkID == linkID }), nil
+}
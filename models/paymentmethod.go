@@ -0,0 +1,232 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PaymentMethod is a card saved to a customer. Fingerprint is the same for
+// every saved copy of one card number, so duplicates can be spotted.
+type PaymentMethod struct {
+	ID                    uint      `json:"id" db:"id"`
+	UserID                uint      `json:"user_id" db:"user_id"`
+	StripePaymentMethodID string    `json:"stripe_payment_method_id" db:"stripe_payment_method_id"`
+	Type                  string    `json:"type" db:"type"`
+	Brand                 string    `json:"brand" db:"brand"`
+	Last4                 string    `json:"last4" db:"last4"`
+	ExpMonth              int64     `json:"exp_month" db:"exp_month"`
+	ExpYear               int64     `json:"exp_year" db:"exp_year"`
+	Fingerprint           string    `json:"fingerprint" db:"fingerprint"`
+	IsDefault             bool      `json:"is_default" db:"is_default"`
+	CreatedAt             time.Time `json:"created_at" db:"created_at"`
+}
+
+const paymentMethodColumns = `id, user_id, stripe_payment_method_id, type, brand, last4, exp_month, exp_year, fingerprint, is_default, created_at`
+
+func scanPaymentMethod(row interface{ Scan(...interface{}) error }) (*PaymentMethod, error) {
+	var pm PaymentMethod
+	err := row.Scan(&pm.ID, &pm.UserID, &pm.StripePaymentMethodID, &pm.Type, &pm.Brand, &pm.Last4, &pm.ExpMonth, &pm.ExpYear, &pm.Fingerprint, &pm.IsDefault, &pm.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &pm, nil
+}
+
+func (s *PostgresStorage) SavePaymentMethod(ctx context.Context, pm *PaymentMethod) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO payment_methods (user_id, stripe_payment_method_id, type, brand, last4, exp_month, exp_year, fingerprint)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (stripe_payment_method_id) DO UPDATE SET
+    type=EXCLUDED.type, brand=EXCLUDED.brand, last4=EXCLUDED.last4,
+    exp_month=EXCLUDED.exp_month, exp_year=EXCLUDED.exp_year, fingerprint=EXCLUDED.fingerprint
+RETURNING id, is_default, created_at`
+
+	err := s.q.QueryRowContext(ctx, query, pm.UserID, pm.StripePaymentMethodID, pm.Type, pm.Brand, pm.Last4, pm.ExpMonth, pm.ExpYear, pm.Fingerprint).
+		Scan(&pm.ID, &pm.IsDefault, &pm.CreatedAt)
+	return constraintError(err)
+}
+
+func (s *PostgresStorage) GetPaymentMethod(ctx context.Context, stripeID string) (*PaymentMethod, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + paymentMethodColumns + ` FROM payment_methods WHERE stripe_payment_method_id=$1`
+
+	pm, err := scanPaymentMethod(s.q.QueryRowContext(ctx, query, stripeID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no payment method found for %s: %w", stripeID, ErrNotFound)
+	}
+	return pm, err
+}
+
+func (s *PostgresStorage) GetPaymentMethods(ctx context.Context, userID uint) ([]*PaymentMethod, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + paymentMethodColumns + ` FROM payment_methods WHERE user_id=$1 ORDER BY is_default DESC, id DESC`
+
+	rows, err := s.q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pms []*PaymentMethod
+	for rows.Next() {
+		pm, err := scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		pms = append(pms, pm)
+	}
+
+	return pms, rows.Err()
+}
+
+func (s *PostgresStorage) DeletePaymentMethod(ctx context.Context, stripeID string) error {
+	query := `DELETE FROM payment_methods WHERE stripe_payment_method_id=$1`
+
+	return s.execOne(ctx, "payment method", query, stripeID)
+}
+
+func (s *PostgresStorage) SetDefaultPaymentMethod(ctx context.Context, userID uint, stripeID string) error {
+	return s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		// Clear the old default first so the partial unique index holds.
+		err := func() error {
+			ctx, cancel := t.withTimeout(ctx)
+			defer cancel()
+
+			_, err := t.q.ExecContext(ctx, `UPDATE payment_methods SET is_default=false WHERE user_id=$1 AND is_default`, userID)
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+
+		query := `UPDATE payment_methods SET is_default=true WHERE user_id=$1 AND stripe_payment_method_id=$2`
+		return t.execOne(ctx, "payment method", query, userID, stripeID)
+	})
+}
+
+func (s *MemoryStorage) paymentMethodByStripeID(stripeID string) *PaymentMethod {
+	for _, pm := range s.paymentMethods {
+		if pm.StripePaymentMethodID == stripeID {
+			return pm
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) SavePaymentMethod(ctx context.Context, pm *PaymentMethod) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := s.paymentMethodByStripeID(pm.StripePaymentMethodID)
+	if row == nil {
+		if _, ok := s.users[pm.UserID]; !ok {
+			return fmt.Errorf("payment method %s: no user %d: %w", pm.StripePaymentMethodID, pm.UserID, ErrInvalidReference)
+		}
+		row = &PaymentMethod{
+			ID:                    s.nextID("payment_methods"),
+			UserID:                pm.UserID,
+			StripePaymentMethodID: pm.StripePaymentMethodID,
+			CreatedAt:             time.Now(),
+		}
+		s.paymentMethods[row.ID] = row
+	}
+	row.Type, row.Brand, row.Last4 = pm.Type, pm.Brand, pm.Last4
+	row.ExpMonth, row.ExpYear, row.Fingerprint = pm.ExpMonth, pm.ExpYear, pm.Fingerprint
+
+	pm.ID, pm.IsDefault, pm.CreatedAt = row.ID, row.IsDefault, row.CreatedAt
+	return nil
+}
+
+func (s *MemoryStorage) GetPaymentMethod(ctx context.Context, stripeID string) (*PaymentMethod, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pm := s.paymentMethodByStripeID(stripeID)
+	if pm == nil {
+		return nil, fmt.Errorf("no payment method found for %s: %w", stripeID, ErrNotFound)
+	}
+	out := *pm
+	return &out, nil
+}
+
+func (s *MemoryStorage) GetPaymentMethods(ctx context.Context, userID uint) ([]*PaymentMethod, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pms []*PaymentMethod
+	for _, pm := range s.paymentMethods {
+		if pm.UserID == userID {
+			out := *pm
+			pms = append(pms, &out)
+		}
+	}
+	sort.Slice(pms, func(i, j int) bool {
+		if pms[i].IsDefault != pms[j].IsDefault {
+			return pms[i].IsDefault
+		}
+		return pms[i].ID > pms[j].ID
+	})
+
+	return pms, nil
+}
+
+func (s *MemoryStorage) DeletePaymentMethod(ctx context.Context, stripeID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pm := s.paymentMethodByStripeID(stripeID)
+	if pm == nil {
+		return fmt.Errorf("no payment method found: %w", ErrNotFound)
+	}
+	delete(s.paymentMethods, pm.ID)
+	return nil
+}
+
+func (s *MemoryStorage) SetDefaultPaymentMethod(ctx context.Context, userID uint, stripeID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pm := s.paymentMethodByStripeID(stripeID)
+	if pm == nil || pm.UserID != userID {
+		return fmt.Errorf("no payment method found: %w", ErrNotFound)
+	}
+	for _, other := range s.paymentMethods {
+		if other.UserID == userID {
+			other.IsDefault = false
+		}
+	}
+	pm.IsDefault = true
+	return nil
+}
@@ -0,0 +1,385 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrInvalidTransition is returned (wrapped) when a status update is not
+// allowed by the transition table for its entity.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// PaymentStatus is the local status of a payment. PaymentSucceeded is stored
+// as "success" for compatibility with existing rows.
+type PaymentStatus string
+
+const (
+	PaymentPending           PaymentStatus = "pending"
+	PaymentProcessing        PaymentStatus = "processing"
+	PaymentRequiresAction    PaymentStatus = "requires_action"
+	PaymentAuthorized        PaymentStatus = "authorized"
+	PaymentSucceeded         PaymentStatus = "success"
+	PaymentFailed            PaymentStatus = "failed"
+	PaymentCanceled          PaymentStatus = "canceled"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentRefunded          PaymentStatus = "refunded"
+	PaymentDisputed          PaymentStatus = "disputed"
+	PaymentDisputeLost       PaymentStatus = "dispute_lost"
+)
+
+// paymentTransitions lists the statuses each payment status may move to.
+// An authorized payment is either captured or voided. A failed payment can
+// still be retried by the customer, and a refunded one
+// moves back when one of its refunds fails. Canceled payments and lost
+// disputes are final.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentPending:           {PaymentProcessing, PaymentRequiresAction, PaymentAuthorized, PaymentSucceeded, PaymentFailed, PaymentCanceled},
+	PaymentProcessing:        {PaymentRequiresAction, PaymentAuthorized, PaymentSucceeded, PaymentFailed, PaymentCanceled},
+	PaymentRequiresAction:    {PaymentProcessing, PaymentAuthorized, PaymentSucceeded, PaymentFailed, PaymentCanceled},
+	PaymentFailed:            {PaymentProcessing, PaymentRequiresAction, PaymentAuthorized, PaymentSucceeded, PaymentCanceled},
+	PaymentAuthorized:        {PaymentSucceeded, PaymentCanceled},
+	PaymentSucceeded:         {PaymentPartiallyRefunded, PaymentRefunded, PaymentDisputed},
+	PaymentPartiallyRefunded: {PaymentRefunded, PaymentSucceeded, PaymentDisputed},
+	PaymentDisputed:          {PaymentSucceeded, PaymentPartiallyRefunded, PaymentDisputeLost},
+	PaymentCanceled:          {},
+	PaymentRefunded:          {PaymentPartiallyRefunded, PaymentSucceeded},
+	PaymentDisputeLost:       {},
+}
+
+func (s PaymentStatus) Valid() bool {
+	_, ok := paymentTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a payment in status s may move to next.
+// Staying in the same status is always allowed.
+func (s PaymentStatus) CanTransitionTo(next PaymentStatus) bool {
+	return s == next || slices.Contains(paymentTransitions[s], next)
+}
+
+// SubscriptionStatus mirrors the Stripe subscription statuses.
+type SubscriptionStatus string
+
+const (
+	SubscriptionIncomplete        SubscriptionStatus = "incomplete"
+	SubscriptionIncompleteExpired SubscriptionStatus = "incomplete_expired"
+	SubscriptionTrialing          SubscriptionStatus = "trialing"
+	SubscriptionActive            SubscriptionStatus = "active"
+	SubscriptionPastDue           SubscriptionStatus = "past_due"
+	SubscriptionUnpaid            SubscriptionStatus = "unpaid"
+	SubscriptionPaused            SubscriptionStatus = "paused"
+	SubscriptionCanceled          SubscriptionStatus = "canceled"
+)
+
+// subscriptionTransitions lists the statuses each subscription status may
+// move to. Canceled and expired subscriptions are final.
+var subscriptionTransitions = map[SubscriptionStatus][]SubscriptionStatus{
+	SubscriptionIncomplete:        {SubscriptionActive, SubscriptionTrialing, SubscriptionPastDue, SubscriptionIncompleteExpired, SubscriptionCanceled},
+	SubscriptionTrialing:          {SubscriptionActive, SubscriptionPastDue, SubscriptionUnpaid, SubscriptionPaused, SubscriptionCanceled},
+	SubscriptionActive:            {SubscriptionTrialing, SubscriptionPastDue, SubscriptionUnpaid, SubscriptionPaused, SubscriptionCanceled},
+	SubscriptionPastDue:           {SubscriptionActive, SubscriptionUnpaid, SubscriptionPaused, SubscriptionCanceled},
+	SubscriptionUnpaid:            {SubscriptionActive, SubscriptionPastDue, SubscriptionCanceled},
+	SubscriptionPaused:            {SubscriptionActive, SubscriptionTrialing, SubscriptionCanceled},
+	SubscriptionIncompleteExpired: {},
+	SubscriptionCanceled:          {},
+}
+
+func (s SubscriptionStatus) Valid() bool {
+	_, ok := subscriptionTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a subscription in status s may move to
+// next. Staying in the same status is always allowed.
+func (s SubscriptionStatus) CanTransitionTo(next SubscriptionStatus) bool {
+	return s == next || slices.Contains(subscriptionTransitions[s], next)
+}
+
+// RefundStatus is the local status of a refund. RefundSucceeded is stored as
+// "refunded" for compatibility with existing rows.
+type RefundStatus string
+
+const (
+	RefundPending        RefundStatus = "pending"
+	RefundRequiresAction RefundStatus = "requires_action"
+	RefundSucceeded      RefundStatus = "refunded"
+	RefundFailed         RefundStatus = "failed"
+	RefundCanceled       RefundStatus = "canceled"
+)
+
+// refundTransitions lists the statuses each refund status may move to. A
+// succeeded refund can still fail later, for example when the card it went
+// back to has been closed.
+var refundTransitions = map[RefundStatus][]RefundStatus{
+	RefundPending:        {RefundRequiresAction, RefundSucceeded, RefundFailed, RefundCanceled},
+	RefundRequiresAction: {RefundPending, RefundSucceeded, RefundFailed, RefundCanceled},
+	RefundSucceeded:      {RefundFailed},
+	RefundFailed:         {},
+	RefundCanceled:       {},
+}
+
+func (s RefundStatus) Valid() bool {
+	_, ok := refundTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a refund in status s may move to next.
+// Staying in the same status is always allowed.
+func (s RefundStatus) CanTransitionTo(next RefundStatus) bool {
+	return s == next || slices.Contains(refundTransitions[s], next)
+}
+
+// Reversed reports whether a refund in status s gave no money back, so its
+// amount no longer counts against the payment.
+func (s RefundStatus) Reversed() bool {
+	return s == RefundFailed || s == RefundCanceled
+}
+
+// CheckoutSessionStatus mirrors the Stripe Checkout Session statuses.
+type CheckoutSessionStatus string
+
+const (
+	CheckoutSessionOpen     CheckoutSessionStatus = "open"
+	CheckoutSessionComplete CheckoutSessionStatus = "complete"
+	CheckoutSessionExpired  CheckoutSessionStatus = "expired"
+)
+
+// checkoutSessionTransitions lists the statuses each checkout session status
+// may move to. A session is completed or expires exactly once.
+var checkoutSessionTransitions = map[CheckoutSessionStatus][]CheckoutSessionStatus{
+	CheckoutSessionOpen:     {CheckoutSessionComplete, CheckoutSessionExpired},
+	CheckoutSessionComplete: {},
+	CheckoutSessionExpired:  {},
+}
+
+func (s CheckoutSessionStatus) Valid() bool {
+	_, ok := checkoutSessionTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a checkout session in status s may move to
+// next. Staying in the same status is always allowed.
+func (s CheckoutSessionStatus) CanTransitionTo(next CheckoutSessionStatus) bool {
+	return s == next || slices.Contains(checkoutSessionTransitions[s], next)
+}
+
+// Entities whose status changes are recorded in the status history.
+const (
+	EntityPayment         = "payment"
+	EntityRefund          = "refund"
+	EntitySubscription    = "subscription"
+	EntityCheckoutSession = "checkout_session"
+)
+
+// StatusHistoryEntry records one status change. From is empty for the status
+// an entity was created with.
+type StatusHistoryEntry struct {
+	ID        uint      `json:"id" db:"id"`
+	Entity    string    `json:"entity" db:"entity"`
+	StripeID  string    `json:"stripe_id" db:"stripe_id"`
+	From      string    `json:"from_status" db:"from_status"`
+	To        string    `json:"to_status" db:"to_status"`
+	ChangedAt time.Time `json:"changed_at" db:"changed_at"`
+}
+
+func (s *PostgresStorage) transitionPayment(ctx context.Context, where string, status PaymentStatus, args ...interface{}) error {
+	allowed := func(from string) bool { return PaymentStatus(from).CanTransitionTo(status) }
+	_, err := s.transition(ctx, "payments", "stripe_payment_intent_id", EntityPayment, where, string(status), allowed, args...)
+	return err
+}
+
+func (s *PostgresStorage) transitionRefund(ctx context.Context, where string, status RefundStatus, args ...interface{}) (RefundStatus, error) {
+	allowed := func(from string) bool { return RefundStatus(from).CanTransitionTo(status) }
+	from, err := s.transition(ctx, "refunds", "stripe_refund_id", EntityRefund, where, string(status), allowed, args...)
+	return RefundStatus(from), err
+}
+
+func (s *PostgresStorage) transitionSubscription(ctx context.Context, where string, status SubscriptionStatus, args ...interface{}) error {
+	allowed := func(from string) bool { return SubscriptionStatus(from).CanTransitionTo(status) }
+	_, err := s.transition(ctx, "subscriptions", "stripe_subscription_id", EntitySubscription, where, string(status), allowed, args...)
+	return err
+}
+
+func (s *PostgresStorage) transitionCheckoutSession(ctx context.Context, where string, status CheckoutSessionStatus, args ...interface{}) error {
+	allowed := func(from string) bool { return CheckoutSessionStatus(from).CanTransitionTo(status) }
+	_, err := s.transition(ctx, "checkout_sessions", "stripe_checkout_session_id", EntityCheckoutSession, where, string(status), allowed, args...)
+	return err
+}
+
+// transition moves the row of table matched by where to status if allowed
+// permits it, records the change and returns the status the row had before.
+// The row stays locked from the check until the history entry is written.
+// Moving to the current status is a no-op and is not recorded.
+func (s *PostgresStorage) transition(ctx context.Context, table, stripeColumn, entity, where, status string, allowed func(from string) bool, args ...interface{}) (string, error) {
+	var from string
+	err := s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		var id uint
+		var stripeID string
+		err := func() error {
+			ctx, cancel := t.withTimeout(ctx)
+			defer cancel()
+
+			query := fmt.Sprintf(`SELECT id, %s, status FROM %s WHERE %s FOR UPDATE`, stripeColumn, table, where)
+			return t.q.QueryRowContext(ctx, query, args...).Scan(&id, &stripeID, &from)
+		}()
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("no %s found: %w", entity, ErrNotFound)
+			}
+			return err
+		}
+
+		if from == status {
+			return nil
+		}
+		if !allowed(from) {
+			return fmt.Errorf("%s %s: %s -> %s: %w", entity, stripeID, from, status, ErrInvalidTransition)
+		}
+
+		query := fmt.Sprintf(`UPDATE %s SET status=$1 WHERE id=$2`, table)
+		if err := t.execOne(ctx, entity, query, status, id); err != nil {
+			return err
+		}
+		return t.recordStatus(ctx, entity, stripeID, from, status)
+	})
+	return from, err
+}
+
+func (s *PostgresStorage) recordStatus(ctx context.Context, entity, stripeID, from, to string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO status_history (entity, stripe_id, from_status, to_status) VALUES ($1, $2, $3, $4)`
+
+	_, err := s.q.ExecContext(ctx, query, entity, stripeID, from, to)
+	return err
+}
+
+func (s *PostgresStorage) OverridePaymentStatus(ctx context.Context, stripeID string, status PaymentStatus) (PaymentStatus, error) {
+	if !status.Valid() {
+		return "", fmt.Errorf("payment %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+	from, err := s.transition(ctx, "payments", "stripe_payment_intent_id", EntityPayment, `stripe_payment_intent_id=$1`, string(status), anyStatus, stripeID)
+	return PaymentStatus(from), err
+}
+
+func (s *PostgresStorage) OverrideSubscriptionStatus(ctx context.Context, stripeID string, status SubscriptionStatus) (SubscriptionStatus, error) {
+	if !status.Valid() {
+		return "", fmt.Errorf("subscription %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+	from, err := s.transition(ctx, "subscriptions", "stripe_subscription_id", EntitySubscription, `stripe_subscription_id=$1`, string(status), anyStatus, stripeID)
+	return SubscriptionStatus(from), err
+}
+
+// anyStatus lets an override leave any status, final ones included.
+func anyStatus(string) bool { return true }
+
+func (s *PostgresStorage) GetStatusHistory(ctx context.Context, entity, stripeID string) ([]*StatusHistoryEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, entity, stripe_id, from_status, to_status, changed_at
+FROM status_history WHERE entity=$1 AND stripe_id=$2 ORDER BY id`
+
+	rows, err := s.q.QueryContext(ctx, query, entity, stripeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hs []*StatusHistoryEntry
+	for rows.Next() {
+		var h StatusHistoryEntry
+		if err := rows.Scan(&h.ID, &h.Entity, &h.StripeID, &h.From, &h.To, &h.ChangedAt); err != nil {
+			return nil, err
+		}
+		hs = append(hs, &h)
+	}
+
+	return hs, rows.Err()
+}
+
+// recordStatus appends to the in-memory status history. The caller must hold
+// s.mu.
+func (s *MemoryStorage) recordStatus(entity, stripeID, from, to string) {
+	h := &StatusHistoryEntry{
+		ID:        s.nextID("status_history"),
+		Entity:    entity,
+		StripeID:  stripeID,
+		From:      from,
+		To:        to,
+		ChangedAt: time.Now(),
+	}
+	s.statusHistory = append(s.statusHistory, h)
+}
+
+func (s *MemoryStorage) OverridePaymentStatus(ctx context.Context, stripeID string, status PaymentStatus) (PaymentStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if !status.Valid() {
+		return "", fmt.Errorf("payment %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.paymentByIntent(stripeID)
+	if p == nil {
+		return "", fmt.Errorf("no payment found: %w", ErrNotFound)
+	}
+	from := p.Status
+	if from != status {
+		s.recordStatus(EntityPayment, stripeID, string(from), string(status))
+		p.Status = status
+	}
+	return from, nil
+}
+
+func (s *MemoryStorage) OverrideSubscriptionStatus(ctx context.Context, stripeID string, status SubscriptionStatus) (SubscriptionStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if !status.Valid() {
+		return "", fmt.Errorf("subscription %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionByStripeID(stripeID)
+	if sub == nil {
+		return "", fmt.Errorf("no subscription found: %w", ErrNotFound)
+	}
+	from := sub.Status
+	if from != status {
+		s.recordStatus(EntitySubscription, stripeID, string(from), string(status))
+		sub.Status = status
+	}
+	return from, nil
+}
+
+func (s *MemoryStorage) GetStatusHistory(ctx context.Context, entity, stripeID string) ([]*StatusHistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hs []*StatusHistoryEntry
+	for _, h := range s.statusHistory {
+		if h.Entity == entity && h.StripeID == stripeID {
+			out := *h
+			hs = append(hs, &out)
+		}
+	}
+
+	return hs, nil
+}
@@ -0,0 +1,100 @@
+package models
+
+import "testing"
+
+func TestPaymentTransitions(t *testing.T) {
+	cases := []struct {
+		from, to PaymentStatus
+		want     bool
+	}{
+		{PaymentPending, PaymentSucceeded, true},
+		{PaymentPending, PaymentPending, true},
+		{PaymentFailed, PaymentSucceeded, true},
+		{PaymentAuthorized, PaymentSucceeded, true},
+		{PaymentSucceeded, PaymentPending, false},
+		{PaymentSucceeded, PaymentFailed, false},
+		{PaymentSucceeded, PaymentCanceled, false},
+		{PaymentRefunded, PaymentPartiallyRefunded, true},
+		{PaymentCanceled, PaymentSucceeded, false},
+		{PaymentDisputeLost, PaymentSucceeded, false},
+	}
+	for _, c := range cases {
+		if got := c.from.CanTransitionTo(c.to); got != c.want {
+			t.Errorf("%s -> %s allowed = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestSubscriptionTransitions(t *testing.T) {
+	cases := []struct {
+		from, to SubscriptionStatus
+		want     bool
+	}{
+		{SubscriptionIncomplete, SubscriptionActive, true},
+		{SubscriptionTrialing, SubscriptionActive, true},
+		{SubscriptionActive, SubscriptionPastDue, true},
+		{SubscriptionPastDue, SubscriptionActive, true},
+		{SubscriptionActive, SubscriptionIncomplete, false},
+		{SubscriptionCanceled, SubscriptionActive, false},
+		{SubscriptionIncompleteExpired, SubscriptionActive, false},
+	}
+	for _, c := range cases {
+		if got := c.from.CanTransitionTo(c.to); got != c.want {
+			t.Errorf("%s -> %s allowed = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestRefundTransitions(t *testing.T) {
+	if !RefundSucceeded.CanTransitionTo(RefundFailed) {
+		t.Error("a succeeded refund must be able to fail later")
+	}
+	if RefundFailed.CanTransitionTo(RefundSucceeded) || RefundCanceled.CanTransitionTo(RefundPending) {
+		t.Error("failed and canceled refunds must be final")
+	}
+	for _, s := range []RefundStatus{RefundFailed, RefundCanceled} {
+		if !s.Reversed() {
+			t.Errorf("%s.Reversed() = false", s)
+		}
+	}
+	if RefundSucceeded.Reversed() || RefundPending.Reversed() {
+		t.Error("pending and succeeded refunds count against the payment")
+	}
+}
+
+// TestTransitionTables checks that every status a table moves to is itself
+// a known status, so nothing can get stuck in a status with no entry.
+func TestTransitionTables(t *testing.T) {
+	for from, tos := range paymentTransitions {
+		for _, to := range tos {
+			if !to.Valid() {
+				t.Errorf("payment %s -> unknown status %q", from, to)
+			}
+		}
+	}
+	for from, tos := range subscriptionTransitions {
+		for _, to := range tos {
+			if !to.Valid() {
+				t.Errorf("subscription %s -> unknown status %q", from, to)
+			}
+		}
+	}
+	for from, tos := range refundTransitions {
+		for _, to := range tos {
+			if !to.Valid() {
+				t.Errorf("refund %s -> unknown status %q", from, to)
+			}
+		}
+	}
+	for from, tos := range checkoutSessionTransitions {
+		for _, to := range tos {
+			if !to.Valid() {
+				t.Errorf("checkout session %s -> unknown status %q", from, to)
+			}
+		}
+	}
+
+	if PaymentStatus("paid").Valid() || SubscriptionStatus("ended").Valid() {
+		t.Error("unknown statuses reported valid")
+	}
+}
@@ -1,11 +1,32 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// ErrNotFound is returned (possibly wrapped) by Storage lookups and updates
+// that match no row.
+var ErrNotFound = errors.New("not found")
+
+// ErrOverRefund is returned (wrapped) when a refund would take a payment's
+// refunded total above the amount paid.
+var ErrOverRefund = errors.New("refund exceeds remaining balance")
+
+// ErrDuplicate is returned (wrapped) when a write would store a Stripe ID
+// that another row already has.
+var ErrDuplicate = errors.New("duplicate Stripe ID")
+
+// ErrInvalidReference is returned (wrapped) when a write refers to a user or
+// payment that does not exist.
+var ErrInvalidReference = errors.New("reference to a missing row")
+
 type Users struct {
 	ID        uint      `json:"id" db:"id"`
 	Name      string    `json:"name" db:"name"`
@@ -15,40 +36,75 @@ type Users struct {
 }
 
 type Payment struct {
-	ID              uint      `json:"id" db:"id"`
-	UserID          uint      `json:"user_id" db:"user_id"`
-	Name            string    `json:"name" db:"name"`
-	Email           string    `json:"email" db:"email"`
-	SubscriptionID  uint      `json:"subscription_id" db:"subscription_id"`
-	TransactionID   uint      `json:"transaction_id" db:"transaction_id"`
-	StripePaymentID string    `json:"stripe_payment_intent_id" db:"stripe_payment_intent_id"`
-	Amount          int64     `json:"amount" db:"amount"`
-	Currency        string    `json:"currency" db:"currency"`
-	PaymentMethod   string    `json:"payment_method" db:"payment_method"`
-	Status          string    `json:"status" db:"status"`
-	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+	ID              uint          `json:"id" db:"id"`
+	UserID          uint          `json:"user_id" db:"user_id"`
+	Name            string        `json:"name" db:"name"`
+	Email           string        `json:"email" db:"email"`
+	SubscriptionID  uint          `json:"subscription_id" db:"subscription_id"`
+	TransactionID   uint          `json:"transaction_id" db:"transaction_id"`
+	StripePaymentID string        `json:"stripe_payment_intent_id" db:"stripe_payment_intent_id"`
+	Amount          int64         `json:"amount" db:"amount"`
+	Currency        string        `json:"currency" db:"currency"`
+	PaymentMethod   string        `json:"payment_method" db:"payment_method"`
+	Status          PaymentStatus `json:"status" db:"status"`
+	CreatedAt       time.Time     `json:"created_at" db:"created_at"`
+	AmountRefunded  int64         `json:"amount_refunded" db:"amount_refunded"`
+	// CaptureMethod is CaptureManual for payments that are authorized first
+	// and captured later, up to AmountAuthorized and before
+	// AuthorizationExpiresAt.
+	CaptureMethod          string     `json:"capture_method" db:"capture_method"`
+	AmountAuthorized       int64      `json:"amount_authorized" db:"amount_authorized"`
+	AmountCaptured         int64      `json:"amount_captured" db:"amount_captured"`
+	AuthorizationExpiresAt *time.Time `json:"authorization_expires_at,omitempty" db:"authorization_expires_at"`
 }
 
 type Refund struct {
-	ID             uint      `json:"id" db:"id"`
-	PaymentID      uint      `json:"payment_id" db:"payment_id"`
-	TransactionID  uint      `json:"transaction_id" db:"transaction_id"`
-	StripeRefundID string    `json:"stripe_refund_id" db:"stripe_refund_id"`
-	Amount         int64     `json:"amount_refunded" db:"amount_refunded"`
-	Status         string    `json:"status" db:"status"`
-	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	ID             uint              `json:"id" db:"id"`
+	PaymentID      uint              `json:"payment_id" db:"payment_id"`
+	TransactionID  uint              `json:"transaction_id" db:"transaction_id"`
+	StripeRefundID string            `json:"stripe_refund_id" db:"stripe_refund_id"`
+	Amount         int64             `json:"amount_refunded" db:"amount_refunded"`
+	Status         RefundStatus      `json:"status" db:"status"`
+	CreatedAt      time.Time         `json:"created_at" db:"created_at"`
+	Reason         string            `json:"reason,omitempty" db:"reason"`
+	Metadata       map[string]string `json:"metadata,omitempty" db:"metadata"`
 }
 
 type Subscription struct {
-	ID                   uint       `json:"id" db:"id"`
-	UserID               uint       `json:"user_id" db:"user_id"`
-	PaymentID            uint       `json:"payment_id" db:"payment_id"`
-	Amount               int64      `json:"amount" db:"amount"`
-	Currency             string     `json:"currency" db:"currency"`
-	StripeSubscriptionID string     `json:"stripe_subscription_id" db:"stripe_subscription_id"`
-	Status               string     `json:"status" db:"status"`
-	StartDate            time.Time  `json:"start_date" db:"start_date"`
-	EndDate              *time.Time `json:"end_date,omitempty" db:"end_date"`
+	ID                   uint               `json:"id" db:"id"`
+	UserID               uint               `json:"user_id" db:"user_id"`
+	PaymentID            uint               `json:"payment_id" db:"payment_id"`
+	PriceID              uint               `json:"price_id,omitempty" db:"price_id"`
+	Amount               int64              `json:"amount" db:"amount"`
+	Currency             string             `json:"currency" db:"currency"`
+	StripeSubscriptionID string             `json:"stripe_subscription_id" db:"stripe_subscription_id"`
+	Status               SubscriptionStatus `json:"status" db:"status"`
+	StartDate            time.Time          `json:"start_date" db:"start_date"`
+	EndDate              *time.Time         `json:"end_date,omitempty" db:"end_date"`
+	TrialEnd             *time.Time         `json:"trial_end,omitempty" db:"trial_end"`
+	Discount             *Discount          `json:"discount,omitempty"`
+	CancelAtPeriodEnd    bool               `json:"cancel_at_period_end" db:"cancel_at_period_end"`
+	Pause                *PauseCollection   `json:"pause_collection,omitempty"`
+}
+
+// PauseCollection describes paused payment collection on a subscription:
+// Behavior says what happens to invoices raised meanwhile, and ResumesAt is
+// nil when collection stays paused until resumed by hand.
+type PauseCollection struct {
+	Behavior  string     `json:"behavior" db:"pause_behavior"`
+	ResumesAt *time.Time `json:"resumes_at,omitempty" db:"pause_resumes_at"`
+}
+
+// Discount is the coupon applied to a subscription, directly or through the
+// promotion code PromotionCodeID. Either PercentOff or AmountOff is set, and
+// EndsAt is nil for discounts that last forever.
+type Discount struct {
+	CouponID        string     `json:"coupon_id" db:"coupon_id"`
+	PromotionCodeID string     `json:"promotion_code_id,omitempty" db:"promotion_code_id"`
+	PercentOff      float64    `json:"percent_off,omitempty" db:"percent_off"`
+	AmountOff       int64      `json:"amount_off,omitempty" db:"amount_off"`
+	Duration        string     `json:"duration" db:"discount_duration"`
+	EndsAt          *time.Time `json:"ends_at,omitempty" db:"discount_ends_at"`
 }
 
 type Transaction struct {
@@ -61,104 +117,388 @@ type Transaction struct {
 	TransactionType string    `json:"transaction_type" db:"transaction_type"`
 	Status          string    `json:"status" db:"status"`
 	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+	// PaymentLinkID is set when the payment, or the refunded payment, came
+	// through a payment link.
+	PaymentLinkID uint `json:"payment_link_id,omitempty" db:"payment_link_id"`
 }
 
 type Storage interface {
-	CreatePayment(uint, string, string, int64, string, string, string) (uint, error)
-	GetPaymentDetails(paymentintentID string) (*Payment, error)
-	UpdatePaymentStatus(string, string) error
-	CreateRefund(uint, int64, string, string) (uint, error)
-	UpdateRefundStatus(string, string) error
-	CancelPayment(uint, uint) error
-	CreateSubscription(uint, uint, int64, string, string, string) error
-	UpdateSubscriptionStatus(string, string) error
-	GetSubscriptionDetails(string) (*Subscription, error)
-	CancelSubscription(uint, uint) error
-	LogTransaction(uint, string, int64, string, *uint) error
-	GetUserTransactions(uint) ([]*Transaction, error)
-	CreateCustomer(name, email, stripeID string) (string, uint, error)
-	CheckCustomer(name, email string) (string, uint, error)
+	CreatePayment(context.Context, uint, string, string, int64, string, string, string, string) (uint, error)
+	GetPaymentDetails(ctx context.Context, paymentintentID string) (*Payment, error)
+	// UpdatePaymentStatus and UpdateSubscriptionStatus, like the Cancel
+	// methods, enforce the status transition tables and record every change
+	// in the status history. Illegal moves fail with ErrInvalidTransition.
+	UpdatePaymentStatus(context.Context, string, PaymentStatus) error
+	// OverridePaymentStatus and OverrideSubscriptionStatus set a status
+	// without consulting the transition table, so an operator can repair a
+	// row wrongly moved to a final status, and return the status replaced.
+	// The change is recorded in the status history like any other.
+	OverridePaymentStatus(ctx context.Context, stripeID string, status PaymentStatus) (from PaymentStatus, err error)
+	OverrideSubscriptionStatus(ctx context.Context, stripeID string, status SubscriptionStatus) (from SubscriptionStatus, err error)
+	CreateRefund(ctx context.Context, paymentID uint, amount int64, status RefundStatus, stripeID, reason string, metadata map[string]string) (uint, error)
+	// AddRefundedAmount adds amount, which is negative when a refund is
+	// reversed, to a payment's refunded total and returns the updated
+	// payment. It fails with ErrOverRefund, changing nothing, if the total
+	// would fall below zero or exceed the amount paid.
+	AddRefundedAmount(ctx context.Context, paymentID uint, amount int64) (*Payment, error)
+	// UpdateRefundStatus enforces the refund transition table like
+	// UpdatePaymentStatus, and returns the status the refund had before so
+	// callers can act on the change exactly once.
+	UpdateRefundStatus(ctx context.Context, stripeRefundID string, status RefundStatus) (from RefundStatus, err error)
+	// GetFailedRefunds returns up to limit failed refunds, newest first.
+	GetFailedRefunds(ctx context.Context, limit int) ([]*Refund, error)
+	CancelPayment(context.Context, uint, uint) error
+	// CreateSubscription stores a subscription for userID. paymentID and
+	// priceID are 0 when there is no such payment or catalog price.
+	CreateSubscription(ctx context.Context, userID, paymentID, priceID uint, amount int64, currency, stripeID string, status SubscriptionStatus) error
+	UpdateSubscriptionStatus(context.Context, string, SubscriptionStatus) error
+	GetSubscriptionDetails(context.Context, string) (*Subscription, error)
+	// UpdateSubscriptionTrial and UpdateSubscriptionDiscount record the trial
+	// end and discount Stripe reports for a subscription; nil clears them.
+	UpdateSubscriptionTrial(ctx context.Context, stripeID string, trialEnd *time.Time) error
+	UpdateSubscriptionDiscount(ctx context.Context, stripeID string, d *Discount) error
+	// UpdateSubscriptionPrice moves a subscription to another catalog price
+	// after a plan change, priceID being 0 for a price outside the catalog.
+	UpdateSubscriptionPrice(ctx context.Context, stripeID string, priceID uint, amount int64) error
+	// UpdateSubscriptionCancellation records whether a subscription is set
+	// to cancel at the end of its period, and its end date: when it ended
+	// or, with atPeriodEnd set, when it is going to.
+	UpdateSubscriptionCancellation(ctx context.Context, stripeID string, atPeriodEnd bool, endDate *time.Time) error
+	// UpdateSubscriptionPause records paused collection; nil means collecting.
+	UpdateSubscriptionPause(ctx context.Context, stripeID string, p *PauseCollection) error
+
+	// CreateNotification queues a message for a customer. It does nothing
+	// if a notification for the same event exists, so an event that is
+	// applied twice notifies once.
+	CreateNotification(ctx context.Context, n *Notification) error
+	GetPendingNotifications(ctx context.Context, limit int) ([]*Notification, error)
+	MarkNotificationSent(ctx context.Context, id uint) error
+	CancelSubscription(context.Context, uint, uint) error
+	LogTransaction(context.Context, uint, string, int64, string, *uint) error
+	GetUserTransactions(context.Context, uint) ([]*Transaction, error)
+	CreateCustomer(ctx context.Context, name, email, stripeID string) (string, uint, error)
+	CheckCustomer(ctx context.Context, name, email string) (string, uint, error)
+	GetCustomer(ctx context.Context, userID uint) (*Users, error)
+	GetCustomerByStripeID(ctx context.Context, stripeID string) (*Users, error)
+	GetRefundDetails(ctx context.Context, stripeRefundID string) (*Refund, error)
+	// RecordAuthorization stores how much of a manual-capture payment was
+	// authorized and when the authorization lapses.
+	RecordAuthorization(ctx context.Context, paymentIntentID string, amount int64, expiresAt *time.Time) error
+	// RecordCapture stores how much of a payment was captured.
+	RecordCapture(ctx context.Context, paymentIntentID string, amount int64) error
+	GetStatusHistory(ctx context.Context, entity, stripeID string) ([]*StatusHistoryEntry, error)
+
+	// SavePaymentMethod inserts pm, or refreshes the card details of the
+	// saved copy, and fills in its ID and default flag.
+	SavePaymentMethod(ctx context.Context, pm *PaymentMethod) error
+	GetPaymentMethod(ctx context.Context, stripeID string) (*PaymentMethod, error)
+	// GetPaymentMethods returns a customer's payment methods, the default
+	// first and then newest first.
+	GetPaymentMethods(ctx context.Context, userID uint) ([]*PaymentMethod, error)
+	DeletePaymentMethod(ctx context.Context, stripeID string) error
+	// SetDefaultPaymentMethod makes stripeID, which must belong to userID,
+	// the customer's only default.
+	SetDefaultPaymentMethod(ctx context.Context, userID uint, stripeID string) error
+
+	// CreateCheckoutSession inserts an open session and fills in its ID,
+	// status and creation time.
+	CreateCheckoutSession(ctx context.Context, cs *CheckoutSession) error
+	GetCheckoutSession(ctx context.Context, stripeID string) (*CheckoutSession, error)
+	// UpdateCheckoutSession moves a session to status, enforcing the
+	// transition table like UpdatePaymentStatus, and links it to paymentID
+	// unless that is nil.
+	UpdateCheckoutSession(ctx context.Context, stripeID string, status CheckoutSessionStatus, paymentID *uint) error
+
+	// CreatePaymentLink inserts an active link and fills in its ID and
+	// creation time.
+	CreatePaymentLink(ctx context.Context, pl *PaymentLink) error
+	GetPaymentLink(ctx context.Context, stripeID string) (*PaymentLink, error)
+	DeactivatePaymentLink(ctx context.Context, stripeID string) error
+	// GetExpiredPaymentLinks returns up to limit active links whose expiry is
+	// at or before now, oldest expiry first.
+	GetExpiredPaymentLinks(ctx context.Context, now time.Time, limit int) ([]*PaymentLink, error)
+	// GetPaymentLinkTransactions returns the ledger entries of the payments
+	// made through a link, and of their refunds.
+	GetPaymentLinkTransactions(ctx context.Context, linkID uint) ([]*Transaction, error)
+
+	// CreateProduct and CreatePrice insert an active catalog entry and fill
+	// in its ID and creation time.
+	CreateProduct(ctx context.Context, p *Product) error
+	GetProduct(ctx context.Context, id uint) (*Product, error)
+	GetProductByStripeID(ctx context.Context, stripeID string) (*Product, error)
+	ListProducts(ctx context.Context) ([]*Product, error)
+	// UpdateProduct saves the name, description and active flag of p.
+	UpdateProduct(ctx context.Context, p *Product) error
+	CreatePrice(ctx context.Context, p *Price) error
+	GetPrice(ctx context.Context, id uint) (*Price, error)
+	GetPriceByCode(ctx context.Context, code string) (*Price, error)
+	GetPriceByStripeID(ctx context.Context, stripeID string) (*Price, error)
+	// ListPrices returns the prices of a product, or of every product when
+	// productID is 0.
+	ListPrices(ctx context.Context, productID uint) ([]*Price, error)
+	SetPriceActive(ctx context.Context, stripeID string, active bool) error
+
+	CreateOutboxEntry(ctx context.Context, kind, stripeID string, payload []byte) (uint, error)
+	UpdateOutboxEntry(ctx context.Context, id uint, status, lastError string) error
+	GetPendingOutboxEntries(ctx context.Context, before time.Time, limit int) ([]*OutboxEntry, error)
+
+	// ReserveIdempotencyKey claims key for a new request. Keys created before
+	// expiredBefore, or still unfinished and created before staleBefore, are
+	// claimed afresh. Otherwise the existing key is returned and reserved is
+	// false.
+	ReserveIdempotencyKey(ctx context.Context, key, fingerprint string, expiredBefore, staleBefore time.Time) (existing *IdempotencyKey, reserved bool, err error)
+	CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, response []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+
+	// CreateWebhookEvent queues a received event for processing. It reports
+	// false, without error, if the event was already received.
+	CreateWebhookEvent(ctx context.Context, e *WebhookEvent) (created bool, err error)
+	// ClaimWebhookEvents hands out up to limit due events, oldest first, and
+	// locks them for lockFor. Events whose lock has run out are due again.
+	ClaimWebhookEvents(ctx context.Context, limit int, lockFor time.Duration) ([]*WebhookEvent, error)
+	GetWebhookEvent(ctx context.Context, id string) (*WebhookEvent, error)
+	// ListWebhookEvents returns the stored events matching f, oldest first.
+	ListWebhookEvents(ctx context.Context, f WebhookEventFilter) ([]*WebhookEvent, error)
+	FinishWebhookEvent(ctx context.Context, id, outcome, errMsg string) error
+	RetryWebhookEvent(ctx context.Context, id, errMsg string, delay time.Duration) error
+	// DeadLetterWebhookEvent gives up on an event and copies it to the dead
+	// letters.
+	DeadLetterWebhookEvent(ctx context.Context, id, errMsg string) error
+	GetWebhookDeadLetters(ctx context.Context, limit int) ([]*WebhookDeadLetter, error)
+	LastAppliedWebhookEvent(ctx context.Context, objectID string) (*WebhookEvent, error)
+	// LockWebhookObject waits until no other unit of work holds the lock on
+	// objectID and holds it until the surrounding one ends, so events for
+	// the same object are applied one at a time. It must be called through
+	// the tx of WithTx.
+	LockWebhookObject(ctx context.Context, objectID string) error
+
+	// WithTx runs fn as a single unit of work: every write fn makes through
+	// tx commits together, or none do if fn returns an error. Calling WithTx
+	// on a tx joins the surrounding unit of work.
+	WithTx(ctx context.Context, fn func(tx Storage) error) error
+}
+
+// querier is the subset of *sql.DB and *sql.Tx the queries need.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 type PostgresStorage struct {
-	db *sql.DB
+	db      *sql.DB
+	q       querier
+	inTx    bool
+	timeout time.Duration
 }
 
-func NewPostgresStorage(db *sql.DB) *PostgresStorage {
+// NewPostgresStorage returns a Storage backed by db. Each query is bounded by
+// timeout on top of the caller's context; zero means no extra deadline.
+func NewPostgresStorage(db *sql.DB, timeout time.Duration) *PostgresStorage {
 	return &PostgresStorage{
-		db: db,
+		db:      db,
+		q:       db,
+		timeout: timeout,
 	}
 }
 
-func (s *PostgresStorage) CreatePayment(userID uint, name, email string, amount int64, currency string, method string, stripeID string) (uint, error) {
-	query := `INSERT INTO payments (user_id, name, email, amount, currency, payment_method, stripe_payment_intent_id)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
-RETURNING id`
+func (s *PostgresStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(&PostgresStorage{db: s.db, q: tx, inTx: true, timeout: s.timeout})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+func (s *PostgresStorage) CreatePayment(ctx context.Context, userID uint, name, email string, amount int64, currency string, method string, stripeID string, captureMethod string) (uint, error) {
+	if captureMethod == "" {
+		captureMethod = CaptureAutomatic
+	}
 
 	var p Payment
-	err := s.db.QueryRow(query, userID, name, email, amount, currency, method, stripeID).Scan(&p.ID)
+	err := s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		ctx, cancel := t.withTimeout(ctx)
+		defer cancel()
+
+		query := `INSERT INTO payments (user_id, name, email, amount, currency, payment_method, stripe_payment_intent_id, capture_method)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING id, status`
+
+		err := t.q.QueryRowContext(ctx, query, userID, name, email, amount, currency, method, stripeID, captureMethod).Scan(&p.ID, &p.Status)
+		if err != nil {
+			return err
+		}
+		return t.recordStatus(ctx, EntityPayment, stripeID, "", string(p.Status))
+	})
 	if err != nil {
-		return 0, err
+		return 0, constraintError(err)
 	}
 	return p.ID, nil
 }
 
-func (s *PostgresStorage) CreateRefund(paymentID uint, amount int64, status string, stripeID string) (uint, error) {
+func (s *PostgresStorage) CreateRefund(ctx context.Context, paymentID uint, amount int64, status RefundStatus, stripeID, reason string, metadata map[string]string) (uint, error) {
+	if !status.Valid() {
+		return 0, fmt.Errorf("refund %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
+
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+
 	var refID uint
-	query := `INSERT INTO refunds (payment_id, amount, status, stripe_refund_id)
-VALUES ($1, $2, $3, $4)
+	err = s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		ctx, cancel := t.withTimeout(ctx)
+		defer cancel()
+
+		query := `INSERT INTO refunds (payment_id, amount, status, stripe_refund_id, reason, metadata)
+VALUES ($1, $2, $3, $4, $5, $6)
 RETURNING id`
 
-	err := s.db.QueryRow(query, paymentID, amount, status, stripeID).Scan(&refID)
+		err := t.q.QueryRowContext(ctx, query, paymentID, amount, status, stripeID, reason, meta).Scan(&refID)
+		if err != nil {
+			return err
+		}
+		return t.recordStatus(ctx, EntityRefund, stripeID, "", string(status))
+	})
 	if err != nil {
-		return 0, err
+		return 0, constraintError(err)
 	}
 
 	return refID, nil
 }
 
-func (s *PostgresStorage) CreateSubscription(userID uint, paymentID uint, amount int64, currency string, stripeID string, status string) error {
-	query := `INSERT INTO subscriptions (user_id, payment_id, amount, currency, stripe_subscription_id, status)
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, user_id, payment_id, amount, currency, stripe_subscription_id, status`
+func (s *PostgresStorage) AddRefundedAmount(ctx context.Context, paymentID uint, amount int64) (*Payment, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 
-	var sb Subscription
-	err := s.db.QueryRow(query, userID, paymentID, amount, currency, stripeID, status).Scan(&sb.ID, &sb.UserID, &sb.PaymentID, &sb.Amount, &sb.Currency, &sb.StripeSubscriptionID, &sb.Status)
+	query := `UPDATE payments SET amount_refunded = amount_refunded + $1
+WHERE id=$2 AND amount_refunded + $1 BETWEEN 0 AND (CASE capture_method WHEN 'manual' THEN amount_captured ELSE amount END)
+RETURNING *`
 
-	return err
+	p, err := scanPayment(s.q.QueryRowContext(ctx, query, amount, paymentID))
+	if err != sql.ErrNoRows {
+		return p, err
+	}
+
+	// Nothing updated: either the payment is missing or the balance is short.
+	p, err = scanPayment(s.q.QueryRowContext(ctx, `SELECT * FROM payments WHERE id=$1`, paymentID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no payment found for ID %d: %w", paymentID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("payment %d: refunding %d with %d of %d already refunded: %w", paymentID, amount, p.AmountRefunded, p.CapturedAmount(), ErrOverRefund)
 }
 
-func (s *PostgresStorage) UpdatePaymentStatus(stripe_payment_intent_id string, status string) error {
-	query := `UPDATE payments SET status=$1 WHERE stripe_payment_intent_id=$2`
+func (s *PostgresStorage) CreateSubscription(ctx context.Context, userID, paymentID, priceID uint, amount int64, currency, stripeID string, status SubscriptionStatus) error {
+	if !status.Valid() {
+		return fmt.Errorf("subscription %s: unknown status %q: %w", stripeID, status, ErrInvalidTransition)
+	}
 
-	_, err := s.db.Exec(query, status, stripe_payment_intent_id)
-	return err
-}
+	return s.WithTx(ctx, func(tx Storage) error {
+		t := tx.(*PostgresStorage)
+
+		ctx, cancel := t.withTimeout(ctx)
+		defer cancel()
 
-func (s *PostgresStorage) CancelPayment(paymentID, userID uint) error {
-	query := `UPDATE payments SET status='canceled' WHERE id=$1 AND user_id=$2`
+		query := `INSERT INTO subscriptions (user_id, payment_id, price_id, amount, currency, stripe_subscription_id, status)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, user_id, payment_id, amount, currency, stripe_subscription_id, status`
 
-	_, err := s.db.Exec(query, paymentID, userID)
+		var sb Subscription
+		err := t.q.QueryRowContext(ctx, query, userID, paymentID, priceID, amount, currency, stripeID, status).Scan(&sb.ID, &sb.UserID, &sb.PaymentID, &sb.Amount, &sb.Currency, &sb.StripeSubscriptionID, &sb.Status)
+		if err != nil {
+			return constraintError(err)
+		}
+		return t.recordStatus(ctx, EntitySubscription, stripeID, "", string(status))
+	})
+}
 
+// constraintError maps the unique and foreign key violations Postgres reports
+// to ErrDuplicate and ErrInvalidReference, the errors MemoryStorage returns
+// for the same writes.
+func constraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		return fmt.Errorf("%w: %w", ErrDuplicate, err)
+	case "foreign_key_violation":
+		return fmt.Errorf("%w: %w", ErrInvalidReference, err)
+	}
 	return err
 }
 
-func (s *PostgresStorage) CancelSubscription(subID, userID uint) error {
-	query := `UPDATE subscriptions SET status='canceled' WHERE id=$1 AND user_id=$2`
+// execOne runs an UPDATE that is expected to touch at least one row and
+// reports ErrNotFound when it did not.
+func (s *PostgresStorage) execOne(ctx context.Context, what string, query string, args ...interface{}) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
 
-	_, err := s.db.Exec(query, subID, userID)
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no %s found: %w", what, ErrNotFound)
+	}
+	return nil
+}
 
-	return err
+func (s *PostgresStorage) UpdatePaymentStatus(ctx context.Context, stripe_payment_intent_id string, status PaymentStatus) error {
+	return s.transitionPayment(ctx, `stripe_payment_intent_id=$1`, status, stripe_payment_intent_id)
 }
 
-func (s *PostgresStorage) UpdateSubscriptionStatus(stripe_subscription_id string, status string) error {
-	query := `UPDATE subscriptions SET status=$1 WHERE stripe_subscription_id=$2`
+func (s *PostgresStorage) CancelPayment(ctx context.Context, paymentID, userID uint) error {
+	return s.transitionPayment(ctx, `id=$1 AND user_id=$2`, PaymentCanceled, paymentID, userID)
+}
 
-	_, err := s.db.Exec(query, status, stripe_subscription_id)
-	return err
+func (s *PostgresStorage) CancelSubscription(ctx context.Context, subID, userID uint) error {
+	return s.transitionSubscription(ctx, `id=$1 AND user_id=$2`, SubscriptionCanceled, subID, userID)
+}
+
+func (s *PostgresStorage) UpdateSubscriptionStatus(ctx context.Context, stripe_subscription_id string, status SubscriptionStatus) error {
+	return s.transitionSubscription(ctx, `stripe_subscription_id=$1`, status, stripe_subscription_id)
 }
 
-func (s *PostgresStorage) LogTransaction(userID uint, txnType string, amount int64, currency string, refID *uint) error {
+func (s *PostgresStorage) LogTransaction(ctx context.Context, userID uint, txnType string, amount int64, currency string, refID *uint) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query1 := `INSERT INTO transactions (user_id, transaction_type, amount, currency, payment_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, user_id, transaction_type, amount, currency, payment_id`
 
 	query2 := `INSERT INTO transactions (user_id, transaction_type, amount, currency, refund_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, user_id, transaction_type, amount, currency, refund_id`
@@ -167,12 +507,12 @@ func (s *PostgresStorage) LogTransaction(userID uint, txnType string, amount int
 
 	switch txnType {
 	case "payment":
-		err := s.db.QueryRow(query1, userID, txnType, amount, currency, refID).Scan(&t.ID, &t.UserID, &t.TransactionType, &t.Amount, &t.Currency, &t.PaymentID)
+		err := s.q.QueryRowContext(ctx, query1, userID, txnType, amount, currency, refID).Scan(&t.ID, &t.UserID, &t.TransactionType, &t.Amount, &t.Currency, &t.PaymentID)
 
 		return err
 
-	case "refund":
-		err := s.db.QueryRow(query2, userID, txnType, amount, currency, refID).Scan(&t.ID, &t.UserID, &t.TransactionType, &t.Amount, &t.Currency, &t.RefundID)
+	case "refund", "refund_reversal":
+		err := s.q.QueryRowContext(ctx, query2, userID, txnType, amount, currency, refID).Scan(&t.ID, &t.UserID, &t.TransactionType, &t.Amount, &t.Currency, &t.RefundID)
 
 		return err
 	}
@@ -180,10 +520,25 @@ func (s *PostgresStorage) LogTransaction(userID uint, txnType string, amount int
 	return nil
 }
 
-func (s *PostgresStorage) GetUserTransactions(userID uint) ([]*Transaction, error) {
-	query := "SELECT * FROM transactions WHERE user_id=$1"
+func (s *PostgresStorage) GetUserTransactions(ctx context.Context, userID uint) ([]*Transaction, error) {
+	return s.queryTransactions(ctx, `t.user_id=$1`, userID)
+}
+
+// transactionQuery lists transactions with the payment link, if any, that the
+// payment behind each one (or behind its refund) was made through.
+const transactionQuery = `SELECT t.id, t.user_id, t.payment_id, t.refund_id, t.amount, t.currency, t.transaction_type, t.status, t.created_at,
+    COALESCE(cs.payment_link_id, 0)
+FROM transactions t
+LEFT JOIN refunds r ON t.refund_id <> 0 AND r.id = t.refund_id
+LEFT JOIN checkout_sessions cs ON cs.payment_id = COALESCE(NULLIF(t.payment_id, 0), r.payment_id)`
+
+func (s *PostgresStorage) queryTransactions(ctx context.Context, where string, args ...interface{}) ([]*Transaction, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := transactionQuery + ` WHERE ` + where + ` ORDER BY t.id`
 
-	rows, err := s.db.Query(query, userID)
+	rows, err := s.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -194,22 +549,25 @@ func (s *PostgresStorage) GetUserTransactions(userID uint) ([]*Transaction, erro
 
 	for rows.Next() {
 		var t Transaction
-		err := rows.Scan(&t.ID, &t.UserID, &t.PaymentID, &t.RefundID, &t.Amount, &t.Currency, &t.TransactionType, &t.Status, &t.CreatedAt)
+		err := rows.Scan(&t.ID, &t.UserID, &t.PaymentID, &t.RefundID, &t.Amount, &t.Currency, &t.TransactionType, &t.Status, &t.CreatedAt, &t.PaymentLinkID)
 		if err != nil {
 			return nil, err
 		}
 		ts = append(ts, &t)
 	}
 
-	return ts, nil
+	return ts, rows.Err()
 }
 
-func (s *PostgresStorage) CreateCustomer(name, email, stripeID string) (string, uint, error) {
+func (s *PostgresStorage) CreateCustomer(ctx context.Context, name, email, stripeID string) (string, uint, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	var userID uint
 
 	// User does not exist, so insert a new one
 	query := `INSERT INTO users (name, email, stripe_id) VALUES ($1, $2, $3) RETURNING id`
-	err := s.db.QueryRow(query, name, email, stripeID).Scan(&userID)
+	err := s.q.QueryRowContext(ctx, query, name, email, stripeID).Scan(&userID)
 	if err != nil {
 		return "", 0, err
 	}
@@ -217,50 +575,210 @@ func (s *PostgresStorage) CreateCustomer(name, email, stripeID string) (string,
 	return stripeID, userID, nil
 }
 
-func (s *PostgresStorage) CheckCustomer(name, email string) (string, uint, error) {
+func (s *PostgresStorage) GetCustomer(ctx context.Context, userID uint) (*Users, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, name, email, stripe_id, created_at FROM users WHERE id=$1`
+
+	var u Users
+	err := s.q.QueryRowContext(ctx, query, userID).Scan(&u.ID, &u.Name, &u.Email, &u.StripeID, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no customer found for user %d: %w", userID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *PostgresStorage) GetCustomerByStripeID(ctx context.Context, stripeID string) (*Users, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, name, email, stripe_id, created_at FROM users WHERE stripe_id=$1 ORDER BY id LIMIT 1`
+
+	var u Users
+	err := s.q.QueryRowContext(ctx, query, stripeID).Scan(&u.ID, &u.Name, &u.Email, &u.StripeID, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no customer found for %s: %w", stripeID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *PostgresStorage) CheckCustomer(ctx context.Context, name, email string) (string, uint, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	var userID uint
 	var stripeID string
 
 	// Check if user already exists
 	query := `SELECT stripe_id, id FROM users WHERE name=$1 AND email=$2`
-	err := s.db.QueryRow(query, name, email).Scan(&userID, &stripeID)
+	err := s.q.QueryRowContext(ctx, query, name, email).Scan(&stripeID, &userID)
 	if err == nil {
 		return stripeID, userID, nil // User already exists, return ID
 	}
+	if err == sql.ErrNoRows {
+		return "", 0, fmt.Errorf("no customer found for %s <%s>: %w", name, email, ErrNotFound)
+	}
 
 	return "", 0, err
 }
 
-func (s *PostgresStorage) GetPaymentDetails(paymentintentID string) (*Payment, error) {
+func (s *PostgresStorage) GetPaymentDetails(ctx context.Context, paymentintentID string) (*Payment, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `SELECT * FROM payments WHERE stripe_payment_intent_id=$1`
 
-	var p Payment
-	err := s.db.QueryRow(query, paymentintentID).Scan(&p.ID, &p.UserID, &p.Name, &p.Email, &p.SubscriptionID, &p.TransactionID, &p.StripePaymentID, &p.Amount, &p.Currency, &p.PaymentMethod, &p.Status, &p.CreatedAt)
+	p, err := scanPayment(s.q.QueryRowContext(ctx, query, paymentintentID))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no payment found for payment intent ID: %s", paymentintentID)
+			return nil, fmt.Errorf("no payment found for payment intent ID %s: %w", paymentintentID, ErrNotFound)
 		}
 		return nil, err
 	}
 
+	return p, nil
+}
+
+// scanPayment reads a payments row selected with *, in table column order.
+func scanPayment(row interface{ Scan(...interface{}) error }) (*Payment, error) {
+	var p Payment
+	err := row.Scan(&p.ID, &p.UserID, &p.Name, &p.Email, &p.SubscriptionID, &p.TransactionID, &p.StripePaymentID, &p.Amount, &p.Currency, &p.PaymentMethod, &p.Status, &p.CreatedAt, &p.AmountRefunded,
+		&p.CaptureMethod, &p.AmountAuthorized, &p.AmountCaptured, &p.AuthorizationExpiresAt)
+	if err != nil {
+		return nil, err
+	}
 	return &p, nil
 }
 
-func (s *PostgresStorage) GetSubscriptionDetails(subID string) (*Subscription, error) {
+func (s *PostgresStorage) GetSubscriptionDetails(ctx context.Context, subID string) (*Subscription, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `SELECT * FROM subscriptions WHERE stripe_subscription_id=$1`
 
 	var sub Subscription
-	err := s.db.QueryRow(query, subID).Scan(&sub)
+	var d Discount
+	var pause PauseCollection
+	err := s.q.QueryRowContext(ctx, query, subID).Scan(&sub.ID, &sub.UserID, &sub.PaymentID, &sub.Amount, &sub.Currency, &sub.StripeSubscriptionID, &sub.Status, &sub.StartDate, &sub.EndDate, &sub.PriceID,
+		&sub.TrialEnd, &d.CouponID, &d.PromotionCodeID, &d.PercentOff, &d.AmountOff, &d.Duration, &d.EndsAt,
+		&sub.CancelAtPeriodEnd, &pause.Behavior, &pause.ResumesAt)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no subscription found for subscription ID %s: %w", subID, ErrNotFound)
+		}
 		return nil, err
 	}
+	if d.CouponID != "" {
+		sub.Discount = &d
+	}
+	if pause.Behavior != "" {
+		sub.Pause = &pause
+	}
 
 	return &sub, nil
 }
 
-func (s *PostgresStorage) UpdateRefundStatus(stripeRefundID, status string) error {
-	query := `UPDATE refunds SET status=$1 WHERE stripe_refund_id=$2`
+func (s *PostgresStorage) UpdateSubscriptionTrial(ctx context.Context, stripeID string, trialEnd *time.Time) error {
+	query := `UPDATE subscriptions SET trial_end=$2 WHERE stripe_subscription_id=$1`
 
-	_, err := s.db.Exec(query, status, stripeRefundID)
-	return err
+	return s.execOne(ctx, "subscription", query, stripeID, trialEnd)
+}
+
+func (s *PostgresStorage) UpdateSubscriptionDiscount(ctx context.Context, stripeID string, d *Discount) error {
+	if d == nil {
+		d = &Discount{}
+	}
+
+	query := `UPDATE subscriptions SET coupon_id=$2, promotion_code_id=$3, percent_off=$4, amount_off=$5, discount_duration=$6, discount_ends_at=$7
+WHERE stripe_subscription_id=$1`
+
+	return s.execOne(ctx, "subscription", query, stripeID, d.CouponID, d.PromotionCodeID, d.PercentOff, d.AmountOff, d.Duration, d.EndsAt)
+}
+
+func (s *PostgresStorage) UpdateSubscriptionPrice(ctx context.Context, stripeID string, priceID uint, amount int64) error {
+	query := `UPDATE subscriptions SET price_id=$2, amount=$3 WHERE stripe_subscription_id=$1`
+
+	return s.execOne(ctx, "subscription", query, stripeID, priceID, amount)
+}
+
+func (s *PostgresStorage) UpdateSubscriptionCancellation(ctx context.Context, stripeID string, atPeriodEnd bool, endDate *time.Time) error {
+	query := `UPDATE subscriptions SET cancel_at_period_end=$2, end_date=$3 WHERE stripe_subscription_id=$1`
+
+	return s.execOne(ctx, "subscription", query, stripeID, atPeriodEnd, endDate)
+}
+
+func (s *PostgresStorage) UpdateSubscriptionPause(ctx context.Context, stripeID string, p *PauseCollection) error {
+	if p == nil {
+		p = &PauseCollection{}
+	}
+
+	query := `UPDATE subscriptions SET pause_behavior=$2, pause_resumes_at=$3 WHERE stripe_subscription_id=$1`
+
+	return s.execOne(ctx, "subscription", query, stripeID, p.Behavior, p.ResumesAt)
+}
+
+func (s *PostgresStorage) UpdateRefundStatus(ctx context.Context, stripeRefundID string, status RefundStatus) (RefundStatus, error) {
+	return s.transitionRefund(ctx, `stripe_refund_id=$1`, status, stripeRefundID)
+}
+
+func (s *PostgresStorage) GetRefundDetails(ctx context.Context, stripeRefundID string) (*Refund, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT * FROM refunds WHERE stripe_refund_id=$1`
+
+	r, err := scanRefund(s.q.QueryRowContext(ctx, query, stripeRefundID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no refund found for refund ID %s: %w", stripeRefundID, ErrNotFound)
+		}
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (s *PostgresStorage) GetFailedRefunds(ctx context.Context, limit int) ([]*Refund, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT * FROM refunds WHERE status=$1 ORDER BY id DESC LIMIT $2`
+
+	rows, err := s.q.QueryContext(ctx, query, RefundFailed, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs []*Refund
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, rows.Err()
+}
+
+// scanRefund reads a refunds row selected with *, in table column order.
+func scanRefund(row interface{ Scan(...interface{}) error }) (*Refund, error) {
+	var r Refund
+	var meta []byte
+	err := row.Scan(&r.ID, &r.PaymentID, &r.TransactionID, &r.StripeRefundID, &r.Amount, &r.Status, &r.CreatedAt, &r.Reason, &meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(meta, &r.Metadata); err != nil {
+		return nil, err
+	}
+	return &r, nil
 }
@@ -0,0 +1,42 @@
+package models_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/migrations"
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/models/storagetest"
+	_ "github.com/lib/pq"
+)
+
+// TestPostgresStorage runs the conformance suite against the database named
+// by TEST_DATABASE_URL, a lib/pq connection string such as
+// "postgres://localhost/payments_test?sslmode=disable". The schema is
+// migrated up first. Every case uses its own IDs, so the database can be
+// reused between runs.
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting to TEST_DATABASE_URL: %v", err)
+	}
+	if _, err := migrations.Up(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	store := models.NewPostgresStorage(db, 5*time.Second)
+	storagetest.Run(t, func(*testing.T) models.Storage {
+		return store
+	})
+}
@@ -0,0 +1,1618 @@
+// Package storagetest is a conformance suite for models.Storage. Every
+// implementation must pass it so handlers behave the same whichever backend
+// they run against:
+//
+//	func TestMemoryStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) models.Storage {
+//			return models.NewMemoryStorage()
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+)
+
+// Run executes the suite. newStorage is called once per subtest; it may hand
+// back a shared database since every case uses its own unique Stripe IDs.
+func Run(t *testing.T, newStorage func(t *testing.T) models.Storage) {
+	cases := []struct {
+		name string
+		fn   func(t *testing.T, s models.Storage)
+	}{
+		{"Payments", testPayments},
+		{"PaymentNotFound", testPaymentNotFound},
+		{"CancelPayment", testCancelPayment},
+		{"Refunds", testRefunds},
+		{"Capture", testCapture},
+		{"Subscriptions", testSubscriptions},
+		{"Constraints", testConstraints},
+		{"SubscriptionTerms", testSubscriptionTerms},
+		{"Notifications", testNotifications},
+		{"Transactions", testTransactions},
+		{"Customers", testCustomers},
+		{"PaymentMethods", testPaymentMethods},
+		{"CheckoutSessions", testCheckoutSessions},
+		{"PaymentLinks", testPaymentLinks},
+		{"Catalog", testCatalog},
+		{"ConcurrentCreates", testConcurrentCreates},
+		{"CanceledContext", testCanceledContext},
+		{"TxCommit", testTxCommit},
+		{"TxRollback", testTxRollback},
+		{"Outbox", testOutbox},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"WebhookEvents", testWebhookEvents},
+		{"ListWebhookEvents", testListWebhookEvents},
+		{"WebhookObjectLock", testWebhookObjectLock},
+		{"PaymentTransitions", testPaymentTransitions},
+		{"SubscriptionTransitions", testSubscriptionTransitions},
+		{"StatusOverride", testStatusOverride},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.fn(t, newStorage(t))
+		})
+	}
+}
+
+var counter atomic.Int64
+
+// uniq returns a value that is unique across runs against the same database.
+func uniq(prefix string) string {
+	return fmt.Sprintf("%s_%d_%d", prefix, time.Now().UnixNano(), counter.Add(1))
+}
+
+func newCustomer(t *testing.T, s models.Storage) uint {
+	t.Helper()
+	ctx := context.Background()
+
+	_, userID, err := s.CreateCustomer(ctx, "Conformance", uniq("user")+"@example.com", uniq("cus"))
+	if err != nil {
+		t.Fatalf("CreateCustomer: %v", err)
+	}
+	return userID
+}
+
+func testPayments(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID := uniq("pi")
+
+	id, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if id == 0 {
+		t.Fatal("CreatePayment returned a zero ID")
+	}
+
+	p, err := s.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails: %v", err)
+	}
+	if p.ID != id || p.UserID != userID || p.Amount != 1500 || p.Currency != "usd" || p.PaymentMethod != "card" || p.StripePaymentID != intentID {
+		t.Fatalf("GetPaymentDetails returned %+v", p)
+	}
+	if p.Status != "pending" {
+		t.Fatalf("new payment status = %q, want pending", p.Status)
+	}
+	if p.CreatedAt.IsZero() {
+		t.Fatal("new payment has no created_at")
+	}
+
+	if err := s.UpdatePaymentStatus(ctx, intentID, "success"); err != nil {
+		t.Fatalf("UpdatePaymentStatus: %v", err)
+	}
+	p, err = s.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails: %v", err)
+	}
+	if p.Status != "success" {
+		t.Fatalf("status after update = %q, want success", p.Status)
+	}
+
+	other, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 100, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if other <= id {
+		t.Fatalf("second payment ID %d not greater than first %d", other, id)
+	}
+}
+
+func testPaymentNotFound(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	missing := uniq("pi_missing")
+
+	if _, err := s.GetPaymentDetails(ctx, missing); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetPaymentDetails(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdatePaymentStatus(ctx, missing, "success"); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdatePaymentStatus(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testCancelPayment(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID := uniq("pi")
+
+	id, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	if err := s.CancelPayment(ctx, id, userID+1000000); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("CancelPayment(wrong user) error = %v, want ErrNotFound", err)
+	}
+	if err := s.CancelPayment(ctx, id, userID); err != nil {
+		t.Fatalf("CancelPayment: %v", err)
+	}
+
+	p, err := s.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails: %v", err)
+	}
+	if p.Status != "canceled" {
+		t.Fatalf("status after cancel = %q, want canceled", p.Status)
+	}
+}
+
+func testRefunds(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+
+	payID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	refundID := uniq("re")
+	id, err := s.CreateRefund(ctx, payID, 1000, "pending", refundID, "requested_by_customer", map[string]string{"ticket": "T-1"})
+	if err != nil {
+		t.Fatalf("CreateRefund: %v", err)
+	}
+	if id == 0 {
+		t.Fatal("CreateRefund returned a zero ID")
+	}
+
+	r, err := s.GetRefundDetails(ctx, refundID)
+	if err != nil {
+		t.Fatalf("GetRefundDetails: %v", err)
+	}
+	if r.PaymentID != payID || r.Amount != 1000 || r.Reason != "requested_by_customer" || r.Metadata["ticket"] != "T-1" {
+		t.Fatalf("GetRefundDetails = %+v", r)
+	}
+
+	if from, err := s.UpdateRefundStatus(ctx, refundID, models.RefundSucceeded); err != nil || from != models.RefundPending {
+		t.Fatalf("UpdateRefundStatus = %q, %v, want from pending", from, err)
+	}
+	if from, err := s.UpdateRefundStatus(ctx, refundID, models.RefundSucceeded); err != nil || from != models.RefundSucceeded {
+		t.Fatalf("UpdateRefundStatus(again) = %q, %v, want from refunded", from, err)
+	}
+	if _, err := s.UpdateRefundStatus(ctx, refundID, models.RefundPending); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("UpdateRefundStatus(refunded -> pending) error = %v, want ErrInvalidTransition", err)
+	}
+	if _, err := s.UpdateRefundStatus(ctx, uniq("re_missing"), models.RefundSucceeded); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateRefundStatus(missing) error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.CreateRefund(ctx, payID, 1, "bogus", uniq("re"), "", nil); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("CreateRefund(unknown status) error = %v, want ErrInvalidTransition", err)
+	}
+
+	// A succeeded refund can still fail, and then shows up as failed.
+	if _, err := s.UpdateRefundStatus(ctx, refundID, models.RefundFailed); err != nil {
+		t.Fatalf("UpdateRefundStatus(failed): %v", err)
+	}
+	failed, err := s.GetFailedRefunds(ctx, 100)
+	if err != nil {
+		t.Fatalf("GetFailedRefunds: %v", err)
+	}
+	if !slices.ContainsFunc(failed, func(r *models.Refund) bool { return r.StripeRefundID == refundID }) {
+		t.Fatalf("GetFailedRefunds = %v, missing %s", failed, refundID)
+	}
+	want := []string{">pending", "pending>refunded", "refunded>failed"}
+	if got := historyOf(t, s, models.EntityRefund, refundID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("refund history = %v, want %v", got, want)
+	}
+
+	p, err := s.AddRefundedAmount(ctx, payID, 1000)
+	if err != nil {
+		t.Fatalf("AddRefundedAmount: %v", err)
+	}
+	if p.ID != payID || p.AmountRefunded != 1000 {
+		t.Fatalf("AddRefundedAmount = %+v, want 1000 refunded", p)
+	}
+	if _, err := s.AddRefundedAmount(ctx, payID, 501); !errors.Is(err, models.ErrOverRefund) {
+		t.Fatalf("AddRefundedAmount(over) error = %v, want ErrOverRefund", err)
+	}
+	if p, err = s.AddRefundedAmount(ctx, payID, 500); err != nil || p.AmountRefunded != 1500 {
+		t.Fatalf("AddRefundedAmount(rest) = %+v, %v, want 1500 refunded", p, err)
+	}
+	if _, err := s.AddRefundedAmount(ctx, payID, -1501); !errors.Is(err, models.ErrOverRefund) {
+		t.Fatalf("AddRefundedAmount(below zero) error = %v, want ErrOverRefund", err)
+	}
+	if p, err = s.AddRefundedAmount(ctx, payID, -1000); err != nil || p.AmountRefunded != 500 {
+		t.Fatalf("AddRefundedAmount(reversal) = %+v, %v, want 500 refunded", p, err)
+	}
+	if _, err := s.AddRefundedAmount(ctx, 0, 1); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("AddRefundedAmount(missing) error = %v, want ErrNotFound", err)
+	}
+
+	p, err = s.GetPaymentDetails(ctx, p.StripePaymentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails: %v", err)
+	}
+	if p.AmountRefunded != 500 {
+		t.Fatalf("AmountRefunded = %d, want 500", p.AmountRefunded)
+	}
+}
+
+func testCapture(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+
+	intentID := uniq("pi")
+	payID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, models.CaptureManual)
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	expires := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Second)
+	if err := s.RecordAuthorization(ctx, intentID, 1500, &expires); err != nil {
+		t.Fatalf("RecordAuthorization: %v", err)
+	}
+	if err := s.UpdatePaymentStatus(ctx, intentID, models.PaymentAuthorized); err != nil {
+		t.Fatalf("UpdatePaymentStatus(authorized): %v", err)
+	}
+
+	p, err := s.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails: %v", err)
+	}
+	if p.CaptureMethod != models.CaptureManual || p.AmountAuthorized != 1500 || p.CapturedAmount() != 0 {
+		t.Fatalf("GetPaymentDetails = %+v", p)
+	}
+	if p.AuthorizationExpiresAt == nil || !p.AuthorizationExpiresAt.Equal(expires) {
+		t.Fatalf("AuthorizationExpiresAt = %v, want %v", p.AuthorizationExpiresAt, expires)
+	}
+	if _, err := s.AddRefundedAmount(ctx, payID, 1); !errors.Is(err, models.ErrOverRefund) {
+		t.Fatalf("AddRefundedAmount(uncaptured) error = %v, want ErrOverRefund", err)
+	}
+
+	if err := s.RecordCapture(ctx, intentID, 900); err != nil {
+		t.Fatalf("RecordCapture: %v", err)
+	}
+	if _, err := s.AddRefundedAmount(ctx, payID, 1000); !errors.Is(err, models.ErrOverRefund) {
+		t.Fatalf("AddRefundedAmount(over captured) error = %v, want ErrOverRefund", err)
+	}
+	if p, err := s.AddRefundedAmount(ctx, payID, 900); err != nil || p.AmountRefunded != 900 {
+		t.Fatalf("AddRefundedAmount(captured) = %+v, %v", p, err)
+	}
+
+	if err := s.RecordCapture(ctx, uniq("pi_missing"), 1); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("RecordCapture(missing) error = %v, want ErrNotFound", err)
+	}
+
+	auto := uniq("pi")
+	if _, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 500, "usd", "card", auto, ""); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if p, err := s.GetPaymentDetails(ctx, auto); err != nil || p.CaptureMethod != models.CaptureAutomatic || p.CapturedAmount() != 500 {
+		t.Fatalf("GetPaymentDetails(automatic) = %+v, %v", p, err)
+	}
+}
+
+func testSubscriptions(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	subID := uniq("sub")
+
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", subID, "active"); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+
+	sub, err := s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.ID == 0 || sub.UserID != userID || sub.Amount != 999 || sub.Currency != "usd" || sub.Status != "active" || sub.StripeSubscriptionID != subID {
+		t.Fatalf("GetSubscriptionDetails returned %+v", sub)
+	}
+	if sub.StartDate.IsZero() {
+		t.Fatal("new subscription has no start_date")
+	}
+	if sub.EndDate != nil {
+		t.Fatalf("new subscription end_date = %v, want nil", sub.EndDate)
+	}
+
+	if err := s.UpdateSubscriptionPrice(ctx, subID, 42, 1999); err != nil {
+		t.Fatalf("UpdateSubscriptionPrice: %v", err)
+	}
+	sub, err = s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.PriceID != 42 || sub.Amount != 1999 || sub.Currency != "usd" {
+		t.Fatalf("after UpdateSubscriptionPrice got price %d, amount %d %s", sub.PriceID, sub.Amount, sub.Currency)
+	}
+
+	if err := s.UpdateSubscriptionStatus(ctx, subID, "past_due"); err != nil {
+		t.Fatalf("UpdateSubscriptionStatus: %v", err)
+	}
+	if err := s.CancelSubscription(ctx, sub.ID, userID+1000000); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("CancelSubscription(wrong user) error = %v, want ErrNotFound", err)
+	}
+	if err := s.CancelSubscription(ctx, sub.ID, userID); err != nil {
+		t.Fatalf("CancelSubscription: %v", err)
+	}
+
+	sub, err = s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.Status != "canceled" {
+		t.Fatalf("status after cancel = %q, want canceled", sub.Status)
+	}
+
+	missing := uniq("sub_missing")
+	if _, err := s.GetSubscriptionDetails(ctx, missing); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetSubscriptionDetails(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateSubscriptionStatus(ctx, missing, "active"); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateSubscriptionStatus(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateSubscriptionPrice(ctx, missing, 1, 100); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateSubscriptionPrice(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+// testConstraints checks that the Stripe IDs are unique and that rows only
+// refer to users and payments that exist, as the Postgres schema enforces.
+func testConstraints(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID, refundID, subID := uniq("pi"), uniq("re"), uniq("sub")
+
+	payID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1000, "usd", "card", intentID, "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if _, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1000, "usd", "card", intentID, ""); !errors.Is(err, models.ErrDuplicate) {
+		t.Fatalf("CreatePayment(duplicate) error = %v, want ErrDuplicate", err)
+	}
+	if _, err := s.CreatePayment(ctx, userID+1000000, "Ada", "ada@example.com", 1000, "usd", "card", uniq("pi"), ""); !errors.Is(err, models.ErrInvalidReference) {
+		t.Fatalf("CreatePayment(missing user) error = %v, want ErrInvalidReference", err)
+	}
+
+	if _, err := s.CreateRefund(ctx, payID, 100, models.RefundSucceeded, refundID, "", nil); err != nil {
+		t.Fatalf("CreateRefund: %v", err)
+	}
+	if _, err := s.CreateRefund(ctx, payID, 100, models.RefundSucceeded, refundID, "", nil); !errors.Is(err, models.ErrDuplicate) {
+		t.Fatalf("CreateRefund(duplicate) error = %v, want ErrDuplicate", err)
+	}
+	if _, err := s.CreateRefund(ctx, payID+1000000, 100, models.RefundSucceeded, uniq("re"), "", nil); !errors.Is(err, models.ErrInvalidReference) {
+		t.Fatalf("CreateRefund(missing payment) error = %v, want ErrInvalidReference", err)
+	}
+
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", subID, "active"); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", subID, "active"); !errors.Is(err, models.ErrDuplicate) {
+		t.Fatalf("CreateSubscription(duplicate) error = %v, want ErrDuplicate", err)
+	}
+	if err := s.CreateSubscription(ctx, userID+1000000, 0, 0, 999, "usd", uniq("sub"), "active"); !errors.Is(err, models.ErrInvalidReference) {
+		t.Fatalf("CreateSubscription(missing user) error = %v, want ErrInvalidReference", err)
+	}
+
+	// The duplicate did not overwrite the original.
+	if p, err := s.GetPaymentDetails(ctx, intentID); err != nil || p.ID != payID || p.Amount != 1000 {
+		t.Fatalf("GetPaymentDetails = %+v, %v, want payment %d", p, err, payID)
+	}
+}
+
+func testSubscriptionTerms(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	subID := uniq("sub")
+
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", subID, "trialing"); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	sub, err := s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.TrialEnd != nil || sub.Discount != nil {
+		t.Fatalf("new subscription has trial_end %v, discount %+v, want none", sub.TrialEnd, sub.Discount)
+	}
+
+	trialEnd := time.Now().Add(14 * 24 * time.Hour).UTC().Truncate(time.Second)
+	endsAt := trialEnd.Add(90 * 24 * time.Hour)
+	discount := &models.Discount{CouponID: uniq("coupon"), PromotionCodeID: uniq("promo"), PercentOff: 25, Duration: "repeating", EndsAt: &endsAt}
+	if err := s.UpdateSubscriptionTrial(ctx, subID, &trialEnd); err != nil {
+		t.Fatalf("UpdateSubscriptionTrial: %v", err)
+	}
+	if err := s.UpdateSubscriptionDiscount(ctx, subID, discount); err != nil {
+		t.Fatalf("UpdateSubscriptionDiscount: %v", err)
+	}
+
+	sub, err = s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.TrialEnd == nil || !sub.TrialEnd.Equal(trialEnd) {
+		t.Fatalf("trial_end = %v, want %v", sub.TrialEnd, trialEnd)
+	}
+	d := sub.Discount
+	if d == nil || d.CouponID != discount.CouponID || d.PromotionCodeID != discount.PromotionCodeID || d.PercentOff != 25 || d.AmountOff != 0 || d.Duration != "repeating" || d.EndsAt == nil || !d.EndsAt.Equal(endsAt) {
+		t.Fatalf("discount = %+v, want %+v", d, discount)
+	}
+
+	if err := s.UpdateSubscriptionTrial(ctx, subID, nil); err != nil {
+		t.Fatalf("UpdateSubscriptionTrial(nil): %v", err)
+	}
+	if err := s.UpdateSubscriptionDiscount(ctx, subID, nil); err != nil {
+		t.Fatalf("UpdateSubscriptionDiscount(nil): %v", err)
+	}
+	sub, err = s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.TrialEnd != nil || sub.Discount != nil {
+		t.Fatalf("after clearing, trial_end %v, discount %+v, want none", sub.TrialEnd, sub.Discount)
+	}
+
+	resumesAt := trialEnd.Add(7 * 24 * time.Hour)
+	if err := s.UpdateSubscriptionCancellation(ctx, subID, true, &trialEnd); err != nil {
+		t.Fatalf("UpdateSubscriptionCancellation: %v", err)
+	}
+	if err := s.UpdateSubscriptionPause(ctx, subID, &models.PauseCollection{Behavior: "void", ResumesAt: &resumesAt}); err != nil {
+		t.Fatalf("UpdateSubscriptionPause: %v", err)
+	}
+	sub, err = s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if !sub.CancelAtPeriodEnd || sub.EndDate == nil || !sub.EndDate.Equal(trialEnd) {
+		t.Fatalf("cancel_at_period_end %v, end_date %v, want true, %v", sub.CancelAtPeriodEnd, sub.EndDate, trialEnd)
+	}
+	if p := sub.Pause; p == nil || p.Behavior != "void" || p.ResumesAt == nil || !p.ResumesAt.Equal(resumesAt) {
+		t.Fatalf("pause = %+v, want void until %v", p, resumesAt)
+	}
+
+	if err := s.UpdateSubscriptionCancellation(ctx, subID, false, nil); err != nil {
+		t.Fatalf("UpdateSubscriptionCancellation(false): %v", err)
+	}
+	if err := s.UpdateSubscriptionPause(ctx, subID, nil); err != nil {
+		t.Fatalf("UpdateSubscriptionPause(nil): %v", err)
+	}
+	sub, err = s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if sub.CancelAtPeriodEnd || sub.EndDate != nil || sub.Pause != nil {
+		t.Fatalf("after clearing, cancel_at_period_end %v, end_date %v, pause %+v", sub.CancelAtPeriodEnd, sub.EndDate, sub.Pause)
+	}
+
+	missing := uniq("sub_missing")
+	if err := s.UpdateSubscriptionCancellation(ctx, missing, true, &trialEnd); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateSubscriptionCancellation(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateSubscriptionPause(ctx, missing, nil); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateSubscriptionPause(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateSubscriptionTrial(ctx, missing, &trialEnd); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateSubscriptionTrial(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateSubscriptionDiscount(ctx, missing, discount); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateSubscriptionDiscount(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testNotifications(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	eventID := uniq("evt")
+
+	n := &models.Notification{UserID: userID, Kind: models.NotificationTrialWillEnd, EventID: eventID, StripeSubscriptionID: uniq("sub"), Payload: []byte(`{"days":3}`)}
+	if err := s.CreateNotification(ctx, n); err != nil {
+		t.Fatalf("CreateNotification: %v", err)
+	}
+	if n.ID == 0 || n.CreatedAt.IsZero() {
+		t.Fatalf("CreateNotification left %+v", n)
+	}
+	dup := &models.Notification{UserID: userID, Kind: models.NotificationTrialWillEnd, EventID: eventID}
+	if err := s.CreateNotification(ctx, dup); err != nil {
+		t.Fatalf("CreateNotification(same event): %v", err)
+	}
+
+	pending := func() []*models.Notification {
+		t.Helper()
+		all, err := s.GetPendingNotifications(ctx, 1000)
+		if err != nil {
+			t.Fatalf("GetPendingNotifications: %v", err)
+		}
+		var mine []*models.Notification
+		for _, p := range all {
+			if p.EventID == eventID {
+				mine = append(mine, p)
+			}
+		}
+		return mine
+	}
+
+	got := pending()
+	if len(got) != 1 {
+		t.Fatalf("pending notifications for the event = %d, want 1", len(got))
+	}
+	if p := got[0]; p.ID != n.ID || p.UserID != userID || p.Kind != models.NotificationTrialWillEnd || p.StripeSubscriptionID != n.StripeSubscriptionID || p.SentAt != nil {
+		t.Fatalf("pending notification = %+v", p)
+	}
+	var payload map[string]int
+	if err := json.Unmarshal(got[0].Payload, &payload); err != nil || payload["days"] != 3 {
+		t.Fatalf("payload = %s (%v), want {\"days\":3}", got[0].Payload, err)
+	}
+
+	if err := s.MarkNotificationSent(ctx, n.ID); err != nil {
+		t.Fatalf("MarkNotificationSent: %v", err)
+	}
+	if err := s.MarkNotificationSent(ctx, n.ID); err != nil {
+		t.Fatalf("MarkNotificationSent(again): %v", err)
+	}
+	if got := pending(); len(got) != 0 {
+		t.Fatalf("sent notification still pending: %+v", got[0])
+	}
+	if err := s.MarkNotificationSent(ctx, 1<<31); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("MarkNotificationSent(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testTransactions(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	otherID := newCustomer(t, s)
+
+	payID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	refID, err := s.CreateRefund(ctx, payID, 500, "pending", uniq("re"), "", nil)
+	if err != nil {
+		t.Fatalf("CreateRefund: %v", err)
+	}
+
+	if err := s.LogTransaction(ctx, userID, "payment", 1500, "usd", &payID); err != nil {
+		t.Fatalf("LogTransaction(payment): %v", err)
+	}
+	if err := s.LogTransaction(ctx, userID, "refund", 500, "usd", &refID); err != nil {
+		t.Fatalf("LogTransaction(refund): %v", err)
+	}
+	if err := s.LogTransaction(ctx, userID, "bogus", 1, "usd", nil); err != nil {
+		t.Fatalf("LogTransaction(unknown type) should be ignored, got %v", err)
+	}
+	if err := s.LogTransaction(ctx, otherID, "payment", 42, "usd", &payID); err != nil {
+		t.Fatalf("LogTransaction(other user): %v", err)
+	}
+
+	ts, err := s.GetUserTransactions(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUserTransactions: %v", err)
+	}
+	if len(ts) != 2 {
+		t.Fatalf("GetUserTransactions returned %d rows, want 2", len(ts))
+	}
+	if ts[0].ID >= ts[1].ID {
+		t.Fatalf("transactions not ordered by ID: %d, %d", ts[0].ID, ts[1].ID)
+	}
+	if ts[0].TransactionType != "payment" || ts[0].PaymentID != payID || ts[0].RefundID != 0 || ts[0].Amount != 1500 {
+		t.Fatalf("payment transaction = %+v", ts[0])
+	}
+	if ts[1].TransactionType != "refund" || ts[1].RefundID != refID || ts[1].PaymentID != 0 || ts[1].Amount != 500 {
+		t.Fatalf("refund transaction = %+v", ts[1])
+	}
+
+	none, err := s.GetUserTransactions(ctx, userID+1000000)
+	if err != nil {
+		t.Fatalf("GetUserTransactions(unknown user): %v", err)
+	}
+	if len(none) != 0 {
+		t.Fatalf("GetUserTransactions(unknown user) returned %d rows", len(none))
+	}
+}
+
+func testCustomers(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	email := uniq("grace") + "@example.com"
+	stripeID := uniq("cus")
+
+	if _, _, err := s.CheckCustomer(ctx, "Grace", email); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("CheckCustomer(missing) error = %v, want ErrNotFound", err)
+	}
+
+	gotStripeID, userID, err := s.CreateCustomer(ctx, "Grace", email, stripeID)
+	if err != nil {
+		t.Fatalf("CreateCustomer: %v", err)
+	}
+	if gotStripeID != stripeID || userID == 0 {
+		t.Fatalf("CreateCustomer returned (%q, %d)", gotStripeID, userID)
+	}
+
+	gotStripeID, gotUserID, err := s.CheckCustomer(ctx, "Grace", email)
+	if err != nil {
+		t.Fatalf("CheckCustomer: %v", err)
+	}
+	if gotStripeID != stripeID || gotUserID != userID {
+		t.Fatalf("CheckCustomer returned (%q, %d), want (%q, %d)", gotStripeID, gotUserID, stripeID, userID)
+	}
+
+	if _, _, err := s.CheckCustomer(ctx, "Someone Else", email); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("CheckCustomer(name mismatch) error = %v, want ErrNotFound", err)
+	}
+
+	u, err := s.GetCustomer(ctx, userID)
+	if err != nil || u.StripeID != stripeID || u.Email != email {
+		t.Fatalf("GetCustomer = %+v, %v", u, err)
+	}
+	if u, err := s.GetCustomerByStripeID(ctx, stripeID); err != nil || u.ID != userID {
+		t.Fatalf("GetCustomerByStripeID = %+v, %v", u, err)
+	}
+	if _, err := s.GetCustomerByStripeID(ctx, uniq("cus_missing")); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetCustomerByStripeID(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testPaymentMethods(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	otherID := newCustomer(t, s)
+
+	card := func(stripeID, last4 string) *models.PaymentMethod {
+		return &models.PaymentMethod{UserID: userID, StripePaymentMethodID: stripeID, Type: "card", Brand: "visa", Last4: last4, ExpMonth: 12, ExpYear: 2030, Fingerprint: "fp_" + last4}
+	}
+
+	first, second := uniq("pm"), uniq("pm")
+	pm := card(first, "4242")
+	if err := s.SavePaymentMethod(ctx, pm); err != nil {
+		t.Fatalf("SavePaymentMethod: %v", err)
+	}
+	if pm.ID == 0 || pm.IsDefault {
+		t.Fatalf("SavePaymentMethod filled in %+v", pm)
+	}
+	if err := s.SavePaymentMethod(ctx, card(second, "4444")); err != nil {
+		t.Fatalf("SavePaymentMethod: %v", err)
+	}
+	orphan := card(uniq("pm"), "0005")
+	orphan.UserID = userID + 1000000
+	if err := s.SavePaymentMethod(ctx, orphan); !errors.Is(err, models.ErrInvalidReference) {
+		t.Fatalf("SavePaymentMethod(missing user) error = %v, want ErrInvalidReference", err)
+	}
+
+	// Saving again refreshes the card details in place.
+	updated := card(first, "4242")
+	updated.ExpYear = 2031
+	if err := s.SavePaymentMethod(ctx, updated); err != nil || updated.ID != pm.ID {
+		t.Fatalf("SavePaymentMethod(again) = %+v, %v, want ID %d", updated, err, pm.ID)
+	}
+	got, err := s.GetPaymentMethod(ctx, first)
+	if err != nil || got.ExpYear != 2031 || got.Last4 != "4242" || got.UserID != userID {
+		t.Fatalf("GetPaymentMethod = %+v, %v", got, err)
+	}
+
+	if err := s.SetDefaultPaymentMethod(ctx, userID, first); err != nil {
+		t.Fatalf("SetDefaultPaymentMethod: %v", err)
+	}
+	if err := s.SetDefaultPaymentMethod(ctx, userID, second); err != nil {
+		t.Fatalf("SetDefaultPaymentMethod: %v", err)
+	}
+	if err := s.SetDefaultPaymentMethod(ctx, otherID, first); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("SetDefaultPaymentMethod(other customer) error = %v, want ErrNotFound", err)
+	}
+
+	pms, err := s.GetPaymentMethods(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetPaymentMethods: %v", err)
+	}
+	if len(pms) != 2 || pms[0].StripePaymentMethodID != second || !pms[0].IsDefault || pms[1].IsDefault {
+		t.Fatalf("GetPaymentMethods = %+v, want %s (default) then %s", pms, second, first)
+	}
+	if pms, err := s.GetPaymentMethods(ctx, otherID); err != nil || len(pms) != 0 {
+		t.Fatalf("GetPaymentMethods(other customer) = %+v, %v", pms, err)
+	}
+
+	if err := s.DeletePaymentMethod(ctx, second); err != nil {
+		t.Fatalf("DeletePaymentMethod: %v", err)
+	}
+	if err := s.DeletePaymentMethod(ctx, second); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("DeletePaymentMethod(again) error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetPaymentMethod(ctx, second); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetPaymentMethod(deleted) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testCheckoutSessions(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	sessionID, expiredID := uniq("cs"), uniq("cs")
+
+	cs := &models.CheckoutSession{UserID: userID, StripeCheckoutSessionID: sessionID, AmountTotal: 2500, Currency: "usd", URL: "https://checkout.stripe.com/c/pay/" + sessionID}
+	if err := s.CreateCheckoutSession(ctx, cs); err != nil {
+		t.Fatalf("CreateCheckoutSession: %v", err)
+	}
+	if cs.ID == 0 || cs.Status != models.CheckoutSessionOpen || cs.CreatedAt.IsZero() {
+		t.Fatalf("CreateCheckoutSession filled in %+v", cs)
+	}
+
+	paymentID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 2500, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if err := s.UpdateCheckoutSession(ctx, sessionID, models.CheckoutSessionComplete, &paymentID); err != nil {
+		t.Fatalf("UpdateCheckoutSession: %v", err)
+	}
+	got, err := s.GetCheckoutSession(ctx, sessionID)
+	if err != nil || got.Status != models.CheckoutSessionComplete || got.PaymentID == nil || *got.PaymentID != paymentID || got.AmountTotal != 2500 || got.UserID != userID {
+		t.Fatalf("GetCheckoutSession = %+v, %v", got, err)
+	}
+
+	// Completing again is a no-op; a completed session cannot expire.
+	if err := s.UpdateCheckoutSession(ctx, sessionID, models.CheckoutSessionComplete, nil); err != nil {
+		t.Fatalf("UpdateCheckoutSession(again): %v", err)
+	}
+	if err := s.UpdateCheckoutSession(ctx, sessionID, models.CheckoutSessionExpired, nil); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("UpdateCheckoutSession(complete -> expired) error = %v, want ErrInvalidTransition", err)
+	}
+	want := []string{">open", "open>complete"}
+	if got := historyOf(t, s, models.EntityCheckoutSession, sessionID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("checkout session history = %v, want %v", got, want)
+	}
+
+	if err := s.CreateCheckoutSession(ctx, &models.CheckoutSession{UserID: userID, StripeCheckoutSessionID: expiredID, AmountTotal: 100, Currency: "usd"}); err != nil {
+		t.Fatalf("CreateCheckoutSession: %v", err)
+	}
+	if err := s.UpdateCheckoutSession(ctx, expiredID, models.CheckoutSessionExpired, nil); err != nil {
+		t.Fatalf("UpdateCheckoutSession(expired): %v", err)
+	}
+	if got, err := s.GetCheckoutSession(ctx, expiredID); err != nil || got.Status != models.CheckoutSessionExpired || got.PaymentID != nil {
+		t.Fatalf("GetCheckoutSession(expired) = %+v, %v", got, err)
+	}
+
+	if _, err := s.GetCheckoutSession(ctx, uniq("cs")); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetCheckoutSession(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateCheckoutSession(ctx, uniq("cs"), models.CheckoutSessionExpired, nil); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateCheckoutSession(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testCatalog(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+
+	prod := &models.Product{StripeProductID: uniq("prod"), Name: "Pro", Description: "Everything"}
+	if err := s.CreateProduct(ctx, prod); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	if prod.ID == 0 || !prod.Active || prod.CreatedAt.IsZero() {
+		t.Fatalf("CreateProduct filled in %+v", prod)
+	}
+	if got, err := s.GetProductByStripeID(ctx, prod.StripeProductID); err != nil || got.ID != prod.ID || got.Name != "Pro" {
+		t.Fatalf("GetProductByStripeID = %+v, %v", got, err)
+	}
+	prod.Name, prod.Description, prod.Active = "Pro Plus", "", false
+	if err := s.UpdateProduct(ctx, prod); err != nil {
+		t.Fatalf("UpdateProduct: %v", err)
+	}
+	if got, err := s.GetProduct(ctx, prod.ID); err != nil || got.Name != "Pro Plus" || got.Description != "" || got.Active {
+		t.Fatalf("GetProduct(updated) = %+v, %v", got, err)
+	}
+	if _, err := s.GetProduct(ctx, 1<<30); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetProduct(missing) err = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateProduct(ctx, &models.Product{ID: 1 << 30, Name: "x"}); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateProduct(missing) err = %v, want ErrNotFound", err)
+	}
+	products, err := s.ListProducts(ctx)
+	if err != nil {
+		t.Fatalf("ListProducts: %v", err)
+	}
+	found := false
+	for _, p := range products {
+		found = found || p.ID == prod.ID
+	}
+	if !found {
+		t.Fatalf("ListProducts did not return product %d", prod.ID)
+	}
+
+	monthly := &models.Price{ProductID: prod.ID, StripePriceID: uniq("price"), Code: uniq("pro-monthly"), UnitAmount: 1500, Currency: "usd", Interval: "month", IntervalCount: 1}
+	if err := s.CreatePrice(ctx, monthly); err != nil {
+		t.Fatalf("CreatePrice: %v", err)
+	}
+	if monthly.ID == 0 || !monthly.Active || !monthly.Recurring() {
+		t.Fatalf("CreatePrice filled in %+v", monthly)
+	}
+	setup := &models.Price{ProductID: prod.ID, StripePriceID: uniq("price"), Code: uniq("pro-setup"), UnitAmount: 5000, Currency: "usd"}
+	if err := s.CreatePrice(ctx, setup); err != nil {
+		t.Fatalf("CreatePrice: %v", err)
+	}
+	if setup.Recurring() {
+		t.Fatalf("one-time price %+v reports recurring", setup)
+	}
+
+	got, err := s.GetPriceByCode(ctx, monthly.Code)
+	if err != nil || got.ID != monthly.ID || got.UnitAmount != 1500 || got.Interval != "month" || got.IntervalCount != 1 {
+		t.Fatalf("GetPriceByCode = %+v, %v", got, err)
+	}
+	if got, err := s.GetPrice(ctx, setup.ID); err != nil || got.Code != setup.Code {
+		t.Fatalf("GetPrice = %+v, %v", got, err)
+	}
+	if _, err := s.GetPriceByCode(ctx, uniq("missing")); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetPriceByCode(missing) err = %v, want ErrNotFound", err)
+	}
+
+	prices, err := s.ListPrices(ctx, prod.ID)
+	if err != nil || len(prices) != 2 || prices[0].ID != monthly.ID || prices[1].ID != setup.ID {
+		t.Fatalf("ListPrices = %+v, %v", prices, err)
+	}
+
+	if err := s.SetPriceActive(ctx, monthly.StripePriceID, false); err != nil {
+		t.Fatalf("SetPriceActive: %v", err)
+	}
+	if got, err := s.GetPriceByStripeID(ctx, monthly.StripePriceID); err != nil || got.Active {
+		t.Fatalf("GetPriceByStripeID(archived) = %+v, %v", got, err)
+	}
+	if err := s.SetPriceActive(ctx, uniq("price"), false); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("SetPriceActive(missing) err = %v, want ErrNotFound", err)
+	}
+
+	// Subscriptions remember the price they were created from.
+	userID := newCustomer(t, s)
+	subID := uniq("sub")
+	if err := s.CreateSubscription(ctx, userID, 0, monthly.ID, 1500, "usd", subID, models.SubscriptionActive); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	if sub, err := s.GetSubscriptionDetails(ctx, subID); err != nil || sub.PriceID != monthly.ID {
+		t.Fatalf("GetSubscriptionDetails = %+v, %v", sub, err)
+	}
+}
+
+func testPaymentLinks(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	now := time.Now().Truncate(time.Second)
+	expired, later := now.Add(-time.Minute), now.Add(time.Hour)
+
+	pl := &models.PaymentLink{StripePaymentLinkID: uniq("plink"), StripePriceID: uniq("price"), URL: "https://buy.stripe.com/test", Amount: 1200, Currency: "usd", MaxPayments: 3, ExpiresAt: &expired}
+	if err := s.CreatePaymentLink(ctx, pl); err != nil {
+		t.Fatalf("CreatePaymentLink: %v", err)
+	}
+	if pl.ID == 0 || !pl.Active || pl.CreatedAt.IsZero() {
+		t.Fatalf("CreatePaymentLink filled in %+v", pl)
+	}
+	open := &models.PaymentLink{StripePaymentLinkID: uniq("plink"), StripePriceID: uniq("price"), URL: "https://buy.stripe.com/test", Amount: 500, Currency: "usd", ExpiresAt: &later}
+	if err := s.CreatePaymentLink(ctx, open); err != nil {
+		t.Fatalf("CreatePaymentLink: %v", err)
+	}
+
+	got, err := s.GetPaymentLink(ctx, pl.StripePaymentLinkID)
+	if err != nil || got.ID != pl.ID || got.Amount != 1200 || got.MaxPayments != 3 || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expired) || !got.Active {
+		t.Fatalf("GetPaymentLink = %+v, %v", got, err)
+	}
+
+	due, err := s.GetExpiredPaymentLinks(ctx, now, 1000)
+	if err != nil {
+		t.Fatalf("GetExpiredPaymentLinks: %v", err)
+	}
+	found := false
+	for _, l := range due {
+		found = found || l.ID == pl.ID
+		if l.ID == open.ID {
+			t.Fatalf("GetExpiredPaymentLinks returned the unexpired link %+v", l)
+		}
+	}
+	if !found {
+		t.Fatalf("GetExpiredPaymentLinks did not return link %d", pl.ID)
+	}
+
+	if err := s.DeactivatePaymentLink(ctx, pl.StripePaymentLinkID); err != nil {
+		t.Fatalf("DeactivatePaymentLink: %v", err)
+	}
+	if got, err := s.GetPaymentLink(ctx, pl.StripePaymentLinkID); err != nil || got.Active {
+		t.Fatalf("GetPaymentLink(deactivated) = %+v, %v", got, err)
+	}
+	due, err = s.GetExpiredPaymentLinks(ctx, now, 1000)
+	if err != nil {
+		t.Fatalf("GetExpiredPaymentLinks: %v", err)
+	}
+	for _, l := range due {
+		if l.ID == pl.ID {
+			t.Fatalf("GetExpiredPaymentLinks returned the deactivated link %+v", l)
+		}
+	}
+
+	// A payment made through the link carries it into the ledger, refunds
+	// included; other payments do not.
+	paymentID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1200, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	sessionID := uniq("cs")
+	if err := s.CreateCheckoutSession(ctx, &models.CheckoutSession{UserID: userID, StripeCheckoutSessionID: sessionID, PaymentLinkID: &pl.ID, AmountTotal: 1200, Currency: "usd"}); err != nil {
+		t.Fatalf("CreateCheckoutSession: %v", err)
+	}
+	if err := s.UpdateCheckoutSession(ctx, sessionID, models.CheckoutSessionComplete, &paymentID); err != nil {
+		t.Fatalf("UpdateCheckoutSession: %v", err)
+	}
+	if got, err := s.GetCheckoutSession(ctx, sessionID); err != nil || got.PaymentLinkID == nil || *got.PaymentLinkID != pl.ID {
+		t.Fatalf("GetCheckoutSession = %+v, %v", got, err)
+	}
+	refundID, err := s.CreateRefund(ctx, paymentID, 200, "pending", uniq("re"), "", nil)
+	if err != nil {
+		t.Fatalf("CreateRefund: %v", err)
+	}
+	otherID, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 700, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	for _, l := range []struct {
+		kind   string
+		amount int64
+		ref    uint
+	}{{"payment", 1200, paymentID}, {"refund", 200, refundID}, {"payment", 700, otherID}} {
+		ref := l.ref
+		if err := s.LogTransaction(ctx, userID, l.kind, l.amount, "usd", &ref); err != nil {
+			t.Fatalf("LogTransaction(%s): %v", l.kind, err)
+		}
+	}
+
+	ts, err := s.GetPaymentLinkTransactions(ctx, pl.ID)
+	if err != nil {
+		t.Fatalf("GetPaymentLinkTransactions: %v", err)
+	}
+	if len(ts) != 2 || ts[0].PaymentID != paymentID || ts[1].RefundID != refundID || ts[0].PaymentLinkID != pl.ID || ts[1].PaymentLinkID != pl.ID {
+		t.Fatalf("GetPaymentLinkTransactions = %+v", ts)
+	}
+	ts, err = s.GetUserTransactions(ctx, userID)
+	if err != nil || len(ts) != 3 || ts[2].PaymentID != otherID || ts[2].PaymentLinkID != 0 {
+		t.Fatalf("GetUserTransactions = %+v, %v", ts, err)
+	}
+
+	if _, err := s.GetPaymentLink(ctx, uniq("plink")); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetPaymentLink(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.DeactivatePaymentLink(ctx, uniq("plink")); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("DeactivatePaymentLink(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testConcurrentCreates(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+
+	const n = 20
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids = make(map[uint]bool)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 100, "usd", "card", uniq("pi"), "")
+			if err != nil {
+				t.Errorf("CreatePayment: %v", err)
+				return
+			}
+			mu.Lock()
+			ids[id] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(ids) != n {
+		t.Fatalf("got %d distinct payment IDs from %d concurrent creates", len(ids), n)
+	}
+}
+
+func testCanceledContext(t *testing.T, s models.Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.CreatePayment(ctx, 1, "Ada", "ada@example.com", 100, "usd", "card", uniq("pi"), ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CreatePayment(canceled ctx) error = %v, want context.Canceled", err)
+	}
+	if _, err := s.GetPaymentDetails(ctx, uniq("pi")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetPaymentDetails(canceled ctx) error = %v, want context.Canceled", err)
+	}
+}
+
+func testTxCommit(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID := uniq("pi")
+
+	err := s.WithTx(ctx, func(tx models.Storage) error {
+		payID, err := tx.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, "")
+		if err != nil {
+			return err
+		}
+		if err := tx.UpdatePaymentStatus(ctx, intentID, "success"); err != nil {
+			return err
+		}
+
+		// Writes are visible inside the unit of work, including from a
+		// nested WithTx, which joins it.
+		return tx.WithTx(ctx, func(inner models.Storage) error {
+			p, err := inner.GetPaymentDetails(ctx, intentID)
+			if err != nil {
+				return err
+			}
+			if p.Status != "success" {
+				return fmt.Errorf("status inside tx = %q, want success", p.Status)
+			}
+			return inner.LogTransaction(ctx, userID, "payment", 1500, "usd", &payID)
+		})
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+
+	p, err := s.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails after commit: %v", err)
+	}
+	if p.Status != "success" {
+		t.Fatalf("status after commit = %q, want success", p.Status)
+	}
+	ts, err := s.GetUserTransactions(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUserTransactions: %v", err)
+	}
+	if len(ts) != 1 || ts[0].PaymentID != p.ID {
+		t.Fatalf("transactions after commit = %+v", ts)
+	}
+}
+
+func testTxRollback(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID := uniq("pi")
+	boom := errors.New("boom")
+
+	var rolledBackID uint
+	err := s.WithTx(ctx, func(tx models.Storage) error {
+		payID, err := tx.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, "")
+		if err != nil {
+			return err
+		}
+		rolledBackID = payID
+		if err := tx.LogTransaction(ctx, userID, "payment", 1500, "usd", &payID); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("WithTx error = %v, want the callback's error", err)
+	}
+
+	if _, err := s.GetPaymentDetails(ctx, intentID); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetPaymentDetails after rollback error = %v, want ErrNotFound", err)
+	}
+	ts, err := s.GetUserTransactions(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUserTransactions: %v", err)
+	}
+	if len(ts) != 0 {
+		t.Fatalf("transactions after rollback = %+v", ts)
+	}
+
+	// Sequences are not rolled back, so the next ID is never a reused one.
+	id, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", uniq("pi"), "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if id <= rolledBackID {
+		t.Fatalf("payment ID %d reuses rolled back ID %d", id, rolledBackID)
+	}
+}
+
+func testOutbox(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	stripeID := uniq("pi")
+
+	id, err := s.CreateOutboxEntry(ctx, models.OutboxPaymentIntent, stripeID, []byte(`{"amount":1500}`))
+	if err != nil {
+		t.Fatalf("CreateOutboxEntry: %v", err)
+	}
+
+	find := func(before time.Time) *models.OutboxEntry {
+		t.Helper()
+		es, err := s.GetPendingOutboxEntries(ctx, before, 1000)
+		if err != nil {
+			t.Fatalf("GetPendingOutboxEntries: %v", err)
+		}
+		for _, e := range es {
+			if e.ID == id {
+				return e
+			}
+		}
+		return nil
+	}
+
+	if e := find(time.Now().Add(-time.Hour)); e != nil {
+		t.Fatalf("entry listed before its cutoff: %+v", e)
+	}
+	e := find(time.Now().Add(time.Hour))
+	if e == nil {
+		t.Fatal("pending entry not listed")
+	}
+	if e.Kind != models.OutboxPaymentIntent || e.StripeID != stripeID || e.Status != models.OutboxPending || e.Attempts != 0 {
+		t.Fatalf("pending entry = %+v", e)
+	}
+	// Postgres may normalize the JSON, so compare the decoded value.
+	var payload struct{ Amount int64 }
+	if err := json.Unmarshal(e.Payload, &payload); err != nil || payload.Amount != 1500 {
+		t.Fatalf("payload = %s", e.Payload)
+	}
+
+	if err := s.UpdateOutboxEntry(ctx, id, models.OutboxPending, "db down"); err != nil {
+		t.Fatalf("UpdateOutboxEntry: %v", err)
+	}
+	e = find(time.Now().Add(time.Hour))
+	if e == nil || e.Attempts != 1 || e.LastError != "db down" {
+		t.Fatalf("entry after failed attempt = %+v", e)
+	}
+
+	if err := s.UpdateOutboxEntry(ctx, id, models.OutboxCompleted, ""); err != nil {
+		t.Fatalf("UpdateOutboxEntry: %v", err)
+	}
+	if e := find(time.Now().Add(time.Hour)); e != nil {
+		t.Fatalf("completed entry still listed: %+v", e)
+	}
+
+	if err := s.UpdateOutboxEntry(ctx, id+1000000, models.OutboxCompleted, ""); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("UpdateOutboxEntry(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	key := uniq("key")
+	longAgo := time.Now().Add(-time.Hour)
+
+	if _, reserved, err := s.ReserveIdempotencyKey(ctx, key, "fp1", longAgo, longAgo); err != nil || !reserved {
+		t.Fatalf("first ReserveIdempotencyKey = %v, %v; want reserved", reserved, err)
+	}
+
+	k, reserved, err := s.ReserveIdempotencyKey(ctx, key, "fp2", longAgo, longAgo)
+	if err != nil || reserved {
+		t.Fatalf("second ReserveIdempotencyKey = %v, %v; want existing key", reserved, err)
+	}
+	if k.Key != key || k.Fingerprint != "fp1" || k.Completed() {
+		t.Fatalf("in-flight key = %+v", k)
+	}
+
+	// An unfinished key older than the stale cutoff can be taken over.
+	if _, reserved, err := s.ReserveIdempotencyKey(ctx, key, "fp3", longAgo, time.Now().Add(time.Hour)); err != nil || !reserved {
+		t.Fatalf("ReserveIdempotencyKey(stale) = %v, %v; want reserved", reserved, err)
+	}
+
+	if err := s.CompleteIdempotencyKey(ctx, key, 200, []byte(`{"ok":true}`)); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	// Completed keys are not stale, only expired.
+	k, reserved, err = s.ReserveIdempotencyKey(ctx, key, "fp3", longAgo, time.Now().Add(time.Hour))
+	if err != nil || reserved {
+		t.Fatalf("ReserveIdempotencyKey(completed) = %v, %v; want existing key", reserved, err)
+	}
+	if k.Fingerprint != "fp3" || !k.Completed() || k.StatusCode != 200 || string(k.Response) != `{"ok":true}` || k.CompletedAt == nil {
+		t.Fatalf("completed key = %+v", k)
+	}
+	if _, reserved, err := s.ReserveIdempotencyKey(ctx, key, "fp4", time.Now().Add(time.Hour), longAgo); err != nil || !reserved {
+		t.Fatalf("ReserveIdempotencyKey(expired) = %v, %v; want reserved", reserved, err)
+	}
+
+	if err := s.ReleaseIdempotencyKey(ctx, key); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if err := s.ReleaseIdempotencyKey(ctx, key); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("second ReleaseIdempotencyKey error = %v, want ErrNotFound", err)
+	}
+	if _, reserved, err := s.ReserveIdempotencyKey(ctx, key, "fp5", longAgo, longAgo); err != nil || !reserved {
+		t.Fatalf("ReserveIdempotencyKey(released) = %v, %v; want reserved", reserved, err)
+	}
+	if err := s.CompleteIdempotencyKey(ctx, uniq("missing"), 200, nil); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("CompleteIdempotencyKey(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testWebhookEvents(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	objectID := uniq("pi")
+	base := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+
+	newEvent := func(created time.Time) *models.WebhookEvent {
+		e := &models.WebhookEvent{
+			ID:       uniq("evt"),
+			Type:     "payment_intent.succeeded",
+			ObjectID: objectID,
+			Payload:  []byte(`{"id":"evt"}`),
+			Created:  created,
+		}
+		ok, err := s.CreateWebhookEvent(ctx, e)
+		if err != nil || !ok {
+			t.Fatalf("CreateWebhookEvent = %v, %v; want created", ok, err)
+		}
+		return e
+	}
+	// claim returns the claimed events among ours, ignoring any left over
+	// from other runs against the same database.
+	claim := func(lockFor time.Duration, ours ...*models.WebhookEvent) []*models.WebhookEvent {
+		t.Helper()
+		es, err := s.ClaimWebhookEvents(ctx, 1000, lockFor)
+		if err != nil {
+			t.Fatalf("ClaimWebhookEvents: %v", err)
+		}
+		var out []*models.WebhookEvent
+		for _, e := range es {
+			for _, o := range ours {
+				if e.ID == o.ID {
+					out = append(out, e)
+				}
+			}
+		}
+		return out
+	}
+
+	if _, err := s.LastAppliedWebhookEvent(ctx, objectID); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("LastAppliedWebhookEvent(none) error = %v, want ErrNotFound", err)
+	}
+
+	newer := newEvent(base.Add(10 * time.Second))
+	older := newEvent(base)
+	if created, err := s.CreateWebhookEvent(ctx, older); err != nil || created {
+		t.Fatalf("CreateWebhookEvent(duplicate) = %v, %v; want not created", created, err)
+	}
+
+	got := claim(time.Minute, newer, older)
+	if len(got) != 2 || got[0].ID != older.ID || got[1].ID != newer.ID {
+		t.Fatalf("claimed %v, want oldest event first", got)
+	}
+	for _, e := range got {
+		if e.Outcome != models.WebhookProcessing || e.Attempts != 1 || e.LockedUntil == nil {
+			t.Fatalf("claimed event = %+v", e)
+		}
+	}
+	if !got[0].Created.Equal(base) || got[0].ObjectID != objectID {
+		t.Fatalf("claimed event = %+v", got[0])
+	}
+	if again := claim(time.Minute, newer, older); len(again) != 0 {
+		t.Fatalf("locked events claimed again: %v", again)
+	}
+
+	// A retry with no delay is due straight away.
+	if err := s.RetryWebhookEvent(ctx, older.ID, "boom", 0); err != nil {
+		t.Fatalf("RetryWebhookEvent: %v", err)
+	}
+	if err := s.RetryWebhookEvent(ctx, newer.ID, "boom", time.Hour); err != nil {
+		t.Fatalf("RetryWebhookEvent: %v", err)
+	}
+	got = claim(-time.Second, newer, older)
+	if len(got) != 1 || got[0].ID != older.ID || got[0].Attempts != 2 || got[0].Error != "boom" {
+		t.Fatalf("claimed after retry = %v", got)
+	}
+
+	// A negative lock has already run out, as if the worker had died.
+	got = claim(time.Minute, older)
+	if len(got) != 1 || got[0].Attempts != 3 {
+		t.Fatalf("abandoned event not reclaimed: %v", got)
+	}
+
+	if err := s.FinishWebhookEvent(ctx, older.ID, models.WebhookProcessed, ""); err != nil {
+		t.Fatalf("FinishWebhookEvent: %v", err)
+	}
+	e, err := s.GetWebhookEvent(ctx, older.ID)
+	if err != nil {
+		t.Fatalf("GetWebhookEvent: %v", err)
+	}
+	if e.Outcome != models.WebhookProcessed || e.ProcessedAt == nil || e.LockedUntil != nil {
+		t.Fatalf("finished event = %+v", e)
+	}
+
+	if err := s.DeadLetterWebhookEvent(ctx, newer.ID, "gave up"); err != nil {
+		t.Fatalf("DeadLetterWebhookEvent: %v", err)
+	}
+	e, err = s.GetWebhookEvent(ctx, newer.ID)
+	if err != nil || e.Outcome != models.WebhookDeadLettered {
+		t.Fatalf("dead lettered event = %+v, %v", e, err)
+	}
+	ds, err := s.GetWebhookDeadLetters(ctx, 1000)
+	if err != nil {
+		t.Fatalf("GetWebhookDeadLetters: %v", err)
+	}
+	var found *models.WebhookDeadLetter
+	for _, d := range ds {
+		if d.EventID == newer.ID {
+			found = d
+		}
+	}
+	if found == nil || found.Type != newer.Type || found.Attempts != 1 || found.Error != "gave up" {
+		t.Fatalf("dead letter = %+v", found)
+	}
+
+	last, err := s.LastAppliedWebhookEvent(ctx, objectID)
+	if err != nil || last.ID != older.ID {
+		t.Fatalf("LastAppliedWebhookEvent = %v, %v; want %s", last, err, older.ID)
+	}
+
+	if _, err := s.GetWebhookEvent(ctx, uniq("evt")); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetWebhookEvent(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.DeadLetterWebhookEvent(ctx, uniq("evt"), ""); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("DeadLetterWebhookEvent(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testWebhookObjectLock(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	objectID := uniq("pi")
+
+	// A second unit of work locking the same object only gets the lock once
+	// the first has ended.
+	held, release := make(chan struct{}), make(chan struct{})
+	var firstDone atomic.Bool
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- s.WithTx(ctx, func(tx models.Storage) error {
+			if err := tx.LockWebhookObject(ctx, objectID); err != nil {
+				return err
+			}
+			close(held)
+			<-release
+			firstDone.Store(true)
+			return nil
+		})
+	}()
+	<-held
+
+	go func() {
+		errs <- s.WithTx(ctx, func(tx models.Storage) error {
+			if err := tx.LockWebhookObject(ctx, objectID); err != nil {
+				return err
+			}
+			if !firstDone.Load() {
+				return errors.New("second lock granted while the first was held")
+			}
+			return nil
+		})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("LockWebhookObject: %v", err)
+		}
+	}
+}
+
+func testListWebhookEvents(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	// A type unique to this run keeps events from other runs out of the way.
+	typ := uniq("test.event")
+	base := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		e := &models.WebhookEvent{
+			ID:      uniq("evt"),
+			Type:    typ,
+			Payload: []byte(`{}`),
+			Created: base.Add(time.Duration(2-i) * time.Minute),
+		}
+		if _, err := s.CreateWebhookEvent(ctx, e); err != nil {
+			t.Fatalf("CreateWebhookEvent: %v", err)
+		}
+		ids = append(ids, e.ID)
+	}
+	// Created order is the reverse of insertion order.
+	oldest, middle, newest := ids[2], ids[1], ids[0]
+
+	list := func(f models.WebhookEventFilter) []string {
+		t.Helper()
+		es, err := s.ListWebhookEvents(ctx, f)
+		if err != nil {
+			t.Fatalf("ListWebhookEvents: %v", err)
+		}
+		var got []string
+		for _, e := range es {
+			got = append(got, e.ID)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name string
+		f    models.WebhookEventFilter
+		want []string
+	}{
+		{"type", models.WebhookEventFilter{Type: typ}, []string{oldest, middle, newest}},
+		{"id", models.WebhookEventFilter{ID: middle}, []string{middle}},
+		{"from", models.WebhookEventFilter{Type: typ, From: base.Add(time.Minute)}, []string{middle, newest}},
+		{"to", models.WebhookEventFilter{Type: typ, To: base.Add(time.Minute)}, []string{oldest, middle}},
+		{"limit", models.WebhookEventFilter{Type: typ, Limit: 1}, []string{oldest}},
+		{"id and type", models.WebhookEventFilter{ID: middle, Type: "other"}, nil},
+	}
+	for _, tt := range tests {
+		if got := list(tt.f); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: ListWebhookEvents = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// historyOf flattens the status history of an entity to "from>to" pairs.
+func historyOf(t *testing.T, s models.Storage, entity, stripeID string) []string {
+	t.Helper()
+
+	hs, err := s.GetStatusHistory(context.Background(), entity, stripeID)
+	if err != nil {
+		t.Fatalf("GetStatusHistory: %v", err)
+	}
+	var out []string
+	for _, h := range hs {
+		if h.ChangedAt.IsZero() {
+			t.Fatalf("history entry without timestamp: %+v", h)
+		}
+		out = append(out, h.From+">"+h.To)
+	}
+	return out
+}
+
+func testPaymentTransitions(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID := uniq("pi")
+
+	id, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, "")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	for _, status := range []models.PaymentStatus{models.PaymentProcessing, models.PaymentSucceeded, models.PaymentSucceeded} {
+		if err := s.UpdatePaymentStatus(ctx, intentID, status); err != nil {
+			t.Fatalf("UpdatePaymentStatus(%s): %v", status, err)
+		}
+	}
+
+	// A late event must not move a succeeded payment back.
+	if err := s.UpdatePaymentStatus(ctx, intentID, models.PaymentPending); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("UpdatePaymentStatus(success -> pending) error = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.CancelPayment(ctx, id, userID); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("CancelPayment(success) error = %v, want ErrInvalidTransition", err)
+	}
+	p, err := s.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		t.Fatalf("GetPaymentDetails: %v", err)
+	}
+	if p.Status != models.PaymentSucceeded {
+		t.Fatalf("status after rejected transitions = %q, want %q", p.Status, models.PaymentSucceeded)
+	}
+
+	want := []string{">pending", "pending>processing", "processing>success"}
+	if got := historyOf(t, s, models.EntityPayment, intentID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("payment history = %v, want %v", got, want)
+	}
+
+	// Rejected transitions inside a unit of work roll it back like any error.
+	other := uniq("pi")
+	if _, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 100, "usd", "card", other, ""); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	err = s.WithTx(ctx, func(tx models.Storage) error {
+		if err := tx.UpdatePaymentStatus(ctx, other, models.PaymentCanceled); err != nil {
+			return err
+		}
+		return tx.UpdatePaymentStatus(ctx, other, models.PaymentSucceeded)
+	})
+	if !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("WithTx error = %v, want ErrInvalidTransition", err)
+	}
+	if got := historyOf(t, s, models.EntityPayment, other); fmt.Sprint(got) != "[>pending]" {
+		t.Fatalf("history after rollback = %v, want [>pending]", got)
+	}
+}
+
+func testSubscriptionTransitions(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	subID := uniq("sub")
+
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", uniq("sub"), "bogus"); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("CreateSubscription(bogus) error = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", subID, models.SubscriptionIncomplete); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	for _, status := range []models.SubscriptionStatus{models.SubscriptionActive, models.SubscriptionPastDue, models.SubscriptionActive} {
+		if err := s.UpdateSubscriptionStatus(ctx, subID, status); err != nil {
+			t.Fatalf("UpdateSubscriptionStatus(%s): %v", status, err)
+		}
+	}
+
+	sub, err := s.GetSubscriptionDetails(ctx, subID)
+	if err != nil {
+		t.Fatalf("GetSubscriptionDetails: %v", err)
+	}
+	if err := s.CancelSubscription(ctx, sub.ID, userID); err != nil {
+		t.Fatalf("CancelSubscription: %v", err)
+	}
+	if err := s.UpdateSubscriptionStatus(ctx, subID, models.SubscriptionActive); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("UpdateSubscriptionStatus(canceled -> active) error = %v, want ErrInvalidTransition", err)
+	}
+
+	want := []string{">incomplete", "incomplete>active", "active>past_due", "past_due>active", "active>canceled"}
+	if got := historyOf(t, s, models.EntitySubscription, subID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("subscription history = %v, want %v", got, want)
+	}
+}
+
+func testStatusOverride(t *testing.T, s models.Storage) {
+	ctx := context.Background()
+	userID := newCustomer(t, s)
+	intentID, subID := uniq("pi"), uniq("sub")
+
+	if _, err := s.CreatePayment(ctx, userID, "Ada", "ada@example.com", 1500, "usd", "card", intentID, ""); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if err := s.UpdatePaymentStatus(ctx, intentID, models.PaymentCanceled); err != nil {
+		t.Fatalf("UpdatePaymentStatus: %v", err)
+	}
+
+	// Canceled is final for events, but not for an operator.
+	from, err := s.OverridePaymentStatus(ctx, intentID, models.PaymentSucceeded)
+	if err != nil || from != models.PaymentCanceled {
+		t.Fatalf("OverridePaymentStatus = %q, %v, want canceled replaced", from, err)
+	}
+	if p, err := s.GetPaymentDetails(ctx, intentID); err != nil || p.Status != models.PaymentSucceeded {
+		t.Fatalf("GetPaymentDetails = %+v, %v, want success", p, err)
+	}
+	want := []string{">pending", "pending>canceled", "canceled>success"}
+	if got := historyOf(t, s, models.EntityPayment, intentID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("payment history = %v, want %v", got, want)
+	}
+
+	if err := s.CreateSubscription(ctx, userID, 0, 0, 999, "usd", subID, models.SubscriptionCanceled); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	if from, err := s.OverrideSubscriptionStatus(ctx, subID, models.SubscriptionActive); err != nil || from != models.SubscriptionCanceled {
+		t.Fatalf("OverrideSubscriptionStatus = %q, %v, want canceled replaced", from, err)
+	}
+	if got := historyOf(t, s, models.EntitySubscription, subID); fmt.Sprint(got) != "[>canceled canceled>active]" {
+		t.Fatalf("subscription history = %v", got)
+	}
+
+	if _, err := s.OverridePaymentStatus(ctx, intentID, "bogus"); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("OverridePaymentStatus(unknown status) error = %v, want ErrInvalidTransition", err)
+	}
+	if _, err := s.OverridePaymentStatus(ctx, uniq("pi_missing"), models.PaymentSucceeded); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("OverridePaymentStatus(missing) error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.OverrideSubscriptionStatus(ctx, uniq("sub_missing"), models.SubscriptionActive); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("OverrideSubscriptionStatus(missing) error = %v, want ErrNotFound", err)
+	}
+}
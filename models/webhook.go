@@ -0,0 +1,516 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Webhook event outcomes. Pending and processing events are still queued;
+// the rest are final. Rejected events asked for a status transition the
+// transition tables do not allow.
+const (
+	WebhookPending      = "pending"
+	WebhookProcessing   = "processing"
+	WebhookProcessed    = "processed"
+	WebhookIgnored      = "ignored"
+	WebhookStale        = "stale"
+	WebhookRejected     = "rejected"
+	WebhookDeadLettered = "dead_lettered"
+)
+
+// WebhookEvent is the processing log entry for one Stripe event and its
+// place in the processing queue. Created is the event's own timestamp, used
+// to order events for the same object.
+type WebhookEvent struct {
+	ID            string          `json:"id" db:"id"`
+	Type          string          `json:"type" db:"type"`
+	ObjectID      string          `json:"object_id" db:"object_id"`
+	Payload       json.RawMessage `json:"payload" db:"payload"`
+	Created       time.Time       `json:"created" db:"created"`
+	Attempts      int             `json:"attempts" db:"attempts"`
+	Outcome       string          `json:"outcome" db:"outcome"`
+	Error         string          `json:"error" db:"error"`
+	ReceivedAt    time.Time       `json:"received_at" db:"received_at"`
+	ProcessedAt   *time.Time      `json:"processed_at" db:"processed_at"`
+	NextAttemptAt time.Time       `json:"next_attempt_at" db:"next_attempt_at"`
+	LockedUntil   *time.Time      `json:"locked_until" db:"locked_until"`
+}
+
+// WebhookDeadLetter is a copy of an event that kept failing, kept for
+// inspection.
+type WebhookDeadLetter struct {
+	ID       uint            `json:"id" db:"id"`
+	EventID  string          `json:"event_id" db:"event_id"`
+	Type     string          `json:"type" db:"type"`
+	Payload  json.RawMessage `json:"payload" db:"payload"`
+	Attempts int             `json:"attempts" db:"attempts"`
+	Error    string          `json:"error" db:"error"`
+	FailedAt time.Time       `json:"failed_at" db:"failed_at"`
+}
+
+// WebhookEventFilter selects stored events. Zero fields match everything;
+// From and To bound the event creation time, inclusive.
+type WebhookEventFilter struct {
+	ID    string
+	Type  string
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+func (f WebhookEventFilter) matches(e *WebhookEvent) bool {
+	return (f.ID == "" || e.ID == f.ID) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.From.IsZero() || !e.Created.Before(f.From)) &&
+		(f.To.IsZero() || !e.Created.After(f.To))
+}
+
+// webhookObjectLockClass is the first key of the advisory locks taken by
+// LockWebhookObject; the second is a hash of the object ID.
+const webhookObjectLockClass = 9_100_210
+
+const webhookEventColumns = `id, type, object_id, payload, created, attempts, outcome, error, received_at, processed_at, next_attempt_at, locked_until`
+
+func scanWebhookEvent(row interface{ Scan(...interface{}) error }) (*WebhookEvent, error) {
+	var e WebhookEvent
+	err := row.Scan(&e.ID, &e.Type, &e.ObjectID, &e.Payload, &e.Created, &e.Attempts, &e.Outcome, &e.Error, &e.ReceivedAt, &e.ProcessedAt, &e.NextAttemptAt, &e.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *PostgresStorage) CreateWebhookEvent(ctx context.Context, e *WebhookEvent) (bool, error) {
+	query := `INSERT INTO webhook_events (id, type, object_id, payload, created) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (id) DO NOTHING`
+
+	err := s.execOne(ctx, "webhook event", query, e.ID, e.Type, e.ObjectID, e.Payload, e.Created)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *PostgresStorage) ClaimWebhookEvents(ctx context.Context, limit int, lockFor time.Duration) ([]*WebhookEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// SKIP LOCKED lets several workers claim from the queue at once; rows
+	// whose lock ran out belong to a worker that died mid-event.
+	query := `UPDATE webhook_events
+SET outcome='processing', attempts=attempts+1, locked_until=now() + make_interval(secs => $2)
+WHERE id IN (
+    SELECT id FROM webhook_events
+    WHERE (outcome='pending' AND next_attempt_at <= now()) OR (outcome='processing' AND locked_until < now())
+    ORDER BY created, received_at
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + webhookEventColumns
+
+	rows, err := s.q.QueryContext(ctx, query, limit, lockFor.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var es []*WebhookEvent
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep the subquery's order.
+	sortWebhookEvents(es)
+	return es, nil
+}
+
+func (s *PostgresStorage) GetWebhookEvent(ctx context.Context, id string) (*WebhookEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + webhookEventColumns + ` FROM webhook_events WHERE id=$1`
+
+	e, err := scanWebhookEvent(s.q.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("no webhook event found for ID %s: %w", id, ErrNotFound)
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *PostgresStorage) FinishWebhookEvent(ctx context.Context, id, outcome, errMsg string) error {
+	query := `UPDATE webhook_events SET outcome=$1, error=$2, processed_at=now(), locked_until=NULL WHERE id=$3`
+
+	return s.execOne(ctx, "webhook event", query, outcome, errMsg, id)
+}
+
+func (s *PostgresStorage) RetryWebhookEvent(ctx context.Context, id, errMsg string, delay time.Duration) error {
+	query := `UPDATE webhook_events
+SET outcome='pending', error=$1, next_attempt_at=now() + make_interval(secs => $2), locked_until=NULL
+WHERE id=$3`
+
+	return s.execOne(ctx, "webhook event", query, errMsg, delay.Seconds(), id)
+}
+
+func (s *PostgresStorage) DeadLetterWebhookEvent(ctx context.Context, id, errMsg string) error {
+	// One statement, so the event cannot end up in both places or neither.
+	query := `WITH moved AS (
+    UPDATE webhook_events SET outcome='dead_lettered', error=$1, processed_at=now(), locked_until=NULL
+    WHERE id=$2
+    RETURNING id, type, payload, attempts
+)
+INSERT INTO webhook_dead_letters (event_id, type, payload, attempts, error)
+SELECT id, type, payload, attempts, $1 FROM moved`
+
+	return s.execOne(ctx, "webhook event", query, errMsg, id)
+}
+
+func (s *PostgresStorage) GetWebhookDeadLetters(ctx context.Context, limit int) ([]*WebhookDeadLetter, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, event_id, type, payload, attempts, error, failed_at
+FROM webhook_dead_letters ORDER BY id DESC LIMIT $1`
+
+	rows, err := s.q.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ds []*WebhookDeadLetter
+	for rows.Next() {
+		var d WebhookDeadLetter
+		if err := rows.Scan(&d.ID, &d.EventID, &d.Type, &d.Payload, &d.Attempts, &d.Error, &d.FailedAt); err != nil {
+			return nil, err
+		}
+		ds = append(ds, &d)
+	}
+
+	return ds, rows.Err()
+}
+
+func (s *PostgresStorage) ListWebhookEvents(ctx context.Context, f WebhookEventFilter) ([]*WebhookEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.ID != "" {
+		add("id=$%d", f.ID)
+	}
+	if f.Type != "" {
+		add("type=$%d", f.Type)
+	}
+	if !f.From.IsZero() {
+		add("created >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created <= $%d", f.To)
+	}
+
+	query := `SELECT ` + webhookEventColumns + ` FROM webhook_events`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY created, received_at`
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	rows, err := s.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var es []*WebhookEvent
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+
+	return es, rows.Err()
+}
+
+func (s *PostgresStorage) LastAppliedWebhookEvent(ctx context.Context, objectID string) (*WebhookEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + webhookEventColumns + ` FROM webhook_events
+WHERE object_id=$1 AND outcome=$2 ORDER BY created DESC, received_at DESC LIMIT 1`
+
+	e, err := scanWebhookEvent(s.q.QueryRowContext(ctx, query, objectID, WebhookProcessed))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("no webhook event applied to %s: %w", objectID, ErrNotFound)
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *PostgresStorage) LockWebhookObject(ctx context.Context, objectID string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// A transaction-level lock is released by the commit or rollback of the
+	// transaction s.q runs in.
+	_, err := s.q.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, webhookObjectLockClass, objectID)
+	return err
+}
+
+// sortWebhookEvents orders events the way the queue hands them out: oldest
+// event first.
+func sortWebhookEvents(es []*WebhookEvent) {
+	sort.Slice(es, func(i, j int) bool {
+		if !es[i].Created.Equal(es[j].Created) {
+			return es[i].Created.Before(es[j].Created)
+		}
+		return es[i].ReceivedAt.Before(es[j].ReceivedAt)
+	})
+}
+
+func (s *MemoryStorage) CreateWebhookEvent(ctx context.Context, e *WebhookEvent) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhookEvents[e.ID]; ok {
+		return false, nil
+	}
+
+	now := time.Now()
+	s.webhookEvents[e.ID] = &WebhookEvent{
+		ID:            e.ID,
+		Type:          e.Type,
+		ObjectID:      e.ObjectID,
+		Payload:       append(json.RawMessage(nil), e.Payload...),
+		Created:       e.Created,
+		Outcome:       WebhookPending,
+		ReceivedAt:    now,
+		NextAttemptAt: now,
+	}
+	return true, nil
+}
+
+func (s *MemoryStorage) ClaimWebhookEvents(ctx context.Context, limit int, lockFor time.Duration) ([]*WebhookEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var due []*WebhookEvent
+	for _, e := range s.webhookEvents {
+		pending := e.Outcome == WebhookPending && !e.NextAttemptAt.After(now)
+		abandoned := e.Outcome == WebhookProcessing && e.LockedUntil != nil && e.LockedUntil.Before(now)
+		if pending || abandoned {
+			due = append(due, e)
+		}
+	}
+	sortWebhookEvents(due)
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	lockedUntil := now.Add(lockFor)
+	es := make([]*WebhookEvent, 0, len(due))
+	for _, e := range due {
+		e.Outcome = WebhookProcessing
+		e.Attempts++
+		e.LockedUntil = &lockedUntil
+		out := *e
+		es = append(es, &out)
+	}
+	return es, nil
+}
+
+func (s *MemoryStorage) GetWebhookEvent(ctx context.Context, id string) (*WebhookEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.webhookEvents[id]
+	if !ok {
+		return nil, fmt.Errorf("no webhook event found for ID %s: %w", id, ErrNotFound)
+	}
+	out := *e
+	return &out, nil
+}
+
+func (s *MemoryStorage) FinishWebhookEvent(ctx context.Context, id, outcome, errMsg string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.webhookEvents[id]
+	if !ok {
+		return fmt.Errorf("no webhook event found: %w", ErrNotFound)
+	}
+	now := time.Now()
+	e.Outcome = outcome
+	e.Error = errMsg
+	e.ProcessedAt = &now
+	e.LockedUntil = nil
+	return nil
+}
+
+func (s *MemoryStorage) RetryWebhookEvent(ctx context.Context, id, errMsg string, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.webhookEvents[id]
+	if !ok {
+		return fmt.Errorf("no webhook event found: %w", ErrNotFound)
+	}
+	e.Outcome = WebhookPending
+	e.Error = errMsg
+	e.NextAttemptAt = time.Now().Add(delay)
+	e.LockedUntil = nil
+	return nil
+}
+
+func (s *MemoryStorage) DeadLetterWebhookEvent(ctx context.Context, id, errMsg string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.webhookEvents[id]
+	if !ok {
+		return fmt.Errorf("no webhook event found: %w", ErrNotFound)
+	}
+	now := time.Now()
+	e.Outcome = WebhookDeadLettered
+	e.Error = errMsg
+	e.ProcessedAt = &now
+	e.LockedUntil = nil
+
+	d := &WebhookDeadLetter{
+		ID:       s.nextID("webhook_dead_letters"),
+		EventID:  e.ID,
+		Type:     e.Type,
+		Payload:  e.Payload,
+		Attempts: e.Attempts,
+		Error:    errMsg,
+		FailedAt: now,
+	}
+	s.webhookDeadLetters[d.ID] = d
+	return nil
+}
+
+func (s *MemoryStorage) GetWebhookDeadLetters(ctx context.Context, limit int) ([]*WebhookDeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ds []*WebhookDeadLetter
+	for _, d := range s.webhookDeadLetters {
+		out := *d
+		ds = append(ds, &out)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].ID > ds[j].ID })
+	if len(ds) > limit {
+		ds = ds[:limit]
+	}
+
+	return ds, nil
+}
+
+func (s *MemoryStorage) ListWebhookEvents(ctx context.Context, f WebhookEventFilter) ([]*WebhookEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var es []*WebhookEvent
+	for _, e := range s.webhookEvents {
+		if f.matches(e) {
+			out := *e
+			es = append(es, &out)
+		}
+	}
+	sortWebhookEvents(es)
+	if f.Limit > 0 && len(es) > f.Limit {
+		es = es[:f.Limit]
+	}
+
+	return es, nil
+}
+
+func (s *MemoryStorage) LastAppliedWebhookEvent(ctx context.Context, objectID string) (*WebhookEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last *WebhookEvent
+	for _, e := range s.webhookEvents {
+		if e.ObjectID != objectID || e.Outcome != WebhookProcessed {
+			continue
+		}
+		if last == nil || e.Created.After(last.Created) ||
+			(e.Created.Equal(last.Created) && e.ReceivedAt.After(last.ReceivedAt)) {
+			last = e
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no webhook event applied to %s: %w", objectID, ErrNotFound)
+	}
+	out := *last
+	return &out, nil
+}
+
+// LockWebhookObject has nothing to wait for: WithTx already runs one unit of
+// work at a time, which holds every object's lock for as long as it runs.
+func (s *MemoryStorage) LockWebhookObject(ctx context.Context, objectID string) error {
+	return ctx.Err()
+}
@@ -0,0 +1,1614 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+// MemoryProvider is an in-memory PaymentProvider for tests. It keeps just
+// enough object state to mimic the Stripe responses the handlers depend on
+// and never touches the network.
+type MemoryProvider struct {
+	mu            sync.Mutex
+	seq           int
+	intents       map[string]*stripe.PaymentIntent
+	refunds       map[string]*stripe.Refund
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	setupIntents  map[string]*stripe.SetupIntent
+	methods       map[string]*stripe.PaymentMethod
+	sessions      map[string]*stripe.CheckoutSession
+	products      map[string]*stripe.Product
+	prices        map[string]*stripe.Price
+	links         map[string]*stripe.PaymentLink
+	coupons       map[string]*stripe.Coupon
+	promoCodes    map[string]*stripe.PromotionCode
+	// testCards maps saved payment methods to the test card they were
+	// created from, which decides how they behave.
+	testCards map[string]string
+	// idempotent maps resource|Idempotency-Key to the object first created
+	// with that key, so retries get the same object back.
+	idempotent map[string]string
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{
+		intents:       make(map[string]*stripe.PaymentIntent),
+		refunds:       make(map[string]*stripe.Refund),
+		customers:     make(map[string]*stripe.Customer),
+		subscriptions: make(map[string]*stripe.Subscription),
+		setupIntents:  make(map[string]*stripe.SetupIntent),
+		methods:       make(map[string]*stripe.PaymentMethod),
+		sessions:      make(map[string]*stripe.CheckoutSession),
+		products:      make(map[string]*stripe.Product),
+		prices:        make(map[string]*stripe.Price),
+		links:         make(map[string]*stripe.PaymentLink),
+		coupons:       make(map[string]*stripe.Coupon),
+		promoCodes:    make(map[string]*stripe.PromotionCode),
+		testCards:     make(map[string]string),
+		idempotent:    make(map[string]string),
+	}
+}
+
+func (p *MemoryProvider) newID(prefix string) string {
+	p.seq++
+	return fmt.Sprintf("%s_%d", prefix, p.seq)
+}
+
+// replayed returns the ID of the resource created earlier with the same
+// idempotency key, if any.
+func (p *MemoryProvider) replayed(resource string, params *stripe.Params) (string, bool) {
+	if params.IdempotencyKey == nil {
+		return "", false
+	}
+	id, ok := p.idempotent[resource+"|"+*params.IdempotencyKey]
+	return id, ok
+}
+
+func (p *MemoryProvider) remember(resource string, params *stripe.Params, id string) {
+	if params.IdempotencyKey != nil {
+		p.idempotent[resource+"|"+*params.IdempotencyKey] = id
+	}
+}
+
+func notFound(resource, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", resource, id),
+	}
+}
+
+func invalidRequest(msg string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		HTTPStatusCode: http.StatusBadRequest,
+		Msg:            msg,
+	}
+}
+
+func unexpectedState(msg string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodePaymentIntentUnexpectedState,
+		HTTPStatusCode: http.StatusBadRequest,
+		Msg:            msg,
+	}
+}
+
+func (p *MemoryProvider) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("payment_intent", &params.Params); ok {
+		out := *p.intents[id]
+		return &out, nil
+	}
+
+	if params.Amount == nil || *params.Amount <= 0 {
+		return nil, invalidRequest("Missing required param: amount.")
+	}
+	if params.Currency == nil || *params.Currency == "" {
+		return nil, invalidRequest("Missing required param: currency.")
+	}
+
+	id := p.newID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Object:       "payment_intent",
+		Amount:       *params.Amount,
+		Currency:     stripe.Currency(*params.Currency),
+		ClientSecret: id + "_secret",
+		Created:      time.Now().Unix(),
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+	}
+	for _, t := range params.PaymentMethodTypes {
+		pi.PaymentMethodTypes = append(pi.PaymentMethodTypes, stripe.StringValue(t))
+	}
+	pi.CaptureMethod = stripe.PaymentIntentCaptureMethodAutomatic
+	if params.CaptureMethod != nil {
+		pi.CaptureMethod = stripe.PaymentIntentCaptureMethod(*params.CaptureMethod)
+	}
+	if params.Customer != nil {
+		if _, ok := p.customers[*params.Customer]; !ok {
+			return nil, notFound("customer", *params.Customer)
+		}
+		pi.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+	if params.PaymentMethod != nil {
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: *params.PaymentMethod}
+		pi.Status = stripe.PaymentIntentStatusRequiresConfirmation
+	}
+	if params.Confirm != nil && *params.Confirm {
+		settle(pi)
+	}
+
+	p.intents[id] = pi
+	p.remember("payment_intent", &params.Params, id)
+	out := *pi
+	return &out, nil
+}
+
+func (p *MemoryProvider) GetPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi, ok := p.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	out := *pi
+	return &out, nil
+}
+
+// ConfirmPaymentIntent confirms like the Stripe test cards do: cards whose
+// name contains "fail" are declined and ones containing "threeDSecure" or
+// "authenticationRequired" require authentication (see
+// AuthenticatePaymentIntent), or are declined with authentication_required
+// when the customer is off session.
+func (p *MemoryProvider) ConfirmPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = &stripe.PaymentIntentConfirmParams{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi, ok := p.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation,
+		stripe.PaymentIntentStatusRequiresAction:
+	default:
+		return nil, unexpectedState(fmt.Sprintf("You cannot confirm this PaymentIntent because it has a status of %s.", pi.Status))
+	}
+	if params.PaymentMethod != nil {
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: *params.PaymentMethod}
+	}
+	if pi.PaymentMethod == nil {
+		return nil, invalidRequest("You cannot confirm this PaymentIntent because it's missing a payment method.")
+	}
+
+	pi.NextAction = nil
+	pi.LastPaymentError = nil
+	card := p.cardName(pi.PaymentMethod.ID)
+	switch {
+	case requiresAuthentication(card) && stripe.BoolValue(params.OffSession):
+		pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		pi.LastPaymentError = &stripe.Error{
+			Type:          stripe.ErrorTypeCard,
+			Code:          stripe.ErrorCodeAuthenticationRequired,
+			DeclineCode:   stripe.DeclineCodeAuthenticationRequired,
+			Msg:           "Your card was declined. This transaction requires authentication.",
+			PaymentMethod: &stripe.PaymentMethod{ID: pi.PaymentMethod.ID},
+		}
+		out := *pi
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeCard,
+			Code:           stripe.ErrorCodeAuthenticationRequired,
+			DeclineCode:    stripe.DeclineCodeAuthenticationRequired,
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Msg:            "Your card was declined. This transaction requires authentication.",
+			PaymentIntent:  &out,
+			PaymentMethod:  &stripe.PaymentMethod{ID: pi.PaymentMethod.ID},
+		}
+	case strings.Contains(card, "fail"):
+		pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		pi.LastPaymentError = &stripe.Error{
+			Type:        stripe.ErrorTypeCard,
+			Code:        stripe.ErrorCodeCardDeclined,
+			DeclineCode: stripe.DeclineCodeGenericDecline,
+			Msg:         "Your card was declined.",
+		}
+		out := *pi
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeCard,
+			Code:           stripe.ErrorCodeCardDeclined,
+			DeclineCode:    stripe.DeclineCodeGenericDecline,
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Msg:            "Your card was declined.",
+			PaymentIntent:  &out,
+		}
+	case requiresAuthentication(card):
+		pi.Status = stripe.PaymentIntentStatusRequiresAction
+		pi.NextAction = &stripe.PaymentIntentNextAction{
+			Type:         stripe.PaymentIntentNextActionTypeUseStripeSDK,
+			UseStripeSDK: &stripe.PaymentIntentNextActionUseStripeSDK{},
+		}
+		if params.ReturnURL != nil && !stripe.BoolValue(params.UseStripeSDK) {
+			pi.NextAction = &stripe.PaymentIntentNextAction{
+				Type: stripe.PaymentIntentNextActionTypeRedirectToURL,
+				RedirectToURL: &stripe.PaymentIntentNextActionRedirectToURL{
+					URL:       "https://hooks.stripe.com/3d_secure_2/authenticate/" + pi.ID,
+					ReturnURL: *params.ReturnURL,
+				},
+			}
+		}
+	default:
+		settle(pi)
+	}
+
+	out := *pi
+	return &out, nil
+}
+
+func (p *MemoryProvider) CapturePaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi, ok := p.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		return nil, unexpectedState(fmt.Sprintf("This PaymentIntent could not be captured because it has a status of %s.", pi.Status))
+	}
+
+	amount := pi.AmountCapturable
+	if params != nil && params.AmountToCapture != nil {
+		amount = *params.AmountToCapture
+	}
+	if amount < 1 || amount > pi.AmountCapturable {
+		return nil, invalidRequest("The amount to capture must be positive and not exceed the capturable amount.")
+	}
+
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountCapturable = 0
+	pi.AmountReceived = amount
+	out := *pi
+	return &out, nil
+}
+
+func (p *MemoryProvider) CancelPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi, ok := p.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	if pi.Status == stripe.PaymentIntentStatusSucceeded || pi.Status == stripe.PaymentIntentStatusCanceled {
+		return nil, unexpectedState(fmt.Sprintf("You cannot cancel this PaymentIntent because it has a status of %s.", pi.Status))
+	}
+
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	pi.AmountCapturable = 0
+	pi.CanceledAt = time.Now().Unix()
+	if params != nil && params.CancellationReason != nil {
+		pi.CancellationReason = stripe.PaymentIntentCancellationReason(*params.CancellationReason)
+	}
+	out := *pi
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("refund", &params.Params); ok {
+		out := *p.refunds[id]
+		return &out, nil
+	}
+
+	if params.PaymentIntent == nil {
+		return nil, invalidRequest("Missing required param: payment_intent.")
+	}
+	pi, ok := p.intents[*params.PaymentIntent]
+	if !ok {
+		return nil, notFound("payment_intent", *params.PaymentIntent)
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, invalidRequest(fmt.Sprintf("PaymentIntent %s does not have a successful charge to refund.", pi.ID))
+	}
+
+	var refunded int64
+	for _, re := range p.refunds {
+		if re.PaymentIntent.ID == pi.ID && re.Status != stripe.RefundStatusCanceled && re.Status != stripe.RefundStatusFailed {
+			refunded += re.Amount
+		}
+	}
+	remaining := pi.AmountReceived - refunded
+	if remaining <= 0 {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeChargeAlreadyRefunded,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("PaymentIntent %s has already been refunded.", pi.ID),
+		}
+	}
+
+	amount := remaining
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+	if amount < 1 || amount > remaining {
+		return nil, invalidRequest(fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, remaining))
+	}
+
+	re := &stripe.Refund{
+		ID:            p.newID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Currency:      pi.Currency,
+		Created:       time.Now().Unix(),
+		Metadata:      params.Metadata,
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Reason:        stripe.RefundReason(stripe.StringValue(params.Reason)),
+		Status:        stripe.RefundStatusSucceeded,
+	}
+	p.refunds[re.ID] = re
+	p.remember("refund", &params.Params, re.ID)
+	out := *re
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("customer", &params.Params); ok {
+		out := *p.customers[id]
+		return &out, nil
+	}
+
+	cus := &stripe.Customer{
+		ID:      p.newID("cus"),
+		Object:  "customer",
+		Created: time.Now().Unix(),
+		Name:    stripe.StringValue(params.Name),
+		Email:   stripe.StringValue(params.Email),
+	}
+	p.customers[cus.ID] = cus
+	p.remember("customer", &params.Params, cus.ID)
+	out := *cus
+	return &out, nil
+}
+
+func (p *MemoryProvider) UpdateCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cus, ok := p.customers[id]
+	if !ok {
+		return nil, notFound("customer", id)
+	}
+	if params.Name != nil {
+		cus.Name = *params.Name
+	}
+	if params.Email != nil {
+		cus.Email = *params.Email
+	}
+	if params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		pmID := *params.InvoiceSettings.DefaultPaymentMethod
+		pm, ok := p.methods[pmID]
+		if !ok || pm.Customer == nil || pm.Customer.ID != id {
+			return nil, invalidRequest(fmt.Sprintf("No such PaymentMethod: '%s' attached to customer %s.", pmID, id))
+		}
+		cus.InvoiceSettings = &stripe.CustomerInvoiceSettings{DefaultPaymentMethod: &stripe.PaymentMethod{ID: pmID}}
+	}
+	out := *cus
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreateSetupIntent(ctx context.Context, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("setup_intent", &params.Params); ok {
+		out := *p.setupIntents[id]
+		return &out, nil
+	}
+
+	id := p.newID("seti")
+	si := &stripe.SetupIntent{
+		ID:           id,
+		Object:       "setup_intent",
+		ClientSecret: id + "_secret",
+		Created:      time.Now().Unix(),
+		Status:       stripe.SetupIntentStatusRequiresPaymentMethod,
+		Usage:        stripe.SetupIntentUsageOffSession,
+	}
+	if params.Customer != nil {
+		if _, ok := p.customers[*params.Customer]; !ok {
+			return nil, notFound("customer", *params.Customer)
+		}
+		si.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+	if params.Usage != nil {
+		si.Usage = stripe.SetupIntentUsage(*params.Usage)
+	}
+	for _, t := range params.PaymentMethodTypes {
+		si.PaymentMethodTypes = append(si.PaymentMethodTypes, stripe.StringValue(t))
+	}
+
+	p.setupIntents[si.ID] = si
+	p.remember("setup_intent", &params.Params, si.ID)
+	out := *si
+	return &out, nil
+}
+
+func (p *MemoryProvider) DetachPaymentMethod(ctx context.Context, id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pm, ok := p.methods[id]
+	if !ok {
+		return nil, notFound("payment_method", id)
+	}
+	if pm.Customer == nil {
+		return nil, invalidRequest("The payment method you provided is not attached to a customer so detachment is impossible.")
+	}
+	if cus := p.customers[pm.Customer.ID]; cus != nil && cus.InvoiceSettings != nil &&
+		cus.InvoiceSettings.DefaultPaymentMethod != nil && cus.InvoiceSettings.DefaultPaymentMethod.ID == id {
+		cus.InvoiceSettings.DefaultPaymentMethod = nil
+	}
+	pm.Customer = nil
+	out := *pm
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("checkout_session", &params.Params); ok {
+		out := *p.sessions[id]
+		return &out, nil
+	}
+
+	if params.SuccessURL == nil || *params.SuccessURL == "" {
+		return nil, invalidRequest("Missing required param: success_url.")
+	}
+	if len(params.LineItems) == 0 {
+		return nil, invalidRequest("Missing required param: line_items.")
+	}
+
+	id := p.newID("cs")
+	cs := &stripe.CheckoutSession{
+		ID:            id,
+		Object:        "checkout.session",
+		Created:       time.Now().Unix(),
+		ExpiresAt:     time.Now().Add(24 * time.Hour).Unix(),
+		Metadata:      params.Metadata,
+		Mode:          stripe.CheckoutSessionMode(stripe.StringValue(params.Mode)),
+		PaymentStatus: stripe.CheckoutSessionPaymentStatusUnpaid,
+		Status:        stripe.CheckoutSessionStatusOpen,
+		SuccessURL:    *params.SuccessURL,
+		CancelURL:     stripe.StringValue(params.CancelURL),
+		URL:           "https://checkout.stripe.com/c/pay/" + id,
+	}
+	for _, li := range params.LineItems {
+		if li.PriceData == nil || li.PriceData.UnitAmount == nil || li.PriceData.Currency == nil {
+			return nil, invalidRequest("Each line item needs price_data with a currency and unit_amount.")
+		}
+		cs.Currency = stripe.Currency(*li.PriceData.Currency)
+		cs.AmountTotal += *li.PriceData.UnitAmount * stripe.Int64Value(li.Quantity)
+	}
+	cs.AmountSubtotal = cs.AmountTotal
+	for _, t := range params.PaymentMethodTypes {
+		cs.PaymentMethodTypes = append(cs.PaymentMethodTypes, stripe.StringValue(t))
+	}
+	if params.Customer != nil {
+		if _, ok := p.customers[*params.Customer]; !ok {
+			return nil, notFound("customer", *params.Customer)
+		}
+		cs.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+
+	p.sessions[id] = cs
+	p.remember("checkout_session", &params.Params, id)
+	out := *cs
+	return &out, nil
+}
+
+func (p *MemoryProvider) ExpireCheckoutSession(ctx context.Context, id string, params *stripe.CheckoutSessionExpireParams) (*stripe.CheckoutSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cs, ok := p.sessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	if cs.Status != stripe.CheckoutSessionStatusOpen {
+		return nil, invalidRequest(fmt.Sprintf("Only Checkout Sessions with a status in [\"open\"] can be expired. This Checkout Session has a status of %q.", cs.Status))
+	}
+	cs.Status = stripe.CheckoutSessionStatusExpired
+	cs.URL = ""
+	out := *cs
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreateProduct(ctx context.Context, params *stripe.ProductParams) (*stripe.Product, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("product", &params.Params); ok {
+		out := *p.products[id]
+		return &out, nil
+	}
+
+	if params.Name == nil || *params.Name == "" {
+		return nil, invalidRequest("Missing required param: name.")
+	}
+	prod := p.newProduct(*params.Name)
+	prod.Description = stripe.StringValue(params.Description)
+	prod.Metadata = params.Metadata
+	p.remember("product", &params.Params, prod.ID)
+	out := *prod
+	return &out, nil
+}
+
+func (p *MemoryProvider) newProduct(name string) *stripe.Product {
+	now := time.Now().Unix()
+	prod := &stripe.Product{
+		ID:      p.newID("prod"),
+		Object:  "product",
+		Active:  true,
+		Created: now,
+		Name:    name,
+		Updated: now,
+	}
+	p.products[prod.ID] = prod
+	return prod
+}
+
+func (p *MemoryProvider) UpdateProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prod, ok := p.products[id]
+	if !ok {
+		return nil, notFound("product", id)
+	}
+	if params.Name != nil {
+		prod.Name = *params.Name
+	}
+	if params.Description != nil {
+		prod.Description = *params.Description
+	}
+	if params.Active != nil {
+		prod.Active = *params.Active
+	}
+	prod.Updated = time.Now().Unix()
+	out := *prod
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreatePrice(ctx context.Context, params *stripe.PriceParams) (*stripe.Price, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("price", &params.Params); ok {
+		out := *p.prices[id]
+		return &out, nil
+	}
+
+	if params.Currency == nil || *params.Currency == "" {
+		return nil, invalidRequest("Missing required param: currency.")
+	}
+	if params.UnitAmount == nil {
+		return nil, invalidRequest("Missing required param: unit_amount.")
+	}
+	var prod *stripe.Product
+	switch {
+	case params.Product != nil:
+		var ok bool
+		if prod, ok = p.products[*params.Product]; !ok {
+			return nil, notFound("product", *params.Product)
+		}
+	case params.ProductData != nil && params.ProductData.Name != nil:
+		prod = p.newProduct(*params.ProductData.Name)
+	default:
+		return nil, invalidRequest("Missing required param: product.")
+	}
+
+	pr := &stripe.Price{
+		ID:         p.newID("price"),
+		Object:     "price",
+		Active:     true,
+		Created:    time.Now().Unix(),
+		Currency:   stripe.Currency(*params.Currency),
+		LookupKey:  stripe.StringValue(params.LookupKey),
+		Metadata:   params.Metadata,
+		Nickname:   stripe.StringValue(params.Nickname),
+		Product:    &stripe.Product{ID: prod.ID},
+		Type:       stripe.PriceTypeOneTime,
+		UnitAmount: *params.UnitAmount,
+	}
+	if r := params.Recurring; r != nil {
+		pr.Type = stripe.PriceTypeRecurring
+		pr.Recurring = &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringInterval(stripe.StringValue(r.Interval)),
+			IntervalCount: 1,
+			UsageType:     stripe.PriceRecurringUsageTypeLicensed,
+		}
+		if r.IntervalCount != nil {
+			pr.Recurring.IntervalCount = *r.IntervalCount
+		}
+	}
+	if pr.LookupKey != "" {
+		if err := p.claimLookupKey(pr.LookupKey, stripe.BoolValue(params.TransferLookupKey)); err != nil {
+			return nil, err
+		}
+	}
+	p.prices[pr.ID] = pr
+	p.remember("price", &params.Params, pr.ID)
+	out := *pr
+	return &out, nil
+}
+
+// claimLookupKey frees key for a new price. Another price holding it is an
+// error unless transfer is set, in which case the key moves.
+func (p *MemoryProvider) claimLookupKey(key string, transfer bool) error {
+	for _, other := range p.prices {
+		if other.LookupKey != key {
+			continue
+		}
+		if !transfer {
+			return invalidRequest(fmt.Sprintf("A price (`%s`) already uses that lookup key.", other.ID))
+		}
+		other.LookupKey = ""
+	}
+	return nil
+}
+
+func (p *MemoryProvider) GetPrice(ctx context.Context, id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, ok := p.prices[id]
+	if !ok {
+		return nil, notFound("price", id)
+	}
+	out := *pr
+	return &out, nil
+}
+
+func (p *MemoryProvider) UpdatePrice(ctx context.Context, id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, ok := p.prices[id]
+	if !ok {
+		return nil, notFound("price", id)
+	}
+	if params.Active != nil {
+		pr.Active = *params.Active
+	}
+	if params.Nickname != nil {
+		pr.Nickname = *params.Nickname
+	}
+	if params.LookupKey != nil && *params.LookupKey != pr.LookupKey {
+		if err := p.claimLookupKey(*params.LookupKey, stripe.BoolValue(params.TransferLookupKey)); err != nil {
+			return nil, err
+		}
+		pr.LookupKey = *params.LookupKey
+	}
+	out := *pr
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreatePaymentLink(ctx context.Context, params *stripe.PaymentLinkParams) (*stripe.PaymentLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("payment_link", &params.Params); ok {
+		out := *p.links[id]
+		return &out, nil
+	}
+
+	if len(params.LineItems) == 0 {
+		return nil, invalidRequest("Missing required param: line_items.")
+	}
+	id := p.newID("plink")
+	pl := &stripe.PaymentLink{
+		ID:               id,
+		Object:           "payment_link",
+		Active:           true,
+		CustomerCreation: stripe.PaymentLinkCustomerCreation(stripe.StringValue(params.CustomerCreation)),
+		InactiveMessage:  stripe.StringValue(params.InactiveMessage),
+		LineItems:        &stripe.LineItemList{},
+		Metadata:         params.Metadata,
+		URL:              "https://buy.stripe.com/test_" + id,
+	}
+	for _, li := range params.LineItems {
+		pr, ok := p.prices[stripe.StringValue(li.Price)]
+		if !ok {
+			return nil, notFound("price", stripe.StringValue(li.Price))
+		}
+		quantity := stripe.Int64Value(li.Quantity)
+		pl.Currency = pr.Currency
+		pl.LineItems.Data = append(pl.LineItems.Data, &stripe.LineItem{
+			Object:         "item",
+			AmountSubtotal: pr.UnitAmount * quantity,
+			AmountTotal:    pr.UnitAmount * quantity,
+			Currency:       pr.Currency,
+			Price:          pr,
+			Quantity:       quantity,
+		})
+	}
+	if params.Restrictions != nil && params.Restrictions.CompletedSessions != nil {
+		pl.Restrictions = &stripe.PaymentLinkRestrictions{
+			CompletedSessions: &stripe.PaymentLinkRestrictionsCompletedSessions{Limit: stripe.Int64Value(params.Restrictions.CompletedSessions.Limit)},
+		}
+	}
+
+	p.links[id] = pl
+	p.remember("payment_link", &params.Params, id)
+	out := *pl
+	return &out, nil
+}
+
+func (p *MemoryProvider) UpdatePaymentLink(ctx context.Context, id string, params *stripe.PaymentLinkParams) (*stripe.PaymentLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pl, ok := p.links[id]
+	if !ok {
+		return nil, notFound("payment_link", id)
+	}
+	if params.Active != nil {
+		pl.Active = *params.Active
+	}
+	if params.InactiveMessage != nil {
+		pl.InactiveMessage = *params.InactiveMessage
+	}
+	out := *pl
+	return &out, nil
+}
+
+func (p *MemoryProvider) CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.replayed("subscription", &params.Params); ok {
+		out := *p.subscriptions[id]
+		return &out, nil
+	}
+
+	if params.Customer == nil || *params.Customer == "" {
+		return nil, invalidRequest("Missing required param: customer.")
+	}
+	if len(params.Items) == 0 {
+		return nil, invalidRequest("Missing required param: items.")
+	}
+	if _, ok := p.customers[*params.Customer]; !ok {
+		return nil, notFound("customer", *params.Customer)
+	}
+
+	now := time.Now()
+	sub := &stripe.Subscription{
+		ID:                 p.newID("sub"),
+		Object:             "subscription",
+		Created:            now.Unix(),
+		Customer:           &stripe.Customer{ID: *params.Customer},
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Items:              &stripe.SubscriptionItemList{},
+		StartDate:          now.Unix(),
+		Status:             stripe.SubscriptionStatusActive,
+	}
+	for _, item := range params.Items {
+		pr, ok := p.prices[stripe.StringValue(item.Price)]
+		if !ok {
+			return nil, notFound("price", stripe.StringValue(item.Price))
+		}
+		if pr.Recurring == nil {
+			return nil, invalidRequest(fmt.Sprintf("The price specified is set to `type=one_time` but this field only accepts prices with `type=recurring`: %s", pr.ID))
+		}
+		if !pr.Active {
+			return nil, invalidRequest(fmt.Sprintf("The price specified is inactive. This field only accepts active prices: %s", pr.ID))
+		}
+		quantity := int64(1)
+		if item.Quantity != nil {
+			quantity = *item.Quantity
+		}
+		sub.Items.Data = append(sub.Items.Data, &stripe.SubscriptionItem{
+			ID:           p.newID("si"),
+			Object:       "subscription_item",
+			Price:        pr,
+			Quantity:     quantity,
+			Subscription: sub.ID,
+		})
+		sub.CurrentPeriodEnd = periodEnd(now, pr.Recurring).Unix()
+	}
+	sub.Items.TotalCount = uint32(len(sub.Items.Data))
+
+	if params.TrialEnd != nil && params.TrialPeriodDays != nil {
+		return nil, invalidRequest("You may only specify one of these parameters: trial_end, trial_period_days.")
+	}
+	var trialEnd time.Time
+	switch {
+	case params.TrialPeriodDays != nil:
+		trialEnd = now.AddDate(0, 0, int(*params.TrialPeriodDays))
+	case params.TrialEnd != nil:
+		trialEnd = time.Unix(*params.TrialEnd, 0)
+		if !trialEnd.After(now) {
+			return nil, invalidRequest("Invalid timestamp: must be in the future.")
+		}
+	}
+	if !trialEnd.IsZero() {
+		sub.Status = stripe.SubscriptionStatusTrialing
+		sub.TrialStart = now.Unix()
+		sub.TrialEnd = trialEnd.Unix()
+		sub.CurrentPeriodEnd = trialEnd.Unix()
+	}
+
+	if params.Coupon != nil || params.PromotionCode != nil {
+		d, err := p.discount(sub.ID, stripe.StringValue(params.Coupon), stripe.StringValue(params.PromotionCode), now)
+		if err != nil {
+			return nil, err
+		}
+		sub.Discount = d
+	}
+
+	p.subscriptions[sub.ID] = sub
+	p.remember("subscription", &params.Params, sub.ID)
+	out := *sub
+	return &out, nil
+}
+
+// discount redeems a coupon, given directly or through a promotion code, for
+// subscription subID.
+func (p *MemoryProvider) discount(subID, couponID, promoID string, now time.Time) (*stripe.Discount, error) {
+	if couponID != "" && promoID != "" {
+		return nil, invalidRequest("You may only specify one of these parameters: coupon, promotion_code.")
+	}
+
+	var promo *stripe.PromotionCode
+	if promoID != "" {
+		var ok bool
+		if promo, ok = p.promoCodes[promoID]; !ok {
+			return nil, notFound("promotion_code", promoID)
+		}
+		if !promo.Active || (promo.ExpiresAt != 0 && promo.ExpiresAt <= now.Unix()) {
+			return nil, invalidRequest(fmt.Sprintf("This promotion code cannot be redeemed: %s", promoID))
+		}
+		couponID = promo.Coupon.ID
+	}
+	coupon, ok := p.coupons[couponID]
+	if !ok {
+		return nil, notFound("coupon", couponID)
+	}
+	if !coupon.Valid {
+		return nil, invalidRequest(fmt.Sprintf("Coupon expired: %s", couponID))
+	}
+
+	d := &stripe.Discount{
+		ID:            p.newID("di"),
+		Object:        "discount",
+		Coupon:        coupon,
+		PromotionCode: promo,
+		Start:         now.Unix(),
+		Subscription:  subID,
+	}
+	if coupon.Duration == stripe.CouponDurationRepeating {
+		d.End = now.AddDate(0, int(coupon.DurationInMonths), 0).Unix()
+	}
+	coupon.TimesRedeemed++
+	if coupon.MaxRedemptions > 0 && coupon.TimesRedeemed >= coupon.MaxRedemptions {
+		coupon.Valid = false
+	}
+	if promo != nil {
+		promo.TimesRedeemed++
+		if promo.MaxRedemptions > 0 && promo.TimesRedeemed >= promo.MaxRedemptions {
+			promo.Active = false
+		}
+	}
+	return d, nil
+}
+
+func (p *MemoryProvider) ListPromotionCodes(ctx context.Context, params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var codes []*stripe.PromotionCode
+	for _, promo := range p.promoCodes {
+		if params.Code != nil && promo.Code != *params.Code {
+			continue
+		}
+		if params.Active != nil && promo.Active != *params.Active {
+			continue
+		}
+		out := *promo
+		codes = append(codes, &out)
+	}
+	return codes, nil
+}
+
+func (p *MemoryProvider) CancelSubscription(ctx context.Context, id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub, ok := p.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest(fmt.Sprintf("Subscription %s is already canceled.", id))
+	}
+
+	now := time.Now().Unix()
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = now
+	sub.EndedAt = now
+	out := *sub
+	return &out, nil
+}
+
+func (p *MemoryProvider) GetSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub, ok := p.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	out := *sub
+	return &out, nil
+}
+
+// planChange is a price swap on one subscription item.
+type planChange struct {
+	item      *stripe.SubscriptionItem
+	price     *stripe.Price
+	behavior  string
+	at        int64
+	newPeriod bool
+}
+
+func (p *MemoryProvider) planChange(sub *stripe.Subscription, itemID, priceID string, behavior *string, prorationDate *int64) (*planChange, error) {
+	change := &planChange{behavior: "create_prorations", at: time.Now().Unix()}
+	for _, it := range sub.Items.Data {
+		if it.ID == itemID {
+			change.item = it
+		}
+	}
+	if change.item == nil {
+		return nil, invalidRequest(fmt.Sprintf("Subscription item %s does not belong to subscription %s.", itemID, sub.ID))
+	}
+	pr, ok := p.prices[priceID]
+	if !ok {
+		return nil, notFound("price", priceID)
+	}
+	if pr.Recurring == nil {
+		return nil, invalidRequest(fmt.Sprintf("The price specified is set to `type=one_time` but this field only accepts prices with `type=recurring`: %s", pr.ID))
+	}
+	if !pr.Active {
+		return nil, invalidRequest(fmt.Sprintf("The price specified is inactive. This field only accepts active prices: %s", pr.ID))
+	}
+	if pr.Currency != change.item.Price.Currency {
+		return nil, invalidRequest("The price specified does not match the currency of the subscription.")
+	}
+	change.price = pr
+
+	if behavior != nil {
+		switch *behavior {
+		case "create_prorations", "always_invoice", "none":
+			change.behavior = *behavior
+		default:
+			return nil, invalidRequest(fmt.Sprintf("Invalid proration_behavior: %s", *behavior))
+		}
+	}
+	if prorationDate != nil {
+		if *prorationDate < sub.CurrentPeriodStart || *prorationDate > sub.CurrentPeriodEnd {
+			return nil, invalidRequest("The proration date must fall within the current billing period.")
+		}
+		change.at = *prorationDate
+	}
+	old := change.item.Price.Recurring
+	change.newPeriod = old.Interval != pr.Recurring.Interval || old.IntervalCount != pr.Recurring.IntervalCount
+	return change, nil
+}
+
+// prorations credits the unused time on the old price and, unless the
+// billing period restarts, charges the rest of the period at the new one.
+// Trials are not prorated.
+func prorations(sub *stripe.Subscription, change *planChange) []*stripe.InvoiceLineItem {
+	if change.behavior == "none" || sub.Status == stripe.SubscriptionStatusTrialing {
+		return nil
+	}
+	period := sub.CurrentPeriodEnd - sub.CurrentPeriodStart
+	remaining := sub.CurrentPeriodEnd - change.at
+	if period <= 0 || remaining <= 0 {
+		return nil
+	}
+
+	qty := change.item.Quantity
+	lines := []*stripe.InvoiceLineItem{{
+		Object:      "line_item",
+		Amount:      -change.item.Price.UnitAmount * qty * remaining / period,
+		Currency:    change.item.Price.Currency,
+		Description: "Unused time on " + change.item.Price.ID,
+		Period:      &stripe.Period{Start: change.at, End: sub.CurrentPeriodEnd},
+		Price:       change.item.Price,
+		Proration:   true,
+		Quantity:    qty,
+	}}
+	if !change.newPeriod {
+		lines = append(lines, &stripe.InvoiceLineItem{
+			Object:      "line_item",
+			Amount:      change.price.UnitAmount * qty * remaining / period,
+			Currency:    change.price.Currency,
+			Description: "Remaining time on " + change.price.ID,
+			Period:      &stripe.Period{Start: change.at, End: sub.CurrentPeriodEnd},
+			Price:       change.price,
+			Proration:   true,
+			Quantity:    qty,
+		})
+	}
+	return lines
+}
+
+func (p *MemoryProvider) UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub, ok := p.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest(fmt.Sprintf("A canceled subscription can only update its cancellation_details. (%s)", id))
+	}
+
+	if len(params.Items) > 0 && params.Items[0].Price != nil {
+		item := params.Items[0]
+		change, err := p.planChange(sub, stripe.StringValue(item.ID), *item.Price, params.ProrationBehavior, params.ProrationDate)
+		if err != nil {
+			return nil, err
+		}
+		change.item.Price = change.price
+		if change.newPeriod && sub.Status != stripe.SubscriptionStatusTrialing {
+			sub.CurrentPeriodStart = change.at
+			sub.CurrentPeriodEnd = periodEnd(time.Unix(change.at, 0), change.price.Recurring).Unix()
+		}
+	}
+	if params.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+		sub.CancelAt, sub.CanceledAt = 0, 0
+		if sub.CancelAtPeriodEnd {
+			sub.CancelAt, sub.CanceledAt = sub.CurrentPeriodEnd, time.Now().Unix()
+		}
+	}
+	// Resuming collection sends pause_collection empty.
+	if params.Extra != nil && params.Extra.Has("pause_collection") {
+		sub.PauseCollection = nil
+	}
+	if pc := params.PauseCollection; pc != nil {
+		switch stripe.SubscriptionPauseCollectionBehavior(stripe.StringValue(pc.Behavior)) {
+		case stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft, stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible, stripe.SubscriptionPauseCollectionBehaviorVoid:
+		default:
+			return nil, invalidRequest(fmt.Sprintf("Invalid pause_collection[behavior]: %s", stripe.StringValue(pc.Behavior)))
+		}
+		if pc.ResumesAt != nil && *pc.ResumesAt <= time.Now().Unix() {
+			return nil, invalidRequest("Invalid timestamp: must be in the future.")
+		}
+		sub.PauseCollection = &stripe.SubscriptionPauseCollection{
+			Behavior:  stripe.SubscriptionPauseCollectionBehavior(*pc.Behavior),
+			ResumesAt: stripe.Int64Value(pc.ResumesAt),
+		}
+	}
+	if params.DefaultPaymentMethod != nil {
+		sub.DefaultPaymentMethod = &stripe.PaymentMethod{ID: *params.DefaultPaymentMethod}
+	}
+
+	out := *sub
+	return &out, nil
+}
+
+func (p *MemoryProvider) UpcomingInvoice(ctx context.Context, params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	subID := stripe.StringValue(params.Subscription)
+	sub, ok := p.subscriptions[subID]
+	if !ok {
+		return nil, notFound("subscription", subID)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest(fmt.Sprintf("No upcoming invoices for customer: %s", sub.Customer.ID))
+	}
+
+	var change *planChange
+	if d := params.SubscriptionDetails; d != nil && len(d.Items) > 0 && d.Items[0].Price != nil {
+		var err error
+		change, err = p.planChange(sub, stripe.StringValue(d.Items[0].ID), *d.Items[0].Price, d.ProrationBehavior, d.ProrationDate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	inv := &stripe.Invoice{
+		Object:       "invoice",
+		Customer:     sub.Customer,
+		Subscription: sub,
+		Lines:        &stripe.InvoiceLineItemList{},
+		PeriodStart:  sub.CurrentPeriodStart,
+		PeriodEnd:    sub.CurrentPeriodEnd,
+		Status:       stripe.InvoiceStatusDraft,
+	}
+	next := sub.CurrentPeriodEnd
+	for _, it := range sub.Items.Data {
+		pr := it.Price
+		if change != nil && it == change.item {
+			inv.Lines.Data = append(inv.Lines.Data, prorations(sub, change)...)
+			pr = change.price
+			if change.newPeriod && sub.Status != stripe.SubscriptionStatusTrialing {
+				next = change.at
+			}
+		}
+		inv.Lines.Data = append(inv.Lines.Data, &stripe.InvoiceLineItem{
+			Object:      "line_item",
+			Amount:      pr.UnitAmount * it.Quantity,
+			Currency:    pr.Currency,
+			Description: fmt.Sprintf("%d × %s", it.Quantity, pr.ID),
+			Period:      &stripe.Period{Start: next, End: periodEnd(time.Unix(next, 0), pr.Recurring).Unix()},
+			Price:       pr,
+			Quantity:    it.Quantity,
+		})
+		inv.Currency = pr.Currency
+	}
+	for _, line := range inv.Lines.Data {
+		inv.Subtotal += line.Amount
+	}
+	inv.Total = inv.Subtotal
+	inv.AmountDue = max(inv.Total, 0)
+	inv.NextPaymentAttempt = next
+	return inv, nil
+}
+
+// SetPaymentIntentStatus moves a stored PaymentIntent to status, standing in
+// for the client-side confirmation that normally happens outside the gateway.
+// Use stripe.PaymentIntentStatusSucceeded for a successful confirmation; a
+// manual-capture intent then waits in requires_capture.
+func (p *MemoryProvider) SetPaymentIntentStatus(id string, status stripe.PaymentIntentStatus) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi, ok := p.intents[id]
+	if !ok {
+		return notFound("payment_intent", id)
+	}
+	if status == stripe.PaymentIntentStatusSucceeded {
+		settle(pi)
+		return nil
+	}
+	pi.Status = status
+	return nil
+}
+
+// AuthenticatePaymentIntent answers the 3-D Secure challenge of a
+// PaymentIntent in requires_action. A failed challenge sends it back to
+// requires_payment_method.
+func (p *MemoryProvider) AuthenticatePaymentIntent(id string, approve bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi, ok := p.intents[id]
+	if !ok {
+		return notFound("payment_intent", id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return unexpectedState(fmt.Sprintf("This PaymentIntent has a status of %s.", pi.Status))
+	}
+
+	pi.NextAction = nil
+	if approve {
+		settle(pi)
+		return nil
+	}
+	pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+	pi.LastPaymentError = &stripe.Error{
+		Type: stripe.ErrorTypeInvalidRequest,
+		Code: stripe.ErrorCodePaymentIntentAuthenticationFailure,
+		Msg:  "We are unable to authenticate your payment method.",
+	}
+	return nil
+}
+
+// ConfirmSetupIntent stands in for the customer entering card details for a
+// SetupIntent: it creates a test card PaymentMethod from paymentMethod and
+// attaches it to the SetupIntent's customer.
+func (p *MemoryProvider) ConfirmSetupIntent(id, paymentMethod string) (*stripe.PaymentMethod, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	si, ok := p.setupIntents[id]
+	if !ok {
+		return nil, notFound("setup_intent", id)
+	}
+	if si.Status != stripe.SetupIntentStatusRequiresPaymentMethod {
+		return nil, unexpectedState(fmt.Sprintf("This SetupIntent has a status of %s.", si.Status))
+	}
+
+	pm := testCard(p.newID("pm"), paymentMethod)
+	pm.Customer = si.Customer
+	p.methods[pm.ID] = pm
+	p.testCards[pm.ID] = paymentMethod
+	si.PaymentMethod = &stripe.PaymentMethod{ID: pm.ID}
+	si.Status = stripe.SetupIntentStatusSucceeded
+	out := *pm
+	return &out, nil
+}
+
+// AddCoupon stands in for creating a coupon in the Dashboard. Either
+// PercentOff or AmountOff with Currency is required; Duration defaults to
+// once.
+func (p *MemoryProvider) AddCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if (params.PercentOff == nil) == (params.AmountOff == nil) {
+		return nil, invalidRequest("You must pass exactly one of percent_off or amount_off.")
+	}
+	c := &stripe.Coupon{
+		ID:               stripe.StringValue(params.ID),
+		Object:           "coupon",
+		AmountOff:        stripe.Int64Value(params.AmountOff),
+		Created:          time.Now().Unix(),
+		Currency:         stripe.Currency(stripe.StringValue(params.Currency)),
+		Duration:         stripe.CouponDuration(stripe.StringValue(params.Duration)),
+		DurationInMonths: stripe.Int64Value(params.DurationInMonths),
+		MaxRedemptions:   stripe.Int64Value(params.MaxRedemptions),
+		Name:             stripe.StringValue(params.Name),
+		PercentOff:       stripe.Float64Value(params.PercentOff),
+		Valid:            true,
+	}
+	if c.ID == "" {
+		c.ID = p.newID("coupon")
+	}
+	if c.Duration == "" {
+		c.Duration = stripe.CouponDurationOnce
+	}
+	p.coupons[c.ID] = c
+	out := *c
+	return &out, nil
+}
+
+// AddPromotionCode stands in for creating a customer-facing promotion code
+// for an existing coupon in the Dashboard.
+func (p *MemoryProvider) AddPromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	coupon, ok := p.coupons[stripe.StringValue(params.Coupon)]
+	if !ok {
+		return nil, notFound("coupon", stripe.StringValue(params.Coupon))
+	}
+	promo := &stripe.PromotionCode{
+		ID:             p.newID("promo"),
+		Object:         "promotion_code",
+		Active:         true,
+		Code:           stripe.StringValue(params.Code),
+		Coupon:         coupon,
+		Created:        time.Now().Unix(),
+		ExpiresAt:      stripe.Int64Value(params.ExpiresAt),
+		MaxRedemptions: stripe.Int64Value(params.MaxRedemptions),
+	}
+	if params.Active != nil {
+		promo.Active = *params.Active
+	}
+	if promo.Code == "" {
+		promo.Code = strings.ToUpper(promo.ID)
+	}
+	p.promoCodes[promo.ID] = promo
+	out := *promo
+	return &out, nil
+}
+
+// CompleteCheckoutSession stands in for the customer paying on the hosted
+// Checkout page with the test card paymentMethod: it creates and settles the
+// session's PaymentIntent and marks the session complete.
+func (p *MemoryProvider) CompleteCheckoutSession(id, paymentMethod string) (*stripe.CheckoutSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cs, ok := p.sessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	if cs.Status != stripe.CheckoutSessionStatusOpen {
+		return nil, invalidRequest(fmt.Sprintf("This Checkout Session has a status of %s.", cs.Status))
+	}
+	if err := p.complete(cs, paymentMethod); err != nil {
+		return nil, err
+	}
+	out := *cs
+	return &out, nil
+}
+
+// PayPaymentLink stands in for a customer named name opening the payment link
+// id and paying with the test card paymentMethod, like
+// CompleteCheckoutSession. A new customer is created for them, and the link
+// is deactivated once its completed-sessions limit is reached.
+func (p *MemoryProvider) PayPaymentLink(id, name, email, paymentMethod string) (*stripe.CheckoutSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pl, ok := p.links[id]
+	if !ok {
+		return nil, notFound("payment_link", id)
+	}
+	if !pl.Active {
+		return nil, invalidRequest(fmt.Sprintf("The payment link %s is no longer active.", id))
+	}
+
+	cus := &stripe.Customer{ID: p.newID("cus"), Object: "customer", Created: time.Now().Unix(), Name: name, Email: email}
+	p.customers[cus.ID] = cus
+
+	csID := p.newID("cs")
+	cs := &stripe.CheckoutSession{
+		ID:                 csID,
+		Object:             "checkout.session",
+		Created:            time.Now().Unix(),
+		Currency:           pl.Currency,
+		Customer:           &stripe.Customer{ID: cus.ID},
+		CustomerDetails:    &stripe.CheckoutSessionCustomerDetails{Name: name, Email: email},
+		Metadata:           pl.Metadata,
+		Mode:               stripe.CheckoutSessionModePayment,
+		PaymentLink:        &stripe.PaymentLink{ID: id},
+		PaymentMethodTypes: []string{"card"},
+		PaymentStatus:      stripe.CheckoutSessionPaymentStatusUnpaid,
+		Status:             stripe.CheckoutSessionStatusOpen,
+	}
+	for _, li := range pl.LineItems.Data {
+		cs.AmountTotal += li.AmountTotal
+	}
+	cs.AmountSubtotal = cs.AmountTotal
+	p.sessions[csID] = cs
+
+	if err := p.complete(cs, paymentMethod); err != nil {
+		return nil, err
+	}
+	if limit := pl.Restrictions; limit != nil && limit.CompletedSessions != nil {
+		limit.CompletedSessions.Count++
+		if limit.CompletedSessions.Limit > 0 && limit.CompletedSessions.Count >= limit.CompletedSessions.Limit {
+			pl.Active = false
+		}
+	}
+	out := *cs
+	return &out, nil
+}
+
+// complete pays the open session cs with paymentMethod.
+func (p *MemoryProvider) complete(cs *stripe.CheckoutSession, paymentMethod string) error {
+	piID := p.newID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:                 piID,
+		Object:             "payment_intent",
+		Amount:             cs.AmountTotal,
+		Currency:           cs.Currency,
+		CaptureMethod:      stripe.PaymentIntentCaptureMethodAutomatic,
+		ClientSecret:       piID + "_secret",
+		Created:            time.Now().Unix(),
+		Customer:           cs.Customer,
+		PaymentMethod:      &stripe.PaymentMethod{ID: paymentMethod},
+		PaymentMethodTypes: []string{"card"},
+	}
+	if strings.Contains(p.cardName(paymentMethod), "fail") {
+		pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		p.intents[piID] = pi
+		cs.PaymentIntent = &stripe.PaymentIntent{ID: piID}
+		return &stripe.Error{
+			Type:           stripe.ErrorTypeCard,
+			Code:           stripe.ErrorCodeCardDeclined,
+			DeclineCode:    stripe.DeclineCodeGenericDecline,
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Msg:            "Your card was declined.",
+		}
+	}
+	settle(pi)
+	p.intents[piID] = pi
+
+	cs.PaymentIntent = &stripe.PaymentIntent{ID: piID}
+	cs.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	cs.Status = stripe.CheckoutSessionStatusComplete
+	cs.URL = ""
+	return nil
+}
+
+// cardName is the test card name behind a payment method ID: the ID itself
+// for test tokens such as pm_card_visa, or the name a saved card was created
+// from.
+func (p *MemoryProvider) cardName(id string) string {
+	if name, ok := p.testCards[id]; ok {
+		return name
+	}
+	return id
+}
+
+// requiresAuthentication reports whether a test card asks for 3-D Secure.
+func requiresAuthentication(name string) bool {
+	return strings.Contains(name, "threeDSecure") || strings.Contains(name, "authenticationRequired")
+}
+
+// testCard builds a card PaymentMethod like the one Stripe creates for the
+// test token name, e.g. pm_card_mastercard. Cards from the same token share a
+// fingerprint.
+func testCard(id, name string) *stripe.PaymentMethod {
+	card := &stripe.PaymentMethodCard{Brand: stripe.PaymentMethodCardBrandVisa, Last4: "4242", ExpMonth: 12, ExpYear: int64(time.Now().Year() + 3)}
+	switch {
+	case strings.Contains(name, "mastercard"):
+		card.Brand, card.Last4 = stripe.PaymentMethodCardBrandMastercard, "4444"
+	case strings.Contains(name, "amex"):
+		card.Brand, card.Last4 = stripe.PaymentMethodCardBrandAmex, "8431"
+	}
+	card.Fingerprint = "fp_" + name
+
+	return &stripe.PaymentMethod{
+		ID:      id,
+		Object:  "payment_method",
+		Created: time.Now().Unix(),
+		Type:    stripe.PaymentMethodTypeCard,
+		Card:    card,
+	}
+}
+
+// periodEnd is when a billing period of r starting at start ends.
+func periodEnd(start time.Time, r *stripe.PriceRecurring) time.Time {
+	n := int(r.IntervalCount)
+	switch r.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		return start.AddDate(0, 0, n)
+	case stripe.PriceRecurringIntervalWeek:
+		return start.AddDate(0, 0, 7*n)
+	case stripe.PriceRecurringIntervalYear:
+		return start.AddDate(n, 0, 0)
+	}
+	return start.AddDate(0, n, 0)
+}
+
+// settle completes a confirmed PaymentIntent: automatic ones are captured in
+// full, manual ones are authorized and left for CapturePaymentIntent.
+func settle(pi *stripe.PaymentIntent) {
+	if pi.CaptureMethod == stripe.PaymentIntentCaptureMethodManual {
+		pi.Status = stripe.PaymentIntentStatusRequiresCapture
+		pi.AmountCapturable = pi.Amount
+		return
+	}
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = pi.Amount
+}
+
+// SetRefundStatus moves a stored Refund to status, standing in for the bank
+// settling (or bouncing) a refund after it was created.
+func (p *MemoryProvider) SetRefundStatus(id string, status stripe.RefundStatus) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	re, ok := p.refunds[id]
+	if !ok {
+		return notFound("refund", id)
+	}
+	re.Status = status
+	return nil
+}
@@ -0,0 +1,148 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+var _ PaymentProvider = (*MemoryProvider)(nil)
+
+// stripeError returns the *stripe.Error in err, failing the test if there is
+// none.
+func stripeError(t *testing.T, err error) *stripe.Error {
+	t.Helper()
+
+	var se *stripe.Error
+	if !errors.As(err, &se) {
+		t.Fatalf("got error %v, want a *stripe.Error", err)
+	}
+	return se
+}
+
+func TestMemoryPaymentIntentLifecycle(t *testing.T) {
+	ctx := context.Background()
+	p := NewMemoryProvider()
+
+	_, err := p.CreatePaymentIntent(ctx, &stripe.PaymentIntentParams{Currency: stripe.String("usd")})
+	if se := stripeError(t, err); se.HTTPStatusCode != http.StatusBadRequest {
+		t.Fatalf("missing amount: got %+v, want a 400", se)
+	}
+
+	pi, err := p.CreatePaymentIntent(ctx, &stripe.PaymentIntentParams{Amount: stripe.Int64(1000), Currency: stripe.String("usd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresPaymentMethod || pi.ClientSecret == "" || pi.Amount != 1000 {
+		t.Fatalf("got %+v, want a new intent awaiting a payment method", pi)
+	}
+
+	if err := p.SetPaymentIntentStatus(pi.ID, stripe.PaymentIntentStatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.GetPaymentIntent(ctx, pi.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != stripe.PaymentIntentStatusSucceeded || got.AmountReceived != 1000 {
+		t.Fatalf("got %+v, want succeeded with 1000 received", got)
+	}
+
+	_, err = p.CancelPaymentIntent(ctx, pi.ID, nil)
+	if se := stripeError(t, err); se.Code != stripe.ErrorCodePaymentIntentUnexpectedState {
+		t.Fatalf("canceling a succeeded intent: got %+v", se)
+	}
+
+	other, err := p.CreatePaymentIntent(ctx, &stripe.PaymentIntentParams{Amount: stripe.Int64(500), Currency: stripe.String("usd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceled, err := p.CancelPaymentIntent(ctx, other.ID, &stripe.PaymentIntentCancelParams{CancellationReason: stripe.String("abandoned")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Status != stripe.PaymentIntentStatusCanceled || canceled.CancellationReason != stripe.PaymentIntentCancellationReasonAbandoned {
+		t.Fatalf("got %+v, want canceled as abandoned", canceled)
+	}
+
+	_, err = p.GetPaymentIntent(ctx, "pi_missing", nil)
+	if se := stripeError(t, err); se.HTTPStatusCode != http.StatusNotFound || se.Code != stripe.ErrorCodeResourceMissing {
+		t.Fatalf("missing intent: got %+v, want resource_missing", se)
+	}
+}
+
+func TestMemoryRefundRequiresSucceededIntent(t *testing.T) {
+	ctx := context.Background()
+	p := NewMemoryProvider()
+
+	pi, err := p.CreatePaymentIntent(ctx, &stripe.PaymentIntentParams{Amount: stripe.Int64(1000), Currency: stripe.String("usd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.CreateRefund(ctx, &stripe.RefundParams{PaymentIntent: stripe.String(pi.ID)})
+	if se := stripeError(t, err); se.HTTPStatusCode != http.StatusBadRequest {
+		t.Fatalf("refunding an unpaid intent: got %+v, want a 400", se)
+	}
+
+	if err := p.SetPaymentIntentStatus(pi.ID, stripe.PaymentIntentStatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	re, err := p.CreateRefund(ctx, &stripe.RefundParams{PaymentIntent: stripe.String(pi.ID), Amount: stripe.Int64(400)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.Amount != 400 || re.Currency != "usd" || re.PaymentIntent.ID != pi.ID {
+		t.Fatalf("got %+v, want 400 usd refunded from %s", re, pi.ID)
+	}
+}
+
+func TestMemorySubscriptions(t *testing.T) {
+	ctx := context.Background()
+	p := NewMemoryProvider()
+
+	cus, err := p.CreateCustomer(ctx, &stripe.CustomerParams{Name: stripe.String("Ada"), Email: stripe.String("ada@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cus.ID == "" || cus.Email != "ada@example.com" {
+		t.Fatalf("got customer %+v", cus)
+	}
+
+	price, err := p.CreatePrice(ctx, &stripe.PriceParams{
+		Currency:    stripe.String("usd"),
+		UnitAmount:  stripe.Int64(999),
+		ProductData: &stripe.PriceProductDataParams{Name: stripe.String("Basic")},
+		Recurring:   &stripe.PriceRecurringParams{Interval: stripe.String("month")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := []*stripe.SubscriptionItemsParams{{Price: stripe.String(price.ID)}}
+	_, err = p.CreateSubscription(ctx, &stripe.SubscriptionParams{Items: items})
+	if se := stripeError(t, err); se.HTTPStatusCode != http.StatusBadRequest {
+		t.Fatalf("missing customer: got %+v, want a 400", se)
+	}
+
+	sub, err := p.CreateSubscription(ctx, &stripe.SubscriptionParams{Customer: stripe.String(cus.ID), Items: items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive || sub.Customer.ID != cus.ID {
+		t.Fatalf("got %+v, want an active subscription for %s", sub, cus.ID)
+	}
+
+	canceled, err := p.CancelSubscription(ctx, sub.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Status != stripe.SubscriptionStatusCanceled || canceled.EndedAt == 0 {
+		t.Fatalf("got %+v, want canceled and ended", canceled)
+	}
+	if _, err := p.CancelSubscription(ctx, sub.ID, nil); err == nil {
+		t.Fatal("canceling twice succeeded")
+	}
+}
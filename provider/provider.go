@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+// PaymentProvider is the set of remote payment operations the gateway relies
+// on. Handlers talk to it instead of calling the Stripe packages directly so
+// the backend can be swapped out, e.g. for the in-memory fake in tests.
+type PaymentProvider interface {
+	CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	GetPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	ConfirmPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error)
+	CapturePaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error)
+	CancelPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error)
+	CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error)
+	CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error)
+	UpdateCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	CreateSetupIntent(ctx context.Context, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error)
+	DetachPaymentMethod(ctx context.Context, id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error)
+	CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	ExpireCheckoutSession(ctx context.Context, id string, params *stripe.CheckoutSessionExpireParams) (*stripe.CheckoutSession, error)
+	CreateProduct(ctx context.Context, params *stripe.ProductParams) (*stripe.Product, error)
+	UpdateProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error)
+	CreatePrice(ctx context.Context, params *stripe.PriceParams) (*stripe.Price, error)
+	GetPrice(ctx context.Context, id string, params *stripe.PriceParams) (*stripe.Price, error)
+	UpdatePrice(ctx context.Context, id string, params *stripe.PriceParams) (*stripe.Price, error)
+	ListPromotionCodes(ctx context.Context, params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error)
+	CreatePaymentLink(ctx context.Context, params *stripe.PaymentLinkParams) (*stripe.PaymentLink, error)
+	UpdatePaymentLink(ctx context.Context, id string, params *stripe.PaymentLinkParams) (*stripe.PaymentLink, error)
+	CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(ctx context.Context, id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error)
+	UpcomingInvoice(ctx context.Context, params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error)
+}
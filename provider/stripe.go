@@ -0,0 +1,220 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/checkout/session"
+	"github.com/stripe/stripe-go/v78/customer"
+	"github.com/stripe/stripe-go/v78/invoice"
+	"github.com/stripe/stripe-go/v78/paymentintent"
+	"github.com/stripe/stripe-go/v78/paymentlink"
+	"github.com/stripe/stripe-go/v78/paymentmethod"
+	"github.com/stripe/stripe-go/v78/price"
+	"github.com/stripe/stripe-go/v78/product"
+	"github.com/stripe/stripe-go/v78/promotioncode"
+	"github.com/stripe/stripe-go/v78/refund"
+	"github.com/stripe/stripe-go/v78/setupintent"
+	"github.com/stripe/stripe-go/v78/subscription"
+)
+
+// StripeProvider implements PaymentProvider against the Stripe API.
+type StripeProvider struct {
+	key     string
+	timeout time.Duration
+}
+
+// NewStripeProvider returns a provider authenticating with key. Each API call
+// is bounded by timeout on top of the caller's context; zero means no extra
+// deadline.
+func NewStripeProvider(key string, timeout time.Duration) *StripeProvider {
+	return &StripeProvider{
+		key:     key,
+		timeout: timeout,
+	}
+}
+
+// backend is resolved on every call so a backend installed with
+// stripe.SetBackend after construction is still picked up.
+func (p *StripeProvider) backend() stripe.Backend {
+	return stripe.GetBackend(stripe.APIBackend)
+}
+
+// bind attaches a deadline-bounded ctx to params.
+func (p *StripeProvider) bind(ctx context.Context, params *stripe.Params) context.CancelFunc {
+	var cancel context.CancelFunc
+	if p.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	params.Context = ctx
+	return cancel
+}
+
+func (p *StripeProvider) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	defer p.bind(ctx, &params.Params)()
+	return paymentintent.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) GetPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return paymentintent.Client{B: p.backend(), Key: p.key}.Get(id, params)
+}
+
+func (p *StripeProvider) ConfirmPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentConfirmParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return paymentintent.Client{B: p.backend(), Key: p.key}.Confirm(id, params)
+}
+
+func (p *StripeProvider) CapturePaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentCaptureParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return paymentintent.Client{B: p.backend(), Key: p.key}.Capture(id, params)
+}
+
+func (p *StripeProvider) CancelPaymentIntent(ctx context.Context, id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	if params == nil {
+		params = &stripe.PaymentIntentCancelParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return paymentintent.Client{B: p.backend(), Key: p.key}.Cancel(id, params)
+}
+
+func (p *StripeProvider) CreateRefund(ctx context.Context, params *stripe.RefundParams) (*stripe.Refund, error) {
+	defer p.bind(ctx, &params.Params)()
+	return refund.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	defer p.bind(ctx, &params.Params)()
+	return customer.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) UpdateCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	defer p.bind(ctx, &params.Params)()
+	return customer.Client{B: p.backend(), Key: p.key}.Update(id, params)
+}
+
+func (p *StripeProvider) CreateSetupIntent(ctx context.Context, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	defer p.bind(ctx, &params.Params)()
+	return setupintent.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) DetachPaymentMethod(ctx context.Context, id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	if params == nil {
+		params = &stripe.PaymentMethodDetachParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return paymentmethod.Client{B: p.backend(), Key: p.key}.Detach(id, params)
+}
+
+func (p *StripeProvider) CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	defer p.bind(ctx, &params.Params)()
+	return session.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) ExpireCheckoutSession(ctx context.Context, id string, params *stripe.CheckoutSessionExpireParams) (*stripe.CheckoutSession, error) {
+	if params == nil {
+		params = &stripe.CheckoutSessionExpireParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return session.Client{B: p.backend(), Key: p.key}.Expire(id, params)
+}
+
+func (p *StripeProvider) CreateProduct(ctx context.Context, params *stripe.ProductParams) (*stripe.Product, error) {
+	defer p.bind(ctx, &params.Params)()
+	return product.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) UpdateProduct(ctx context.Context, id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	defer p.bind(ctx, &params.Params)()
+	return product.Client{B: p.backend(), Key: p.key}.Update(id, params)
+}
+
+func (p *StripeProvider) CreatePrice(ctx context.Context, params *stripe.PriceParams) (*stripe.Price, error) {
+	defer p.bind(ctx, &params.Params)()
+	return price.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) GetPrice(ctx context.Context, id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	if params == nil {
+		params = &stripe.PriceParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return price.Client{B: p.backend(), Key: p.key}.Get(id, params)
+}
+
+func (p *StripeProvider) UpdatePrice(ctx context.Context, id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	defer p.bind(ctx, &params.Params)()
+	return price.Client{B: p.backend(), Key: p.key}.Update(id, params)
+}
+
+// ListPromotionCodes returns every promotion code matching params, following
+// pagination.
+func (p *StripeProvider) ListPromotionCodes(ctx context.Context, params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	var cancel context.CancelFunc
+	if p.timeout > 0 {
+		params.Context, cancel = context.WithTimeout(ctx, p.timeout)
+	} else {
+		params.Context, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	var codes []*stripe.PromotionCode
+	it := promotioncode.Client{B: p.backend(), Key: p.key}.List(params)
+	for it.Next() {
+		codes = append(codes, it.PromotionCode())
+	}
+	return codes, it.Err()
+}
+
+func (p *StripeProvider) CreatePaymentLink(ctx context.Context, params *stripe.PaymentLinkParams) (*stripe.PaymentLink, error) {
+	defer p.bind(ctx, &params.Params)()
+	return paymentlink.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) UpdatePaymentLink(ctx context.Context, id string, params *stripe.PaymentLinkParams) (*stripe.PaymentLink, error) {
+	defer p.bind(ctx, &params.Params)()
+	return paymentlink.Client{B: p.backend(), Key: p.key}.Update(id, params)
+}
+
+func (p *StripeProvider) CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	defer p.bind(ctx, &params.Params)()
+	return subscription.Client{B: p.backend(), Key: p.key}.New(params)
+}
+
+func (p *StripeProvider) GetSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	if params == nil {
+		params = &stripe.SubscriptionParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return subscription.Client{B: p.backend(), Key: p.key}.Get(id, params)
+}
+
+func (p *StripeProvider) UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	defer p.bind(ctx, &params.Params)()
+	return subscription.Client{B: p.backend(), Key: p.key}.Update(id, params)
+}
+
+func (p *StripeProvider) CancelSubscription(ctx context.Context, id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	if params == nil {
+		params = &stripe.SubscriptionCancelParams{}
+	}
+	defer p.bind(ctx, &params.Params)()
+	return subscription.Client{B: p.backend(), Key: p.key}.Cancel(id, params)
+}
+
+func (p *StripeProvider) UpcomingInvoice(ctx context.Context, params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	defer p.bind(ctx, &params.Params)()
+	return invoice.Client{B: p.backend(), Key: p.key}.Upcoming(params)
+}
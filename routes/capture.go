@@ -0,0 +1,165 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// voidReasons are the cancellation reasons Stripe accepts for a PaymentIntent.
+var voidReasons = []stripe.PaymentIntentCancellationReason{
+	stripe.PaymentIntentCancellationReasonAbandoned,
+	stripe.PaymentIntentCancellationReasonDuplicate,
+	stripe.PaymentIntentCancellationReasonFraudulent,
+	stripe.PaymentIntentCancellationReasonRequestedByCustomer,
+}
+
+// HandleCapturePayment captures an authorized manual-capture payment. An
+// amount below the authorized one captures part of it and releases the rest;
+// leaving it out captures everything.
+func (s *APIServer) HandleCapturePayment(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		PaymentIntentID string `json:"paymentIntentID"`
+		Amount          int64  `json:"amount"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.PaymentIntentID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "PaymentIntent ID is required"})
+	}
+	if request.Amount < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Capture amount must be positive"})
+	}
+
+	p, err := s.storage.GetPaymentDetails(ctx, request.PaymentIntentID)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Payment not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment details"})
+	}
+
+	if p.CaptureMethod != models.CaptureManual {
+		return c.Status(409).JSON(fiber.Map{"error": "Payment was not created for manual capture"})
+	}
+	if p.AmountCaptured > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Payment has already been captured"})
+	}
+	// Until Stripe reports the authorization there is nothing to capture.
+	if p.Status != models.PaymentAuthorized {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Payment is %s and cannot be captured", p.Status)})
+	}
+	if p.AuthorizationExpiresAt != nil && time.Now().After(*p.AuthorizationExpiresAt) {
+		return c.Status(409).JSON(fiber.Map{"error": "Authorization has expired"})
+	}
+
+	authorized := p.AmountAuthorized
+	if authorized == 0 {
+		authorized = p.Amount
+	}
+	if request.Amount > authorized {
+		return c.Status(400).JSON(fiber.Map{
+			"error":      "Capture amount exceeds authorized amount",
+			"authorized": authorized,
+		})
+	}
+
+	params := &stripe.PaymentIntentCaptureParams{}
+	if request.Amount > 0 {
+		params.AmountToCapture = stripe.Int64(request.Amount)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+	result, err := s.provider.CapturePaymentIntent(ctx, request.PaymentIntentID, params)
+	if err != nil {
+		log.Println("Capture error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Capture failed"})
+	}
+
+	err = s.storage.WithTx(ctx, func(tx models.Storage) error {
+		if err := tx.RecordCapture(ctx, p.StripePaymentID, result.AmountReceived); err != nil {
+			return err
+		}
+		return tx.UpdatePaymentStatus(ctx, p.StripePaymentID, models.PaymentSucceeded)
+	})
+	if err != nil {
+		log.Println("Failed to persist payment capture:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":         "Payment captured",
+		"payment_intent":  result.ID,
+		"amount_captured": result.AmountReceived,
+		"status":          result.Status,
+	})
+}
+
+// HandleVoidPayment releases the authorization on a payment that has not
+// been captured, so the customer is never charged.
+func (s *APIServer) HandleVoidPayment(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		PaymentIntentID string `json:"paymentIntentID"`
+		Reason          string `json:"reason"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.PaymentIntentID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "PaymentIntent ID is required"})
+	}
+	if request.Reason != "" && !slices.Contains(voidReasons, stripe.PaymentIntentCancellationReason(request.Reason)) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid void reason"})
+	}
+
+	p, err := s.storage.GetPaymentDetails(ctx, request.PaymentIntentID)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Payment not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment details"})
+	}
+
+	if p.CaptureMethod != models.CaptureManual {
+		return c.Status(409).JSON(fiber.Map{"error": "Payment was not created for manual capture"})
+	}
+	if !p.Status.CanTransitionTo(models.PaymentCanceled) {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Payment is %s and cannot be voided", p.Status)})
+	}
+
+	params := &stripe.PaymentIntentCancelParams{}
+	if request.Reason != "" {
+		params.CancellationReason = stripe.String(request.Reason)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+	result, err := s.provider.CancelPaymentIntent(ctx, request.PaymentIntentID, params)
+	if err != nil {
+		log.Println("Void error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Void failed"})
+	}
+
+	if err := s.storage.UpdatePaymentStatus(ctx, p.StripePaymentID, models.PaymentCanceled); err != nil {
+		log.Println("Failed to persist payment void:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Authorization voided",
+		"payment_intent": result.ID,
+		"status":         result.Status,
+	})
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// authorize creates a manual-capture payment and confirms it, leaving the
+// provider's intent in requires_capture and the payment authorized.
+func authorize(t *testing.T, ts *testServer, email string, amount int64) string {
+	t.Helper()
+
+	id, _ := ts.createPayment(email, amount, models.CaptureManual)
+	if err := ts.memory.SetPaymentIntentStatus(id, stripe.PaymentIntentStatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+
+	pi := intentObject(id, "requires_capture", amount)
+	pi["amount_received"], pi["amount_capturable"] = 0, amount
+	ts.deliver("payment_intent.amount_capturable_updated", time.Now(), pi)
+	ts.processWebhooks()
+	if p := ts.payment(id); p.Status != models.PaymentAuthorized {
+		t.Fatalf("got status %s, want authorized", p.Status)
+	}
+	return id
+}
+
+func TestPartialCapture(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id := authorize(t, ts, "ada@example.com", 1000)
+
+	ts.expect(409, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+
+	out := ts.expect(400, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id, "amount": 2000})
+	if out["authorized"] != float64(1000) {
+		t.Fatalf("got %v, want the authorized amount reported", out)
+	}
+	ts.expect(400, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id, "amount": -1})
+
+	out = ts.expect(200, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id, "amount": 600})
+	if out["amount_captured"] != float64(600) {
+		t.Fatalf("got %v", out)
+	}
+	p := ts.payment(id)
+	if p.Status != models.PaymentSucceeded || p.AmountCaptured != 600 || p.CapturedAmount() != 600 {
+		t.Fatalf("got status %s with %d captured, want success with 600", p.Status, p.AmountCaptured)
+	}
+	ts.expect(409, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id})
+
+	// Only the captured amount can be refunded.
+	out = ts.expect(400, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 700})
+	if out["remaining"] != float64(600) {
+		t.Fatalf("got %v, want 600 remaining", out)
+	}
+	out = ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	if out["amount"] != float64(600) || out["remaining"] != float64(0) {
+		t.Fatalf("got %v, want the 600 captured refunded", out)
+	}
+	ts.expect(409, "POST", "/payment/void", fiber.Map{"paymentIntentID": id})
+}
+
+func TestCaptureRequiresManualPayment(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	ts.expect(409, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id})
+	ts.expect(400, "POST", "/payment/capture", fiber.Map{})
+	ts.expect(404, "POST", "/payment/capture", fiber.Map{"paymentIntentID": "pi_missing"})
+}
+
+func TestCaptureRequiresAuthorization(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, models.CaptureManual)
+
+	// The customer has not confirmed yet, so nothing is authorized.
+	ts.expect(409, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id})
+	if p := ts.payment(id); p.Status != models.PaymentPending || p.AmountCaptured != 0 {
+		t.Fatalf("got status %s with %d captured, want pending with nothing", p.Status, p.AmountCaptured)
+	}
+}
+
+func TestVoidAuthorization(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+	id := authorize(t, ts, "ada@example.com", 500)
+
+	ts.expect(400, "POST", "/payment/void", fiber.Map{"paymentIntentID": id, "reason": "nope"})
+	ts.expect(404, "POST", "/payment/void", fiber.Map{"paymentIntentID": "pi_missing"})
+
+	out := ts.expect(200, "POST", "/payment/void", fiber.Map{"paymentIntentID": id, "reason": "abandoned"})
+	if out["status"] != string(stripe.PaymentIntentStatusCanceled) {
+		t.Fatalf("got %v", out)
+	}
+	if got := ts.payment(id).Status; got != models.PaymentCanceled {
+		t.Fatalf("got status %s, want canceled", got)
+	}
+	pi, err := p.GetPaymentIntent(context.Background(), id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.CancellationReason != stripe.PaymentIntentCancellationReasonAbandoned {
+		t.Fatalf("got cancellation reason %q, want abandoned", pi.CancellationReason)
+	}
+	ts.expect(409, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id})
+}
@@ -0,0 +1,381 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// Catalog products and prices are created on Stripe first and mirrored
+// locally through the outbox, like every other remote object. Prices are
+// found by a code of our choosing, which is also their Stripe lookup key.
+// Neither can be deleted once used, so DELETE archives them. Since
+// subscriptions are billed from these prices, changing the catalog takes the
+// admin token; reading it does not.
+
+func (s *APIServer) HandleCreateProduct(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+	}
+
+	params := &stripe.ProductParams{Name: stripe.String(request.Name)}
+	if request.Description != "" {
+		params.Description = stripe.String(request.Description)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.CreateProduct(ctx, params)
+	if err != nil {
+		log.Println("Product creation error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Product creation failed"})
+	}
+
+	rec := productRecord{ProductID: result.ID, Name: result.Name, Description: result.Description}
+	outboxID, err := s.recordRemote(ctx, models.OutboxProduct, result.ID, rec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store product"})
+	}
+
+	if err := s.persistProduct(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist product, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store product"})
+	}
+
+	product, err := s.storage.GetProductByStripeID(ctx, result.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve product"})
+	}
+	return c.JSON(product)
+}
+
+// HandleListProducts lists the catalog, each product with its prices.
+func (s *APIServer) HandleListProducts(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	products, err := s.storage.ListProducts(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve products"})
+	}
+	prices, err := s.storage.ListPrices(ctx, 0)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve prices"})
+	}
+
+	byProduct := make(map[uint][]*models.Price)
+	for _, p := range prices {
+		byProduct[p.ProductID] = append(byProduct[p.ProductID], p)
+	}
+	out := make([]fiber.Map, 0, len(products))
+	for _, p := range products {
+		out = append(out, fiber.Map{"product": p, "prices": byProduct[p.ID]})
+	}
+
+	return c.JSON(fiber.Map{"products": out})
+}
+
+func (s *APIServer) HandleGetProduct(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	product, ok, err := s.lookupProduct(c)
+	if !ok {
+		return err
+	}
+
+	prices, err := s.storage.ListPrices(ctx, product.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve prices"})
+	}
+
+	return c.JSON(fiber.Map{"product": product, "prices": prices})
+}
+
+// HandleUpdateProduct changes a product's name, description or active flag
+// on Stripe and then locally.
+func (s *APIServer) HandleUpdateProduct(c *fiber.Ctx) error {
+	var request struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Active      *bool   `json:"active"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.Name != nil && *request.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name must not be empty"})
+	}
+
+	product, ok, err := s.lookupProduct(c)
+	if !ok {
+		return err
+	}
+	if request.Name != nil {
+		product.Name = *request.Name
+	}
+	if request.Description != nil {
+		product.Description = *request.Description
+	}
+	if request.Active != nil {
+		product.Active = *request.Active
+	}
+
+	return s.syncProduct(c, product)
+}
+
+// HandleArchiveProduct deactivates a product so it can no longer be
+// subscribed to. Existing subscriptions are untouched.
+func (s *APIServer) HandleArchiveProduct(c *fiber.Ctx) error {
+	product, ok, err := s.lookupProduct(c)
+	if !ok {
+		return err
+	}
+	product.Active = false
+
+	return s.syncProduct(c, product)
+}
+
+// syncProduct writes product to Stripe and then to the products table.
+func (s *APIServer) syncProduct(c *fiber.Ctx, product *models.Product) error {
+	ctx := c.UserContext()
+
+	params := &stripe.ProductParams{
+		Name:        stripe.String(product.Name),
+		Description: stripe.String(product.Description),
+		Active:      stripe.Bool(product.Active),
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	if _, err := s.provider.UpdateProduct(ctx, product.StripeProductID, params); err != nil {
+		log.Println("Product update error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Product update failed"})
+	}
+
+	if err := s.storage.UpdateProduct(ctx, product); err != nil {
+		log.Println("Failed to update product:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store product"})
+	}
+
+	return c.JSON(product)
+}
+
+// lookupProduct loads the product named by the :id parameter, answering the
+// request itself when that fails.
+func (s *APIServer) lookupProduct(c *fiber.Ctx) (*models.Product, bool, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Invalid product ID"})
+	}
+
+	product, err := s.storage.GetProduct(c.UserContext(), uint(id))
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, false, c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+	}
+	if err != nil {
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve product"})
+	}
+	return product, true, nil
+}
+
+// HandleCreatePrice adds a price to a product. Leaving out interval makes a
+// one-time price, which cannot be used for subscriptions.
+func (s *APIServer) HandleCreatePrice(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		ProductID     uint   `json:"product_id"`
+		Code          string `json:"code"`
+		UnitAmount    int64  `json:"unit_amount"`
+		Currency      string `json:"currency"`
+		Interval      string `json:"interval"`
+		IntervalCount int64  `json:"interval_count"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.ProductID == 0 || request.Code == "" || request.Currency == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "product_id, code and currency are required"})
+	}
+	if request.UnitAmount <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "unit_amount must be positive"})
+	}
+	switch stripe.PriceRecurringInterval(request.Interval) {
+	case "":
+		if request.IntervalCount != 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "interval_count needs an interval"})
+		}
+	case stripe.PriceRecurringIntervalDay, stripe.PriceRecurringIntervalWeek,
+		stripe.PriceRecurringIntervalMonth, stripe.PriceRecurringIntervalYear:
+		if request.IntervalCount == 0 {
+			request.IntervalCount = 1
+		}
+		if request.IntervalCount < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "interval_count must be positive"})
+		}
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "interval must be day, week, month or year"})
+	}
+
+	product, err := s.storage.GetProduct(ctx, request.ProductID)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve product"})
+	}
+	if !product.Active {
+		return c.Status(409).JSON(fiber.Map{"error": "Product is archived"})
+	}
+
+	if _, err := s.storage.GetPriceByCode(ctx, request.Code); err == nil {
+		return c.Status(409).JSON(fiber.Map{"error": "A price with this code already exists"})
+	} else if !errors.Is(err, models.ErrNotFound) {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve price"})
+	}
+
+	params := &stripe.PriceParams{
+		Product:    stripe.String(product.StripeProductID),
+		Currency:   stripe.String(request.Currency),
+		UnitAmount: stripe.Int64(request.UnitAmount),
+		LookupKey:  stripe.String(request.Code),
+	}
+	if request.Interval != "" {
+		params.Recurring = &stripe.PriceRecurringParams{
+			Interval:      stripe.String(request.Interval),
+			IntervalCount: stripe.Int64(request.IntervalCount),
+		}
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.CreatePrice(ctx, params)
+	if err != nil {
+		log.Println("Price creation error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Price creation failed"})
+	}
+
+	rec := priceRecord{ProductID: product.ID, PriceID: result.ID, Code: request.Code, UnitAmount: result.UnitAmount, Currency: string(result.Currency), Interval: request.Interval, IntervalCount: request.IntervalCount}
+	outboxID, err := s.recordRemote(ctx, models.OutboxPrice, result.ID, rec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store price"})
+	}
+
+	if err := s.persistPrice(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist price, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store price"})
+	}
+
+	price, err := s.storage.GetPriceByStripeID(ctx, result.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve price"})
+	}
+	return c.JSON(price)
+}
+
+// HandleListPrices lists every price, or only those of ?product_id.
+func (s *APIServer) HandleListPrices(c *fiber.Ctx) error {
+	var productID uint64
+	if v := c.Query("product_id"); v != "" {
+		var err error
+		if productID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid product ID"})
+		}
+	}
+
+	prices, err := s.storage.ListPrices(c.UserContext(), uint(productID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve prices"})
+	}
+
+	return c.JSON(fiber.Map{"prices": prices})
+}
+
+func (s *APIServer) HandleGetPrice(c *fiber.Ctx) error {
+	price, ok, err := s.lookupPrice(c)
+	if !ok {
+		return err
+	}
+	return c.JSON(price)
+}
+
+// HandleUpdatePrice switches a price on or off. Amounts and intervals are
+// fixed on Stripe, so changing them means creating a new price.
+func (s *APIServer) HandleUpdatePrice(c *fiber.Ctx) error {
+	var request struct {
+		Active *bool `json:"active"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.Active == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "active is required; create a new price to change amounts"})
+	}
+
+	price, ok, err := s.lookupPrice(c)
+	if !ok {
+		return err
+	}
+
+	return s.syncPriceActive(c, price, *request.Active)
+}
+
+// HandleArchivePrice deactivates a price so no new subscriptions use it.
+func (s *APIServer) HandleArchivePrice(c *fiber.Ctx) error {
+	price, ok, err := s.lookupPrice(c)
+	if !ok {
+		return err
+	}
+
+	return s.syncPriceActive(c, price, false)
+}
+
+func (s *APIServer) syncPriceActive(c *fiber.Ctx, price *models.Price, active bool) error {
+	ctx := c.UserContext()
+
+	params := &stripe.PriceParams{Active: stripe.Bool(active)}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	if _, err := s.provider.UpdatePrice(ctx, price.StripePriceID, params); err != nil {
+		log.Println("Price update error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Price update failed"})
+	}
+
+	if err := s.storage.SetPriceActive(ctx, price.StripePriceID, active); err != nil {
+		log.Println("Failed to update price:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store price"})
+	}
+
+	price.Active = active
+	return c.JSON(price)
+}
+
+// lookupPrice loads the price named by the :code parameter, answering the
+// request itself when that fails.
+func (s *APIServer) lookupPrice(c *fiber.Ctx) (*models.Price, bool, error) {
+	price, err := s.storage.GetPriceByCode(c.UserContext(), c.Params("code"))
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, false, c.Status(404).JSON(fiber.Map{"error": "Price not found"})
+	}
+	if err != nil {
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve price"})
+	}
+	return price, true, nil
+}
@@ -0,0 +1,173 @@
+package routes
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// createProduct adds a product to the catalog and returns its ID.
+func createProduct(t *testing.T, ts *testServer, name string) uint {
+	t.Helper()
+
+	out := ts.expectAdmin(200, "POST", "/catalog/products", fiber.Map{"name": name})
+	return uint(out["id"].(float64))
+}
+
+// createPrice adds a price under code to a product; interval is empty for a
+// one-time price.
+func createPrice(t *testing.T, ts *testServer, productID uint, code string, amount int64, currency, interval string) {
+	t.Helper()
+
+	body := fiber.Map{"product_id": productID, "code": code, "unit_amount": amount, "currency": currency}
+	if interval != "" {
+		body["interval"] = interval
+	}
+	ts.expectAdmin(200, "POST", "/catalog/prices", body)
+}
+
+// priceCodes lists the codes of the prices GET path answers with.
+func (ts *testServer) priceCodes(path string) []string {
+	ts.t.Helper()
+
+	var out struct {
+		Prices []models.Price `json:"prices"`
+	}
+	ts.get(path, &out)
+	var codes []string
+	for _, p := range out.Prices {
+		codes = append(codes, p.Code)
+	}
+	return codes
+}
+
+func TestCatalogProductsAndPrices(t *testing.T) {
+	ts := newStripeTestServer(t)
+	productID := createProduct(t, ts, "Pro")
+	createPrice(t, ts, productID, "pro-monthly", 1500, "usd", "month")
+	createPrice(t, ts, productID, "pro-setup", 5000, "usd", "")
+
+	ts.expectAdmin(409, "POST", "/catalog/prices", fiber.Map{"product_id": productID, "code": "pro-monthly", "unit_amount": 1500, "currency": "usd", "interval": "month"})
+	ts.expectAdmin(400, "POST", "/catalog/prices", fiber.Map{"product_id": productID, "code": "pro-fortnightly", "unit_amount": 5000, "currency": "usd", "interval": "fortnight"})
+
+	want := []string{"pro-monthly", "pro-setup"}
+	if got := ts.priceCodes(fmt.Sprintf("/catalog/prices?product_id=%d", productID)); !slices.Equal(got, want) {
+		t.Fatalf("got prices %v, want %v", got, want)
+	}
+	var price models.Price
+	ts.get("/catalog/prices/pro-monthly", &price)
+	if price.UnitAmount != 1500 || price.Interval != "month" || price.IntervalCount != 1 || !price.Active {
+		t.Fatalf("got price %+v, want 1500 a month", price)
+	}
+
+	out := ts.expectAdmin(200, "PATCH", fmt.Sprintf("/catalog/products/%d", productID), fiber.Map{"name": "Pro Plus"})
+	if out["name"] != "Pro Plus" {
+		t.Fatalf("got %v", out)
+	}
+
+	// Archiving a product and reactivating a price reach storage again
+	// through Stripe's webhooks without undoing each other.
+	ts.expectAdmin(200, "DELETE", "/catalog/prices/pro-monthly", nil)
+	ts.expectAdmin(200, "PATCH", "/catalog/prices/pro-monthly", fiber.Map{"active": true})
+	ts.expectAdmin(200, "DELETE", fmt.Sprintf("/catalog/products/%d", productID), nil)
+	ts.sync()
+
+	var detail struct {
+		Product models.Product `json:"product"`
+		Prices  []models.Price `json:"prices"`
+	}
+	ts.get(fmt.Sprintf("/catalog/products/%d", productID), &detail)
+	if detail.Product.Name != "Pro Plus" || detail.Product.Active || len(detail.Prices) != 2 || !detail.Prices[0].Active {
+		t.Fatalf("got %+v, want Pro Plus archived with pro-monthly active", detail)
+	}
+}
+
+func TestSubscribeToCatalogPrice(t *testing.T) {
+	ts := newStripeTestServer(t)
+	productID := createProduct(t, ts, "Pro")
+	createPrice(t, ts, productID, "pro-monthly", 1500, "usd", "month")
+	createPrice(t, ts, productID, "pro-setup", 5000, "usd", "")
+
+	userID, visa := setupCard(t, ts, "ada@example.com", "pm_card_visa")
+	out := ts.expect(409, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro-monthly"})
+	if out["error"] != "Customer has no default payment method" {
+		t.Fatalf("got %v", out)
+	}
+	ts.sync()
+	ts.expect(200, "POST", "/customer/payment-methods/default", fiber.Map{"customer_id": userID, "payment_method": visa})
+
+	ts.expect(400, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro-setup"})
+	ts.expect(404, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "nope"})
+
+	out = ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro-monthly"})
+	sub := ts.subscription(out["subscription_id"].(string))
+	if sub.Status != models.SubscriptionActive || sub.Amount != 1500 || sub.UserID != userID {
+		t.Fatalf("got subscription %+v, want active at 1500", sub)
+	}
+	remote, _ := ts.stripe.Subscription(sub.StripeSubscriptionID)
+	if item := remote.Items.Data[0]; item.Price.UnitAmount != 1500 || item.Price.Recurring.Interval != "month" {
+		t.Fatalf("got Stripe item %+v, want the catalog price", item.Price)
+	}
+
+	ts.expectAdmin(200, "DELETE", "/catalog/prices/pro-monthly", nil)
+	out = ts.expect(409, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro-monthly"})
+	if out["error"] != "Price is archived" {
+		t.Fatalf("got %v", out)
+	}
+	ts.expectAdmin(200, "PATCH", "/catalog/prices/pro-monthly", fiber.Map{"active": true})
+	ts.expectAdmin(200, "DELETE", fmt.Sprintf("/catalog/products/%d", productID), nil)
+	out = ts.expect(409, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro-monthly"})
+	if out["error"] != "Product is archived" {
+		t.Fatalf("got %v", out)
+	}
+}
+
+func TestCatalogWritesRequireAdminToken(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	productID := createProduct(t, ts, "Pro")
+	createPrice(t, ts, productID, "pro-monthly", 1500, "usd", "month")
+
+	for _, r := range []struct {
+		method, path string
+		body         fiber.Map
+	}{
+		{"POST", "/catalog/products", fiber.Map{"name": "Free"}},
+		{"PATCH", fmt.Sprintf("/catalog/products/%d", productID), fiber.Map{"name": "Pro Plus"}},
+		{"DELETE", fmt.Sprintf("/catalog/products/%d", productID), nil},
+		{"POST", "/catalog/prices", fiber.Map{"product_id": productID, "code": "pro-cheap", "unit_amount": 1, "currency": "usd", "interval": "month"}},
+		{"PATCH", "/catalog/prices/pro-monthly", fiber.Map{"active": false}},
+		{"DELETE", "/catalog/prices/pro-monthly", nil},
+	} {
+		ts.expect(401, r.method, r.path, r.body)
+	}
+
+	// Reads stay public, and nothing above went through.
+	var price models.Price
+	ts.get("/catalog/prices/pro-monthly", &price)
+	if !price.Active {
+		t.Fatal("price archived without the admin token")
+	}
+	if got := ts.priceCodes("/catalog/prices"); !slices.Equal(got, []string{"pro-monthly"}) {
+		t.Fatalf("got prices %v, want only pro-monthly", got)
+	}
+}
+
+func TestCatalogWithMemoryProvider(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	productID := createProduct(t, ts, "Pro")
+	createPrice(t, ts, productID, "pro-yearly", 15000, "usd", "year")
+
+	var out struct {
+		Products []struct {
+			Product models.Product `json:"product"`
+			Prices  []models.Price `json:"prices"`
+		} `json:"products"`
+	}
+	ts.get("/catalog/products", &out)
+	if len(out.Products) != 1 || len(out.Products[0].Prices) != 1 || out.Products[0].Prices[0].Interval != "year" {
+		t.Fatalf("got %+v, want Pro with a yearly price", out)
+	}
+}
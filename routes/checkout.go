@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"log"
+	"net/url"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// checkoutLineItem is one product line on a hosted Checkout page. Amount is
+// the unit price in the smallest currency unit.
+type checkoutLineItem struct {
+	Name     string `json:"name"`
+	Amount   int64  `json:"amount"`
+	Quantity int64  `json:"quantity"`
+}
+
+// HandleCreateCheckoutSession starts a hosted Stripe Checkout page for the
+// given line items and returns its URL. The customer pays on Stripe's page;
+// the payment is recorded when checkout.session.completed arrives.
+func (s *APIServer) HandleCreateCheckoutSession(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		Name       string             `json:"name"`
+		Email      string             `json:"email"`
+		Currency   string             `json:"currency"`
+		LineItems  []checkoutLineItem `json:"line_items"`
+		SuccessURL string             `json:"success_url"`
+		CancelURL  string             `json:"cancel_url"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.Name == "" || request.Email == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name and email are required"})
+	}
+	if request.Currency == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "currency is required"})
+	}
+	if len(request.LineItems) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "line_items are required"})
+	}
+	for _, raw := range []string{request.SuccessURL, request.CancelURL} {
+		if u, err := url.Parse(raw); err != nil || !u.IsAbs() {
+			return c.Status(400).JSON(fiber.Map{"error": "success_url and cancel_url must be absolute URLs"})
+		}
+	}
+
+	var lineItems []*stripe.CheckoutSessionLineItemParams
+	for _, li := range request.LineItems {
+		if li.Quantity == 0 {
+			li.Quantity = 1
+		}
+		if li.Name == "" || li.Amount <= 0 || li.Quantity < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Each line item needs a name, a positive amount and quantity"})
+		}
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency:    stripe.String(request.Currency),
+				UnitAmount:  stripe.Int64(li.Amount),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{Name: stripe.String(li.Name)},
+			},
+			Quantity: stripe.Int64(li.Quantity),
+		})
+	}
+
+	stripeID, userID, err := s.HandleCreateCustomer(ctx, request.Name, request.Email, idempotencyKey(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create or retrieve user"})
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Customer:           stripe.String(stripeID),
+		LineItems:          lineItems,
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		SuccessURL:         stripe.String(request.SuccessURL),
+		CancelURL:          stripe.String(request.CancelURL),
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.CreateCheckoutSession(ctx, params)
+	if err != nil {
+		log.Println("Checkout Session error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Checkout failed"})
+	}
+
+	rec := checkoutSessionRecord{UserID: userID, AmountTotal: result.AmountTotal, Currency: string(result.Currency), SessionID: result.ID, URL: result.URL}
+	outboxID, err := s.recordRemote(ctx, models.OutboxCheckoutSession, result.ID, rec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store checkout session"})
+	}
+
+	if err := s.persistCheckoutSession(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist checkout session, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store checkout session"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Checkout session created",
+		"checkout_session": result.ID,
+		"url":              result.URL,
+		"expires_at":       result.ExpiresAt,
+		"customer_id":      userID,
+	})
+}
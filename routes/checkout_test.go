@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// openCheckout starts a Checkout Session for a 3500 cent cart and returns
+// its ID along with the customer's user ID.
+func openCheckout(t *testing.T, ts *testServer) (string, uint) {
+	t.Helper()
+
+	out := ts.expect(200, "POST", "/checkout/session", fiber.Map{
+		"name": "Test", "email": "ada@example.com", "currency": "usd",
+		"line_items":  []fiber.Map{{"name": "Shirt", "amount": 1500, "quantity": 2}, {"name": "Hat", "amount": 500}},
+		"success_url": "https://shop.example/success", "cancel_url": "https://shop.example/cancel",
+	})
+	return out["checkout_session"].(string), uint(out["customer_id"].(float64))
+}
+
+// checkoutSession returns the stored Checkout Session with the given ID.
+func (ts *testServer) checkoutSession(id string) *models.CheckoutSession {
+	ts.t.Helper()
+
+	cs, err := ts.storage.GetCheckoutSession(context.Background(), id)
+	if err != nil {
+		ts.t.Fatalf("checkout session %s: %v", id, err)
+	}
+	return cs
+}
+
+func TestCompletedCheckoutRecordsPayment(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, userID := openCheckout(t, ts)
+
+	if _, err := ts.stripe.CompleteCheckoutSession(id, "pm_card_chargeDeclined_fail"); err == nil {
+		t.Fatal("declined card completed the session")
+	}
+	cs, err := ts.stripe.CompleteCheckoutSession(id, "pm_card_threeDSecure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+
+	local := ts.checkoutSession(id)
+	if local.Status != models.CheckoutSessionComplete || local.PaymentID == nil || local.AmountTotal != 3500 {
+		t.Fatalf("got session %+v, want complete with a payment of 3500", local)
+	}
+	p := ts.payment(cs.PaymentIntent.ID)
+	if p.ID != *local.PaymentID || p.Status != models.PaymentSucceeded || p.AmountCaptured != 3500 {
+		t.Fatalf("got payment %+v, want the session's, succeeded with 3500 captured", p)
+	}
+	if got, want := ts.ledger(userID), []string{"payment 3500"}; !slices.Equal(got, want) {
+		t.Fatalf("got ledger %v, want %v", got, want)
+	}
+
+	// The declined attempt's events, replayed now that the payment exists,
+	// cannot move it back.
+	report, err := ts.srv.ReplayWebhookEvents(context.Background(), models.WebhookEventFilter{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 0 {
+		t.Fatalf("got replay changes %+v, want none", report.Changes)
+	}
+}
+
+func TestExpiredCheckoutRecordsNoPayment(t *testing.T) {
+	ts := newStripeTestServer(t)
+	attempted, userID := openCheckout(t, ts)
+	abandoned, _ := openCheckout(t, ts)
+
+	if _, err := ts.stripe.CompleteCheckoutSession(attempted, "pm_card_fail"); err == nil {
+		t.Fatal("failing card completed the session")
+	}
+	cs, err := ts.stripe.ExpireCheckoutSession(attempted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.PaymentIntent == nil {
+		t.Fatal("no PaymentIntent for the failed attempt")
+	}
+	if _, err := ts.stripe.ExpireCheckoutSession(abandoned); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+
+	for _, id := range []string{attempted, abandoned} {
+		if local := ts.checkoutSession(id); local.Status != models.CheckoutSessionExpired || local.PaymentID != nil {
+			t.Fatalf("got session %+v, want expired without a payment", local)
+		}
+	}
+	if _, err := ts.storage.GetPaymentDetails(context.Background(), cs.PaymentIntent.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("got %v looking up the failed attempt, want no payment stored", err)
+	}
+	if got := ts.ledger(userID); len(got) != 0 {
+		t.Fatalf("got ledger %v, want nothing recorded", got)
+	}
+}
+
+func TestCheckoutSessionRejectsInvalidRequest(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	ts.expect(400, "POST", "/checkout/session", fiber.Map{
+		"name": "Test", "email": "ada@example.com", "currency": "usd", "line_items": []fiber.Map{},
+		"success_url": "https://shop.example/success", "cancel_url": "https://shop.example/cancel",
+	})
+	ts.expect(400, "POST", "/checkout/session", fiber.Map{
+		"name": "Test", "email": "ada@example.com", "currency": "usd", "line_items": []fiber.Map{{"name": "Hat", "amount": 1}},
+		"success_url": "/success", "cancel_url": "https://shop.example/cancel",
+	})
+}
+
+func TestCheckoutWithMemoryProvider(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+	id, _ := openCheckout(t, ts)
+
+	cs, err := p.CompleteCheckoutSession(id, "pm_card_visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Status != "complete" || cs.PaymentStatus != "paid" || cs.PaymentIntent == nil {
+		t.Fatalf("got session %+v, want it paid", cs)
+	}
+
+	// Without webhooks the gateway still has the session open.
+	if local := ts.checkoutSession(id); local.Status != models.CheckoutSessionOpen || local.AmountTotal != 3500 {
+		t.Fatalf("got session %+v, want open for 3500", local)
+	}
+}
@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// intentStatuses maps the status a PaymentIntent is left in after
+// confirmation to the local payment status. requires_payment_method means the
+// attempt was declined or failed authentication.
+var intentStatuses = map[stripe.PaymentIntentStatus]models.PaymentStatus{
+	stripe.PaymentIntentStatusRequiresAction:        models.PaymentRequiresAction,
+	stripe.PaymentIntentStatusProcessing:            models.PaymentProcessing,
+	stripe.PaymentIntentStatusRequiresCapture:       models.PaymentAuthorized,
+	stripe.PaymentIntentStatusSucceeded:             models.PaymentSucceeded,
+	stripe.PaymentIntentStatusRequiresPaymentMethod: models.PaymentFailed,
+	stripe.PaymentIntentStatusCanceled:              models.PaymentCanceled,
+}
+
+// HandleConfirmPayment confirms a PaymentIntent server-side with the given
+// payment method. When the bank asks for 3-D Secure the response carries a
+// next_action for the client to complete; the outcome then arrives by webhook.
+func (s *APIServer) HandleConfirmPayment(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		PaymentIntentID string `json:"paymentIntentID"`
+		PaymentMethod   string `json:"payment_method"`
+		ReturnURL       string `json:"return_url"`
+		UseStripeSDK    bool   `json:"use_stripe_sdk"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.PaymentIntentID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "PaymentIntent ID is required"})
+	}
+	if request.PaymentMethod == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "payment_method is required"})
+	}
+	if request.ReturnURL != "" {
+		if u, err := url.Parse(request.ReturnURL); err != nil || !u.IsAbs() {
+			return c.Status(400).JSON(fiber.Map{"error": "return_url must be an absolute URL"})
+		}
+	}
+
+	p, err := s.storage.GetPaymentDetails(ctx, request.PaymentIntentID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment details"})
+	}
+
+	if !p.Status.CanTransitionTo(models.PaymentRequiresAction) {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Payment is %s and cannot be confirmed", p.Status)})
+	}
+
+	params := &stripe.PaymentIntentConfirmParams{
+		PaymentMethod: stripe.String(request.PaymentMethod),
+	}
+	if request.ReturnURL != "" {
+		params.ReturnURL = stripe.String(request.ReturnURL)
+	}
+	if request.UseStripeSDK {
+		params.UseStripeSDK = stripe.Bool(true)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.ConfirmPaymentIntent(ctx, request.PaymentIntentID, params)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+		log.Printf("Payment %s declined: %s", p.StripePaymentID, stripeErr.Msg)
+		declined := &stripe.PaymentIntent{ID: p.StripePaymentID, Status: stripe.PaymentIntentStatusRequiresPaymentMethod}
+		if err := s.recordConfirmation(ctx, declined); err != nil {
+			log.Println("Failed to persist payment decline:", err)
+		}
+		return c.Status(402).JSON(fiber.Map{
+			"error":        stripeErr.Msg,
+			"code":         stripeErr.Code,
+			"decline_code": stripeErr.DeclineCode,
+		})
+	}
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodePaymentIntentUnexpectedState {
+		return c.Status(409).JSON(fiber.Map{"error": stripeErr.Msg})
+	}
+	if err != nil {
+		log.Println("Confirmation error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Confirmation failed"})
+	}
+
+	if err := s.recordConfirmation(ctx, result); err != nil {
+		log.Println("Failed to persist payment confirmation:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
+	}
+
+	message := "Payment confirmed"
+	if result.Status == stripe.PaymentIntentStatusRequiresAction {
+		message = "Customer action required"
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        message,
+		"payment_intent": result.ID,
+		"status":         result.Status,
+		"next_action":    nextAction(result),
+	})
+}
+
+// recordConfirmation moves the payment to the status pi was confirmed into.
+// Webhooks for the same intent may have got there first; like them, a
+// confirmation never undoes progress already recorded.
+func (s *APIServer) recordConfirmation(ctx context.Context, pi *stripe.PaymentIntent) error {
+	status, ok := intentStatuses[pi.Status]
+	if !ok {
+		return nil
+	}
+
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		outcome, err := updatePaymentFromEvent(ctx, tx, pi.ID, status)
+		if err != nil || outcome != models.WebhookProcessed {
+			return err
+		}
+		return recordIntentAmounts(ctx, tx, pi, status, time.Now().Unix())
+	})
+}
+
+// nextAction flattens what the customer has to do next into a shape clients
+// can switch on: "redirect" carries the URL to send the customer to and
+// "use_stripe_sdk" means handing the client secret to Stripe.js or a mobile
+// SDK. Other action types are passed through by name.
+func nextAction(pi *stripe.PaymentIntent) fiber.Map {
+	if pi.NextAction == nil {
+		return nil
+	}
+
+	switch pi.NextAction.Type {
+	case stripe.PaymentIntentNextActionTypeRedirectToURL:
+		if r := pi.NextAction.RedirectToURL; r != nil {
+			return fiber.Map{"type": "redirect", "url": r.URL, "return_url": r.ReturnURL}
+		}
+	case stripe.PaymentIntentNextActionTypeUseStripeSDK:
+		return fiber.Map{"type": "use_stripe_sdk", "client_secret": pi.ClientSecret}
+	}
+	return fiber.Map{"type": string(pi.NextAction.Type)}
+}
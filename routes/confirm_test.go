@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestConfirmWithRedirectAuthentication(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	out := ts.expect(200, "POST", "/payment/confirm", fiber.Map{
+		"paymentIntentID": id, "payment_method": "pm_card_threeDSecure2Required", "return_url": "https://shop.example/done",
+	})
+	next, _ := out["next_action"].(map[string]interface{})
+	if out["status"] != "requires_action" || next["type"] != "redirect" || next["return_url"] != "https://shop.example/done" || next["url"] == "" {
+		t.Fatalf("got %v, want a redirect to authenticate", out)
+	}
+	if got := ts.payment(id).Status; got != models.PaymentRequiresAction {
+		t.Fatalf("got status %s, want requires_action", got)
+	}
+
+	if _, err := ts.stripe.AuthenticatePaymentIntent(id, true); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	if p := ts.payment(id); p.Status != models.PaymentSucceeded || p.AmountCaptured != 1000 {
+		t.Fatalf("got status %s with %d captured, want success with 1000", p.Status, p.AmountCaptured)
+	}
+}
+
+func TestConfirmAfterFailedAuthentication(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	out := ts.expect(200, "POST", "/payment/confirm", fiber.Map{
+		"paymentIntentID": id, "payment_method": "pm_card_threeDSecure2Required", "use_stripe_sdk": true,
+	})
+	next, _ := out["next_action"].(map[string]interface{})
+	if next["type"] != "use_stripe_sdk" || next["client_secret"] == nil {
+		t.Fatalf("got %v, want the client to authenticate with the SDK", out)
+	}
+	if _, err := ts.stripe.AuthenticatePaymentIntent(id, false); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	if got := ts.payment(id).Status; got != models.PaymentFailed {
+		t.Fatalf("got status %s after failed authentication, want failed", got)
+	}
+
+	out = ts.expect(402, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": "pm_card_fail"})
+	if out["code"] != "card_declined" || out["decline_code"] != "generic_decline" {
+		t.Fatalf("got %v, want a card decline", out)
+	}
+	if got := ts.payment(id).Status; got != models.PaymentFailed {
+		t.Fatalf("got status %s after decline, want failed", got)
+	}
+
+	// Another card goes through; the decline's late event cannot undo it.
+	out = ts.expect(200, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": "pm_card_visa"})
+	if out["status"] != "succeeded" || out["next_action"] != nil {
+		t.Fatalf("got %v", out)
+	}
+	ts.sync()
+	if p := ts.payment(id); p.Status != models.PaymentSucceeded || p.AmountCaptured != 1000 {
+		t.Fatalf("got status %s with %d captured, want success with 1000", p.Status, p.AmountCaptured)
+	}
+
+	ts.expect(409, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": "pm_card_visa"})
+	ts.expect(400, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": "pm_card_visa", "return_url": "nope"})
+}
+
+func TestConfirmManualCaptureAuthorizes(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, models.CaptureManual)
+
+	out := ts.expect(200, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": "pm_card_visa"})
+	if out["status"] != "requires_capture" {
+		t.Fatalf("got %v", out)
+	}
+	ts.sync()
+
+	p := ts.payment(id)
+	if p.Status != models.PaymentAuthorized || p.AmountAuthorized != 1000 {
+		t.Fatalf("got status %s with %d authorized, want authorized with 1000", p.Status, p.AmountAuthorized)
+	}
+	if p.AuthorizationExpiresAt == nil || p.AuthorizationExpiresAt.Before(time.Now().Add(6*24*time.Hour)) {
+		t.Fatalf("got authorization expiry %v, want about a week out", p.AuthorizationExpiresAt)
+	}
+	if got, want := ts.history("payment", id), []string{"pending", "authorized"}; !slices.Equal(got, want) {
+		t.Fatalf("got history %v, want %v", got, want)
+	}
+}
+
+func TestConfirmWithMemoryProvider(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	out := ts.expect(200, "POST", "/payment/confirm", fiber.Map{
+		"paymentIntentID": id, "payment_method": "pm_card_threeDSecure2Required", "return_url": "myapp://done",
+	})
+	if next, _ := out["next_action"].(map[string]interface{}); next["return_url"] != "myapp://done" {
+		t.Fatalf("got %v, want an app return URL accepted", out)
+	}
+
+	// Once authenticated the intent has gone through at the provider.
+	if err := p.AuthenticatePaymentIntent(id, true); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(409, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": "pm_card_fail"})
+}
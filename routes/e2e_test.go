@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestPaymentSucceedsAndIsRefundedThroughWebhooks(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, userID := ts.createPayment("ada@example.com", 1000, "")
+
+	if _, err := ts.stripe.ConfirmPaymentIntent(id, "pm_card_visa"); err != nil {
+		t.Fatal(err)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentPending {
+		t.Fatalf("got status %s before the webhook, want pending", p.Status)
+	}
+	ts.sync()
+	if p := ts.payment(id); p.Status != models.PaymentSucceeded {
+		t.Fatalf("got status %s after payment_intent.succeeded, want success", p.Status)
+	}
+
+	out := ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 400})
+	partial, _ := out["refund_id"].(string)
+	if out["remaining"] != float64(600) {
+		t.Fatalf("got %v", out)
+	}
+	out = ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	if out["amount"] != float64(600) || out["remaining"] != float64(0) {
+		t.Fatalf("got %v", out)
+	}
+	ts.sync()
+
+	p := ts.payment(id)
+	if p.Status != models.PaymentRefunded || p.AmountRefunded != 1000 {
+		t.Fatalf("got status %s with %d refunded, want refunded with 1000", p.Status, p.AmountRefunded)
+	}
+	r, err := ts.storage.GetRefundDetails(context.Background(), partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != models.RefundSucceeded || r.Amount != 400 {
+		t.Fatalf("got refund %+v", r)
+	}
+
+	ts.expect(409, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+
+	want := []string{"pending", "success", "partially_refunded", "refunded"}
+	if got := ts.history("payment", id); !slices.Equal(got, want) {
+		t.Fatalf("got history %v, want %v", got, want)
+	}
+	want = []string{"payment 1000", "refund 400", "refund 600"}
+	if got := ts.ledger(userID); !slices.Equal(got, want) {
+		t.Fatalf("got ledger %v, want %v", got, want)
+	}
+}
+
+func TestPaymentFailsThroughWebhooks(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	if _, err := ts.stripe.ConfirmPaymentIntent(id, "pm_card_fail"); err == nil {
+		t.Fatal("confirming with a failing payment method succeeded")
+	}
+	ts.sync()
+	if p := ts.payment(id); p.Status != models.PaymentFailed {
+		t.Fatalf("got status %s after payment_intent.payment_failed, want failed", p.Status)
+	}
+}
+
+func TestWebhookRequiresValidSignature(t *testing.T) {
+	ts := newStripeTestServer(t)
+	ts.createPayment("ada@example.com", 1000, "")
+
+	event := ts.stripe.Events()[0]
+	payload, header, err := ts.stripe.SignedPayload(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := ts.request("POST", "/payment/webhook", nil, nil)
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("unsigned: got %d, want 401", status)
+	}
+
+	req, err := http.NewRequest("POST", "/payment/webhook", bytes.NewReader(append(payload, ' ')))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Stripe-Signature", header)
+	resp, err := ts.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("tampered: got %d, want 401", resp.StatusCode)
+	}
+
+	if err := ts.stripe.DeliverWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.storage.GetWebhookEvent(context.Background(), event.ID); err != nil {
+		t.Fatalf("signed event was not queued: %v", err)
+	}
+}
+
+func TestManualCaptureThroughWebhooks(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, models.CaptureManual)
+
+	if _, err := ts.stripe.ConfirmPaymentIntent(id, "pm_card_visa"); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	p := ts.payment(id)
+	if p.Status != models.PaymentAuthorized || p.AmountAuthorized != 1000 || p.AuthorizationExpiresAt == nil {
+		t.Fatalf("got payment %+v, want an authorization of 1000", p)
+	}
+
+	out := ts.expect(200, "POST", "/payment/capture", fiber.Map{"paymentIntentID": id, "amount": 700})
+	if out["amount_captured"] != float64(700) {
+		t.Fatalf("got %v", out)
+	}
+	ts.sync()
+	if p := ts.payment(id); p.Status != models.PaymentSucceeded || p.AmountCaptured != 700 {
+		t.Fatalf("got status %s with %d captured, want success with 700", p.Status, p.AmountCaptured)
+	}
+
+	out = ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	if out["amount"] != float64(700) {
+		t.Fatalf("refund: got %v, want the captured 700", out)
+	}
+	ts.sync()
+
+	// Replaying the whole history must not move the payment back.
+	ts.expectAdmin(200, "POST", "/admin/webhooks/replay", fiber.Map{"dry_run": false})
+	p = ts.payment(id)
+	if p.Status != models.PaymentRefunded || p.AmountCaptured != 700 || p.AmountRefunded != 700 {
+		t.Fatalf("got payment %+v after replay", p)
+	}
+
+	want := []string{"pending", "authorized", "success", "refunded"}
+	if got := ts.history("payment", id); !slices.Equal(got, want) {
+		t.Fatalf("got history %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,635 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// paymentIntentStatuses maps PaymentIntent events to the payment status they
+// set.
+var paymentIntentStatuses = map[stripe.EventType]models.PaymentStatus{
+	"payment_intent.succeeded":       models.PaymentSucceeded,
+	"payment_intent.payment_failed":  models.PaymentFailed,
+	"payment_intent.canceled":        models.PaymentCanceled,
+	"payment_intent.processing":      models.PaymentProcessing,
+	"payment_intent.requires_action": models.PaymentRequiresAction,
+	// Sent when a manual-capture intent is authorized and waits for capture.
+	"payment_intent.amount_capturable_updated": models.PaymentAuthorized,
+}
+
+// cardAuthorizationWindow is how long Stripe holds an uncaptured card
+// authorization when the charge does not say otherwise.
+const cardAuthorizationWindow = 7 * 24 * time.Hour
+
+// applyWebhookEvent updates local state for event and reports the outcome.
+// Events for objects the gateway does not know about are ignored.
+func applyWebhookEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	switch event.Type {
+	case "payment_intent.succeeded", "payment_intent.payment_failed", "payment_intent.canceled",
+		"payment_intent.processing", "payment_intent.requires_action", "payment_intent.amount_capturable_updated":
+		return applyPaymentIntentEvent(ctx, tx, event)
+
+	case "charge.captured", "charge.expired":
+		return applyChargeCaptureEvent(ctx, tx, event)
+
+	case "charge.refunded":
+		return applyChargeRefunded(ctx, tx, event)
+
+	case "refund.updated", "charge.refund.updated":
+		return applyRefundUpdated(ctx, tx, event)
+
+	case "charge.dispute.created", "charge.dispute.updated", "charge.dispute.closed",
+		"charge.dispute.funds_withdrawn", "charge.dispute.funds_reinstated":
+		return applyDisputeEvent(ctx, tx, event)
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		return applySubscriptionEvent(ctx, tx, event)
+
+	case "customer.subscription.trial_will_end":
+		return applyTrialWillEnd(ctx, tx, event)
+
+	case "invoice.paid", "invoice.payment_failed":
+		return applyInvoiceEvent(ctx, tx, event)
+
+	case "checkout.session.completed", "checkout.session.expired":
+		return applyCheckoutSessionEvent(ctx, tx, event)
+
+	case "payment_link.updated":
+		return applyPaymentLinkUpdated(ctx, tx, event)
+
+	case "payment_method.attached", "payment_method.updated", "payment_method.automatically_updated", "payment_method.detached":
+		return applyPaymentMethodEvent(ctx, tx, event)
+
+	case "customer.updated":
+		return applyCustomerUpdated(ctx, tx, event)
+
+	case "product.updated", "product.deleted":
+		return applyProductEvent(ctx, tx, event)
+
+	case "price.updated", "price.deleted":
+		return applyPriceEvent(ctx, tx, event)
+
+	default:
+		log.Printf("Unhandled event type: %s", event.Type)
+		return models.WebhookIgnored, nil
+	}
+}
+
+// decodeEventObject unmarshals the object an event carries into v.
+func decodeEventObject(event stripe.Event, v interface{}) error {
+	if event.Data == nil {
+		return fmt.Errorf("%w: %s has no data", errInvalidPayload, event.Type)
+	}
+	if err := json.Unmarshal(event.Data.Raw, v); err != nil {
+		log.Printf("Error parsing %s: %v", event.Type, err)
+		return fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	return nil
+}
+
+func applyPaymentIntentEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var paymentIntent stripe.PaymentIntent
+	if err := decodeEventObject(event, &paymentIntent); err != nil {
+		return "", err
+	}
+
+	status := paymentIntentStatuses[event.Type]
+	// An off-session charge the bank wants authenticated is not lost: the
+	// customer can still complete it on session.
+	if e := paymentIntent.LastPaymentError; status == models.PaymentFailed && e != nil && e.Code == stripe.ErrorCodeAuthenticationRequired {
+		status = models.PaymentRequiresAction
+	}
+	log.Printf("PaymentIntent %s: %s (%d %s)", paymentIntent.ID, status, paymentIntent.Amount, paymentIntent.Currency)
+
+	outcome, err := updatePaymentFromEvent(ctx, tx, paymentIntent.ID, status)
+	if err != nil || outcome != models.WebhookProcessed {
+		return outcome, err
+	}
+
+	return appliedOrIgnored(recordIntentAmounts(ctx, tx, &paymentIntent, status, event.Created))
+}
+
+// recordIntentAmounts stores how much a PaymentIntent that just reached
+// status has authorized or captured. at is when Stripe reported it.
+func recordIntentAmounts(ctx context.Context, tx models.Storage, pi *stripe.PaymentIntent, status models.PaymentStatus, at int64) error {
+	switch {
+	case status == models.PaymentAuthorized:
+		expiresAt := authorizationExpiry(pi.LatestCharge, at)
+		return tx.RecordAuthorization(ctx, pi.ID, pi.AmountCapturable, &expiresAt)
+	case status == models.PaymentSucceeded && pi.AmountReceived > 0:
+		return tx.RecordCapture(ctx, pi.ID, pi.AmountReceived)
+	}
+	return nil
+}
+
+// applyChargeCaptureEvent settles a manual-capture payment from its charge:
+// captured charges record the amount taken and expired ones were never
+// captured at all.
+func applyChargeCaptureEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var charge stripe.Charge
+	if err := decodeEventObject(event, &charge); err != nil {
+		return "", err
+	}
+	if charge.PaymentIntent == nil {
+		return models.WebhookIgnored, nil
+	}
+
+	if event.Type == "charge.expired" {
+		log.Printf("Authorization for PaymentIntent %s expired uncaptured", charge.PaymentIntent.ID)
+		return updatePaymentFromEvent(ctx, tx, charge.PaymentIntent.ID, models.PaymentCanceled)
+	}
+
+	outcome, err := updatePaymentFromEvent(ctx, tx, charge.PaymentIntent.ID, models.PaymentSucceeded)
+	if err != nil || outcome != models.WebhookProcessed {
+		return outcome, err
+	}
+	return appliedOrIgnored(tx.RecordCapture(ctx, charge.PaymentIntent.ID, charge.AmountCaptured))
+}
+
+// authorizationExpiry is when an uncaptured authorization lapses: the
+// capture_before of an expanded card charge, or the default card window from
+// when the authorization was reported.
+func authorizationExpiry(charge *stripe.Charge, authorizedAt int64) time.Time {
+	if charge != nil && charge.PaymentMethodDetails != nil && charge.PaymentMethodDetails.Card != nil && charge.PaymentMethodDetails.Card.CaptureBefore > 0 {
+		return time.Unix(charge.PaymentMethodDetails.Card.CaptureBefore, 0)
+	}
+	return time.Unix(authorizedAt, 0).Add(cardAuthorizationWindow)
+}
+
+// refundProgress orders the statuses a payment passes through as it is
+// refunded.
+var refundProgress = map[models.PaymentStatus]int{
+	models.PaymentSucceeded:         1,
+	models.PaymentPartiallyRefunded: 2,
+	models.PaymentRefunded:          3,
+}
+
+// updatePaymentFromEvent applies a payment status taken from an event
+// snapshot. Snapshots never undo refunds: a late payment_intent.succeeded or
+// an older charge.refunded is stale once the payment has been refunded
+// further, and only a failed refund moves it back (see applyRefundStatus).
+func updatePaymentFromEvent(ctx context.Context, tx models.Storage, intentID string, status models.PaymentStatus) (string, error) {
+	p, err := tx.GetPaymentDetails(ctx, intentID)
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+	if refundProgress[status] > 0 && refundProgress[status] < refundProgress[p.Status] {
+		log.Printf("Ignoring %s for payment %s, already %s", status, intentID, p.Status)
+		return models.WebhookStale, nil
+	}
+
+	return appliedOrIgnored(tx.UpdatePaymentStatus(ctx, intentID, status))
+}
+
+// applyChargeRefunded syncs the refunds the charge carries, brings the
+// payment's refunded total up to the charge's and marks it partially or fully
+// refunded.
+func applyChargeRefunded(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var charge stripe.Charge
+	if err := decodeEventObject(event, &charge); err != nil {
+		return "", err
+	}
+	if charge.PaymentIntent == nil {
+		return models.WebhookIgnored, nil
+	}
+
+	outcome := models.WebhookIgnored
+	if charge.Refunds != nil {
+		for _, re := range charge.Refunds.Data {
+			o, err := appliedOrIgnored(applyRefundStatus(ctx, tx, re.ID, refundStatus(re.Status)))
+			if err != nil {
+				return "", err
+			}
+			// The snapshot predates a refund that has since failed, so its
+			// refunded total is out of date too.
+			if o == models.WebhookRejected {
+				log.Printf("Charge %s snapshot is older than its refunds, keeping payment status", charge.ID)
+				return models.WebhookStale, nil
+			}
+			outcome = mergeOutcomes(outcome, o)
+		}
+	}
+
+	if charge.AmountRefunded > 0 {
+		p, err := tx.GetPaymentDetails(ctx, charge.PaymentIntent.ID)
+		if err != nil {
+			return appliedOrIgnored(err)
+		}
+		// Refunds made from the Dashboard never pass through
+		// HandlePaymentRefund, so the charge is the only place their amount
+		// shows up. The total only ever catches up: reversals of failed
+		// refunds lower it through charge.refund.updated instead.
+		if missing := charge.AmountRefunded - p.AmountRefunded; missing > 0 {
+			if _, err := tx.AddRefundedAmount(ctx, p.ID, missing); err != nil {
+				return "", err
+			}
+		}
+
+		status := models.PaymentPartiallyRefunded
+		if charge.Refunded {
+			status = models.PaymentRefunded
+		}
+		o, err := updatePaymentFromEvent(ctx, tx, charge.PaymentIntent.ID, status)
+		if err != nil {
+			return "", err
+		}
+		outcome = mergeOutcomes(outcome, o)
+	}
+
+	return outcome, nil
+}
+
+func applyRefundUpdated(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var refund stripe.Refund
+	if err := decodeEventObject(event, &refund); err != nil {
+		return "", err
+	}
+
+	if refund.Status == stripe.RefundStatusFailed {
+		log.Printf("Refund %s failed: %s", refund.ID, refund.FailureReason)
+	}
+
+	return appliedOrIgnored(applyRefundStatus(ctx, tx, refund.ID, refundStatus(refund.Status)))
+}
+
+// refundStatus maps a Stripe refund status to the one stored locally, where
+// a completed refund is "refunded".
+func refundStatus(status stripe.RefundStatus) models.RefundStatus {
+	if status == stripe.RefundStatusSucceeded {
+		return models.RefundSucceeded
+	}
+	return models.RefundStatus(status)
+}
+
+// applyDisputeEvent marks the disputed payment while the dispute is open and
+// settles it once the dispute is decided.
+func applyDisputeEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var dispute stripe.Dispute
+	if err := decodeEventObject(event, &dispute); err != nil {
+		return "", err
+	}
+	if dispute.PaymentIntent == nil {
+		return models.WebhookIgnored, nil
+	}
+
+	status := models.PaymentDisputed
+	switch dispute.Status {
+	case stripe.DisputeStatusWon, stripe.DisputeStatusWarningClosed:
+		// Go back to where the payment was before the dispute.
+		status = models.PaymentSucceeded
+		p, err := tx.GetPaymentDetails(ctx, dispute.PaymentIntent.ID)
+		if err != nil {
+			return appliedOrIgnored(err)
+		}
+		if p.AmountRefunded > 0 {
+			status = models.PaymentPartiallyRefunded
+		}
+	case stripe.DisputeStatusLost:
+		status = models.PaymentDisputeLost
+	}
+	log.Printf("Dispute %s on PaymentIntent %s: %s", dispute.ID, dispute.PaymentIntent.ID, dispute.Status)
+
+	return appliedOrIgnored(tx.UpdatePaymentStatus(ctx, dispute.PaymentIntent.ID, status))
+}
+
+func applySubscriptionEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var sub stripe.Subscription
+	if err := decodeEventObject(event, &sub); err != nil {
+		return "", err
+	}
+
+	status := models.SubscriptionStatus(sub.Status)
+	if event.Type == "customer.subscription.deleted" {
+		status = models.SubscriptionCanceled
+	}
+
+	// An event whose status change is refused is older than what is stored,
+	// so its terms would be stale too.
+	outcome, err := appliedOrIgnored(tx.UpdateSubscriptionStatus(ctx, sub.ID, status))
+	if err != nil || outcome != models.WebhookProcessed {
+		return outcome, err
+	}
+	return appliedOrIgnored(syncSubscriptionTerms(ctx, tx, &sub))
+}
+
+// syncSubscriptionTerms records the trial end, discount, cancellation, pause
+// and price Stripe reports for sub, clearing any that no longer apply.
+func syncSubscriptionTerms(ctx context.Context, tx models.Storage, sub *stripe.Subscription) error {
+	if err := tx.UpdateSubscriptionTrial(ctx, sub.ID, subscriptionTrialEnd(sub)); err != nil {
+		return err
+	}
+	if err := tx.UpdateSubscriptionDiscount(ctx, sub.ID, subscriptionDiscount(sub.Discount)); err != nil {
+		return err
+	}
+	if err := tx.UpdateSubscriptionCancellation(ctx, sub.ID, sub.CancelAtPeriodEnd, subscriptionEndDate(sub)); err != nil {
+		return err
+	}
+	if err := tx.UpdateSubscriptionPause(ctx, sub.ID, subscriptionPause(sub.PauseCollection)); err != nil {
+		return err
+	}
+	return syncSubscriptionPrice(ctx, tx, sub)
+}
+
+// applyTrialWillEnd queues a reminder for the customer, which Stripe asks
+// for three days before a trial ends. The event ID keeps a redelivered event
+// from queueing it twice.
+func applyTrialWillEnd(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var sub stripe.Subscription
+	if err := decodeEventObject(event, &sub); err != nil {
+		return "", err
+	}
+
+	local, err := tx.GetSubscriptionDetails(ctx, sub.ID)
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+	trialEnd := subscriptionTrialEnd(&sub)
+	if err := tx.UpdateSubscriptionTrial(ctx, sub.ID, trialEnd); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"subscription_id":    sub.ID,
+		"trial_end":          trialEnd,
+		"has_payment_method": sub.DefaultPaymentMethod != nil,
+	})
+	if err != nil {
+		return "", err
+	}
+	err = tx.CreateNotification(ctx, &models.Notification{
+		UserID:               local.UserID,
+		Kind:                 models.NotificationTrialWillEnd,
+		EventID:              event.ID,
+		StripeSubscriptionID: sub.ID,
+		Payload:              payload,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Trial of subscription %s ends at %v, notification queued for customer %d", sub.ID, trialEnd, local.UserID)
+	return models.WebhookProcessed, nil
+}
+
+// applyInvoiceEvent keeps a subscription's status in line with its latest
+// invoice: paid keeps it active, a failed payment makes it past due.
+func applyInvoiceEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var invoice stripe.Invoice
+	if err := decodeEventObject(event, &invoice); err != nil {
+		return "", err
+	}
+	if invoice.Subscription == nil {
+		return models.WebhookIgnored, nil
+	}
+
+	sub, err := tx.GetSubscriptionDetails(ctx, invoice.Subscription.ID)
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+	// Only a subscription that is already billing is settled by its
+	// invoices. The $0 invoice opening a trial does not end the trial, and
+	// a failed first invoice leaves an incomplete subscription incomplete;
+	// Stripe reports those moves with customer.subscription.* events.
+	if sub.Status == models.SubscriptionTrialing || sub.Status == models.SubscriptionIncomplete {
+		return models.WebhookIgnored, nil
+	}
+
+	status := models.SubscriptionActive
+	if event.Type == "invoice.payment_failed" {
+		status = models.SubscriptionPastDue
+	}
+
+	return appliedOrIgnored(tx.UpdateSubscriptionStatus(ctx, invoice.Subscription.ID, status))
+}
+
+// applyPaymentMethodEvent keeps the saved copy of a customer's payment
+// method in line with Stripe, including card details the card network
+// updated on its own.
+func applyPaymentMethodEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var pm stripe.PaymentMethod
+	if err := decodeEventObject(event, &pm); err != nil {
+		return "", err
+	}
+
+	if event.Type == "payment_method.detached" || pm.Customer == nil {
+		return appliedOrIgnored(tx.DeletePaymentMethod(ctx, pm.ID))
+	}
+
+	user, err := tx.GetCustomerByStripeID(ctx, pm.Customer.ID)
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+	return appliedOrIgnored(tx.SavePaymentMethod(ctx, savedPaymentMethod(user.ID, &pm)))
+}
+
+// applyCustomerUpdated follows the customer's default payment method when it
+// is changed outside the gateway, e.g. in the Dashboard.
+func applyCustomerUpdated(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var cus stripe.Customer
+	if err := decodeEventObject(event, &cus); err != nil {
+		return "", err
+	}
+	if cus.InvoiceSettings == nil || cus.InvoiceSettings.DefaultPaymentMethod == nil {
+		return models.WebhookIgnored, nil
+	}
+
+	user, err := tx.GetCustomerByStripeID(ctx, cus.ID)
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+	return appliedOrIgnored(tx.SetDefaultPaymentMethod(ctx, user.ID, cus.InvoiceSettings.DefaultPaymentMethod.ID))
+}
+
+func appliedOrIgnored(err error) (string, error) {
+	if errors.Is(err, models.ErrNotFound) {
+		log.Println("Event refers to an unknown object:", err)
+		return models.WebhookIgnored, nil
+	}
+	if errors.Is(err, models.ErrInvalidTransition) {
+		log.Println("Rejected status change from event:", err)
+		return models.WebhookRejected, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return models.WebhookProcessed, nil
+}
+
+// mergeOutcomes combines the outcomes of the writes one event makes: it
+// counts as processed if any of them applied, and as rejected if none did
+// but one was refused.
+func mergeOutcomes(a, b string) string {
+	for _, outcome := range []string{models.WebhookProcessed, models.WebhookRejected} {
+		if a == outcome || b == outcome {
+			return outcome
+		}
+	}
+	return a
+}
+
+// checkoutPaymentStatuses maps a Checkout Session's payment status on
+// completion to the local payment status. Delayed payment methods complete
+// unpaid and settle through the PaymentIntent webhooks.
+var checkoutPaymentStatuses = map[stripe.CheckoutSessionPaymentStatus]models.PaymentStatus{
+	stripe.CheckoutSessionPaymentStatusPaid:              models.PaymentSucceeded,
+	stripe.CheckoutSessionPaymentStatusNoPaymentRequired: models.PaymentSucceeded,
+	stripe.CheckoutSessionPaymentStatusUnpaid:            models.PaymentProcessing,
+}
+
+// applyCheckoutSessionEvent closes a hosted Checkout Session. Stripe only
+// creates the PaymentIntent once the customer tries to pay, so the payment
+// row and its ledger entry are written here for a completed session. A
+// session that expired took no money: it records nothing new and only
+// cancels a payment that was already stored for it.
+func applyCheckoutSessionEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var cs stripe.CheckoutSession
+	if err := decodeEventObject(event, &cs); err != nil {
+		return "", err
+	}
+
+	local, err := tx.GetCheckoutSession(ctx, cs.ID)
+	if errors.Is(err, models.ErrNotFound) && cs.PaymentLink != nil && event.Type == "checkout.session.completed" {
+		local, err = adoptPaymentLinkSession(ctx, tx, &cs)
+	}
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+
+	status, paymentStatus := models.CheckoutSessionComplete, checkoutPaymentStatuses[cs.PaymentStatus]
+	if event.Type == "checkout.session.expired" {
+		status, paymentStatus = models.CheckoutSessionExpired, models.PaymentCanceled
+	}
+	log.Printf("Checkout Session %s: %s (%d %s)", cs.ID, status, cs.AmountTotal, cs.Currency)
+
+	paymentID := local.PaymentID
+	if cs.PaymentIntent != nil && paymentStatus != "" {
+		if paymentID == nil && status == models.CheckoutSessionComplete {
+			id, err := insertCheckoutPayment(ctx, tx, local, &cs)
+			if err != nil {
+				return "", err
+			}
+			paymentID = &id
+		}
+
+		outcome, err := updatePaymentFromEvent(ctx, tx, cs.PaymentIntent.ID, paymentStatus)
+		if err != nil {
+			return "", err
+		}
+		if outcome == models.WebhookProcessed && paymentStatus == models.PaymentSucceeded && cs.AmountTotal > 0 {
+			if err := tx.RecordCapture(ctx, cs.PaymentIntent.ID, cs.AmountTotal); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return appliedOrIgnored(tx.UpdateCheckoutSession(ctx, cs.ID, status, paymentID))
+}
+
+// adoptPaymentLinkSession stores a session Stripe opened from one of the
+// gateway's payment links, which the gateway only hears of once it is paid.
+// The payer becomes a local customer if they are not one already.
+func adoptPaymentLinkSession(ctx context.Context, tx models.Storage, cs *stripe.CheckoutSession) (*models.CheckoutSession, error) {
+	link, err := tx.GetPaymentLink(ctx, cs.PaymentLink.ID)
+	if err != nil {
+		return nil, err
+	}
+	if cs.Customer == nil {
+		return nil, fmt.Errorf("%w: checkout session %s has no customer", errInvalidPayload, cs.ID)
+	}
+
+	var userID uint
+	user, err := tx.GetCustomerByStripeID(ctx, cs.Customer.ID)
+	switch {
+	case err == nil:
+		userID = user.ID
+	case errors.Is(err, models.ErrNotFound):
+		var name, email string
+		if d := cs.CustomerDetails; d != nil {
+			name, email = d.Name, d.Email
+		}
+		if _, userID, err = tx.CreateCustomer(ctx, name, email, cs.Customer.ID); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	log.Printf("Checkout Session %s opened from payment link %s", cs.ID, link.StripePaymentLinkID)
+	local := &models.CheckoutSession{UserID: userID, StripeCheckoutSessionID: cs.ID, PaymentLinkID: &link.ID, AmountTotal: cs.AmountTotal, Currency: string(cs.Currency)}
+	if err := tx.CreateCheckoutSession(ctx, local); err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+// applyPaymentLinkUpdated mirrors Stripe deactivating a payment link, which it
+// does by itself once the link's payment limit is reached.
+func applyPaymentLinkUpdated(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var pl stripe.PaymentLink
+	if err := decodeEventObject(event, &pl); err != nil {
+		return "", err
+	}
+	if pl.Active {
+		return models.WebhookIgnored, nil
+	}
+
+	log.Printf("Payment link %s deactivated", pl.ID)
+	return appliedOrIgnored(tx.DeactivatePaymentLink(ctx, pl.ID))
+}
+
+// applyProductEvent keeps catalog products in step with changes made on
+// Stripe, e.g. in the Dashboard.
+func applyProductEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var prod stripe.Product
+	if err := decodeEventObject(event, &prod); err != nil {
+		return "", err
+	}
+
+	product, err := tx.GetProductByStripeID(ctx, prod.ID)
+	if err != nil {
+		return appliedOrIgnored(err)
+	}
+	product.Name, product.Description = prod.Name, prod.Description
+	product.Active = prod.Active && event.Type != "product.deleted"
+	return appliedOrIgnored(tx.UpdateProduct(ctx, product))
+}
+
+// applyPriceEvent follows a catalog price being archived or reactivated on
+// Stripe.
+func applyPriceEvent(ctx context.Context, tx models.Storage, event stripe.Event) (string, error) {
+	var pr stripe.Price
+	if err := decodeEventObject(event, &pr); err != nil {
+		return "", err
+	}
+
+	return appliedOrIgnored(tx.SetPriceActive(ctx, pr.ID, pr.Active && event.Type != "price.deleted"))
+}
+
+// insertCheckoutPayment writes the payment for a session's PaymentIntent,
+// unless a payment for it exists already, and returns its ID.
+func insertCheckoutPayment(ctx context.Context, tx models.Storage, local *models.CheckoutSession, cs *stripe.CheckoutSession) (uint, error) {
+	if p, err := tx.GetPaymentDetails(ctx, cs.PaymentIntent.ID); err == nil {
+		return p.ID, nil
+	} else if !errors.Is(err, models.ErrNotFound) {
+		return 0, err
+	}
+
+	user, err := tx.GetCustomer(ctx, local.UserID)
+	if err != nil {
+		return 0, err
+	}
+	method := "card"
+	if len(cs.PaymentMethodTypes) > 0 {
+		method = cs.PaymentMethodTypes[0]
+	}
+
+	rec := paymentRecord{UserID: user.ID, Name: user.Name, Email: user.Email, Amount: local.AmountTotal, Currency: local.Currency, Method: method, IntentID: cs.PaymentIntent.ID, CaptureMethod: models.CaptureAutomatic}
+	return insertPayment(ctx, tx, rec)
+}
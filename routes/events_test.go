@@ -0,0 +1,208 @@
+package routes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// succeed marks a payment succeeded the way Stripe reports it.
+func succeed(t *testing.T, ts *testServer, intentID string, amount int64) {
+	t.Helper()
+
+	if ts.memory != nil {
+		if err := ts.memory.SetPaymentIntentStatus(intentID, stripe.PaymentIntentStatusSucceeded); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts.deliver("payment_intent.succeeded", time.Now(), intentObject(intentID, "succeeded", amount))
+	ts.processWebhooks()
+	if p := ts.payment(intentID); p.Status != models.PaymentSucceeded {
+		t.Fatalf("got status %s, want success", p.Status)
+	}
+}
+
+func TestPaymentIntentEvents(t *testing.T) {
+	cases := []struct {
+		event  string
+		status string
+		want   models.PaymentStatus
+	}{
+		{"payment_intent.processing", "processing", models.PaymentProcessing},
+		{"payment_intent.requires_action", "requires_action", models.PaymentRequiresAction},
+		{"payment_intent.payment_failed", "requires_payment_method", models.PaymentFailed},
+		{"payment_intent.canceled", "canceled", models.PaymentCanceled},
+	}
+	for _, c := range cases {
+		t.Run(c.event, func(t *testing.T) {
+			ts, _ := newMemoryTestServer(t)
+			id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+			ts.deliver(c.event, time.Now(), intentObject(id, c.status, 1000))
+			ts.processWebhooks()
+
+			if p := ts.payment(id); p.Status != c.want {
+				t.Fatalf("got status %s, want %s", p.Status, c.want)
+			}
+		})
+	}
+}
+
+func TestChargeRefundedOutsideGateway(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, id, 1000)
+
+	// A refund made in the Dashboard only reaches the gateway as an event.
+	ts.deliver("charge.refunded", time.Now(), map[string]interface{}{
+		"id": "ch_123", "object": "charge", "payment_intent": id, "amount": 1000, "amount_refunded": 1000, "refunded": true,
+	})
+	ts.processWebhooks()
+
+	if p := ts.payment(id); p.Status != models.PaymentRefunded {
+		t.Fatalf("got status %s, want refunded", p.Status)
+	}
+}
+
+func TestChargeRefundedUpdatesRefundedAmount(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, id, 1000)
+
+	ts.deliver("charge.refunded", time.Now(), map[string]interface{}{
+		"id": "ch_123", "object": "charge", "payment_intent": id, "amount": 1000, "amount_refunded": 600, "refunded": false,
+	})
+	ts.processWebhooks()
+
+	p := ts.payment(id)
+	if p.Status != models.PaymentPartiallyRefunded || p.AmountRefunded != 600 {
+		t.Fatalf("got %s with %d refunded, want partially refunded with 600", p.Status, p.AmountRefunded)
+	}
+	// Only the 400 the Dashboard left is still refundable.
+	ts.expect(400, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 500})
+	ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 400})
+}
+
+func TestRefundUpdatedEvent(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, id, 1000)
+	out := ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 400})
+	refundID := out["refund_id"].(string)
+
+	ts.deliver("refund.updated", time.Now(), map[string]interface{}{
+		"id": refundID, "object": "refund", "payment_intent": id, "amount": 400, "status": "failed", "failure_reason": "lost_or_stolen_card",
+	})
+	ts.processWebhooks()
+
+	r, err := ts.storage.GetRefundDetails(context.Background(), refundID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != models.RefundFailed {
+		t.Fatalf("got refund status %s, want failed", r.Status)
+	}
+}
+
+func TestDisputeEvents(t *testing.T) {
+	dispute := func(id, intentID, status string) map[string]interface{} {
+		return map[string]interface{}{"id": id, "object": "dispute", "payment_intent": intentID, "amount": 1000, "status": status}
+	}
+
+	ts, _ := newMemoryTestServer(t)
+	won, _ := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, won, 1000)
+	lost, _ := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, lost, 1000)
+	now := time.Now()
+
+	ts.deliver("charge.dispute.created", now, dispute("dp_won", won, "needs_response"))
+	ts.deliver("charge.dispute.created", now, dispute("dp_lost", lost, "needs_response"))
+	ts.processWebhooks()
+	if p := ts.payment(won); p.Status != models.PaymentDisputed {
+		t.Fatalf("got status %s after the dispute opened, want disputed", p.Status)
+	}
+
+	ts.deliver("charge.dispute.closed", now.Add(time.Second), dispute("dp_won", won, "won"))
+	ts.deliver("charge.dispute.closed", now.Add(time.Second), dispute("dp_lost", lost, "lost"))
+	ts.processWebhooks()
+	if p := ts.payment(won); p.Status != models.PaymentSucceeded {
+		t.Fatalf("won dispute: got status %s, want success", p.Status)
+	}
+	if p := ts.payment(lost); p.Status != models.PaymentDisputeLost {
+		t.Fatalf("lost dispute: got status %s, want dispute_lost", p.Status)
+	}
+}
+
+func TestSubscriptionAndInvoiceEvents(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	ts.storeSubscription("sub_123", models.SubscriptionActive)
+	now := time.Now()
+
+	steps := []struct {
+		event string
+		obj   map[string]interface{}
+		want  models.SubscriptionStatus
+	}{
+		{"invoice.payment_failed", map[string]interface{}{"id": "in_1", "object": "invoice", "subscription": "sub_123"}, models.SubscriptionPastDue},
+		{"invoice.paid", map[string]interface{}{"id": "in_2", "object": "invoice", "subscription": "sub_123"}, models.SubscriptionActive},
+		{"customer.subscription.updated", map[string]interface{}{"id": "sub_123", "object": "subscription", "status": "unpaid"}, models.SubscriptionUnpaid},
+		{"customer.subscription.deleted", map[string]interface{}{"id": "sub_123", "object": "subscription", "status": "canceled"}, models.SubscriptionCanceled},
+	}
+	for i, step := range steps {
+		ts.deliver(step.event, now.Add(time.Duration(i)*time.Second), step.obj)
+		ts.processWebhooks()
+		if sub := ts.subscription("sub_123"); sub.Status != step.want {
+			t.Fatalf("after %s: got status %s, want %s", step.event, sub.Status, step.want)
+		}
+	}
+}
+
+func TestInvoiceEventsLeaveTrialsAndIncompleteSubscriptions(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	ts.storeSubscription("sub_trial", models.SubscriptionTrialing)
+	ts.storeSubscription("sub_new", models.SubscriptionIncomplete)
+
+	// The $0 invoice that opens a trial is paid straight away.
+	ts.deliver("invoice.paid", time.Now(), map[string]interface{}{"id": "in_1", "object": "invoice", "subscription": "sub_trial", "amount_paid": 0})
+	ts.deliver("invoice.payment_failed", time.Now(), map[string]interface{}{"id": "in_2", "object": "invoice", "subscription": "sub_new"})
+	ts.processWebhooks()
+
+	if got := ts.subscription("sub_trial").Status; got != models.SubscriptionTrialing {
+		t.Fatalf("got trial status %s, want trialing", got)
+	}
+	if got := ts.subscription("sub_new").Status; got != models.SubscriptionIncomplete {
+		t.Fatalf("got status %s, want incomplete", got)
+	}
+}
+
+func TestIllegalTransitionFromEventIsRejected(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	ts.expect(200, "POST", "/payment/cancel", fiber.Map{"paymentIntentID": id})
+
+	event := ts.deliver("payment_intent.succeeded", time.Now(), intentObject(id, "succeeded", 1000))
+	ts.processWebhooks()
+
+	if e := webhookEvent(t, ts, event.ID); e.Outcome != models.WebhookRejected {
+		t.Fatalf("got outcome %s, want rejected", e.Outcome)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentCanceled {
+		t.Fatalf("got status %s, want canceled", p.Status)
+	}
+	if got := ts.history("payment", id); len(got) != 2 || got[1] != "canceled" {
+		t.Fatalf("got history %v, want pending then canceled", got)
+	}
+}
+
+func TestExpiredSubscriptionCannotBeCanceled(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	ts.storeSubscription("sub_123", models.SubscriptionIncompleteExpired)
+
+	ts.expect(409, "POST", "/subscription/cancel", fiber.Map{"subscription_id": "sub_123"})
+}
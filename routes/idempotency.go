@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+const (
+	// idempotencyKeyTTL is how long a stored response is replayed.
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyLockTimeout frees keys whose first request never finished,
+	// e.g. because the process died mid-request.
+	idempotencyLockTimeout = 2 * time.Minute
+	// idempotencyFinishTimeout bounds releasing or completing a key once the
+	// request is over.
+	idempotencyFinishTimeout = 5 * time.Second
+	maxIdempotencyKeyLength  = 255
+
+	idempotencyKeyLocal = "idempotencyKey"
+)
+
+// idempotent honors the Idempotency-Key header. The first request with a key
+// runs normally and its response is stored; retries with the same key and
+// payload get that response back, while a different payload is a conflict.
+// Server errors are not stored, so a retry after one runs the request again;
+// the key is forwarded to Stripe so that retry reuses any object the failed
+// attempt already created.
+func (s *APIServer) idempotent(c *fiber.Ctx) error {
+	key := c.Get("Idempotency-Key")
+	if key == "" {
+		return c.Next()
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return c.Status(400).JSON(fiber.Map{"error": "Idempotency-Key must be at most 255 characters"})
+	}
+
+	ctx := c.UserContext()
+	fp := fingerprint(c)
+	now := time.Now()
+
+	existing, reserved, err := s.storage.ReserveIdempotencyKey(ctx, key, fp, now.Add(-idempotencyKeyTTL), now.Add(-idempotencyLockTimeout))
+	if err != nil {
+		log.Println("Failed to reserve idempotency key:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check Idempotency-Key"})
+	}
+
+	if !reserved {
+		if existing.Fingerprint != fp {
+			return c.Status(409).JSON(fiber.Map{"error": "Idempotency-Key was already used with a different request"})
+		}
+		if !existing.Completed() {
+			return c.Status(409).JSON(fiber.Map{"error": "A request with this Idempotency-Key is still in progress"})
+		}
+
+		c.Set("Idempotent-Replayed", "true")
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(existing.StatusCode).Send(existing.Response)
+	}
+
+	c.Locals(idempotencyKeyLocal, key)
+	err = c.Next()
+
+	// The request's deadline may be what ended it, but the key must still be
+	// released or completed, or retries wait out idempotencyLockTimeout.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyFinishTimeout)
+	defer cancel()
+
+	status := c.Response().StatusCode()
+	if err != nil || status >= 500 {
+		if rerr := s.storage.ReleaseIdempotencyKey(ctx, key); rerr != nil {
+			log.Println("Failed to release idempotency key:", rerr)
+		}
+		return err
+	}
+
+	if err := s.storage.CompleteIdempotencyKey(ctx, key, status, c.Response().Body()); err != nil {
+		log.Println("Failed to store idempotent response:", err)
+	}
+	return nil
+}
+
+// fingerprint identifies a request by its route and raw body.
+func fingerprint(c *fiber.Ctx) string {
+	h := sha256.New()
+	h.Write([]byte(c.Method()))
+	h.Write([]byte{0})
+	h.Write([]byte(c.Path()))
+	h.Write([]byte{0})
+	h.Write(c.Body())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyKey returns the Idempotency-Key reserved for this request, or
+// "" if the client did not send one.
+func idempotencyKey(c *fiber.Ctx) string {
+	key, _ := c.Locals(idempotencyKeyLocal).(string)
+	return key
+}
+
+// forwardIdempotencyKey passes key on to Stripe. scope tells apart the
+// Stripe calls made by one request, since Stripe rejects a key reused with
+// different parameters.
+func forwardIdempotencyKey(params *stripe.Params, key, scope string) {
+	if key == "" {
+		return
+	}
+	if scope != "" {
+		key += "-" + scope
+	}
+	params.SetIdempotencyKey(key)
+}
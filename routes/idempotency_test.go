@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// keyRecorder is a MemoryProvider that keeps the idempotency keys it is sent.
+type keyRecorder struct {
+	*provider.MemoryProvider
+	keys []string
+}
+
+func (p *keyRecorder) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	p.keys = append(p.keys, stripe.StringValue(params.IdempotencyKey))
+	return p.MemoryProvider.CreatePaymentIntent(ctx, params)
+}
+
+func (p *keyRecorder) CancelSubscription(ctx context.Context, id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	p.keys = append(p.keys, stripe.StringValue(params.IdempotencyKey))
+	return &stripe.Subscription{ID: id, Status: stripe.SubscriptionStatusCanceled}, nil
+}
+
+// stallingProvider is a MemoryProvider whose first CreatePaymentIntent
+// blocks until the request context is done.
+type stallingProvider struct {
+	*provider.MemoryProvider
+	stalled bool
+}
+
+func (p *stallingProvider) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if !p.stalled {
+		p.stalled = true
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return p.MemoryProvider.CreatePaymentIntent(ctx, params)
+}
+
+func withKey(key string) http.Header {
+	return http.Header{"Idempotency-Key": {key}}
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	p := &keyRecorder{MemoryProvider: provider.NewMemoryProvider()}
+	ts := newTestServer(t, p)
+	body := fiber.Map{"name": "Test", "email": "ada@example.com", "amount": 1000, "currency": "usd", "payment_method": "card"}
+
+	status, first := ts.send("POST", "/payment/intent", body, withKey("key-1"))
+	if status != 200 {
+		t.Fatalf("got %d: %v", status, first)
+	}
+	status, again := ts.send("POST", "/payment/intent", body, withKey("key-1"))
+	if status != 200 || again["payment_intent"] != first["payment_intent"] {
+		t.Fatalf("retry: got %d %v, want the first response %v", status, again, first)
+	}
+	if len(p.keys) != 1 || p.keys[0] != "key-1" {
+		t.Fatalf("got keys %q sent to Stripe, want one key-1", p.keys)
+	}
+
+	body["amount"] = 2000
+	if status, _ := ts.send("POST", "/payment/intent", body, withKey("key-1")); status != 409 {
+		t.Fatalf("reused with another payload: got %d, want 409", status)
+	}
+}
+
+func TestCancelSubscriptionForwardsIdempotencyKey(t *testing.T) {
+	p := &keyRecorder{MemoryProvider: provider.NewMemoryProvider()}
+	ts := newTestServer(t, p)
+	ts.storeSubscription("sub_123", models.SubscriptionActive)
+
+	status, out := ts.send("POST", "/subscription/cancel", fiber.Map{"subscription_id": "sub_123"}, withKey("cancel-1"))
+	if status != 200 {
+		t.Fatalf("got %d: %v", status, out)
+	}
+	if len(p.keys) != 1 || p.keys[0] != "cancel-1" {
+		t.Fatalf("got keys %q sent to Stripe, want cancel-1", p.keys)
+	}
+}
+
+func TestTimedOutRequestReleasesIdempotencyKey(t *testing.T) {
+	ts := newTestServer(t, &stallingProvider{MemoryProvider: provider.NewMemoryProvider()})
+	ts.srv.SetRequestTimeout(100 * time.Millisecond)
+	body := fiber.Map{"name": "Test", "email": "ada@example.com", "amount": 1000, "currency": "usd", "payment_method": "card"}
+
+	if status, out := ts.send("POST", "/payment/intent", body, withKey("key-1")); status != 500 {
+		t.Fatalf("got %d %v, want the timed out request to fail", status, out)
+	}
+	// The key was released even though the request's context had expired,
+	// so the retry runs instead of waiting for the lock to time out.
+	if status, out := ts.send("POST", "/payment/intent", body, withKey("key-1")); status != 200 {
+		t.Fatalf("retry: got %d %v, want 200", status, out)
+	}
+}
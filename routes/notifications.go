@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	pendingNotificationsLimit    = 50
+	maxPendingNotificationsLimit = 500
+)
+
+// HandlePendingNotifications lists customer notifications that have not been
+// sent yet, oldest first, for whatever delivers them.
+func (s *APIServer) HandlePendingNotifications(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	limit := c.QueryInt("limit", pendingNotificationsLimit)
+	if limit <= 0 || limit > maxPendingNotificationsLimit {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid limit"})
+	}
+
+	notifications, err := s.storage.GetPendingNotifications(ctx, limit)
+	if err != nil {
+		log.Println("Failed to fetch pending notifications:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch notifications"})
+	}
+
+	return c.JSON(fiber.Map{"notifications": notifications})
+}
+
+// HandleNotificationSent marks a notification as delivered.
+func (s *APIServer) HandleNotificationSent(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid notification ID"})
+	}
+
+	err = s.storage.MarkNotificationSent(c.UserContext(), uint(id))
+	if errors.Is(err, models.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Notification not found"})
+	}
+	if err != nil {
+		log.Println("Failed to mark notification sent:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update notification"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Notification marked as sent"})
+}
@@ -0,0 +1,159 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// HandleOffSessionCharge charges a customer's saved card while they are not
+// present, using the given payment method or else their default. When the
+// bank insists on authentication the payment is left as requires_action and
+// the response carries what the customer needs to finish it on session: the
+// client_secret, and a recovery_url when PAYMENT_RECOVERY_URL is set.
+func (s *APIServer) HandleOffSessionCharge(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		CustomerID    uint   `json:"customer_id"`
+		Amount        int64  `json:"amount"`
+		Currency      string `json:"currency"`
+		PaymentMethod string `json:"payment_method"`
+		Description   string `json:"description"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.CustomerID == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "customer_id is required"})
+	}
+	if request.Amount <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "amount must be positive"})
+	}
+	if request.Currency == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "currency is required"})
+	}
+
+	user, err := s.storage.GetCustomer(ctx, request.CustomerID)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Customer not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve customer"})
+	}
+
+	var pm *models.PaymentMethod
+	if request.PaymentMethod != "" {
+		pm, err = s.storage.GetPaymentMethod(ctx, request.PaymentMethod)
+		if errors.Is(err, models.ErrNotFound) || (err == nil && pm.UserID != user.ID) {
+			return c.Status(404).JSON(fiber.Map{"error": "Payment method not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment method"})
+		}
+	} else {
+		pms, err := s.storage.GetPaymentMethods(ctx, user.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment methods"})
+		}
+		// The default, if any, is listed first.
+		if len(pms) == 0 || !pms[0].IsDefault {
+			return c.Status(409).JSON(fiber.Map{"error": "Customer has no default payment method"})
+		}
+		pm = pms[0]
+	}
+
+	// Create the intent unconfirmed so the payment is stored before any money
+	// moves, then confirm it off session.
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(request.Amount),
+		Currency:           stripe.String(request.Currency),
+		Customer:           stripe.String(user.StripeID),
+		PaymentMethod:      stripe.String(pm.StripePaymentMethodID),
+		PaymentMethodTypes: stripe.StringSlice([]string{pm.Type}),
+	}
+	if request.Description != "" {
+		params.Description = stripe.String(request.Description)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.CreatePaymentIntent(ctx, params)
+	if err != nil {
+		log.Println("Off-session PaymentIntent error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Payment failed"})
+	}
+
+	rec := paymentRecord{UserID: user.ID, Name: user.Name, Email: user.Email, Amount: request.Amount, Currency: request.Currency, Method: pm.Type, IntentID: result.ID, CaptureMethod: models.CaptureAutomatic}
+	outboxID, err := s.recordRemote(ctx, models.OutboxPaymentIntent, result.ID, rec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store payment"})
+	}
+
+	if err := s.persistPayment(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist payment, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store payment"})
+	}
+
+	confirm := &stripe.PaymentIntentConfirmParams{
+		OffSession: stripe.Bool(true),
+	}
+	forwardIdempotencyKey(&confirm.Params, idempotencyKey(c), "confirm")
+
+	confirmed, err := s.provider.ConfirmPaymentIntent(ctx, result.ID, confirm)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeAuthenticationRequired {
+		log.Printf("Off-session payment %s needs customer authentication", result.ID)
+		if _, err := updatePaymentFromEvent(ctx, s.storage, result.ID, models.PaymentRequiresAction); err != nil {
+			log.Println("Failed to persist payment status:", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
+		}
+
+		response := fiber.Map{
+			"error":          stripeErr.Msg,
+			"code":           stripeErr.Code,
+			"payment_intent": result.ID,
+			"client_secret":  result.ClientSecret,
+			"payment_method": pm.StripePaymentMethodID,
+		}
+		if base := os.Getenv("PAYMENT_RECOVERY_URL"); base != "" {
+			response["recovery_url"] = base + "?payment_intent=" + url.QueryEscape(result.ID)
+		}
+		return c.Status(402).JSON(response)
+	}
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+		log.Printf("Off-session payment %s declined: %s", result.ID, stripeErr.Msg)
+		declined := &stripe.PaymentIntent{ID: result.ID, Status: stripe.PaymentIntentStatusRequiresPaymentMethod}
+		if err := s.recordConfirmation(ctx, declined); err != nil {
+			log.Println("Failed to persist payment decline:", err)
+		}
+		return c.Status(402).JSON(fiber.Map{
+			"error":          stripeErr.Msg,
+			"code":           stripeErr.Code,
+			"decline_code":   stripeErr.DeclineCode,
+			"payment_intent": result.ID,
+		})
+	}
+	if err != nil {
+		log.Println("Off-session confirmation error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Confirmation failed"})
+	}
+
+	if err := s.recordConfirmation(ctx, confirmed); err != nil {
+		log.Println("Failed to persist payment confirmation:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Payment confirmed",
+		"payment_intent": confirmed.ID,
+		"status":         confirmed.Status,
+		"payment_method": pm.StripePaymentMethodID,
+	})
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOffSessionPayment(t *testing.T) {
+	ts := newStripeTestServer(t)
+	userID, visa := setupCard(t, ts, "ada@example.com", "pm_card_visa")
+
+	out := ts.expect(409, "POST", "/payment/off-session", fiber.Map{"customer_id": userID, "amount": 500, "currency": "usd"})
+	if out["error"] != "Customer has no default payment method" {
+		t.Fatalf("got %v", out)
+	}
+	ts.sync()
+	ts.expect(200, "POST", "/customer/payment-methods/default", fiber.Map{"customer_id": userID, "payment_method": visa})
+
+	out = ts.expect(200, "POST", "/payment/off-session", fiber.Map{"customer_id": userID, "amount": 500, "currency": "usd", "description": "renewal"})
+	if out["payment_method"] != visa || out["status"] != "succeeded" {
+		t.Fatalf("got %v, want the default card charged", out)
+	}
+	ts.sync()
+	if got := ts.payment(out["payment_intent"].(string)).Status; got != models.PaymentSucceeded {
+		t.Fatalf("got status %s, want success", got)
+	}
+
+	ts.expect(404, "POST", "/payment/off-session", fiber.Map{"customer_id": 999, "amount": 700, "currency": "usd"})
+	ts.expect(404, "POST", "/payment/off-session", fiber.Map{"customer_id": userID, "amount": 700, "currency": "usd", "payment_method": "pm_nope"})
+}
+
+func TestOffSessionPaymentNeedsAuthentication(t *testing.T) {
+	t.Setenv("PAYMENT_RECOVERY_URL", "https://shop.example/pay")
+	ts := newStripeTestServer(t)
+	userID, card := setupCard(t, ts, "ada@example.com", "pm_card_authenticationRequired")
+	ts.sync()
+
+	out := ts.expect(402, "POST", "/payment/off-session", fiber.Map{"customer_id": userID, "amount": 700, "currency": "usd", "payment_method": card})
+	id, _ := out["payment_intent"].(string)
+	if out["code"] != "authentication_required" || out["client_secret"] == nil || out["recovery_url"] != "https://shop.example/pay?payment_intent="+id {
+		t.Fatalf("got %v, want the customer sent to authenticate", out)
+	}
+	ts.sync()
+	if got := ts.payment(id).Status; got != models.PaymentRequiresAction {
+		t.Fatalf("got status %s, want requires_action", got)
+	}
+
+	// The customer comes back and authenticates on session.
+	ts.expect(200, "POST", "/payment/confirm", fiber.Map{"paymentIntentID": id, "payment_method": card, "return_url": "https://shop.example/done"})
+	if _, err := ts.stripe.AuthenticatePaymentIntent(id, true); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	if got := ts.payment(id).Status; got != models.PaymentSucceeded {
+		t.Fatalf("got status %s, want success", got)
+	}
+}
+
+func TestOffSessionPaymentWithMemoryProvider(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": "ada@example.com"})
+	userID := uint(out["customer_id"].(float64))
+	pm, err := p.ConfirmSetupIntent(out["setup_intent"].(string), "pm_card_authenticationRequired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.storage.SavePaymentMethod(context.Background(), &models.PaymentMethod{UserID: userID, StripePaymentMethodID: pm.ID, Type: "card"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out = ts.expect(402, "POST", "/payment/off-session", fiber.Map{"customer_id": userID, "amount": 700, "currency": "usd", "payment_method": pm.ID})
+	if _, ok := out["recovery_url"]; ok {
+		t.Fatalf("got %v, want no recovery_url without PAYMENT_RECOVERY_URL", out)
+	}
+	if got := ts.payment(out["payment_intent"].(string)).Status; got != models.PaymentRequiresAction {
+		t.Fatalf("got status %s, want requires_action", got)
+	}
+}
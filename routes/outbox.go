@@ -0,0 +1,442 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/stripe/stripe-go/v78"
+)
+
+const (
+	// outboxInterval is how often the worker looks for stuck entries.
+	outboxInterval = 30 * time.Second
+	// outboxGracePeriod keeps the worker away from entries whose request may
+	// still be in flight.
+	outboxGracePeriod = time.Minute
+	// outboxMaxAttempts is how many times persistence is tried before the
+	// remote object is compensated. Refunds are never compensated; they are
+	// retried for as long as it takes, with an alert from this attempt on.
+	outboxMaxAttempts = 5
+	outboxBatchSize   = 50
+)
+
+// The *Record types are the outbox payloads: everything needed to write the
+// local rows for a Stripe object after the original request has gone.
+
+type paymentRecord struct {
+	UserID        uint   `json:"user_id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	Method        string `json:"payment_method"`
+	IntentID      string `json:"payment_intent_id"`
+	CaptureMethod string `json:"capture_method,omitempty"`
+}
+
+type refundRecord struct {
+	PaymentID uint              `json:"payment_id"`
+	UserID    uint              `json:"user_id"`
+	Amount    int64             `json:"amount"`
+	Currency  string            `json:"currency"`
+	Status    string            `json:"status"`
+	RefundID  string            `json:"refund_id"`
+	Reason    string            `json:"reason,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+type subscriptionRecord struct {
+	UserID         uint   `json:"user_id"`
+	PaymentID      uint   `json:"payment_id"`
+	PriceID        uint   `json:"price_id,omitempty"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	Status         string `json:"status"`
+	SubscriptionID string `json:"subscription_id"`
+
+	TrialEnd *time.Time       `json:"trial_end,omitempty"`
+	Discount *models.Discount `json:"discount,omitempty"`
+}
+
+type checkoutSessionRecord struct {
+	UserID      uint   `json:"user_id"`
+	AmountTotal int64  `json:"amount_total"`
+	Currency    string `json:"currency"`
+	SessionID   string `json:"checkout_session_id"`
+	URL         string `json:"url"`
+}
+
+type paymentLinkRecord struct {
+	LinkID      string     `json:"payment_link_id"`
+	PriceID     string     `json:"price_id"`
+	URL         string     `json:"url"`
+	Amount      int64      `json:"amount"`
+	Currency    string     `json:"currency"`
+	Description string     `json:"description,omitempty"`
+	MaxPayments int64      `json:"max_payments,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type productRecord struct {
+	ProductID   string `json:"product_id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type priceRecord struct {
+	ProductID     uint   `json:"product_id"`
+	PriceID       string `json:"price_id"`
+	Code          string `json:"code"`
+	UnitAmount    int64  `json:"unit_amount"`
+	Currency      string `json:"currency"`
+	Interval      string `json:"interval,omitempty"`
+	IntervalCount int64  `json:"interval_count,omitempty"`
+}
+
+// errRefundNotCompensable is returned by compensate for refunds. A refund
+// can only be canceled while it is pending, and undoing one the customer was
+// told about would be worse than a missing local record.
+var errRefundNotCompensable = errors.New("refunds are not compensated")
+
+// recordRemote writes the outbox entry for a freshly created Stripe object.
+// If even that fails the object is compensated straight away, since nothing
+// would be left to find it later. A refund is left in place and alerted on.
+func (s *APIServer) recordRemote(ctx context.Context, kind, stripeID string, record interface{}) (uint, error) {
+	payload, err := json.Marshal(record)
+	if err == nil {
+		var id uint
+		id, err = s.storage.CreateOutboxEntry(ctx, kind, stripeID, payload)
+		if err == nil {
+			return id, nil
+		}
+	}
+
+	if kind == models.OutboxRefund {
+		log.Printf("ALERT: refund %s was issued but could not be recorded in the outbox, record it by hand: %v (payload %s)", stripeID, err, payload)
+		return 0, err
+	}
+
+	log.Printf("Failed to record %s %s in outbox, compensating: %v", kind, stripeID, err)
+	// The request context may be what failed, so compensate on a fresh one.
+	if cerr := s.compensate(context.Background(), kind, stripeID); cerr != nil {
+		log.Printf("Compensation of %s %s failed: %v", kind, stripeID, cerr)
+	}
+	return 0, err
+}
+
+// persistPayment writes the payment, its pending status and ledger entry and
+// closes the outbox entry, all as one unit of work.
+func (s *APIServer) persistPayment(ctx context.Context, outboxID uint, rec paymentRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		if _, err := insertPayment(ctx, tx, rec); err != nil {
+			return err
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+// insertPayment writes a pending payment and its ledger entry through tx and
+// returns the payment ID.
+func insertPayment(ctx context.Context, tx models.Storage, rec paymentRecord) (uint, error) {
+	payID, err := tx.CreatePayment(ctx, rec.UserID, rec.Name, rec.Email, rec.Amount, rec.Currency, rec.Method, rec.IntentID, rec.CaptureMethod)
+	if err != nil {
+		return 0, err
+	}
+
+	// Update payment status to pending
+	if err := tx.UpdatePaymentStatus(ctx, rec.IntentID, models.PaymentPending); err != nil {
+		return 0, err
+	}
+
+	if err := tx.LogTransaction(ctx, rec.UserID, "payment", rec.Amount, rec.Currency, &payID); err != nil {
+		return 0, err
+	}
+	return payID, nil
+}
+
+// persistRefund writes the refund and its ledger entry, adds it to the
+// payment's refunded total and moves the payment to partially_refunded or
+// refunded accordingly. Pending refunds count against the balance until they
+// fail or are canceled.
+func (s *APIServer) persistRefund(ctx context.Context, outboxID uint, rec refundRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		// The refund keeps the status Stripe reported; webhooks move it on.
+		status := refundStatus(stripe.RefundStatus(rec.Status))
+		refID, err := tx.CreateRefund(ctx, rec.PaymentID, rec.Amount, status, rec.RefundID, rec.Reason, rec.Metadata)
+		if err != nil {
+			return err
+		}
+
+		// A refund that failed outright never touched the balance.
+		if !status.Reversed() {
+			if err := tx.LogTransaction(ctx, rec.UserID, "refund", rec.Amount, rec.Currency, &refID); err != nil {
+				return err
+			}
+
+			p, err := tx.AddRefundedAmount(ctx, rec.PaymentID, rec.Amount)
+			if err != nil {
+				return err
+			}
+
+			if err := markRefunded(ctx, tx, p); err != nil {
+				return err
+			}
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+func (s *APIServer) persistSubscription(ctx context.Context, outboxID uint, rec subscriptionRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		if err := tx.CreateSubscription(ctx, rec.UserID, rec.PaymentID, rec.PriceID, rec.Amount, rec.Currency, rec.SubscriptionID, models.SubscriptionStatus(rec.Status)); err != nil {
+			return err
+		}
+		if rec.TrialEnd != nil {
+			if err := tx.UpdateSubscriptionTrial(ctx, rec.SubscriptionID, rec.TrialEnd); err != nil {
+				return err
+			}
+		}
+		if rec.Discount != nil {
+			if err := tx.UpdateSubscriptionDiscount(ctx, rec.SubscriptionID, rec.Discount); err != nil {
+				return err
+			}
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+// persistCheckoutSession writes the open session and closes the outbox
+// entry. The payment itself is written when the session completes.
+func (s *APIServer) persistCheckoutSession(ctx context.Context, outboxID uint, rec checkoutSessionRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		cs := &models.CheckoutSession{UserID: rec.UserID, StripeCheckoutSessionID: rec.SessionID, AmountTotal: rec.AmountTotal, Currency: rec.Currency, URL: rec.URL}
+		if err := tx.CreateCheckoutSession(ctx, cs); err != nil {
+			return err
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+func (s *APIServer) persistPaymentLink(ctx context.Context, outboxID uint, rec paymentLinkRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		pl := &models.PaymentLink{StripePaymentLinkID: rec.LinkID, StripePriceID: rec.PriceID, URL: rec.URL, Amount: rec.Amount, Currency: rec.Currency, Description: rec.Description, MaxPayments: rec.MaxPayments, ExpiresAt: rec.ExpiresAt}
+		if err := tx.CreatePaymentLink(ctx, pl); err != nil {
+			return err
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+func (s *APIServer) persistProduct(ctx context.Context, outboxID uint, rec productRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		p := &models.Product{StripeProductID: rec.ProductID, Name: rec.Name, Description: rec.Description}
+		if err := tx.CreateProduct(ctx, p); err != nil {
+			return err
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+func (s *APIServer) persistPrice(ctx context.Context, outboxID uint, rec priceRecord) error {
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		p := &models.Price{ProductID: rec.ProductID, StripePriceID: rec.PriceID, Code: rec.Code, UnitAmount: rec.UnitAmount, Currency: rec.Currency, Interval: rec.Interval, IntervalCount: rec.IntervalCount}
+		if err := tx.CreatePrice(ctx, p); err != nil {
+			return err
+		}
+
+		return tx.UpdateOutboxEntry(ctx, outboxID, models.OutboxCompleted, "")
+	})
+}
+
+// compensate undoes a remote object whose local rows could not be written.
+// Refunds cannot be undone; see errRefundNotCompensable.
+func (s *APIServer) compensate(ctx context.Context, kind, stripeID string) error {
+	var err error
+	switch kind {
+	case models.OutboxPaymentIntent:
+		_, err = s.provider.CancelPaymentIntent(ctx, stripeID, nil)
+	case models.OutboxRefund:
+		err = errRefundNotCompensable
+	case models.OutboxSubscription:
+		_, err = s.provider.CancelSubscription(ctx, stripeID, nil)
+	case models.OutboxCheckoutSession:
+		_, err = s.provider.ExpireCheckoutSession(ctx, stripeID, nil)
+	case models.OutboxPaymentLink:
+		_, err = s.provider.UpdatePaymentLink(ctx, stripeID, &stripe.PaymentLinkParams{Active: stripe.Bool(false)})
+	case models.OutboxProduct:
+		_, err = s.provider.UpdateProduct(ctx, stripeID, &stripe.ProductParams{Active: stripe.Bool(false)})
+	case models.OutboxPrice:
+		// Prices cannot be deleted; archive it and free its lookup key for a
+		// retry of the same code.
+		_, err = s.provider.UpdatePrice(ctx, stripeID, &stripe.PriceParams{Active: stripe.Bool(false), LookupKey: stripe.String("")})
+	default:
+		err = fmt.Errorf("unknown outbox kind %q", kind)
+	}
+	return err
+}
+
+// RunOutboxWorker processes stuck outbox entries every interval until ctx is
+// done.
+func (s *APIServer) RunOutboxWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.ProcessOutbox(ctx, time.Now().Add(-outboxGracePeriod)); err != nil {
+			log.Println("Outbox worker error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessOutbox makes one pass over pending entries last touched before
+// cutoff. Each entry is either persisted, retried on a later pass or, once
+// it runs out of attempts, compensated. Refunds out of attempts stay pending
+// and raise an alert on every further pass until they are recorded.
+func (s *APIServer) ProcessOutbox(ctx context.Context, cutoff time.Time) error {
+	entries, err := s.storage.GetPendingOutboxEntries(ctx, cutoff, outboxBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		err := s.retryPersist(ctx, e)
+		if err == nil {
+			log.Printf("Outbox: persisted %s %s", e.Kind, e.StripeID)
+			continue
+		}
+
+		if e.Attempts+1 < outboxMaxAttempts || e.Kind == models.OutboxRefund {
+			if e.Attempts+1 >= outboxMaxAttempts {
+				log.Printf("ALERT: Outbox: refund %s was issued but is still not recorded after %d attempts: %v", e.StripeID, e.Attempts+1, err)
+			} else {
+				log.Printf("Outbox: persisting %s %s failed (attempt %d): %v", e.Kind, e.StripeID, e.Attempts+1, err)
+			}
+			if uerr := s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxPending, err.Error()); uerr != nil {
+				log.Println("Outbox: failed to record attempt:", uerr)
+			}
+			continue
+		}
+
+		status := models.OutboxCompensated
+		reason := err.Error()
+		if cerr := s.compensate(ctx, e.Kind, e.StripeID); cerr != nil {
+			status = models.OutboxFailed
+			reason = fmt.Sprintf("%s; compensation failed: %v", reason, cerr)
+		}
+		log.Printf("Outbox: gave up persisting %s %s, marked %s: %s", e.Kind, e.StripeID, status, reason)
+		if uerr := s.storage.UpdateOutboxEntry(ctx, e.ID, status, reason); uerr != nil {
+			log.Println("Outbox: failed to record outcome:", uerr)
+		}
+	}
+
+	return nil
+}
+
+// retryPersist writes the local rows for an entry, treating rows that already
+// exist (a commit whose acknowledgement was lost) as success.
+func (s *APIServer) retryPersist(ctx context.Context, e *models.OutboxEntry) error {
+	switch e.Kind {
+	case models.OutboxPaymentIntent:
+		var rec paymentRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetPaymentDetails(ctx, rec.IntentID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistPayment(ctx, e.ID, rec)
+
+	case models.OutboxRefund:
+		var rec refundRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetRefundDetails(ctx, rec.RefundID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistRefund(ctx, e.ID, rec)
+
+	case models.OutboxSubscription:
+		var rec subscriptionRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetSubscriptionDetails(ctx, rec.SubscriptionID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistSubscription(ctx, e.ID, rec)
+
+	case models.OutboxCheckoutSession:
+		var rec checkoutSessionRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetCheckoutSession(ctx, rec.SessionID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistCheckoutSession(ctx, e.ID, rec)
+
+	case models.OutboxPaymentLink:
+		var rec paymentLinkRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetPaymentLink(ctx, rec.LinkID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistPaymentLink(ctx, e.ID, rec)
+
+	case models.OutboxProduct:
+		var rec productRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetProductByStripeID(ctx, rec.ProductID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistProduct(ctx, e.ID, rec)
+
+	case models.OutboxPrice:
+		var rec priceRecord
+		if err := json.Unmarshal(e.Payload, &rec); err != nil {
+			return err
+		}
+		if _, err := s.storage.GetPriceByStripeID(ctx, rec.PriceID); err == nil {
+			return s.storage.UpdateOutboxEntry(ctx, e.ID, models.OutboxCompleted, "")
+		} else if !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		return s.persistPrice(ctx, e.ID, rec)
+	}
+
+	return fmt.Errorf("unknown outbox kind %q", e.Kind)
+}
@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+var errDatabaseDown = errors.New("database unavailable")
+
+// flakyStorage fails payment or refund inserts, inside transactions too,
+// while the matching counter is above zero.
+type flakyStorage struct {
+	models.Storage
+	failPayments *int
+	failRefunds  *int
+}
+
+func newFlakyStorage() flakyStorage {
+	return flakyStorage{Storage: models.NewMemoryStorage(), failPayments: new(int), failRefunds: new(int)}
+}
+
+func (s flakyStorage) WithTx(ctx context.Context, fn func(tx models.Storage) error) error {
+	return s.Storage.WithTx(ctx, func(tx models.Storage) error {
+		return fn(flakyStorage{Storage: tx, failPayments: s.failPayments, failRefunds: s.failRefunds})
+	})
+}
+
+func (s flakyStorage) CreatePayment(ctx context.Context, userID uint, name, email string, amount int64, currency, method, intentID, captureMethod string) (uint, error) {
+	if *s.failPayments > 0 {
+		*s.failPayments--
+		return 0, errDatabaseDown
+	}
+	return s.Storage.CreatePayment(ctx, userID, name, email, amount, currency, method, intentID, captureMethod)
+}
+
+func (s flakyStorage) CreateRefund(ctx context.Context, paymentID uint, amount int64, status models.RefundStatus, stripeRefundID, reason string, metadata map[string]string) (uint, error) {
+	if *s.failRefunds > 0 {
+		*s.failRefunds--
+		return 0, errDatabaseDown
+	}
+	return s.Storage.CreateRefund(ctx, paymentID, amount, status, stripeRefundID, reason, metadata)
+}
+
+// processOutbox runs n passes of the outbox worker over every pending entry.
+func processOutbox(t *testing.T, ts *testServer, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := ts.srv.ProcessOutbox(context.Background(), time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pendingOutbox(t *testing.T, ts *testServer) []*models.OutboxEntry {
+	t.Helper()
+
+	entries, err := ts.storage.GetPendingOutboxEntries(context.Background(), time.Now().Add(time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestOutboxCompensatesUnrecordedPayment(t *testing.T) {
+	st := newFlakyStorage()
+	p := provider.NewMemoryProvider()
+	ts := newTestServerWith(t, st, p)
+
+	*st.failPayments = outboxMaxAttempts + 1
+	ts.expect(500, "POST", "/payment/intent", fiber.Map{
+		"name": "Test", "email": "ada@example.com", "amount": 1000, "currency": "usd", "payment_method": "card",
+	})
+	entries := pendingOutbox(t, ts)
+	if len(entries) != 1 || entries[0].Kind != models.OutboxPaymentIntent {
+		t.Fatalf("got outbox %+v, want the payment intent", entries)
+	}
+	id := entries[0].StripeID
+
+	processOutbox(t, ts, outboxMaxAttempts)
+
+	if entries := pendingOutbox(t, ts); len(entries) != 0 {
+		t.Fatalf("got pending entries %+v after running out of attempts", entries)
+	}
+	pi, err := p.GetPaymentIntent(context.Background(), id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Status != stripe.PaymentIntentStatusCanceled {
+		t.Fatalf("got intent status %s, want canceled", pi.Status)
+	}
+}
+
+func TestOutboxRetriesUnrecordedRefund(t *testing.T) {
+	st := newFlakyStorage()
+	p := provider.NewMemoryProvider()
+	ts := newTestServerWith(t, st, p)
+	id, userID := ts.createPayment("ada@example.com", 1000, "")
+	if err := p.SetPaymentIntentStatus(id, stripe.PaymentIntentStatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+
+	*st.failRefunds = 2 * outboxMaxAttempts
+	ts.expect(500, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+
+	// Well past the attempts other kinds get, the refund is still waiting to
+	// be recorded rather than undone.
+	processOutbox(t, ts, outboxMaxAttempts+2)
+	entries := pendingOutbox(t, ts)
+	if len(entries) != 1 || entries[0].Kind != models.OutboxRefund || entries[0].Attempts != outboxMaxAttempts+2 {
+		t.Fatalf("got outbox %+v, want the refund still pending", entries)
+	}
+	if got := ts.payment(id).AmountRefunded; got != 0 {
+		t.Fatalf("got amount refunded %d before the refund was recorded", got)
+	}
+
+	// Once the database is back the refund is recorded.
+	*st.failRefunds = 0
+	processOutbox(t, ts, 1)
+	if entries := pendingOutbox(t, ts); len(entries) != 0 {
+		t.Fatalf("got pending entries %+v after recovery", entries)
+	}
+	if got := ts.payment(id).AmountRefunded; got != 1000 {
+		t.Fatalf("got amount refunded %d, want 1000", got)
+	}
+	if got := ts.ledger(userID); len(got) != 2 || got[1] != "refund 1000" {
+		t.Fatalf("got ledger %v", got)
+	}
+}
+
+func TestRefundIsNotCompensated(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	if err := ts.srv.compensate(context.Background(), models.OutboxRefund, "re_123"); !errors.Is(err, errRefundNotCompensable) {
+		t.Fatalf("got %v, want errRefundNotCompensable", err)
+	}
+}
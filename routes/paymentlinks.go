@@ -0,0 +1,177 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+const (
+	// paymentLinkInterval is how often expired payment links are switched
+	// off.
+	paymentLinkInterval  = time.Minute
+	paymentLinkBatchSize = 50
+)
+
+// paymentLinkInactiveMessage is shown to customers opening a link that has
+// expired or reached its payment limit.
+const paymentLinkInactiveMessage = "This payment link has expired or is no longer accepting payments."
+
+// HandleCreatePaymentLink creates a shareable Stripe Payment Link, either for
+// an existing price or for an amount, which gets a price of its own. Stripe
+// links do not expire, so expires_at is enforced by RunPaymentLinkWorker;
+// max_payments is left to Stripe. Payments made through the link are
+// recorded when checkout.session.completed arrives.
+func (s *APIServer) HandleCreatePaymentLink(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		Amount      int64  `json:"amount"`
+		Currency    string `json:"currency"`
+		Description string `json:"description"`
+		Price       string `json:"price"`
+		Quantity    int64  `json:"quantity"`
+		MaxPayments int64  `json:"max_payments"`
+		ExpiresAt   int64  `json:"expires_at"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if (request.Price == "") == (request.Amount == 0) {
+		return c.Status(400).JSON(fiber.Map{"error": "Exactly one of price or amount is required"})
+	}
+	if request.Price == "" && (request.Amount < 0 || request.Currency == "" || request.Description == "") {
+		return c.Status(400).JSON(fiber.Map{"error": "amount must be positive and needs a currency and description"})
+	}
+	if request.Quantity == 0 {
+		request.Quantity = 1
+	}
+	if request.Quantity < 0 || request.MaxPayments < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "quantity and max_payments must not be negative"})
+	}
+	var expiresAt *time.Time
+	if request.ExpiresAt != 0 {
+		t := time.Unix(request.ExpiresAt, 0)
+		if !t.After(time.Now()) {
+			return c.Status(400).JSON(fiber.Map{"error": "expires_at must be in the future"})
+		}
+		expiresAt = &t
+	}
+
+	var price *stripe.Price
+	var err error
+	if request.Price != "" {
+		price, err = s.provider.GetPrice(ctx, request.Price, nil)
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			return c.Status(404).JSON(fiber.Map{"error": "Price not found"})
+		}
+	} else {
+		params := &stripe.PriceParams{
+			Currency:    stripe.String(request.Currency),
+			UnitAmount:  stripe.Int64(request.Amount),
+			ProductData: &stripe.PriceProductDataParams{Name: stripe.String(request.Description)},
+		}
+		forwardIdempotencyKey(&params.Params, idempotencyKey(c), "price")
+		price, err = s.provider.CreatePrice(ctx, params)
+	}
+	if err != nil {
+		log.Println("Price error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to prepare price"})
+	}
+
+	params := &stripe.PaymentLinkParams{
+		LineItems: []*stripe.PaymentLinkLineItemParams{{
+			Price:    stripe.String(price.ID),
+			Quantity: stripe.Int64(request.Quantity),
+		}},
+		// A customer for every payment lets the webhook tie it to a local one.
+		CustomerCreation: stripe.String(string(stripe.PaymentLinkCustomerCreationAlways)),
+		InactiveMessage:  stripe.String(paymentLinkInactiveMessage),
+	}
+	if request.MaxPayments > 0 {
+		params.Restrictions = &stripe.PaymentLinkRestrictionsParams{
+			CompletedSessions: &stripe.PaymentLinkRestrictionsCompletedSessionsParams{Limit: stripe.Int64(request.MaxPayments)},
+		}
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.CreatePaymentLink(ctx, params)
+	if err != nil {
+		log.Println("Payment Link error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create payment link"})
+	}
+
+	rec := paymentLinkRecord{LinkID: result.ID, PriceID: price.ID, URL: result.URL, Amount: price.UnitAmount * request.Quantity, Currency: string(price.Currency), Description: request.Description, MaxPayments: request.MaxPayments, ExpiresAt: expiresAt}
+	outboxID, err := s.recordRemote(ctx, models.OutboxPaymentLink, result.ID, rec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store payment link"})
+	}
+
+	if err := s.persistPaymentLink(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist payment link, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store payment link"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":      "Payment link created",
+		"payment_link": result.ID,
+		"url":          result.URL,
+		"price":        price.ID,
+		"amount":       rec.Amount,
+		"currency":     rec.Currency,
+		"max_payments": request.MaxPayments,
+		"expires_at":   expiresAt,
+	})
+}
+
+// RunPaymentLinkWorker switches off expired payment links every interval
+// until ctx is done.
+func (s *APIServer) RunPaymentLinkWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.ExpirePaymentLinks(ctx, time.Now()); err != nil {
+			log.Println("Payment link worker error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpirePaymentLinks deactivates, on Stripe and locally, the active links
+// whose expiry is at or before now. A link that fails is left for the next
+// pass.
+func (s *APIServer) ExpirePaymentLinks(ctx context.Context, now time.Time) error {
+	links, err := s.storage.GetExpiredPaymentLinks(ctx, now, paymentLinkBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, pl := range links {
+		params := &stripe.PaymentLinkParams{Active: stripe.Bool(false)}
+		if _, err := s.provider.UpdatePaymentLink(ctx, pl.StripePaymentLinkID, params); err != nil {
+			log.Printf("Failed to deactivate payment link %s: %v", pl.StripePaymentLinkID, err)
+			continue
+		}
+		if err := s.storage.DeactivatePaymentLink(ctx, pl.StripePaymentLinkID); err != nil {
+			log.Printf("Failed to record expiry of payment link %s: %v", pl.StripePaymentLinkID, err)
+			continue
+		}
+		log.Printf("Payment link %s expired", pl.StripePaymentLinkID)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// linkPayers returns the user IDs on the transactions /transactions lists for
+// query, oldest first.
+func (ts *testServer) linkPayers(query string) []uint {
+	ts.t.Helper()
+
+	var txs []models.Transaction
+	ts.get("/transactions?"+query, &txs)
+	var users []uint
+	for _, tx := range txs {
+		users = append(users, tx.UserID)
+	}
+	return users
+}
+
+func TestPaymentLinkRejectsInvalidRequest(t *testing.T) {
+	ts := newStripeTestServer(t)
+
+	ts.expect(400, "POST", "/payment/link", fiber.Map{})
+	ts.expect(400, "POST", "/payment/link", fiber.Map{"amount": 100, "price": "price_x"})
+	ts.expect(400, "POST", "/payment/link", fiber.Map{"amount": 100, "currency": "usd"})
+	ts.expect(404, "POST", "/payment/link", fiber.Map{"price": "price_nope"})
+	ts.expect(400, "POST", "/payment/link", fiber.Map{"amount": 100, "currency": "usd", "description": "Tickets", "expires_at": 1})
+}
+
+func TestPaymentLinkStopsAtMaxPayments(t *testing.T) {
+	ts := newStripeTestServer(t)
+
+	out := ts.expect(200, "POST", "/payment/link", fiber.Map{"amount": 1200, "currency": "usd", "description": "Tickets", "quantity": 2, "max_payments": 2})
+	link := out["payment_link"].(string)
+	if out["amount"] != float64(2400) || out["price"] == nil {
+		t.Fatalf("got %v, want a price for 2 tickets at 2400", out)
+	}
+
+	if _, err := ts.stripe.PayPaymentLink(link, "Ada", "ada@example.com", "pm_card_fail"); err == nil {
+		t.Fatal("failing card paid the link")
+	}
+	for _, payer := range []struct{ name, card string }{{"Ada", "pm_card_visa"}, {"Bob", "pm_card_threeDSecure"}} {
+		if _, err := ts.stripe.PayPaymentLink(link, payer.name, payer.name+"@example.com", payer.card); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.stripe.PayPaymentLink(link, "Cy", "cy@example.com", "pm_card_visa"); err == nil {
+		t.Fatal("link accepted a payment past its limit")
+	}
+	ts.sync()
+
+	pl, err := ts.storage.GetPaymentLink(context.Background(), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pl.Active {
+		t.Fatal("link still active after its last payment")
+	}
+
+	// Each payer is a new customer with the link's payment in their ledger.
+	payers := ts.linkPayers("payment_link=" + link)
+	if len(payers) != 2 || payers[0] == payers[1] {
+		t.Fatalf("got payers %v, want two customers", payers)
+	}
+	for _, userID := range payers {
+		if got := ts.ledger(userID); len(got) != 1 || got[0] != "payment 2400" {
+			t.Fatalf("got ledger %v for user %d, want one payment of 2400", got, userID)
+		}
+	}
+	if got := ts.linkPayers(fmt.Sprintf("user_id=%d&payment_link=%s", payers[1], link)); len(got) != 1 || got[0] != payers[1] {
+		t.Fatalf("got %v filtering by user and link, want only user %d", got, payers[1])
+	}
+	ts.expect(404, "GET", "/transactions?payment_link=plink_nope", nil)
+
+	report, err := ts.srv.ReplayWebhookEvents(context.Background(), models.WebhookEventFilter{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 0 {
+		t.Fatalf("got replay changes %+v, want none", report.Changes)
+	}
+}
+
+func TestPaymentLinkExpires(t *testing.T) {
+	ts := newStripeTestServer(t)
+
+	out := ts.expect(200, "POST", "/payment/link", fiber.Map{"amount": 1200, "currency": "usd", "description": "Tickets"})
+	out = ts.expect(200, "POST", "/payment/link", fiber.Map{"price": out["price"], "expires_at": time.Now().Add(time.Hour).Unix()})
+	link := out["payment_link"].(string)
+	if out["expires_at"] == nil {
+		t.Fatalf("got %v, want an expiry", out)
+	}
+
+	if _, err := ts.stripe.PayPaymentLink(link, "Dee", "dee@example.com", "pm_card_visa"); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	if got := ts.linkPayers("payment_link=" + link); len(got) != 1 {
+		t.Fatalf("got payers %v, want one", got)
+	}
+
+	if err := ts.srv.ExpirePaymentLinks(context.Background(), time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	pl, err := ts.storage.GetPaymentLink(context.Background(), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pl.Active {
+		t.Fatal("link still active after it expired")
+	}
+	if _, err := ts.stripe.PayPaymentLink(link, "Eve", "eve@example.com", "pm_card_visa"); err == nil {
+		t.Fatal("expired link accepted a payment")
+	}
+	ts.sync()
+}
+
+func TestPaymentLinkWithMemoryProvider(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+
+	out := ts.expect(200, "POST", "/payment/link", fiber.Map{"amount": 500, "currency": "eur", "description": "Donation", "max_payments": 1})
+	link := out["payment_link"].(string)
+
+	cs, err := p.PayPaymentLink(link, "Ada", "ada@example.com", "pm_card_visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.AmountTotal != 500 || cs.PaymentLink == nil || cs.PaymentLink.ID != link {
+		t.Fatalf("got session %+v, want 500 paid through %s", cs, link)
+	}
+	if _, err := p.PayPaymentLink(link, "Ada", "ada@example.com", "pm_card_visa"); err == nil {
+		t.Fatal("link accepted a payment past its limit")
+	}
+}
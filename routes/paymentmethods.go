@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"errors"
+	"log"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// savedPaymentMethod is the local copy of pm for customer userID.
+func savedPaymentMethod(userID uint, pm *stripe.PaymentMethod) *models.PaymentMethod {
+	saved := &models.PaymentMethod{
+		UserID:                userID,
+		StripePaymentMethodID: pm.ID,
+		Type:                  string(pm.Type),
+	}
+	if pm.Card != nil {
+		saved.Brand = string(pm.Card.Brand)
+		saved.Last4 = pm.Card.Last4
+		saved.ExpMonth = pm.Card.ExpMonth
+		saved.ExpYear = pm.Card.ExpYear
+		saved.Fingerprint = pm.Card.Fingerprint
+	}
+	return saved
+}
+
+// HandleCreateSetupIntent starts saving a card for later: the client
+// collects the card details against the returned client_secret, and the
+// saved payment method arrives by webhook once Stripe attaches it.
+func (s *APIServer) HandleCreateSetupIntent(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.Name == "" || request.Email == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name and email are required"})
+	}
+
+	stripeID, userID, err := s.HandleCreateCustomer(ctx, request.Name, request.Email, idempotencyKey(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create or retrieve user"})
+	}
+
+	params := &stripe.SetupIntentParams{
+		Customer:           stripe.String(stripeID),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.CreateSetupIntent(ctx, params)
+	if err != nil {
+		log.Println("SetupIntent error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Setup failed"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":       "Setup initiated",
+		"setup_intent":  result.ID,
+		"client_secret": result.ClientSecret,
+		"customer_id":   userID,
+	})
+}
+
+func (s *APIServer) HandleListPaymentMethods(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	userID, err := c.ParamsInt("id")
+	if err != nil || userID <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid customer ID"})
+	}
+
+	if _, err := s.storage.GetCustomer(ctx, uint(userID)); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Customer not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve customer"})
+	}
+
+	pms, err := s.storage.GetPaymentMethods(ctx, uint(userID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment methods"})
+	}
+	if pms == nil {
+		pms = []*models.PaymentMethod{}
+	}
+
+	return c.JSON(fiber.Map{"payment_methods": pms})
+}
+
+// paymentMethodRequest names a saved payment method and the customer it must
+// belong to.
+type paymentMethodRequest struct {
+	CustomerID    uint   `json:"customer_id"`
+	PaymentMethod string `json:"payment_method"`
+}
+
+// ownedPaymentMethod parses a paymentMethodRequest and looks the payment
+// method up, answering the request itself when that fails.
+func (s *APIServer) ownedPaymentMethod(c *fiber.Ctx) (*models.PaymentMethod, bool, error) {
+	var request paymentMethodRequest
+	if err := c.BodyParser(&request); err != nil {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.CustomerID == 0 || request.PaymentMethod == "" {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "customer_id and payment_method are required"})
+	}
+
+	pm, err := s.storage.GetPaymentMethod(c.UserContext(), request.PaymentMethod)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && pm.UserID != request.CustomerID) {
+		return nil, false, c.Status(404).JSON(fiber.Map{"error": "Payment method not found"})
+	}
+	if err != nil {
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment method"})
+	}
+	return pm, true, nil
+}
+
+func (s *APIServer) HandleDetachPaymentMethod(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	pm, ok, err := s.ownedPaymentMethod(c)
+	if !ok {
+		return err
+	}
+
+	params := &stripe.PaymentMethodDetachParams{}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+	if _, err := s.provider.DetachPaymentMethod(ctx, pm.StripePaymentMethodID, params); err != nil {
+		log.Println("PaymentMethod detach error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Detach failed"})
+	}
+
+	// The payment_method.detached webhook may have removed it already.
+	if err := s.storage.DeletePaymentMethod(ctx, pm.StripePaymentMethodID); err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Println("Failed to delete payment method:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete payment method"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Payment method detached",
+		"payment_method": pm.StripePaymentMethodID,
+	})
+}
+
+// HandleSetDefaultPaymentMethod makes a saved payment method the one Stripe
+// charges for the customer's invoices and the one listed first.
+func (s *APIServer) HandleSetDefaultPaymentMethod(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	pm, ok, err := s.ownedPaymentMethod(c)
+	if !ok {
+		return err
+	}
+
+	user, err := s.storage.GetCustomer(ctx, pm.UserID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve customer"})
+	}
+
+	params := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm.StripePaymentMethodID),
+		},
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+	if _, err := s.provider.UpdateCustomer(ctx, user.StripeID, params); err != nil {
+		log.Println("Customer update error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set default payment method"})
+	}
+
+	if err := s.storage.SetDefaultPaymentMethod(ctx, user.ID, pm.StripePaymentMethodID); err != nil {
+		log.Println("Failed to store default payment method:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set default payment method"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Default payment method updated",
+		"payment_method": pm.StripePaymentMethodID,
+	})
+}
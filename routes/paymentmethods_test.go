@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupCard starts a setup intent for the customer with the given email and
+// saves the test card at Stripe, returning the customer ID and the new
+// payment method's ID.
+func setupCard(t *testing.T, ts *testServer, email, card string) (uint, string) {
+	t.Helper()
+
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": email})
+	pm, err := ts.stripe.ConfirmSetupIntent(out["setup_intent"].(string), card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint(out["customer_id"].(float64)), pm.ID
+}
+
+// paymentMethods lists a customer's saved cards as "brand last4", with the
+// default marked by a trailing "*".
+func (ts *testServer) paymentMethods(userID uint) []string {
+	ts.t.Helper()
+
+	var out struct {
+		PaymentMethods []models.PaymentMethod `json:"payment_methods"`
+	}
+	ts.get(fmt.Sprintf("/customer/%d/payment-methods", userID), &out)
+	var cards []string
+	for _, pm := range out.PaymentMethods {
+		card := pm.Brand + " " + pm.Last4
+		if pm.IsDefault {
+			card += " *"
+		}
+		cards = append(cards, card)
+	}
+	return cards
+}
+
+func TestSavedPaymentMethods(t *testing.T) {
+	ts := newStripeTestServer(t)
+	userID, visa := setupCard(t, ts, "ada@example.com", "pm_card_visa")
+	again, _ := setupCard(t, ts, "ada@example.com", "pm_card_mastercard")
+	if again != userID {
+		t.Fatalf("got customer %d for a second card, want %d", again, userID)
+	}
+
+	// Cards are saved once Stripe reports them attached.
+	if got := ts.paymentMethods(userID); len(got) != 0 {
+		t.Fatalf("got %v before webhooks, want none", got)
+	}
+	ts.sync()
+	if got, want := ts.paymentMethods(userID), []string{"mastercard 4444", "visa 4242"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	ts.expect(200, "POST", "/customer/payment-methods/default", fiber.Map{"customer_id": userID, "payment_method": visa})
+	ts.expect(404, "POST", "/customer/payment-methods/default", fiber.Map{"customer_id": 99, "payment_method": visa})
+	ts.sync()
+	if got, want := ts.paymentMethods(userID), []string{"visa 4242 *", "mastercard 4444"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	ts.expect(200, "POST", "/customer/payment-methods/detach", fiber.Map{"customer_id": userID, "payment_method": visa})
+	ts.sync()
+	if got, want := ts.paymentMethods(userID), []string{"mastercard 4444"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	ts.expect(404, "GET", "/customer/999/payment-methods", nil)
+	ts.expect(400, "GET", "/customer/x/payment-methods", nil)
+}
+
+func TestSetupIntentWithMemoryProvider(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": "ada@example.com"})
+	pm, err := p.ConfirmSetupIntent(out["setup_intent"].(string), "pm_card_amex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm.Card == nil || pm.Card.Brand != "amex" {
+		t.Fatalf("got payment method %+v, want an amex card", pm)
+	}
+
+	ts.expect(400, "POST", "/customer/setup-intent", fiber.Map{"name": "", "email": "ada@example.com"})
+}
+
+// subscriber returns a customer whose default payment method is a saved Visa
+// card, ready to subscribe.
+func subscriber(t *testing.T, ts *testServer, email string) uint {
+	t.Helper()
+
+	userID, visa := setupCard(t, ts, email, "pm_card_visa")
+	ts.sync()
+	ts.expect(200, "POST", "/customer/payment-methods/default", fiber.Map{"customer_id": userID, "payment_method": visa})
+	return userID
+}
@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"context"
+	"log"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	failedRefundsLimit    = 50
+	maxFailedRefundsLimit = 500
+)
+
+// markRefunded moves a payment to partially_refunded or refunded to match its
+// refunded total.
+func markRefunded(ctx context.Context, tx models.Storage, p *models.Payment) error {
+	// A charge.refunded webhook may already have closed the payment while an
+	// earlier partial refund waited in the outbox.
+	if p.Status == models.PaymentRefunded {
+		return nil
+	}
+
+	status := models.PaymentPartiallyRefunded
+	if p.AmountRefunded == p.CapturedAmount() {
+		status = models.PaymentRefunded
+	}
+
+	// Stripe only refunds successful charges, so catch up on a
+	// payment_intent.succeeded webhook that has not been applied yet.
+	if !p.Status.CanTransitionTo(status) && p.Status.CanTransitionTo(models.PaymentSucceeded) {
+		if err := tx.UpdatePaymentStatus(ctx, p.StripePaymentID, models.PaymentSucceeded); err != nil {
+			return err
+		}
+	}
+	return tx.UpdatePaymentStatus(ctx, p.StripePaymentID, status)
+}
+
+// applyRefundStatus moves a refund to status. The first time a refund fails
+// or is canceled its amount goes back to the payment and the ledger gets a
+// matching refund_reversal entry.
+func applyRefundStatus(ctx context.Context, tx models.Storage, stripeRefundID string, status models.RefundStatus) error {
+	from, err := tx.UpdateRefundStatus(ctx, stripeRefundID, status)
+	if err != nil {
+		return err
+	}
+	if !status.Reversed() || from.Reversed() {
+		return nil
+	}
+
+	r, err := tx.GetRefundDetails(ctx, stripeRefundID)
+	if err != nil {
+		return err
+	}
+
+	p, err := tx.AddRefundedAmount(ctx, r.PaymentID, -r.Amount)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.LogTransaction(ctx, p.UserID, "refund_reversal", r.Amount, p.Currency, &r.ID); err != nil {
+		return err
+	}
+	log.Printf("Refund %s %s, %d %s returned to payment %s", stripeRefundID, status, r.Amount, p.Currency, p.StripePaymentID)
+
+	// Only undo the refunded status; a payment that has since been disputed
+	// keeps its status.
+	if p.Status != models.PaymentRefunded && p.Status != models.PaymentPartiallyRefunded {
+		return nil
+	}
+	next := models.PaymentPartiallyRefunded
+	if p.AmountRefunded == 0 {
+		next = models.PaymentSucceeded
+	}
+	return tx.UpdatePaymentStatus(ctx, p.StripePaymentID, next)
+}
+
+// HandleFailedRefunds lists the most recent failed refunds so they can be
+// followed up, for example by paying the customer another way.
+func (s *APIServer) HandleFailedRefunds(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	limit := c.QueryInt("limit", failedRefundsLimit)
+	if limit <= 0 || limit > maxFailedRefundsLimit {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid limit"})
+	}
+
+	refunds, err := s.storage.GetFailedRefunds(ctx, limit)
+	if err != nil {
+		log.Println("Failed to fetch failed refunds:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch refunds"})
+	}
+
+	return c.JSON(fiber.Map{"refunds": refunds})
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+func TestPartialAndMultipleRefunds(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, userID := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, id, 1000)
+
+	out := ts.expect(200, "POST", "/payment/refund", fiber.Map{
+		"paymentIntentID": id, "amount": 300, "reason": "requested_by_customer", "metadata": map[string]string{"ticket": "T-1"},
+	})
+	if out["amount"] != float64(300) || out["remaining"] != float64(700) {
+		t.Fatalf("got %v", out)
+	}
+	r, err := ts.storage.GetRefundDetails(context.Background(), out["refund_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Amount != 300 || r.Reason != "requested_by_customer" || r.Metadata["ticket"] != "T-1" {
+		t.Fatalf("got refund %+v", r)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentPartiallyRefunded || p.AmountRefunded != 300 {
+		t.Fatalf("got status %s with %d refunded, want partially_refunded with 300", p.Status, p.AmountRefunded)
+	}
+
+	out = ts.expect(400, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 800})
+	if out["remaining"] != float64(700) {
+		t.Fatalf("over-refund: got %v, want the remaining 700 reported", out)
+	}
+	ts.expect(400, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": -5})
+	ts.expect(400, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "reason": "changed_mind"})
+	ts.expect(400, "POST", "/payment/refund", fiber.Map{"amount": 100})
+
+	// Leaving out the amount refunds what remains.
+	out = ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	if out["amount"] != float64(700) || out["remaining"] != float64(0) {
+		t.Fatalf("got %v", out)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentRefunded || p.AmountRefunded != 1000 {
+		t.Fatalf("got status %s with %d refunded, want refunded with 1000", p.Status, p.AmountRefunded)
+	}
+	ts.expect(409, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+
+	want := []string{"payment 1000", "refund 300", "refund 700"}
+	if got := ts.ledger(userID); !slices.Equal(got, want) {
+		t.Fatalf("got ledger %v, want %v", got, want)
+	}
+	want = []string{"pending", "success", "partially_refunded", "refunded"}
+	if got := ts.history("payment", id); !slices.Equal(got, want) {
+		t.Fatalf("got history %v, want %v", got, want)
+	}
+}
+
+func TestFailedRefundIsReversed(t *testing.T) {
+	ts := newStripeTestServer(t)
+	id, userID := ts.createPayment("ada@example.com", 1000, "")
+	if _, err := ts.stripe.ConfirmPaymentIntent(id, "pm_card_visa"); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+
+	out := ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 400})
+	bounced := out["refund_id"].(string)
+	ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	ts.sync()
+
+	if _, err := ts.stripe.FailRefund(bounced, stripe.RefundFailureReasonExpiredOrCanceledCard); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+
+	r, err := ts.storage.GetRefundDetails(context.Background(), bounced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != models.RefundFailed {
+		t.Fatalf("got refund status %s, want failed", r.Status)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentPartiallyRefunded || p.AmountRefunded != 600 {
+		t.Fatalf("got status %s with %d refunded, want partially_refunded with 600", p.Status, p.AmountRefunded)
+	}
+	want := []string{"payment 1000", "refund 400", "refund 600", "refund_reversal 400"}
+	if got := ts.ledger(userID); !slices.Equal(got, want) {
+		t.Fatalf("got ledger %v, want %v", got, want)
+	}
+
+	out = ts.expectAdmin(200, "GET", "/admin/refunds/failed", nil)
+	refunds, _ := out["refunds"].([]interface{})
+	if len(refunds) != 1 || refunds[0].(map[string]interface{})["stripe_refund_id"] != bounced {
+		t.Fatalf("got failed refunds %v, want %s", out, bounced)
+	}
+	ts.expectAdmin(400, "GET", "/admin/refunds/failed?limit=0", nil)
+
+	// Replaying the history reverses nothing twice.
+	ts.expectAdmin(200, "POST", "/admin/webhooks/replay", fiber.Map{})
+	if got := ts.ledger(userID); !slices.Equal(got, want) {
+		t.Fatalf("got ledger %v after replay, want %v", got, want)
+	}
+
+	// The amount given back can be refunded again, another way.
+	out = ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	if out["amount"] != float64(400) {
+		t.Fatalf("got %v, want the bounced 400 refundable again", out)
+	}
+}
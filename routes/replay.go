@@ -0,0 +1,239 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// errDryRun rolls back the unit of work of a dry-run replay.
+var errDryRun = errors.New("dry run")
+
+// ReplayReport describes a webhook replay: every event it went through and
+// every status it changed or, in a dry run, would have changed.
+type ReplayReport struct {
+	DryRun  bool            `json:"dry_run"`
+	Events  []ReplayedEvent `json:"events"`
+	Changes []StatusChange  `json:"changes"`
+}
+
+type ReplayedEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// StatusChange is one status write made by an event. Kind is payment, refund
+// or subscription and StripeID identifies the object.
+type StatusChange struct {
+	EventID  string `json:"event_id"`
+	Kind     string `json:"kind"`
+	StripeID string `json:"stripe_id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// ReplayWebhookEvents runs the stored events matching f back through the
+// webhook logic, oldest first, as one unit of work. Stale checks are skipped
+// since history is replayed in order. The processing log is left untouched.
+// With dryRun set the writes are rolled back and only reported.
+func (s *APIServer) ReplayWebhookEvents(ctx context.Context, f models.WebhookEventFilter, dryRun bool) (*ReplayReport, error) {
+	events, err := s.storage.ListWebhookEvents(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReplayReport{DryRun: dryRun, Events: []ReplayedEvent{}, Changes: []StatusChange{}}
+	err = s.storage.WithTx(ctx, func(tx models.Storage) error {
+		rec := &changeRecorder{Storage: tx, changes: &report.Changes}
+
+		for _, e := range events {
+			r := ReplayedEvent{ID: e.ID, Type: e.Type}
+
+			event, err := decodeWebhookEvent(e)
+			if err == nil {
+				rec.eventID = e.ID
+				r.Outcome, err = applyWebhookEvent(ctx, rec, event)
+			}
+			if errors.Is(err, errInvalidPayload) {
+				r.Outcome, r.Error = "invalid", err.Error()
+			} else if err != nil {
+				return fmt.Errorf("replaying %s: %w", e.ID, err)
+			}
+
+			report.Events = append(report.Events, r)
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// changeRecorder is a Storage that notes the status changes made through it.
+type changeRecorder struct {
+	models.Storage
+	eventID string
+	changes *[]StatusChange
+}
+
+func (r *changeRecorder) WithTx(ctx context.Context, fn func(tx models.Storage) error) error {
+	return r.Storage.WithTx(ctx, func(tx models.Storage) error {
+		return fn(&changeRecorder{Storage: tx, eventID: r.eventID, changes: r.changes})
+	})
+}
+
+func (r *changeRecorder) record(kind, stripeID, from, to string) {
+	if from != to {
+		*r.changes = append(*r.changes, StatusChange{EventID: r.eventID, Kind: kind, StripeID: stripeID, From: from, To: to})
+	}
+}
+
+func (r *changeRecorder) UpdatePaymentStatus(ctx context.Context, stripeID string, status models.PaymentStatus) error {
+	p, err := r.Storage.GetPaymentDetails(ctx, stripeID)
+	if err != nil {
+		return err
+	}
+	if err := r.Storage.UpdatePaymentStatus(ctx, stripeID, status); err != nil {
+		return err
+	}
+	r.record(models.EntityPayment, stripeID, string(p.Status), string(status))
+	return nil
+}
+
+func (r *changeRecorder) UpdateRefundStatus(ctx context.Context, stripeID string, status models.RefundStatus) (models.RefundStatus, error) {
+	from, err := r.Storage.UpdateRefundStatus(ctx, stripeID, status)
+	if err != nil {
+		return from, err
+	}
+	r.record(models.EntityRefund, stripeID, string(from), string(status))
+	return from, nil
+}
+
+func (r *changeRecorder) UpdateSubscriptionStatus(ctx context.Context, stripeID string, status models.SubscriptionStatus) error {
+	sub, err := r.Storage.GetSubscriptionDetails(ctx, stripeID)
+	if err != nil {
+		return err
+	}
+	if err := r.Storage.UpdateSubscriptionStatus(ctx, stripeID, status); err != nil {
+		return err
+	}
+	r.record(models.EntitySubscription, stripeID, string(sub.Status), string(status))
+	return nil
+}
+
+func (r *changeRecorder) UpdateCheckoutSession(ctx context.Context, stripeID string, status models.CheckoutSessionStatus, paymentID *uint) error {
+	cs, err := r.Storage.GetCheckoutSession(ctx, stripeID)
+	if err != nil {
+		return err
+	}
+	if err := r.Storage.UpdateCheckoutSession(ctx, stripeID, status, paymentID); err != nil {
+		return err
+	}
+	r.record(models.EntityCheckoutSession, stripeID, string(cs.Status), string(status))
+	return nil
+}
+
+// adminOnly guards the admin API with the bearer token in ADMIN_API_TOKEN.
+// Without a token configured the admin API is disabled.
+func (s *APIServer) adminOnly(c *fiber.Ctx) error {
+	token := os.Getenv("ADMIN_API_TOKEN")
+	if token == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "admin API is disabled"})
+	}
+
+	given, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid admin token"})
+	}
+	return c.Next()
+}
+
+func (s *APIServer) HandleReplayWebhooks(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		EventID string    `json:"event_id"`
+		Type    string    `json:"type"`
+		From    time.Time `json:"from"`
+		To      time.Time `json:"to"`
+		Limit   int       `json:"limit"`
+		DryRun  bool      `json:"dry_run"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	f := models.WebhookEventFilter{ID: request.EventID, Type: request.Type, From: request.From, To: request.To, Limit: request.Limit}
+	report, err := s.ReplayWebhookEvents(ctx, f, request.DryRun)
+	if err != nil {
+		log.Println("Webhook replay failed:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Replay failed"})
+	}
+
+	return c.JSON(report)
+}
+
+// HandleOverrideStatus sets a payment's or subscription's status outside the
+// transition table. Replay goes through the table, so a row a bad event moved
+// to a final status such as canceled or dispute_lost can only be repaired
+// here. The change is recorded in the status history.
+func (s *APIServer) HandleOverrideStatus(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		Kind     string `json:"kind"`
+		StripeID string `json:"stripe_id"`
+		Status   string `json:"status"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if request.StripeID == "" || request.Status == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "stripe_id and status are required"})
+	}
+
+	var from string
+	var err error
+	switch request.Kind {
+	case models.EntityPayment:
+		var f models.PaymentStatus
+		f, err = s.storage.OverridePaymentStatus(ctx, request.StripeID, models.PaymentStatus(request.Status))
+		from = string(f)
+	case models.EntitySubscription:
+		var f models.SubscriptionStatus
+		f, err = s.storage.OverrideSubscriptionStatus(ctx, request.StripeID, models.SubscriptionStatus(request.Status))
+		from = string(f)
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "kind must be payment or subscription"})
+	}
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": fmt.Sprintf("No %s found for %s", request.Kind, request.StripeID)})
+	case errors.Is(err, models.ErrInvalidTransition):
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unknown %s status %q", request.Kind, request.Status)})
+	case err != nil:
+		log.Println("Status override failed:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to override status"})
+	}
+
+	log.Printf("Admin override: %s %s moved from %s to %s", request.Kind, request.StripeID, from, request.Status)
+	return c.JSON(fiber.Map{"kind": request.Kind, "stripe_id": request.StripeID, "from": from, "to": request.Status})
+}
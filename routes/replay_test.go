@@ -0,0 +1,162 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func replay(t *testing.T, ts *testServer, body fiber.Map) ReplayReport {
+	t.Helper()
+
+	header := http.Header{fiber.HeaderAuthorization: {"Bearer " + testAdminToken}}
+	status, raw := ts.request("POST", "/admin/webhooks/replay", body, header)
+	if status != 200 {
+		t.Fatalf("replay: got status %d: %s", status, raw)
+	}
+	var report ReplayReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// lateEvent delivers payment_intent.succeeded for an intent the gateway
+// does not know yet, then records the payment, as if its row was written
+// after the webhook had been processed and ignored.
+func lateEvent(t *testing.T, ts *testServer) (eventID, intentID string) {
+	t.Helper()
+	ctx := context.Background()
+
+	intentID = "pi_late"
+	event := ts.deliver("payment_intent.succeeded", time.Now(), intentObject(intentID, "succeeded", 1000))
+	ts.processWebhooks()
+	if e := webhookEvent(t, ts, event.ID); e.Outcome != models.WebhookIgnored {
+		t.Fatalf("got outcome %s for an unknown intent, want ignored", e.Outcome)
+	}
+
+	_, userID, err := ts.storage.CreateCustomer(ctx, "Test", "ada@example.com", "cus_late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.storage.CreatePayment(ctx, userID, "Test", "ada@example.com", 1000, "usd", "card", intentID, models.CaptureAutomatic); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.storage.UpdatePaymentStatus(ctx, intentID, models.PaymentPending); err != nil {
+		t.Fatal(err)
+	}
+	return event.ID, intentID
+}
+
+func TestReplayDryRunReportsWithoutWriting(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	eventID, intentID := lateEvent(t, ts)
+
+	report := replay(t, ts, fiber.Map{"event_id": eventID, "dry_run": true})
+	if !report.DryRun || len(report.Events) != 1 || report.Events[0].Outcome != models.WebhookProcessed {
+		t.Fatalf("got report %+v", report)
+	}
+	want := StatusChange{EventID: eventID, Kind: "payment", StripeID: intentID, From: "pending", To: "success"}
+	if len(report.Changes) != 1 || report.Changes[0] != want {
+		t.Fatalf("got changes %+v, want %+v", report.Changes, want)
+	}
+	if p := ts.payment(intentID); p.Status != models.PaymentPending {
+		t.Fatalf("dry run changed the status to %s", p.Status)
+	}
+}
+
+func TestReplayAppliesMatchingEvents(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	eventID, intentID := lateEvent(t, ts)
+
+	report := replay(t, ts, fiber.Map{"type": "payment_intent.canceled"})
+	if len(report.Events) != 0 {
+		t.Fatalf("type filter: got events %+v", report.Events)
+	}
+	report = replay(t, ts, fiber.Map{"to": time.Now().Add(-time.Hour)})
+	if len(report.Events) != 0 {
+		t.Fatalf("time filter: got events %+v", report.Events)
+	}
+
+	report = replay(t, ts, fiber.Map{"type": "payment_intent.succeeded"})
+	if len(report.Events) != 1 || report.Events[0].ID != eventID || len(report.Changes) != 1 {
+		t.Fatalf("got report %+v", report)
+	}
+	if p := ts.payment(intentID); p.Status != models.PaymentSucceeded {
+		t.Fatalf("got status %s after replay, want success", p.Status)
+	}
+	// The processing log keeps the original outcome.
+	if e := webhookEvent(t, ts, eventID); e.Outcome != models.WebhookIgnored {
+		t.Fatalf("got outcome %s after replay, want the original ignored", e.Outcome)
+	}
+
+	// Replaying again changes nothing.
+	if report := replay(t, ts, fiber.Map{}); len(report.Changes) != 0 {
+		t.Fatalf("second replay: got changes %+v", report.Changes)
+	}
+}
+
+func TestReplayRequiresAdminToken(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	if status, _ := ts.do("POST", "/admin/webhooks/replay", fiber.Map{}); status != 401 {
+		t.Fatalf("no token: got %d, want 401", status)
+	}
+	header := http.Header{fiber.HeaderAuthorization: {"Bearer wrong"}}
+	if status, _ := ts.send("POST", "/admin/webhooks/replay", fiber.Map{}, header); status != 401 {
+		t.Fatalf("wrong token: got %d, want 401", status)
+	}
+
+	t.Setenv("ADMIN_API_TOKEN", "")
+	if status, _ := ts.do("POST", "/admin/webhooks/replay", fiber.Map{}); status != 404 {
+		t.Fatalf("admin API disabled: got %d, want 404", status)
+	}
+}
+
+func TestOverrideRepairsFinalStatus(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	succeed(t, ts, id, 1000)
+
+	// A lost dispute is final, so neither events nor replay can undo it.
+	dispute := func(status string) map[string]interface{} {
+		return map[string]interface{}{"id": "dp_1", "object": "dispute", "payment_intent": id, "amount": 1000, "status": status}
+	}
+	now := time.Now()
+	ts.deliver("charge.dispute.created", now, dispute("needs_response"))
+	ts.deliver("charge.dispute.closed", now.Add(time.Second), dispute("lost"))
+	ts.processWebhooks()
+	if p := ts.payment(id); p.Status != models.PaymentDisputeLost {
+		t.Fatalf("got status %s, want dispute_lost", p.Status)
+	}
+
+	body := fiber.Map{"kind": "payment", "stripe_id": id, "status": "success"}
+	if status, _ := ts.send("POST", "/admin/status", body, nil); status != 401 {
+		t.Fatalf("without the admin token: got %d, want 401", status)
+	}
+	out := ts.expectAdmin(200, "POST", "/admin/status", body)
+	if out["from"] != "dispute_lost" || out["to"] != "success" {
+		t.Fatalf("got %v", out)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentSucceeded {
+		t.Fatalf("got status %s after the override, want success", p.Status)
+	}
+	if got := ts.history(models.EntityPayment, id); got[len(got)-1] != "success" || got[len(got)-2] != "dispute_lost" {
+		t.Fatalf("got history %v, want the override recorded", got)
+	}
+
+	ts.storeSubscription("sub_123", models.SubscriptionCanceled)
+	ts.expectAdmin(200, "POST", "/admin/status", fiber.Map{"kind": "subscription", "stripe_id": "sub_123", "status": "active"})
+	if sub := ts.subscription("sub_123"); sub.Status != models.SubscriptionActive {
+		t.Fatalf("got subscription status %s, want active", sub.Status)
+	}
+
+	ts.expectAdmin(400, "POST", "/admin/status", fiber.Map{"kind": "payment", "stripe_id": id, "status": "bogus"})
+	ts.expectAdmin(400, "POST", "/admin/status", fiber.Map{"kind": "refund", "stripe_id": "re_1", "status": "refunded"})
+	ts.expectAdmin(404, "POST", "/admin/status", fiber.Map{"kind": "payment", "stripe_id": "pi_missing", "status": "success"})
+}
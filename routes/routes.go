@@ -1,62 +1,153 @@
 package routes
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stripe/stripe-go/v78"
-	"github.com/stripe/stripe-go/v78/customer"
-	"github.com/stripe/stripe-go/v78/paymentintent"
-	"github.com/stripe/stripe-go/v78/refund"
-	"github.com/stripe/stripe-go/v78/subscription"
 	"github.com/stripe/stripe-go/v78/webhook"
 )
 
-var stripeKey = os.Getenv("STRIPE_SECRET_KEY")
-
 type APIServer struct {
 	listenAddr string
 	storage    models.Storage
+	provider   provider.PaymentProvider
+
+	// requestTimeout bounds how long a request may take, storage and
+	// Stripe calls included. Zero leaves requests without a deadline.
+	requestTimeout time.Duration
+
+	webhookWake chan struct{}
 }
 
-func NewAPIServer(listenAddr string, storage models.Storage) *APIServer {
+func NewAPIServer(listenAddr string, storage models.Storage, paymentProvider provider.PaymentProvider) *APIServer {
 	return &APIServer{listenAddr: listenAddr,
-		storage: storage}
+		storage:     storage,
+		provider:    paymentProvider,
+		webhookWake: make(chan struct{}, 1)}
 }
 
-func (s *APIServer) Run() {
+// SetRequestTimeout sets the deadline given to the context of every request.
+func (s *APIServer) SetRequestTimeout(d time.Duration) {
+	s.requestTimeout = d
+}
+
+// requestContext hands the rest of the chain a context derived from the
+// request, ending when the server shuts down or the request timeout runs
+// out. Handlers read it with c.UserContext.
+func (s *APIServer) requestContext(c *fiber.Ctx) error {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if s.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(c.Context(), s.requestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(c.Context())
+	}
+	defer cancel()
+
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// App builds the fiber application with every route registered, without
+// starting a listener. Tests drive it through app.Test.
+func (s *APIServer) App() *fiber.App {
 	app := fiber.New()
+	app.Use(s.requestContext)
 
 	api1 := app.Group("/payment")
 	api2 := app.Group("/subscription")
+	api3 := app.Group("/customer")
+	api4 := app.Group("/checkout")
+	catalog := app.Group("/catalog")
 
-	api1.Post("/intent", s.HandlePaymentRequest)
+	api1.Post("/intent", s.idempotent, s.HandlePaymentRequest)
+	api1.Post("/confirm", s.idempotent, s.HandleConfirmPayment)
 	api1.Post("/webhook", s.HandleStripeWebhook)
-	api1.Post("/refund", s.HandlePaymentRefund)
-	api1.Post("/cancel", s.HandleCancelPayment)
-
-	api2.Post("/create", s.HandleCreateSubscription)
-	api2.Post("/cancel", s.HandleCancelSubscription)
+	api1.Post("/refund", s.idempotent, s.HandlePaymentRefund)
+	api1.Post("/cancel", s.idempotent, s.HandleCancelPayment)
+	api1.Post("/capture", s.idempotent, s.HandleCapturePayment)
+	api1.Post("/void", s.idempotent, s.HandleVoidPayment)
+	api1.Post("/off-session", s.idempotent, s.HandleOffSessionCharge)
+	api1.Post("/link", s.idempotent, s.HandleCreatePaymentLink)
+
+	api2.Post("/create", s.idempotent, s.HandleCreateSubscription)
+	api2.Post("/cancel", s.idempotent, s.HandleCancelSubscription)
+	api2.Post("/cancel/undo", s.idempotent, s.HandleUndoCancelSubscription)
+	api2.Post("/pause", s.idempotent, s.HandlePauseSubscription)
+	api2.Post("/resume", s.idempotent, s.HandleResumeSubscription)
+	api2.Post("/change-plan", s.idempotent, s.HandleChangePlan)
+	api2.Post("/change-plan/preview", s.HandlePreviewPlanChange)
+
+	api3.Post("/setup-intent", s.idempotent, s.HandleCreateSetupIntent)
+	api3.Get("/:id/payment-methods", s.HandleListPaymentMethods)
+	api3.Post("/payment-methods/detach", s.idempotent, s.HandleDetachPaymentMethod)
+	api3.Post("/payment-methods/default", s.idempotent, s.HandleSetDefaultPaymentMethod)
+
+	api4.Post("/session", s.idempotent, s.HandleCreateCheckoutSession)
+
+	catalog.Post("/products", s.adminOnly, s.idempotent, s.HandleCreateProduct)
+	catalog.Get("/products", s.HandleListProducts)
+	catalog.Get("/products/:id", s.HandleGetProduct)
+	catalog.Patch("/products/:id", s.adminOnly, s.idempotent, s.HandleUpdateProduct)
+	catalog.Delete("/products/:id", s.adminOnly, s.idempotent, s.HandleArchiveProduct)
+	catalog.Post("/prices", s.adminOnly, s.idempotent, s.HandleCreatePrice)
+	catalog.Get("/prices", s.HandleListPrices)
+	catalog.Get("/prices/:code", s.HandleGetPrice)
+	catalog.Patch("/prices/:code", s.adminOnly, s.idempotent, s.HandleUpdatePrice)
+	catalog.Delete("/prices/:code", s.adminOnly, s.idempotent, s.HandleArchivePrice)
 
 	app.Get("/transactions", s.HandleGetTransactions)
 
+	admin := app.Group("/admin", s.adminOnly)
+	admin.Post("/webhooks/replay", s.HandleReplayWebhooks)
+	admin.Post("/status", s.HandleOverrideStatus)
+	admin.Get("/refunds/failed", s.HandleFailedRefunds)
+	admin.Get("/notifications", s.HandlePendingNotifications)
+	admin.Post("/notifications/:id/sent", s.HandleNotificationSent)
+
+	return app
+}
+
+func (s *APIServer) Run() {
+	app := s.App()
+
+	go s.RunOutboxWorker(context.Background(), outboxInterval)
+	go s.RunWebhookWorkers(context.Background(), webhookWorkers)
+	go s.RunPaymentLinkWorker(context.Background(), paymentLinkInterval)
+
 	if err := app.Listen(s.listenAddr); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
 func (s *APIServer) HandlePaymentRequest(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var p models.Payment
 	if err := c.BodyParser(&p); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	if p.CaptureMethod == "" {
+		p.CaptureMethod = models.CaptureAutomatic
+	}
+	if p.CaptureMethod != models.CaptureAutomatic && p.CaptureMethod != models.CaptureManual {
+		return c.Status(400).JSON(fiber.Map{"error": "capture_method must be automatic or manual"})
+	}
 
 	// Create or retrieve user
-	_, userID, err := s.HandleCreateCustomer(p.Name, p.Email) // Call the customer creation function
+	_, userID, err := s.HandleCreateCustomer(ctx, p.Name, p.Email, idempotencyKey(c)) // Call the customer creation function
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create or retrieve user"})
 	}
@@ -66,38 +157,40 @@ func (s *APIServer) HandlePaymentRequest(c *fiber.Ctx) error {
 		Amount:             stripe.Int64(p.Amount),
 		Currency:           stripe.String(p.Currency),
 		PaymentMethodTypes: stripe.StringSlice([]string{p.PaymentMethod}),
+		CaptureMethod:      stripe.String(p.CaptureMethod),
 	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
 
-	result, err := paymentintent.New(params)
+	result, err := s.provider.CreatePaymentIntent(ctx, params)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Payment failed"})
 	}
 
-	// Store payment in the database
-	payID, err := s.storage.CreatePayment(userID, p.Name, p.Email, p.Amount, p.Currency, p.PaymentMethod, result.ID)
+	// Record the intent before touching the database so it can be persisted
+	// later or canceled if this request does not get that far.
+	rec := paymentRecord{UserID: userID, Name: p.Name, Email: p.Email, Amount: p.Amount, Currency: p.Currency, Method: p.PaymentMethod, IntentID: result.ID, CaptureMethod: p.CaptureMethod}
+	outboxID, err := s.recordRemote(ctx, models.OutboxPaymentIntent, result.ID, rec)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to store payment"})
 	}
 
-	// Update payment status to pending
-	err = s.storage.UpdatePaymentStatus(result.ID, "pending")
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
-	}
-
-	err = s.storage.LogTransaction(p.UserID, "payment", p.Amount, p.Currency, &payID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to store transaction details"})
+	// Store payment, its status and the ledger entry as one unit of work
+	if err := s.persistPayment(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist payment, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store payment"})
 	}
 
 	return c.JSON(fiber.Map{
 		"message":        "Payment initiated",
 		"payment_intent": result.ID,
 		"client_secret":  result.ClientSecret,
+		"capture_method": p.CaptureMethod,
 	})
 }
 
 func (s *APIServer) HandleStripeWebhook(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
 	if stripeWebhookSecret == "" {
 		log.Fatal("Missing STRIPE_WEBHOOK_SECRET environment variable")
@@ -116,45 +209,39 @@ func (s *APIServer) HandleStripeWebhook(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid signature"})
 	}
 
-	switch event.Type {
-	case "payment_intent.succeeded":
-		var paymentIntent stripe.PaymentIntent
-		if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
-			log.Println("Error parsing payment_intent.succeeded:", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
-		}
-		fmt.Printf("Payment successful: ID=%s, Amount=%d %s, Status=%s\n", paymentIntent.ID, paymentIntent.Amount, paymentIntent.Currency, paymentIntent.Status)
-
-		// Update payment status in the database
-		err = s.storage.UpdatePaymentStatus(paymentIntent.ID, "success")
-		if err != nil {
-			log.Println("Failed to update payment status:", err)
-		}
-
-	case "payment_intent.payment_failed":
-		var paymentIntent stripe.PaymentIntent
-		if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
-			log.Println("Error parsing payment_intent.payment_failed:", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
-		}
-		fmt.Printf("PaymentIntent failed! ID: %s\n", paymentIntent.ID)
-
-		// Update payment status in the database
-		err = s.storage.UpdatePaymentStatus(paymentIntent.ID, "failed")
-		if err != nil {
-			log.Println("Failed to update payment status:", err)
-		}
-
-	default:
-		fmt.Printf("Unhandled event type: %s\n", event.Type)
+	// Queue the event and acknowledge it; the webhook workers apply it.
+	created, err := s.storage.CreateWebhookEvent(ctx, newWebhookEvent(event, payload))
+	if err != nil {
+		log.Println("Failed to queue webhook event:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to record event"})
+	}
+	if !created {
+		log.Printf("Duplicate event %s (%s), already received", event.ID, event.Type)
+		return c.SendStatus(fiber.StatusOK)
 	}
+	s.wakeWebhookWorkers()
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
+// refundReasons are the reasons Stripe accepts when a refund is created.
+var refundReasons = []stripe.RefundReason{
+	stripe.RefundReasonDuplicate,
+	stripe.RefundReasonFraudulent,
+	stripe.RefundReasonRequestedByCustomer,
+}
+
+// HandlePaymentRefund refunds all or part of a payment. Several refunds may
+// be made against one payment as long as their total stays within the
+// amount paid; leaving out the amount refunds whatever remains.
 func (s *APIServer) HandlePaymentRefund(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var request struct {
-		PaymentIntentID string `json:"paymentIntentID"`
+		PaymentIntentID string            `json:"paymentIntentID"`
+		Amount          int64             `json:"amount"`
+		Reason          string            `json:"reason"`
+		Metadata        map[string]string `json:"metadata"`
 	}
 
 	if err := c.BodyParser(&request); err != nil {
@@ -164,47 +251,83 @@ func (s *APIServer) HandlePaymentRefund(c *fiber.Ctx) error {
 	if request.PaymentIntentID == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "PaymentIntent ID is required"})
 	}
+	if request.Amount < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Refund amount must be positive"})
+	}
+	if request.Reason != "" && !slices.Contains(refundReasons, stripe.RefundReason(request.Reason)) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid refund reason"})
+	}
 
-	p, err := s.storage.GetPaymentDetails(request.PaymentIntentID)
+	p, err := s.storage.GetPaymentDetails(ctx, request.PaymentIntentID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment details"})
 	}
 
-	stripe.Key = stripeKey
+	if p.CaptureMethod == models.CaptureManual && p.AmountCaptured == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Payment has not been captured"})
+	}
+	remaining := p.CapturedAmount() - p.AmountRefunded
+	if remaining <= 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Payment is already fully refunded"})
+	}
+	amount := request.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		return c.Status(400).JSON(fiber.Map{
+			"error":     "Refund amount exceeds remaining balance",
+			"remaining": remaining,
+		})
+	}
 
-	paymentIntent, err := paymentintent.Get(request.PaymentIntentID, nil)
+	paymentIntent, err := s.provider.GetPaymentIntent(ctx, request.PaymentIntentID, nil)
 	if err != nil {
 		log.Println("Error fetching PaymentIntent:", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch payment details"})
 	}
 
 	if paymentIntent.Status == "succeeded" {
-		params := &stripe.RefundParams{PaymentIntent: stripe.String(request.PaymentIntentID)}
-		result, err := refund.New(params)
+		params := &stripe.RefundParams{
+			PaymentIntent: stripe.String(request.PaymentIntentID),
+			Amount:        stripe.Int64(amount),
+			Metadata:      request.Metadata,
+		}
+		if request.Reason != "" {
+			params.Reason = stripe.String(request.Reason)
+		}
+		forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+		result, err := s.provider.CreateRefund(ctx, params)
 		if err != nil {
 			log.Println("Refund error:", err)
 			return c.Status(500).JSON(fiber.Map{"error": "Refund failed"})
 		}
 
-		refID, err := s.storage.CreateRefund(p.ID, p.Amount, string(result.Status), result.ID)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to store refund"})
+		rec := refundRecord{
+			PaymentID: p.ID,
+			UserID:    p.UserID,
+			Amount:    result.Amount,
+			Currency:  p.Currency,
+			Status:    string(result.Status),
+			RefundID:  result.ID,
+			Reason:    request.Reason,
+			Metadata:  request.Metadata,
 		}
-
-		err = s.storage.LogTransaction(p.UserID, "refund", p.Amount, p.Currency, &refID)
+		outboxID, err := s.recordRemote(ctx, models.OutboxRefund, result.ID, rec)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to store transaction details"})
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to store refund"})
 		}
 
-		// Update refund status to refunded
-		err = s.storage.UpdateRefundStatus(result.ID, "refunded")
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to update refund status"})
+		if err := s.persistRefund(ctx, outboxID, rec); err != nil {
+			log.Println("Failed to persist refund, left for the outbox worker:", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to store refund"})
 		}
 
 		return c.JSON(fiber.Map{
 			"message":   "Refund initiated",
 			"refund_id": result.ID,
+			"amount":    result.Amount,
+			"remaining": remaining - result.Amount,
 			"status":    result.Status,
 		})
 	} else {
@@ -213,34 +336,46 @@ func (s *APIServer) HandlePaymentRefund(c *fiber.Ctx) error {
 }
 
 func (s *APIServer) HandleCancelPayment(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var request struct {
 		PaymentIntentID string `json:"paymentIntentID"`
 	}
 
-	p, err := s.storage.GetPaymentDetails(request.PaymentIntentID)
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	p, err := s.storage.GetPaymentDetails(ctx, request.PaymentIntentID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment details"})
 	}
 
-	if err := c.BodyParser(&request); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	if !p.Status.CanTransitionTo(models.PaymentCanceled) {
+		log.Printf("Rejected cancellation of payment %s in status %s", p.StripePaymentID, p.Status)
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Payment is %s and cannot be canceled", p.Status)})
 	}
 
 	params := &stripe.PaymentIntentCancelParams{}
-	result, err := paymentintent.Cancel(request.PaymentIntentID, params)
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+	result, err := s.provider.CancelPaymentIntent(ctx, request.PaymentIntentID, params)
 	if err != nil {
 		log.Println("PaymentIntent error:", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Cancellation failed"})
 	}
 
-	err = s.storage.CancelPayment(p.ID, p.UserID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove payment details from database"})
-	}
+	failure := "Failed to remove payment details from database"
+	err = s.storage.WithTx(ctx, func(tx models.Storage) error {
+		if err := tx.CancelPayment(ctx, p.ID, p.UserID); err != nil {
+			return err
+		}
 
-	err = s.storage.UpdatePaymentStatus(p.StripePaymentID, "canceled")
+		failure = "Failed to update payment status"
+		return tx.UpdatePaymentStatus(ctx, p.StripePaymentID, models.PaymentCanceled)
+	})
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update payment status"})
+		log.Println("Failed to persist payment cancellation:", err)
+		return c.Status(500).JSON(fiber.Map{"error": failure})
 	}
 
 	return c.JSON(fiber.Map{
@@ -250,73 +385,199 @@ func (s *APIServer) HandleCancelPayment(c *fiber.Ctx) error {
 	})
 }
 
+// HandleCreateSubscription subscribes a customer to a recurring catalog
+// price, found by its code, billed to the given saved payment method or the
+// customer's default one. A trial, given as trial_period_days or trial_end,
+// makes the payment method optional until the trial is over. A discount comes
+// from a coupon ID or a customer-facing promotion code.
 func (s *APIServer) HandleCreateSubscription(c *fiber.Ctx) error {
-	var sub models.Subscription
-	if err := c.BodyParser(&sub); err != nil {
+	ctx := c.UserContext()
+
+	var request struct {
+		UserID          uint   `json:"user_id"`
+		PaymentID       uint   `json:"payment_id"`
+		PriceCode       string `json:"price_code"`
+		PaymentMethod   string `json:"payment_method"`
+		TrialPeriodDays int64  `json:"trial_period_days"`
+		TrialEnd        int64  `json:"trial_end"`
+		Coupon          string `json:"coupon"`
+		PromotionCode   string `json:"promotion_code"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	stripe.Key = stripeKey
+	if request.UserID == 0 || request.PriceCode == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "user_id and price_code are required"})
+	}
+	if request.TrialPeriodDays != 0 && request.TrialEnd != 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Only one of trial_period_days and trial_end may be given"})
+	}
+	if request.TrialPeriodDays < 0 || request.TrialPeriodDays > maxTrialPeriodDays {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("trial_period_days must be between 0 and %d", maxTrialPeriodDays)})
+	}
+	if request.TrialEnd != 0 && !time.Unix(request.TrialEnd, 0).After(time.Now()) {
+		return c.Status(400).JSON(fiber.Map{"error": "trial_end must be in the future"})
+	}
+	if request.Coupon != "" && request.PromotionCode != "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Only one of coupon and promotion_code may be given"})
+	}
+	trial := request.TrialPeriodDays != 0 || request.TrialEnd != 0
 
-	usrID := string(sub.UserID)
-	amount := string(sub.Amount)
+	user, err := s.storage.GetCustomer(ctx, request.UserID)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Customer not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve customer"})
+	}
+
+	price, ok, err := s.subscribablePrice(c, request.PriceCode)
+	if !ok {
+		return err
+	}
+
+	var pm *models.PaymentMethod
+	if request.PaymentMethod != "" {
+		pm, err = s.storage.GetPaymentMethod(ctx, request.PaymentMethod)
+		if errors.Is(err, models.ErrNotFound) || (err == nil && pm.UserID != user.ID) {
+			return c.Status(404).JSON(fiber.Map{"error": "Payment method not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment method"})
+		}
+	} else {
+		pms, err := s.storage.GetPaymentMethods(ctx, user.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve payment methods"})
+		}
+		// The default, if any, is listed first.
+		if len(pms) > 0 && pms[0].IsDefault {
+			pm = pms[0]
+		} else if !trial {
+			return c.Status(409).JSON(fiber.Map{"error": "Customer has no default payment method"})
+		}
+	}
 
 	params := &stripe.SubscriptionParams{
-		Customer: stripe.String(usrID),
+		Customer: stripe.String(user.StripeID),
 		Items: []*stripe.SubscriptionItemsParams{
 			{
-				Price: stripe.String(amount), // Price ID must be dynamic
+				Price: stripe.String(price.StripePriceID),
 			},
 		},
 	}
+	if pm != nil {
+		params.DefaultPaymentMethod = stripe.String(pm.StripePaymentMethodID)
+	}
+	if request.TrialPeriodDays != 0 {
+		params.TrialPeriodDays = stripe.Int64(request.TrialPeriodDays)
+	}
+	if request.TrialEnd != 0 {
+		params.TrialEnd = stripe.Int64(request.TrialEnd)
+	}
+	if request.Coupon != "" {
+		params.Coupon = stripe.String(request.Coupon)
+	}
+	if request.PromotionCode != "" {
+		promo, err := s.findPromotionCode(ctx, request.PromotionCode)
+		if err != nil {
+			log.Println("Promotion code lookup error:", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to look up promotion code"})
+		}
+		if promo == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Promotion code is invalid or expired"})
+		}
+		params.PromotionCode = stripe.String(promo.ID)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
 
-	result, err := subscription.New(params)
+	result, err := s.provider.CreateSubscription(ctx, params)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+		// Typically an unknown or used-up coupon or promotion code.
+		log.Println("Subscription rejected:", stripeErr.Msg)
+		return c.Status(400).JSON(fiber.Map{"error": stripeErr.Msg})
+	}
 	if err != nil {
 		log.Println("Subscription creation error:", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Subscription creation failed"})
 	}
 
-	err = s.storage.CreateSubscription(sub.UserID, sub.PaymentID, sub.Amount, sub.Currency, string(result.ID), string(result.Status))
+	rec := subscriptionRecord{UserID: user.ID, PaymentID: request.PaymentID, PriceID: price.ID, Amount: price.UnitAmount, Currency: price.Currency, Status: string(result.Status), SubscriptionID: result.ID,
+		TrialEnd: subscriptionTrialEnd(result), Discount: subscriptionDiscount(result.Discount)}
+	outboxID, err := s.recordRemote(ctx, models.OutboxSubscription, result.ID, rec)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to store subscription details"})
 	}
 
+	if err := s.persistSubscription(ctx, outboxID, rec); err != nil {
+		log.Println("Failed to persist subscription, left for the outbox worker:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store subscription details"})
+	}
+
 	return c.JSON(fiber.Map{
 		"message":         "Subscription created",
 		"subscription_id": result.ID,
+		"price":           price.Code,
 		"status":          result.Status,
+		"trial_end":       rec.TrialEnd,
+		"discount":        rec.Discount,
 	})
 }
 
 func (s *APIServer) HandleCancelSubscription(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var request struct {
 		SubscriptionID string `json:"subscription_id"`
+		// AtPeriodEnd lets the customer keep the subscription until the
+		// end of the period already paid for.
+		AtPeriodEnd bool `json:"at_period_end"`
 	}
 
 	if err := c.BodyParser(&request); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	sub, err := s.storage.GetSubscriptionDetails(request.SubscriptionID)
+	sub, err := s.storage.GetSubscriptionDetails(ctx, request.SubscriptionID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve subscription details"})
 	}
 
+	if !sub.Status.CanTransitionTo(models.SubscriptionCanceled) {
+		log.Printf("Rejected cancellation of subscription %s in status %s", sub.StripeSubscriptionID, sub.Status)
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Subscription is %s and cannot be canceled", sub.Status)})
+	}
+
+	if request.AtPeriodEnd {
+		return s.scheduleCancellation(c, sub)
+	}
+
 	params := &stripe.SubscriptionCancelParams{}
-	result, err := subscription.Cancel(request.SubscriptionID, params)
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+	result, err := s.provider.CancelSubscription(ctx, request.SubscriptionID, params)
 	if err != nil {
 		log.Println("Subscription cancellation error:", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Subscription cancellation failed"})
 	}
 
-	err = s.storage.CancelSubscription(sub.ID, sub.UserID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove subscription details from database"})
-	}
+	failure := "Failed to remove subscription details from database"
+	err = s.storage.WithTx(ctx, func(tx models.Storage) error {
+		if err := tx.CancelSubscription(ctx, sub.ID, sub.UserID); err != nil {
+			return err
+		}
 
-	err = s.storage.UpdateSubscriptionStatus(sub.StripeSubscriptionID, "canceled")
+		failure = "Failed to update subscription status"
+		if err := tx.UpdateSubscriptionStatus(ctx, sub.StripeSubscriptionID, models.SubscriptionCanceled); err != nil {
+			return err
+		}
+		return tx.UpdateSubscriptionCancellation(ctx, sub.StripeSubscriptionID, false, subscriptionEndDate(result))
+	})
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update subscription status"})
+		log.Println("Failed to persist subscription cancellation:", err)
+		return c.Status(500).JSON(fiber.Map{"error": failure})
 	}
 
 	return c.JSON(fiber.Map{
@@ -326,26 +587,61 @@ func (s *APIServer) HandleCancelSubscription(c *fiber.Ctx) error {
 	})
 }
 
-func (s *APIServer) HandleCreateCustomer(name, email string) (string, uint, error) {
-	stripeID, userID, err := s.storage.CheckCustomer(name, email)
+// scheduleCancellation sets sub to cancel at the end of its current period.
+// It stays in its status until then, and can be kept with
+// HandleUndoCancelSubscription.
+func (s *APIServer) scheduleCancellation(c *fiber.Ctx, sub *models.Subscription) error {
+	ctx := c.UserContext()
+
+	if sub.CancelAtPeriodEnd {
+		return c.Status(409).JSON(fiber.Map{"error": "Subscription is already set to cancel at period end"})
+	}
+
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(true),
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.UpdateSubscription(ctx, sub.StripeSubscriptionID, params)
+	if err != nil {
+		log.Println("Subscription cancellation error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Subscription cancellation failed"})
+	}
+
+	endDate := subscriptionEndDate(result)
+	if err := s.storage.UpdateSubscriptionCancellation(ctx, result.ID, result.CancelAtPeriodEnd, endDate); err != nil {
+		log.Println("Failed to persist scheduled cancellation:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update subscription details"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":              "Subscription will cancel at period end",
+		"subscription_id":      result.ID,
+		"status":               result.Status,
+		"cancel_at_period_end": result.CancelAtPeriodEnd,
+		"end_date":             endDate,
+	})
+}
+
+func (s *APIServer) HandleCreateCustomer(ctx context.Context, name, email, idempotencyKey string) (string, uint, error) {
+	stripeID, userID, err := s.storage.CheckCustomer(ctx, name, email)
 	if err == nil {
 		return stripeID, userID, nil
 	}
 
-	stripe.Key = stripeKey
-
 	params := &stripe.CustomerParams{
 		Name:  stripe.String(name),
 		Email: stripe.String(email),
 	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey, "customer")
 
-	result, err := customer.New(params)
+	result, err := s.provider.CreateCustomer(ctx, params)
 	if err != nil {
 		log.Println("User creation error:", err)
 		return "", 0, fmt.Errorf("user creation failed")
 	}
 
-	_, userID, err = s.storage.CreateCustomer(name, email, result.ID)
+	_, userID, err = s.storage.CreateCustomer(ctx, name, email, result.ID)
 	if err != nil {
 		return "", 0, fmt.Errorf("failed to create user in database")
 	}
@@ -354,10 +650,38 @@ func (s *APIServer) HandleCreateCustomer(name, email string) (string, uint, erro
 }
 
 func (s *APIServer) HandleGetTransactions(c *fiber.Ctx) error {
-	var t models.Transaction
-	Transactions, err := s.storage.GetUserTransactions(t.UserID)
+	ctx := c.UserContext()
+
+	userID, err := strconv.ParseUint(c.Query("user_id", "0"), 10, 64)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return c.Status(400).JSON(fiber.Map{"error": "user_id must be a number"})
+	}
+	linkID := c.Query("payment_link")
+	if userID == 0 && linkID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "user_id or payment_link is required"})
+	}
+
+	var Transactions []*models.Transaction
+	if linkID != "" {
+		link, err := s.storage.GetPaymentLink(ctx, linkID)
+		if errors.Is(err, models.ErrNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Payment link not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		Transactions, err = s.storage.GetPaymentLinkTransactions(ctx, link.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if userID != 0 {
+			Transactions = slices.DeleteFunc(Transactions, func(t *models.Transaction) bool { return t.UserID != uint(userID) })
+		}
+	} else {
+		Transactions, err = s.storage.GetUserTransactions(ctx, uint(userID))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
 	}
 
 	return c.JSON(Transactions)
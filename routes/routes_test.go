@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+func TestPaymentIntentIsStoredWithLedgerEntry(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	id, userID := ts.createPayment("ada@example.com", 1000, "")
+
+	p := ts.payment(id)
+	if p.Status != models.PaymentPending || p.Amount != 1000 || p.CaptureMethod != models.CaptureAutomatic {
+		t.Fatalf("got payment %+v", p)
+	}
+
+	txs, err := ts.storage.GetUserTransactions(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || txs[0].Amount != 1000 || txs[0].PaymentID != p.ID {
+		t.Fatalf("got transactions %+v", txs)
+	}
+
+	// The same customer is reused for a second payment.
+	_, again := ts.createPayment("ada@example.com", 500, "")
+	if again != userID {
+		t.Fatalf("got user %d for returning customer, want %d", again, userID)
+	}
+}
+
+func TestPaymentIntentRejectsInvalidRequest(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	status, _ := ts.send("POST", "/payment/intent", nil, nil)
+	if status != 400 {
+		t.Fatalf("empty body: got %d, want 400", status)
+	}
+
+	ts.expect(400, "POST", "/payment/intent", fiber.Map{
+		"name": "Test", "email": "ada@example.com", "amount": 1000, "currency": "usd", "payment_method": "card", "capture_method": "later",
+	})
+}
+
+func TestCancelPayment(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	out := ts.expect(200, "POST", "/payment/cancel", fiber.Map{"paymentIntentID": id})
+	if out["status"] != string(stripe.PaymentIntentStatusCanceled) {
+		t.Fatalf("got %v", out)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentCanceled {
+		t.Fatalf("got status %s, want canceled", p.Status)
+	}
+
+	// A payment that has gone through can no longer be canceled.
+	paid, _ := ts.createPayment("ada@example.com", 500, "")
+	if err := ts.storage.UpdatePaymentStatus(context.Background(), paid, models.PaymentSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(409, "POST", "/payment/cancel", fiber.Map{"paymentIntentID": paid})
+}
+
+func TestRefundRequiresSucceededPayment(t *testing.T) {
+	ts, p := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	ts.expect(400, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+
+	if err := p.SetPaymentIntentStatus(id, stripe.PaymentIntentStatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	out := ts.expect(200, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id})
+	if out["amount"] != float64(1000) {
+		t.Fatalf("got %v", out)
+	}
+	if got := ts.payment(id).AmountRefunded; got != 1000 {
+		t.Fatalf("got amount refunded %d, want 1000", got)
+	}
+}
+
+func TestGetTransactions(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	_, userID := ts.createPayment("ada@example.com", 1000, "")
+
+	ts.expect(400, "GET", "/transactions", nil)
+	ts.expect(400, "GET", "/transactions?user_id=abc", nil)
+
+	var txs []models.Transaction
+	ts.get(fmt.Sprintf("/transactions?user_id=%d", userID), &txs)
+	if len(txs) != 1 || txs[0].Amount != 1000 || txs[0].UserID != userID {
+		t.Fatalf("got transactions %+v", txs)
+	}
+}
+
+// contextRecorder is a MemoryProvider that keeps the context of the last
+// payment intent it was asked to create.
+type contextRecorder struct {
+	*provider.MemoryProvider
+	ctx context.Context
+}
+
+func (p *contextRecorder) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	p.ctx = ctx
+	return p.MemoryProvider.CreatePaymentIntent(ctx, params)
+}
+
+func TestRequestContextCarriesDeadline(t *testing.T) {
+	p := &contextRecorder{MemoryProvider: provider.NewMemoryProvider()}
+	ts := newTestServer(t, p)
+	ts.srv.SetRequestTimeout(time.Minute)
+
+	start := time.Now()
+	ts.createPayment("ada@example.com", 1000, "")
+
+	deadline, ok := p.ctx.Deadline()
+	if !ok || deadline.Before(start) || deadline.After(start.Add(time.Minute+time.Second)) {
+		t.Fatalf("got deadline %v (set %v), want about a minute from %v", deadline, ok, start)
+	}
+	if p.ctx.Err() == nil {
+		t.Fatal("request context still live after the request finished")
+	}
+}
+
+func TestRequestTimeoutStopsHandler(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	ts.srv.SetRequestTimeout(time.Nanosecond)
+
+	ts.expect(500, "POST", "/payment/intent", fiber.Map{
+		"name": "Test", "email": "ada@example.com", "amount": 1000, "currency": "usd", "payment_method": "card",
+	})
+	if _, _, err := ts.storage.CheckCustomer(context.Background(), "Test", "ada@example.com"); err == nil {
+		t.Fatal("customer stored after the request timed out")
+	}
+}
@@ -0,0 +1,336 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+	"github.com/Faizan2005/payment-gateway-stripe/stripetest"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/webhook"
+)
+
+// testWebhookSecret signs the events stripetest delivers in tests.
+const testWebhookSecret = "whsec_test"
+
+// testAdminToken authorizes requests to the admin API in tests.
+const testAdminToken = "admin_test"
+
+// stripeTestKey is the secret key stripetest servers are called with.
+const stripeTestKey = "sk_test_stripetest"
+
+// testServer drives an APIServer through its fiber app the way a client
+// would, backed by in-memory storage.
+type testServer struct {
+	t       *testing.T
+	srv     *APIServer
+	app     *fiber.App
+	storage models.Storage
+
+	// stripe is the stand-in Stripe API for servers made by
+	// newStripeTestServer, memory the provider of those made by
+	// newMemoryTestServer.
+	stripe *stripetest.Server
+	memory *provider.MemoryProvider
+}
+
+func newTestServer(t *testing.T, p provider.PaymentProvider) *testServer {
+	t.Helper()
+	return newTestServerWith(t, models.NewMemoryStorage(), p)
+}
+
+// newTestServerWith is newTestServer over the given storage.
+func newTestServerWith(t *testing.T, st models.Storage, p provider.PaymentProvider) *testServer {
+	t.Helper()
+	t.Setenv("ADMIN_API_TOKEN", testAdminToken)
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+
+	srv := NewAPIServer(":0", st, p)
+	return &testServer{t: t, srv: srv, app: srv.App(), storage: st}
+}
+
+// newMemoryTestServer returns a testServer backed by the in-memory provider.
+func newMemoryTestServer(t *testing.T) (*testServer, *provider.MemoryProvider) {
+	t.Helper()
+
+	p := provider.NewMemoryProvider()
+	ts := newTestServer(t, p)
+	ts.memory = p
+	return ts, p
+}
+
+// newStripeTestServer returns a testServer that talks to a stripetest server
+// through the real Stripe provider, with webhooks delivered back in process.
+// Tests using it must not run in parallel, since it replaces the global
+// stripe-go backend.
+func newStripeTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ss := stripetest.NewServer(testWebhookSecret)
+	t.Cleanup(ss.Close)
+	t.Cleanup(ss.Install())
+
+	ts := newTestServer(t, provider.NewStripeProvider(stripeTestKey, 0))
+	ts.stripe = ss
+	ss.SetWebhookTarget("/payment/webhook", func(r *http.Request) (*http.Response, error) {
+		return ts.app.Test(r, -1)
+	})
+	return ts
+}
+
+// sync delivers the events stripetest has emitted since the last call and
+// processes them, the way the webhook workers would.
+func (ts *testServer) sync() {
+	ts.t.Helper()
+
+	if err := ts.stripe.DeliverWebhooks(); err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.processWebhooks()
+}
+
+// processWebhooks processes every queued webhook event that is due.
+func (ts *testServer) processWebhooks() {
+	ts.t.Helper()
+
+	for {
+		n, err := ts.srv.ProcessWebhookEvents(context.Background(), webhookBatchSize)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+var testEventCounter atomic.Int64
+
+// deliver posts a signed event of the given type carrying obj to the webhook
+// endpoint, fails the test unless it is accepted and returns the event.
+func (ts *testServer) deliver(eventType string, created time.Time, obj interface{}) *stripe.Event {
+	ts.t.Helper()
+
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	event := &stripe.Event{
+		ID:         fmt.Sprintf("evt_test_%d", testEventCounter.Add(1)),
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    created.Unix(),
+		Data:       &stripe.EventData{Raw: raw},
+		Type:       stripe.EventType(eventType),
+	}
+	ts.redeliver(event)
+	return event
+}
+
+// redeliver posts event to the webhook endpoint again, the way Stripe
+// retries a delivery.
+func (ts *testServer) redeliver(event *stripe.Event) {
+	ts.t.Helper()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: testWebhookSecret})
+
+	req := httptest.NewRequest("POST", "/payment/webhook", bytes.NewReader(signed.Payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+	resp, err := ts.app.Test(req, -1)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		ts.t.Fatalf("delivering %s (%s): got status %d", event.ID, event.Type, resp.StatusCode)
+	}
+}
+
+// request sends body, if any, as JSON with the given headers and returns the
+// status and raw response body.
+func (ts *testServer) request(method, path string, body interface{}, header http.Header) (int, []byte) {
+	ts.t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := ts.app.Test(req, -1)
+	if err != nil {
+		ts.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp.StatusCode, raw
+}
+
+// send is request for endpoints that answer with a JSON object.
+func (ts *testServer) send(method, path string, body interface{}, header http.Header) (int, map[string]interface{}) {
+	ts.t.Helper()
+
+	status, raw := ts.request(method, path, body, header)
+	var out map[string]interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &out); err != nil {
+			ts.t.Fatalf("%s %s: decoding %s: %v", method, path, raw, err)
+		}
+	}
+	return status, out
+}
+
+// get fetches path, fails the test unless it answers 200 and decodes the
+// response into out.
+func (ts *testServer) get(path string, out interface{}) {
+	ts.t.Helper()
+
+	status, raw := ts.request("GET", path, nil, nil)
+	if status != 200 {
+		ts.t.Fatalf("GET %s: got status %d: %s", path, status, raw)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		ts.t.Fatalf("GET %s: decoding %s: %v", path, raw, err)
+	}
+}
+
+// do sends a request and returns the status and decoded response.
+func (ts *testServer) do(method, path string, body interface{}) (int, map[string]interface{}) {
+	ts.t.Helper()
+	return ts.send(method, path, body, nil)
+}
+
+// expect sends a request and fails the test unless it answers with want.
+func (ts *testServer) expect(want int, method, path string, body interface{}) map[string]interface{} {
+	ts.t.Helper()
+
+	status, out := ts.do(method, path, body)
+	if status != want {
+		ts.t.Fatalf("%s %s: got status %d, want %d: %v", method, path, status, want, out)
+	}
+	return out
+}
+
+// expectAdmin is expect for the admin API.
+func (ts *testServer) expectAdmin(want int, method, path string, body interface{}) map[string]interface{} {
+	ts.t.Helper()
+
+	header := http.Header{fiber.HeaderAuthorization: {"Bearer " + testAdminToken}}
+	status, out := ts.send(method, path, body, header)
+	if status != want {
+		ts.t.Fatalf("%s %s: got status %d, want %d: %v", method, path, status, want, out)
+	}
+	return out
+}
+
+// createPayment creates a payment intent for a new customer and returns its
+// ID along with the customer's user ID.
+func (ts *testServer) createPayment(email string, amount int64, captureMethod string) (string, uint) {
+	ts.t.Helper()
+
+	body := fiber.Map{"name": "Test", "email": email, "amount": amount, "currency": "usd", "payment_method": "card"}
+	if captureMethod != "" {
+		body["capture_method"] = captureMethod
+	}
+	out := ts.expect(200, "POST", "/payment/intent", body)
+	id, _ := out["payment_intent"].(string)
+	if id == "" {
+		ts.t.Fatalf("no payment intent in %v", out)
+	}
+	return id, ts.payment(id).UserID
+}
+
+// payment returns the stored payment for a payment intent.
+func (ts *testServer) payment(id string) *models.Payment {
+	ts.t.Helper()
+
+	p, err := ts.storage.GetPaymentDetails(context.Background(), id)
+	if err != nil {
+		ts.t.Fatalf("payment %s: %v", id, err)
+	}
+	return p
+}
+
+// history returns the statuses an entity has moved through, oldest first.
+func (ts *testServer) history(entity, id string) []string {
+	ts.t.Helper()
+
+	entries, err := ts.storage.GetStatusHistory(context.Background(), entity, id)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	var statuses []string
+	for _, e := range entries {
+		statuses = append(statuses, e.To)
+	}
+	return statuses
+}
+
+// ledger returns a customer's transactions as "type amount", oldest first.
+func (ts *testServer) ledger(userID uint) []string {
+	ts.t.Helper()
+
+	txs, err := ts.storage.GetUserTransactions(context.Background(), userID)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	var entries []string
+	for _, tx := range txs {
+		entries = append(entries, fmt.Sprintf("%s %d", tx.TransactionType, tx.Amount))
+	}
+	return entries
+}
+
+// storeSubscription records a subscription for a new customer directly in
+// storage, as if it had been created earlier, and returns the user ID.
+func (ts *testServer) storeSubscription(stripeID string, status models.SubscriptionStatus) uint {
+	ts.t.Helper()
+	ctx := context.Background()
+
+	_, userID, err := ts.storage.CreateCustomer(ctx, "Test", stripeID+"@example.com", "cus_"+stripeID)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if err := ts.storage.CreateSubscription(ctx, userID, 0, 0, 1000, "usd", stripeID, status); err != nil {
+		ts.t.Fatal(err)
+	}
+	return userID
+}
+
+// subscription returns the stored subscription with the given Stripe ID.
+func (ts *testServer) subscription(stripeID string) *models.Subscription {
+	ts.t.Helper()
+
+	sub, err := ts.storage.GetSubscriptionDetails(context.Background(), stripeID)
+	if err != nil {
+		ts.t.Fatalf("subscription %s: %v", stripeID, err)
+	}
+	return sub
+}
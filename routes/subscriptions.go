@@ -0,0 +1,513 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// maxTrialPeriodDays is the longest trial Stripe allows.
+const maxTrialPeriodDays = 730
+
+// subscribablePrice loads the catalog price with the given code, answering
+// the request itself unless it is recurring and on sale.
+func (s *APIServer) subscribablePrice(c *fiber.Ctx, code string) (*models.Price, bool, error) {
+	ctx := c.UserContext()
+
+	price, err := s.storage.GetPriceByCode(ctx, code)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, false, c.Status(404).JSON(fiber.Map{"error": "Price not found"})
+	}
+	if err != nil {
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve price"})
+	}
+	if !price.Recurring() {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Price is not recurring"})
+	}
+	if !price.Active {
+		return nil, false, c.Status(409).JSON(fiber.Map{"error": "Price is archived"})
+	}
+	product, err := s.storage.GetProduct(ctx, price.ProductID)
+	if err != nil {
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve product"})
+	}
+	if !product.Active {
+		return nil, false, c.Status(409).JSON(fiber.Map{"error": "Product is archived"})
+	}
+	return price, true, nil
+}
+
+// lookupSubscription loads the local subscription with the given Stripe ID,
+// answering the request itself when that fails.
+func (s *APIServer) lookupSubscription(c *fiber.Ctx, stripeID string) (*models.Subscription, bool, error) {
+	if stripeID == "" {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "subscription_id is required"})
+	}
+
+	sub, err := s.storage.GetSubscriptionDetails(c.UserContext(), stripeID)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, false, c.Status(404).JSON(fiber.Map{"error": "Subscription not found"})
+	}
+	if err != nil {
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve subscription details"})
+	}
+	return sub, true, nil
+}
+
+// findPromotionCode resolves the customer-facing code to the active Stripe
+// promotion code carrying it, or nil if there is none.
+func (s *APIServer) findPromotionCode(ctx context.Context, code string) (*stripe.PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code:   stripe.String(code),
+		Active: stripe.Bool(true),
+	}
+	codes, err := s.provider.ListPromotionCodes(ctx, params)
+	if err != nil || len(codes) == 0 {
+		return nil, err
+	}
+	return codes[0], nil
+}
+
+// subscriptionTrialEnd returns when sub's trial ends, or nil if it has none.
+func subscriptionTrialEnd(sub *stripe.Subscription) *time.Time {
+	if sub.TrialEnd == 0 {
+		return nil
+	}
+	t := time.Unix(sub.TrialEnd, 0).UTC()
+	return &t
+}
+
+// subscriptionEndDate returns when sub ended or, if it is set to cancel,
+// when it will end.
+func subscriptionEndDate(sub *stripe.Subscription) *time.Time {
+	end := sub.EndedAt
+	if end == 0 {
+		end = sub.CancelAt
+	}
+	if end == 0 {
+		return nil
+	}
+	t := time.Unix(end, 0).UTC()
+	return &t
+}
+
+// subscriptionPause converts the paused collection of a subscription.
+func subscriptionPause(p *stripe.SubscriptionPauseCollection) *models.PauseCollection {
+	if p == nil || p.Behavior == "" {
+		return nil
+	}
+
+	out := &models.PauseCollection{Behavior: string(p.Behavior)}
+	if p.ResumesAt != 0 {
+		resumesAt := time.Unix(p.ResumesAt, 0).UTC()
+		out.ResumesAt = &resumesAt
+	}
+	return out
+}
+
+// subscriptionDiscount converts the discount Stripe applied to a subscription.
+func subscriptionDiscount(d *stripe.Discount) *models.Discount {
+	if d == nil || d.Coupon == nil {
+		return nil
+	}
+
+	out := &models.Discount{
+		CouponID:   d.Coupon.ID,
+		PercentOff: d.Coupon.PercentOff,
+		AmountOff:  d.Coupon.AmountOff,
+		Duration:   string(d.Coupon.Duration),
+	}
+	if d.PromotionCode != nil {
+		out.PromotionCodeID = d.PromotionCode.ID
+	}
+	if d.End != 0 {
+		end := time.Unix(d.End, 0).UTC()
+		out.EndsAt = &end
+	}
+	return out
+}
+
+// prorationBehaviors are the ways Stripe can bill a plan change: prorate on
+// the next invoice (the default), invoice the proration straight away, or
+// not prorate at all.
+var prorationBehaviors = []string{"create_prorations", "always_invoice", "none"}
+
+// planChangeRequest is the body of the plan change endpoints.
+type planChangeRequest struct {
+	SubscriptionID    string `json:"subscription_id"`
+	PriceCode         string `json:"price_code"`
+	ProrationBehavior string `json:"proration_behavior"`
+	// ProrationDate pins the moment the change is prorated from, so that a
+	// change made after a preview is billed exactly as previewed.
+	ProrationDate int64 `json:"proration_date"`
+}
+
+// planChange is a validated plan change: the local subscription, the price
+// it moves to and the Stripe subscription item carrying the current price.
+type planChange struct {
+	request planChangeRequest
+	sub     *models.Subscription
+	price   *models.Price
+	item    *stripe.SubscriptionItem
+}
+
+// parsePlanChange reads and checks a plan change request, answering the
+// request itself when it cannot go ahead.
+func (s *APIServer) parsePlanChange(c *fiber.Ctx) (*planChange, bool, error) {
+	ctx := c.UserContext()
+
+	var request planChangeRequest
+	if err := c.BodyParser(&request); err != nil {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if request.SubscriptionID == "" || request.PriceCode == "" {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "subscription_id and price_code are required"})
+	}
+	if request.ProrationBehavior == "" {
+		request.ProrationBehavior = prorationBehaviors[0]
+	}
+	if !slices.Contains(prorationBehaviors, request.ProrationBehavior) {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Invalid proration_behavior"})
+	}
+	if request.ProrationDate < 0 {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Invalid proration_date"})
+	}
+
+	sub, ok, err := s.lookupSubscription(c, request.SubscriptionID)
+	if !ok {
+		return nil, false, err
+	}
+	switch sub.Status {
+	case models.SubscriptionTrialing, models.SubscriptionActive, models.SubscriptionPastDue:
+	default:
+		return nil, false, c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Subscription is %s and cannot change plan", sub.Status)})
+	}
+
+	price, ok, err := s.subscribablePrice(c, request.PriceCode)
+	if !ok {
+		return nil, false, err
+	}
+	if price.ID == sub.PriceID {
+		return nil, false, c.Status(409).JSON(fiber.Map{"error": "Subscription is already on this price"})
+	}
+	if price.Currency != sub.Currency {
+		return nil, false, c.Status(400).JSON(fiber.Map{"error": "Price currency does not match the subscription"})
+	}
+
+	remote, err := s.provider.GetSubscription(ctx, sub.StripeSubscriptionID, nil)
+	if err != nil {
+		log.Println("Subscription lookup error:", err)
+		return nil, false, c.Status(500).JSON(fiber.Map{"error": "Failed to retrieve subscription"})
+	}
+	if remote.Items == nil || len(remote.Items.Data) != 1 {
+		return nil, false, c.Status(409).JSON(fiber.Map{"error": "Only single-item subscriptions can change plan"})
+	}
+
+	return &planChange{request: request, sub: sub, price: price, item: remote.Items.Data[0]}, true, nil
+}
+
+// HandlePreviewPlanChange shows what moving a subscription to another price
+// would cost, from the upcoming invoice Stripe would raise. The returned
+// proration_date should be passed on to HandleChangePlan so the change is
+// billed as previewed.
+func (s *APIServer) HandlePreviewPlanChange(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	change, ok, err := s.parsePlanChange(c)
+	if !ok {
+		return err
+	}
+	at := change.request.ProrationDate
+	if at == 0 {
+		at = time.Now().Unix()
+	}
+
+	params := &stripe.InvoiceUpcomingParams{
+		Subscription: stripe.String(change.sub.StripeSubscriptionID),
+		SubscriptionDetails: &stripe.InvoiceUpcomingSubscriptionDetailsParams{
+			Items: []*stripe.InvoiceUpcomingSubscriptionDetailsItemParams{
+				{
+					ID:    stripe.String(change.item.ID),
+					Price: stripe.String(change.price.StripePriceID),
+				},
+			},
+			ProrationBehavior: stripe.String(change.request.ProrationBehavior),
+			ProrationDate:     stripe.Int64(at),
+		},
+	}
+
+	invoice, err := s.provider.UpcomingInvoice(ctx, params)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+		return c.Status(400).JSON(fiber.Map{"error": stripeErr.Msg})
+	}
+	if err != nil {
+		log.Println("Upcoming invoice error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to preview plan change"})
+	}
+
+	var proration int64
+	lines := []fiber.Map{}
+	for _, line := range invoice.Lines.Data {
+		if line.Proration {
+			proration += line.Amount
+		}
+		l := fiber.Map{"description": line.Description, "amount": line.Amount, "proration": line.Proration}
+		if line.Period != nil {
+			l["period_start"], l["period_end"] = line.Period.Start, line.Period.End
+		}
+		lines = append(lines, l)
+	}
+
+	return c.JSON(fiber.Map{
+		"subscription_id":      change.sub.StripeSubscriptionID,
+		"price":                change.price.Code,
+		"proration_behavior":   change.request.ProrationBehavior,
+		"proration_date":       at,
+		"proration_amount":     proration,
+		"amount_due":           invoice.AmountDue,
+		"currency":             invoice.Currency,
+		"next_payment_attempt": invoice.NextPaymentAttempt,
+		"lines":                lines,
+	})
+}
+
+// HandleChangePlan moves a subscription to another catalog price, prorating
+// as asked, and updates the local subscription's price and amount.
+func (s *APIServer) HandleChangePlan(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	change, ok, err := s.parsePlanChange(c)
+	if !ok {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(change.item.ID),
+				Price: stripe.String(change.price.StripePriceID),
+			},
+		},
+		ProrationBehavior: stripe.String(change.request.ProrationBehavior),
+	}
+	if change.request.ProrationDate != 0 {
+		params.ProrationDate = stripe.Int64(change.request.ProrationDate)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.UpdateSubscription(ctx, change.sub.StripeSubscriptionID, params)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+		log.Println("Plan change rejected:", stripeErr.Msg)
+		return c.Status(400).JSON(fiber.Map{"error": stripeErr.Msg})
+	}
+	if err != nil {
+		log.Println("Plan change error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Plan change failed"})
+	}
+
+	if err := s.storage.UpdateSubscriptionPrice(ctx, result.ID, change.price.ID, change.price.UnitAmount); err != nil {
+		log.Println("Failed to persist plan change:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update subscription details"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":            "Plan changed",
+		"subscription_id":    result.ID,
+		"price":              change.price.Code,
+		"amount":             change.price.UnitAmount,
+		"proration_behavior": change.request.ProrationBehavior,
+		"status":             result.Status,
+	})
+}
+
+// syncSubscriptionPrice follows a price change on a single-item subscription,
+// such as one made in the Dashboard. Prices outside the catalog are recorded
+// by amount alone.
+func syncSubscriptionPrice(ctx context.Context, tx models.Storage, sub *stripe.Subscription) error {
+	if sub.Items == nil || len(sub.Items.Data) != 1 || sub.Items.Data[0].Price == nil {
+		return nil
+	}
+	remote := sub.Items.Data[0].Price
+
+	var priceID uint
+	amount := remote.UnitAmount
+	price, err := tx.GetPriceByStripeID(ctx, remote.ID)
+	if err == nil {
+		priceID, amount = price.ID, price.UnitAmount
+	} else if !errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+	return tx.UpdateSubscriptionPrice(ctx, sub.ID, priceID, amount)
+}
+
+// HandleUndoCancelSubscription keeps a subscription that was set to cancel at
+// the end of its period.
+func (s *APIServer) HandleUndoCancelSubscription(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		SubscriptionID string `json:"subscription_id"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	sub, ok, err := s.lookupSubscription(c, request.SubscriptionID)
+	if !ok {
+		return err
+	}
+	if sub.Status == models.SubscriptionCanceled || !sub.CancelAtPeriodEnd {
+		return c.Status(409).JSON(fiber.Map{"error": "Subscription is not set to cancel"})
+	}
+
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.UpdateSubscription(ctx, sub.StripeSubscriptionID, params)
+	if err != nil {
+		log.Println("Subscription update error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to undo cancellation"})
+	}
+
+	if err := s.storage.UpdateSubscriptionCancellation(ctx, result.ID, result.CancelAtPeriodEnd, subscriptionEndDate(result)); err != nil {
+		log.Println("Failed to persist undone cancellation:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update subscription details"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":              "Subscription will renew",
+		"subscription_id":      result.ID,
+		"status":               result.Status,
+		"cancel_at_period_end": result.CancelAtPeriodEnd,
+	})
+}
+
+// pauseBehaviors are what Stripe may do with invoices raised while
+// collection is paused; void, the default, means the customer is not billed.
+var pauseBehaviors = []string{
+	string(stripe.SubscriptionPauseCollectionBehaviorVoid),
+	string(stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft),
+	string(stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible),
+}
+
+// HandlePauseSubscription pauses payment collection on a subscription, until
+// resumes_at if given or else until HandleResumeSubscription. Pausing an
+// already paused subscription changes its behavior or resume date.
+func (s *APIServer) HandlePauseSubscription(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		SubscriptionID string `json:"subscription_id"`
+		Behavior       string `json:"behavior"`
+		ResumesAt      int64  `json:"resumes_at"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if request.Behavior == "" {
+		request.Behavior = pauseBehaviors[0]
+	}
+	if !slices.Contains(pauseBehaviors, request.Behavior) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid behavior"})
+	}
+	if request.ResumesAt != 0 && !time.Unix(request.ResumesAt, 0).After(time.Now()) {
+		return c.Status(400).JSON(fiber.Map{"error": "resumes_at must be in the future"})
+	}
+
+	sub, ok, err := s.lookupSubscription(c, request.SubscriptionID)
+	if !ok {
+		return err
+	}
+	switch sub.Status {
+	case models.SubscriptionTrialing, models.SubscriptionActive, models.SubscriptionPastDue, models.SubscriptionUnpaid:
+	default:
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Subscription is %s and cannot be paused", sub.Status)})
+	}
+
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(request.Behavior),
+		},
+	}
+	if request.ResumesAt != 0 {
+		params.PauseCollection.ResumesAt = stripe.Int64(request.ResumesAt)
+	}
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.UpdateSubscription(ctx, sub.StripeSubscriptionID, params)
+	if err != nil {
+		log.Println("Subscription pause error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to pause subscription"})
+	}
+
+	pause := subscriptionPause(result.PauseCollection)
+	if err := s.storage.UpdateSubscriptionPause(ctx, result.ID, pause); err != nil {
+		log.Println("Failed to persist subscription pause:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update subscription details"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Subscription paused",
+		"subscription_id":  result.ID,
+		"status":           result.Status,
+		"pause_collection": pause,
+	})
+}
+
+// HandleResumeSubscription resumes payment collection on a paused
+// subscription straight away.
+func (s *APIServer) HandleResumeSubscription(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var request struct {
+		SubscriptionID string `json:"subscription_id"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	sub, ok, err := s.lookupSubscription(c, request.SubscriptionID)
+	if !ok {
+		return err
+	}
+	if sub.Pause == nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Subscription is not paused"})
+	}
+
+	// An empty pause_collection clears it.
+	params := &stripe.SubscriptionParams{}
+	params.AddExtra("pause_collection", "")
+	forwardIdempotencyKey(&params.Params, idempotencyKey(c), "")
+
+	result, err := s.provider.UpdateSubscription(ctx, sub.StripeSubscriptionID, params)
+	if err != nil {
+		log.Println("Subscription resume error:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resume subscription"})
+	}
+
+	if err := s.storage.UpdateSubscriptionPause(ctx, result.ID, subscriptionPause(result.PauseCollection)); err != nil {
+		log.Println("Failed to persist subscription resume:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update subscription details"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":         "Subscription resumed",
+		"subscription_id": result.ID,
+		"status":          result.Status,
+	})
+}
@@ -0,0 +1,405 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// createCoupon sets up a coupon, and a promotion code for it unless code is
+// empty, on the installed stripetest server.
+func createCoupon(t *testing.T, params *stripe.CouponParams, code string) {
+	t.Helper()
+
+	backend := stripe.GetBackend(stripe.APIBackend)
+	var coupon stripe.Coupon
+	if err := backend.Call(http.MethodPost, "/v1/coupons", stripeTestKey, params, &coupon); err != nil {
+		t.Fatal(err)
+	}
+	if code == "" {
+		return
+	}
+	promo := &stripe.PromotionCodeParams{Coupon: stripe.String(coupon.ID), Code: stripe.String(code)}
+	if err := backend.Call(http.MethodPost, "/v1/promotion_codes", stripeTestKey, promo, &stripe.PromotionCode{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// monthlyPlan adds a product with a 1500 cent monthly price under code and a
+// customer to subscribe to it, returning the customer's user ID.
+func monthlyPlan(t *testing.T, ts *testServer, code string) uint {
+	t.Helper()
+
+	createPrice(t, ts, createProduct(t, ts, "Pro"), code, 1500, "usd", "month")
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": "ada@example.com"})
+	return uint(out["customer_id"].(float64))
+}
+
+// notifications returns the notifications waiting to be sent.
+func (ts *testServer) notifications() []models.Notification {
+	ts.t.Helper()
+
+	header := http.Header{fiber.HeaderAuthorization: {"Bearer " + testAdminToken}}
+	status, raw := ts.request("GET", "/admin/notifications", nil, header)
+	if status != 200 {
+		ts.t.Fatalf("GET /admin/notifications: got status %d: %s", status, raw)
+	}
+	var out struct {
+		Notifications []models.Notification `json:"notifications"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		ts.t.Fatal(err)
+	}
+	return out.Notifications
+}
+
+func TestSubscriptionTermsAreValidated(t *testing.T) {
+	ts := newStripeTestServer(t)
+	createCoupon(t, &stripe.CouponParams{ID: stripe.String("SAVE20"), PercentOff: stripe.Float64(20), Duration: stripe.String("repeating"), DurationInMonths: stripe.Int64(3)}, "WELCOME")
+	userID := monthlyPlan(t, ts, "pro-monthly")
+
+	for _, terms := range []fiber.Map{
+		{"trial_period_days": 7, "trial_end": 9999999999},
+		{"trial_period_days": 1000},
+		{"trial_end": 1000},
+		{"coupon": "SAVE20", "promotion_code": "WELCOME"},
+		{"promotion_code": "NOPE", "trial_period_days": 7},
+		{"coupon": "NOPE", "trial_period_days": 7},
+	} {
+		terms["user_id"], terms["price_code"] = userID, "pro-monthly"
+		ts.expect(400, "POST", "/subscription/create", terms)
+	}
+}
+
+func TestTrialWithPromotionCode(t *testing.T) {
+	ts := newStripeTestServer(t)
+	createCoupon(t, &stripe.CouponParams{ID: stripe.String("SAVE20"), PercentOff: stripe.Float64(20), Duration: stripe.String("repeating"), DurationInMonths: stripe.Int64(3)}, "WELCOME")
+	userID := monthlyPlan(t, ts, "pro-monthly")
+
+	out := ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro-monthly", "trial_period_days": 14, "promotion_code": "WELCOME"})
+	if out["status"] != "trialing" {
+		t.Fatalf("got %v, want a trial", out)
+	}
+	id := out["subscription_id"].(string)
+	sub := ts.subscription(id)
+	if sub.TrialEnd == nil || sub.TrialEnd.Before(time.Now().Add(13*24*time.Hour)) {
+		t.Fatalf("got trial end %v, want two weeks out", sub.TrialEnd)
+	}
+	if d := sub.Discount; d == nil || d.CouponID != "SAVE20" || d.PromotionCodeID == "" || d.PercentOff != 20 {
+		t.Fatalf("got discount %+v, want 20%% off through WELCOME", sub.Discount)
+	}
+	// The $0 invoice opening the trial is paid without ending it.
+	ts.sync()
+	if sub := ts.subscription(id); sub.Status != models.SubscriptionTrialing {
+		t.Fatalf("got status %s after the trial invoice, want trialing", sub.Status)
+	}
+
+	// Stripe's warning that the trial is ending queues one notification,
+	// however often it is replayed.
+	if _, err := ts.stripe.TrialWillEnd(id); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	ts.expectAdmin(200, "POST", "/admin/webhooks/replay", fiber.Map{})
+	notes := ts.notifications()
+	if len(notes) != 1 || notes[0].Kind != "trial_will_end" || notes[0].UserID != userID || notes[0].StripeSubscriptionID != id {
+		t.Fatalf("got notifications %+v, want one trial_will_end for %s", notes, id)
+	}
+
+	ts.expectAdmin(200, "POST", fmt.Sprintf("/admin/notifications/%d/sent", notes[0].ID), nil)
+	ts.expectAdmin(404, "POST", "/admin/notifications/9999/sent", nil)
+	if notes := ts.notifications(); len(notes) != 0 {
+		t.Fatalf("got notifications %+v after sending, want none", notes)
+	}
+
+	if _, err := ts.stripe.EndTrial(id); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	if sub := ts.subscription(id); sub.Status != models.SubscriptionActive || sub.TrialEnd == nil {
+		t.Fatalf("got subscription %+v, want active with its trial kept", sub)
+	}
+}
+
+func TestTrialWithMemoryProvider(t *testing.T) {
+	p := provider.NewMemoryProvider()
+	if _, err := p.AddCoupon(&stripe.CouponParams{ID: stripe.String("TEN"), AmountOff: stripe.Int64(1000), Currency: stripe.String("usd"), Duration: stripe.String("once")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddPromotionCode(&stripe.PromotionCodeParams{Coupon: stripe.String("TEN"), Code: stripe.String("TENOFF")}); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, p)
+	userID := monthlyPlan(t, ts, "pro")
+	end := time.Now().Add(48 * time.Hour).Unix()
+
+	out := ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro", "trial_end": end, "promotion_code": "TENOFF"})
+	discount, _ := out["discount"].(map[string]interface{})
+	if out["status"] != "trialing" || discount["coupon_id"] != "TEN" || discount["promotion_code_id"] == nil || discount["amount_off"] != float64(1000) {
+		t.Fatalf("got %v, want a trial with 1000 off through TENOFF", out)
+	}
+	out = ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro", "trial_end": end, "coupon": "TEN"})
+	if discount, _ := out["discount"].(map[string]interface{}); discount["coupon_id"] != "TEN" {
+		t.Fatalf("got %v, want the coupon applied", out)
+	}
+	ts.expect(400, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "pro", "trial_end": end, "coupon": "NOPE"})
+}
+
+// plans adds a product priced "basic" at 1000 and "pro" at 3000 a month,
+// "yearly" at 30000 a year and "eur" at 3000 euros a month.
+func plans(t *testing.T, ts *testServer) {
+	t.Helper()
+
+	productID := createProduct(t, ts, "Pro")
+	createPrice(t, ts, productID, "basic", 1000, "usd", "month")
+	createPrice(t, ts, productID, "pro", 3000, "usd", "month")
+	createPrice(t, ts, productID, "yearly", 30000, "usd", "year")
+	createPrice(t, ts, productID, "eur", 3000, "eur", "month")
+}
+
+func TestPreviewPlanChange(t *testing.T) {
+	ts := newStripeTestServer(t)
+	plans(t, ts)
+
+	// Trials are not prorated.
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": "ada@example.com"})
+	out = ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": out["customer_id"], "price_code": "basic", "trial_period_days": 3})
+	out = ts.expect(200, "POST", "/subscription/change-plan/preview", fiber.Map{"subscription_id": out["subscription_id"], "price_code": "pro"})
+	if out["proration_amount"] != float64(0) || out["amount_due"] != float64(3000) {
+		t.Fatalf("got %v, want the trial switched without prorations", out)
+	}
+
+	userID := subscriber(t, ts, "ada@example.com")
+	out = ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "basic"})
+	id := out["subscription_id"].(string)
+	remote, _ := ts.stripe.Subscription(id)
+	mid := remote.CurrentPeriodStart + (remote.CurrentPeriodEnd-remote.CurrentPeriodStart)/2
+
+	for _, c := range []struct {
+		change fiber.Map
+		want   int
+	}{
+		{fiber.Map{"price_code": "basic"}, 409},
+		{fiber.Map{"price_code": "eur"}, 400},
+		{fiber.Map{"price_code": "nope"}, 404},
+		{fiber.Map{"price_code": "pro", "proration_behavior": "sometimes"}, 400},
+		{fiber.Map{"price_code": "pro", "proration_date": 1}, 400},
+	} {
+		c.change["subscription_id"] = id
+		ts.expect(c.want, "POST", "/subscription/change-plan/preview", c.change)
+	}
+
+	// Halfway through, half of basic is credited and half of pro charged.
+	out = ts.expect(200, "POST", "/subscription/change-plan/preview", fiber.Map{"subscription_id": id, "price_code": "pro", "proration_date": mid})
+	if out["proration_amount"] != float64(1000) || out["amount_due"] != float64(4000) {
+		t.Fatalf("got %v, want 1000 prorated on top of 3000", out)
+	}
+	out = ts.expect(200, "POST", "/subscription/change-plan/preview", fiber.Map{"subscription_id": id, "price_code": "pro", "proration_behavior": "none"})
+	if out["proration_amount"] != float64(0) || out["amount_due"] != float64(3000) {
+		t.Fatalf("got %v, want no prorations", out)
+	}
+	// A new interval restarts the billing period, so only the credit applies.
+	out = ts.expect(200, "POST", "/subscription/change-plan/preview", fiber.Map{"subscription_id": id, "price_code": "yearly", "proration_date": mid})
+	if out["proration_amount"] != float64(-500) || out["amount_due"] != float64(29500) {
+		t.Fatalf("got %v, want 500 credited against 30000", out)
+	}
+
+	if got := ts.subscription(id).Amount; got != 1000 {
+		t.Fatalf("got amount %d after previews, want 1000", got)
+	}
+}
+
+func TestChangePlan(t *testing.T) {
+	ts := newStripeTestServer(t)
+	plans(t, ts)
+	userID := subscriber(t, ts, "ada@example.com")
+	out := ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": userID, "price_code": "basic"})
+	id := out["subscription_id"].(string)
+
+	ts.expect(404, "POST", "/subscription/change-plan", fiber.Map{"subscription_id": "sub_nope", "price_code": "pro"})
+
+	out = ts.expect(200, "POST", "/subscription/change-plan", fiber.Map{"subscription_id": id, "price_code": "pro"})
+	if out["amount"] != float64(3000) {
+		t.Fatalf("got %v", out)
+	}
+	if got := ts.subscription(id).Amount; got != 3000 {
+		t.Fatalf("got amount %d, want 3000", got)
+	}
+	// Stripe's update events agree with what was stored.
+	ts.sync()
+	if got := ts.subscription(id).Amount; got != 3000 {
+		t.Fatalf("got amount %d after webhooks, want 3000", got)
+	}
+
+	ts.expect(200, "POST", "/subscription/change-plan", fiber.Map{"subscription_id": id, "price_code": "yearly"})
+	ts.sync()
+	if got := ts.subscription(id).Amount; got != 30000 {
+		t.Fatalf("got amount %d, want 30000", got)
+	}
+	remote, _ := ts.stripe.Subscription(id)
+	if period := time.Unix(remote.CurrentPeriodEnd, 0).Sub(time.Unix(remote.CurrentPeriodStart, 0)); period < 365*24*time.Hour {
+		t.Fatalf("got billing period %v, want a year", period)
+	}
+
+	ts.expect(200, "POST", "/subscription/cancel", fiber.Map{"subscription_id": id})
+	ts.expect(409, "POST", "/subscription/change-plan", fiber.Map{"subscription_id": id, "price_code": "pro"})
+}
+
+func TestChangePlanWithMemoryProvider(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	plans(t, ts)
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": "ada@example.com"})
+	out = ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": out["customer_id"], "price_code": "basic", "trial_period_days": 3})
+	id := out["subscription_id"].(string)
+
+	ts.expect(200, "POST", "/subscription/change-plan/preview", fiber.Map{"subscription_id": id, "price_code": "pro"})
+	out = ts.expect(200, "POST", "/subscription/change-plan", fiber.Map{"subscription_id": id, "price_code": "pro", "proration_behavior": "always_invoice"})
+	if out["status"] != "trialing" || out["proration_behavior"] != "always_invoice" {
+		t.Fatalf("got %v", out)
+	}
+	if got := ts.subscription(id).Amount; got != 3000 {
+		t.Fatalf("got amount %d, want 3000", got)
+	}
+	ts.expect(400, "POST", "/subscription/change-plan", fiber.Map{"subscription_id": id, "price_code": "eur"})
+}
+
+// trial subscribes a new customer to a three-day trial of the given plan
+// and returns the subscription's Stripe ID.
+func trial(t *testing.T, ts *testServer, priceCode string) string {
+	t.Helper()
+
+	out := ts.expect(200, "POST", "/customer/setup-intent", fiber.Map{"name": "Test", "email": "ada@example.com"})
+	out = ts.expect(200, "POST", "/subscription/create", fiber.Map{"user_id": out["customer_id"], "price_code": priceCode, "trial_period_days": 3})
+	return out["subscription_id"].(string)
+}
+
+func TestCancelAtPeriodEndCanBeUndone(t *testing.T) {
+	ts := newStripeTestServer(t)
+	plans(t, ts)
+	id := trial(t, ts, "basic")
+	body := fiber.Map{"subscription_id": id}
+
+	ts.expect(409, "POST", "/subscription/cancel/undo", body)
+	ts.expect(200, "POST", "/subscription/cancel", fiber.Map{"subscription_id": id, "at_period_end": true})
+	sub := ts.subscription(id)
+	if !sub.CancelAtPeriodEnd || sub.EndDate == nil || sub.Status != models.SubscriptionTrialing {
+		t.Fatalf("got subscription %+v, want a trial set to end", sub)
+	}
+	ts.expect(409, "POST", "/subscription/cancel", fiber.Map{"subscription_id": id, "at_period_end": true})
+
+	ts.expect(200, "POST", "/subscription/cancel/undo", body)
+	if sub := ts.subscription(id); sub.CancelAtPeriodEnd || sub.EndDate != nil {
+		t.Fatalf("got subscription %+v, want the cancellation undone", sub)
+	}
+	ts.sync()
+	if sub := ts.subscription(id); sub.CancelAtPeriodEnd {
+		t.Fatal("webhooks brought the cancellation back")
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	ts := newStripeTestServer(t)
+	plans(t, ts)
+	id := trial(t, ts, "basic")
+	body := fiber.Map{"subscription_id": id}
+
+	ts.expect(409, "POST", "/subscription/resume", body)
+	ts.expect(400, "POST", "/subscription/pause", fiber.Map{"subscription_id": id, "behavior": "sometimes"})
+	ts.expect(400, "POST", "/subscription/pause", fiber.Map{"subscription_id": id, "resumes_at": 1})
+	ts.expect(404, "POST", "/subscription/pause", fiber.Map{"subscription_id": "sub_nope"})
+
+	ts.expect(200, "POST", "/subscription/pause", fiber.Map{"subscription_id": id, "resumes_at": time.Now().Add(10 * 24 * time.Hour).Unix()})
+	if pause := ts.subscription(id).Pause; pause == nil || pause.Behavior != "void" || pause.ResumesAt == nil {
+		t.Fatalf("got pause %+v, want void until a date", pause)
+	}
+	ts.expect(200, "POST", "/subscription/resume", body)
+	if pause := ts.subscription(id).Pause; pause != nil {
+		t.Fatalf("got pause %+v after resuming, want none", pause)
+	}
+	ts.sync()
+	if pause := ts.subscription(id).Pause; pause != nil {
+		t.Fatalf("got pause %+v after webhooks, want none", pause)
+	}
+}
+
+func TestBillingPeriodResumesAndCancels(t *testing.T) {
+	ts := newStripeTestServer(t)
+	plans(t, ts)
+	id := trial(t, ts, "basic")
+
+	ts.expect(200, "POST", "/subscription/pause", fiber.Map{"subscription_id": id, "behavior": "keep_as_draft", "resumes_at": time.Now().Add(24 * time.Hour).Unix()})
+	ts.sync()
+
+	// The pause is rebuilt from Stripe's events when local state is lost.
+	if err := ts.storage.UpdateSubscriptionPause(context.Background(), id, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.expectAdmin(200, "POST", "/admin/webhooks/replay", fiber.Map{})
+	if pause := ts.subscription(id).Pause; pause == nil || pause.Behavior != "keep_as_draft" {
+		t.Fatalf("got pause %+v after replay, want keep_as_draft", pause)
+	}
+
+	if _, err := ts.stripe.EndBillingPeriod(id); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	if sub := ts.subscription(id); sub.Pause != nil || sub.Status != models.SubscriptionActive {
+		t.Fatalf("got subscription %+v, want it active and resumed", sub)
+	}
+
+	ts.expect(200, "POST", "/subscription/cancel", fiber.Map{"subscription_id": id, "at_period_end": true})
+	ts.sync()
+	remote, _ := ts.stripe.Subscription(id)
+	if _, err := ts.stripe.EndBillingPeriod(id); err != nil {
+		t.Fatal(err)
+	}
+	ts.sync()
+	sub := ts.subscription(id)
+	if sub.Status != models.SubscriptionCanceled || sub.EndDate == nil || sub.EndDate.Unix() != remote.CurrentPeriodEnd {
+		t.Fatalf("got subscription %+v, want it canceled at the period end", sub)
+	}
+	ts.expect(409, "POST", "/subscription/pause", fiber.Map{"subscription_id": id})
+}
+
+func TestImmediateCancelRecordsEndDate(t *testing.T) {
+	ts := newStripeTestServer(t)
+	plans(t, ts)
+	id := trial(t, ts, "pro")
+
+	ts.expect(200, "POST", "/subscription/cancel", fiber.Map{"subscription_id": id})
+	if sub := ts.subscription(id); sub.Status != models.SubscriptionCanceled || sub.EndDate == nil {
+		t.Fatalf("got subscription %+v, want canceled with an end date", sub)
+	}
+
+	// The events Stripe sent before the cancellation do not wipe it.
+	ts.sync()
+	if sub := ts.subscription(id); sub.Status != models.SubscriptionCanceled || sub.EndDate == nil {
+		t.Fatalf("got subscription %+v after webhooks, want canceled with an end date", sub)
+	}
+}
+
+func TestPauseWithMemoryProvider(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	plans(t, ts)
+	id := trial(t, ts, "basic")
+	body := fiber.Map{"subscription_id": id}
+
+	ts.expect(200, "POST", "/subscription/cancel", fiber.Map{"subscription_id": id, "at_period_end": true})
+	ts.expect(200, "POST", "/subscription/cancel/undo", body)
+	ts.expect(200, "POST", "/subscription/pause", fiber.Map{"subscription_id": id, "behavior": "mark_uncollectible"})
+	if pause := ts.subscription(id).Pause; pause == nil || pause.Behavior != "mark_uncollectible" || pause.ResumesAt != nil {
+		t.Fatalf("got pause %+v, want mark_uncollectible indefinitely", pause)
+	}
+	ts.expect(200, "POST", "/subscription/resume", body)
+	if sub := ts.subscription(id); sub.Pause != nil || sub.CancelAtPeriodEnd {
+		t.Fatalf("got subscription %+v, want it running again", sub)
+	}
+}
@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/migrations"
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+var errLedgerDown = errors.New("ledger unavailable")
+
+// failingLedger fails ledger writes while down is set, so a unit of work
+// that records a payment or refund fails after the row itself was inserted.
+// It keeps the Stripe IDs of those rows so tests can look for them after.
+type failingLedger struct {
+	models.Storage
+	down     *bool
+	inserted *[]string
+}
+
+func (s failingLedger) WithTx(ctx context.Context, fn func(tx models.Storage) error) error {
+	return s.Storage.WithTx(ctx, func(tx models.Storage) error {
+		return fn(failingLedger{Storage: tx, down: s.down, inserted: s.inserted})
+	})
+}
+
+func (s failingLedger) CreatePayment(ctx context.Context, userID uint, name, email string, amount int64, currency, method, intentID, captureMethod string) (uint, error) {
+	*s.inserted = append(*s.inserted, intentID)
+	return s.Storage.CreatePayment(ctx, userID, name, email, amount, currency, method, intentID, captureMethod)
+}
+
+func (s failingLedger) CreateRefund(ctx context.Context, paymentID uint, amount int64, status models.RefundStatus, stripeRefundID, reason string, metadata map[string]string) (uint, error) {
+	*s.inserted = append(*s.inserted, stripeRefundID)
+	return s.Storage.CreateRefund(ctx, paymentID, amount, status, stripeRefundID, reason, metadata)
+}
+
+func (s failingLedger) LogTransaction(ctx context.Context, userID uint, txnType string, amount int64, currency string, refID *uint) error {
+	if *s.down {
+		return errLedgerDown
+	}
+	return s.Storage.LogTransaction(ctx, userID, txnType, amount, currency, refID)
+}
+
+// newPostgresTestStorage returns PostgresStorage over a freshly migrated
+// schema of its own in the database named by TEST_DATABASE_URL, and skips
+// the test when it is not set. The memory provider's IDs restart with every
+// server, so sharing tables between runs would collide.
+func newPostgresTestStorage(t *testing.T) models.Storage {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("routes_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("connecting to TEST_DATABASE_URL: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	// lib/pq sends unknown settings to the server as run-time parameters,
+	// so every connection of the pool starts in the new schema.
+	conninfo := dsn
+	if parsed, err := pq.ParseURL(dsn); err == nil {
+		conninfo = parsed
+	}
+	db, err := sql.Open("postgres", conninfo+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrations.Up(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return models.NewPostgresStorage(db, 5*time.Second)
+}
+
+// TestFailedUnitOfWorkLeavesNoRows breaks the ledger write that follows the
+// payment and refund inserts and checks that neither insert survives.
+func TestFailedUnitOfWorkLeavesNoRows(t *testing.T) {
+	backends := []struct {
+		name       string
+		newStorage func(t *testing.T) models.Storage
+	}{
+		{"Memory", func(*testing.T) models.Storage { return models.NewMemoryStorage() }},
+		{"Postgres", newPostgresTestStorage},
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			st := failingLedger{Storage: b.newStorage(t), down: new(bool), inserted: new([]string)}
+			p := provider.NewMemoryProvider()
+			ts := newTestServerWith(t, st, p)
+			ts.memory = p
+
+			*st.down = true
+			ts.expect(500, "POST", "/payment/intent", fiber.Map{"name": "Test", "email": "ada@example.com", "amount": 1000, "currency": "usd", "payment_method": "card"})
+			if len(*st.inserted) != 1 {
+				t.Fatalf("inserted %v, want one payment", *st.inserted)
+			}
+			if _, err := st.GetPaymentDetails(ctx, (*st.inserted)[0]); !errors.Is(err, models.ErrNotFound) {
+				t.Fatalf("payment %s after a failed unit of work: %v, want ErrNotFound", (*st.inserted)[0], err)
+			}
+
+			*st.down, *st.inserted = false, nil
+			id, userID := ts.createPayment("grace@example.com", 1000, "")
+			succeed(t, ts, id, 1000)
+
+			*st.down = true
+			ts.expect(500, "POST", "/payment/refund", fiber.Map{"paymentIntentID": id, "amount": 400})
+			if len(*st.inserted) != 2 {
+				t.Fatalf("inserted %v, want the payment and one refund", *st.inserted)
+			}
+			refundID := (*st.inserted)[1]
+			if _, err := st.GetRefundDetails(ctx, refundID); !errors.Is(err, models.ErrNotFound) {
+				t.Fatalf("refund %s after a failed unit of work: %v, want ErrNotFound", refundID, err)
+			}
+			if got := ts.payment(id); got.Status != models.PaymentSucceeded || got.AmountRefunded != 0 {
+				t.Fatalf("got status %s with %d refunded, want the payment untouched", got.Status, got.AmountRefunded)
+			}
+			if got := ts.ledger(userID); !slices.Equal(got, []string{"payment 1000"}) {
+				t.Fatalf("got ledger %v, want only the payment", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/stripe/stripe-go/v78"
+)
+
+const (
+	// webhookWorkers is how many events are processed concurrently.
+	webhookWorkers = 4
+	// webhookPollInterval is how often idle workers check for due events
+	// when no delivery wakes them.
+	webhookPollInterval = 5 * time.Second
+	// webhookLockTimeout hands an event to another worker if the one that
+	// claimed it has not finished by then.
+	webhookLockTimeout = 2 * time.Minute
+	// webhookMaxAttempts is how often an event is tried before it is dead
+	// lettered; retries back off exponentially from webhookBaseBackoff.
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 5 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookBatchSize   = 10
+)
+
+// errInvalidPayload marks events whose object could not be decoded. Retrying
+// them cannot help, so they are dead lettered straight away.
+var errInvalidPayload = errors.New("invalid event payload")
+
+// newWebhookEvent builds the queue entry for a verified event.
+func newWebhookEvent(event stripe.Event, payload []byte) *models.WebhookEvent {
+	e := &models.WebhookEvent{
+		ID:      event.ID,
+		Type:    string(event.Type),
+		Payload: payload,
+		Created: time.Unix(event.Created, 0).UTC(),
+	}
+	if event.Data != nil {
+		if id, ok := event.Data.Object["id"].(string); ok {
+			e.ObjectID = id
+		}
+	}
+	return e
+}
+
+// decodeWebhookEvent parses the stored payload of e.
+func decodeWebhookEvent(e *models.WebhookEvent) (stripe.Event, error) {
+	var event stripe.Event
+	if err := json.Unmarshal(e.Payload, &event); err != nil {
+		return event, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	return event, nil
+}
+
+// wakeWebhookWorkers tells an idle worker that an event has been queued.
+func (s *APIServer) wakeWebhookWorkers() {
+	select {
+	case s.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// RunWebhookWorkers processes queued webhook events with n workers until ctx
+// is done.
+func (s *APIServer) RunWebhookWorkers(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.webhookWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *APIServer) webhookWorker(ctx context.Context) {
+	for {
+		n, err := s.ProcessWebhookEvents(ctx, webhookBatchSize)
+		if err != nil {
+			log.Println("Webhook worker error:", err)
+		}
+		// A full batch suggests more are waiting.
+		if err == nil && n == webhookBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.webhookWake:
+		case <-time.After(webhookPollInterval):
+		}
+	}
+}
+
+// ProcessWebhookEvents claims up to limit due events and processes them,
+// returning how many it claimed. Failed events are rescheduled with backoff
+// or, once out of attempts, dead lettered.
+func (s *APIServer) ProcessWebhookEvents(ctx context.Context, limit int) (int, error) {
+	events, err := s.storage.ClaimWebhookEvents(ctx, limit, webhookLockTimeout)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range events {
+		err := s.processWebhookEvent(ctx, e)
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, errInvalidPayload) || e.Attempts >= webhookMaxAttempts {
+			log.Printf("Dead lettering event %s (%s) after %d attempts: %v", e.ID, e.Type, e.Attempts, err)
+			if derr := s.storage.DeadLetterWebhookEvent(ctx, e.ID, err.Error()); derr != nil {
+				log.Println("Failed to dead letter webhook event:", derr)
+			}
+			continue
+		}
+
+		delay := webhookBackoff(e.Attempts)
+		log.Printf("Failed to process event %s (%s), retrying in %s: %v", e.ID, e.Type, delay, err)
+		if rerr := s.storage.RetryWebhookEvent(ctx, e.ID, err.Error(), delay); rerr != nil {
+			log.Println("Failed to reschedule webhook event:", rerr)
+		}
+	}
+
+	return len(events), nil
+}
+
+// webhookBackoff returns the delay before the next try of an event that has
+// failed attempts times.
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookBaseBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// processWebhookEvent applies a claimed event and records its outcome in the
+// same unit of work. Events older than the last one applied to the same
+// object are logged as stale and not applied. The object is locked first so
+// that workers handling two events for it do not both pass the check.
+func (s *APIServer) processWebhookEvent(ctx context.Context, e *models.WebhookEvent) error {
+	event, err := decodeWebhookEvent(e)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.WithTx(ctx, func(tx models.Storage) error {
+		if e.ObjectID != "" {
+			if err := tx.LockWebhookObject(ctx, e.ObjectID); err != nil {
+				return err
+			}
+			last, err := tx.LastAppliedWebhookEvent(ctx, e.ObjectID)
+			if err != nil && !errors.Is(err, models.ErrNotFound) {
+				return err
+			}
+			if last != nil && last.Created.After(e.Created) {
+				log.Printf("Skipping stale event %s (%s): %s is newer", e.ID, e.Type, last.ID)
+				return tx.FinishWebhookEvent(ctx, e.ID, models.WebhookStale, "superseded by "+last.ID)
+			}
+		}
+
+		outcome, err := applyWebhookEvent(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+		return tx.FinishWebhookEvent(ctx, e.ID, outcome, "")
+	})
+}
@@ -0,0 +1,207 @@
+package routes
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Faizan2005/payment-gateway-stripe/models"
+	"github.com/Faizan2005/payment-gateway-stripe/provider"
+)
+
+// intentObject is the payload of a payment_intent.* event.
+func intentObject(id, status string, amount int64) map[string]interface{} {
+	return map[string]interface{}{"id": id, "object": "payment_intent", "status": status, "amount": amount, "amount_received": amount, "currency": "usd"}
+}
+
+func webhookEvent(t *testing.T, ts *testServer, id string) *models.WebhookEvent {
+	t.Helper()
+
+	e, err := ts.storage.GetWebhookEvent(context.Background(), id)
+	if err != nil {
+		t.Fatalf("webhook event %s: %v", id, err)
+	}
+	return e
+}
+
+func TestDuplicateWebhookIsNotReapplied(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	event := ts.deliver("payment_intent.succeeded", time.Now(), intentObject(id, "succeeded", 1000))
+	ts.processWebhooks()
+	e := webhookEvent(t, ts, event.ID)
+	if e.Outcome != models.WebhookProcessed || e.Attempts != 1 || e.ProcessedAt == nil {
+		t.Fatalf("got event %+v, want processed on the first attempt", e)
+	}
+
+	// Stripe retries a delivery it did not see acknowledged.
+	ts.redeliver(event)
+	n, err := ts.srv.ProcessWebhookEvents(context.Background(), webhookBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("duplicate queued again: %d events claimed", n)
+	}
+	if e := webhookEvent(t, ts, event.ID); e.Attempts != 1 {
+		t.Fatalf("got %d attempts after the duplicate, want 1", e.Attempts)
+	}
+	want := []string{"pending", "success"}
+	if got := ts.history("payment", id); !slices.Equal(got, want) {
+		t.Fatalf("got history %v, want %v", got, want)
+	}
+}
+
+func TestStaleWebhookIsSkipped(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	now := time.Now()
+
+	newer := ts.deliver("payment_intent.payment_failed", now, intentObject(id, "requires_payment_method", 1000))
+	ts.processWebhooks()
+
+	// An older event for the same intent arrives late.
+	older := ts.deliver("payment_intent.processing", now.Add(-time.Minute), intentObject(id, "processing", 1000))
+	ts.processWebhooks()
+
+	if e := webhookEvent(t, ts, newer.ID); e.Outcome != models.WebhookProcessed {
+		t.Fatalf("newer event: got outcome %s", e.Outcome)
+	}
+	if e := webhookEvent(t, ts, older.ID); e.Outcome != models.WebhookStale {
+		t.Fatalf("older event: got outcome %s, want stale", e.Outcome)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentFailed {
+		t.Fatalf("got status %s, want the newer failed", p.Status)
+	}
+}
+
+func TestUnhandledWebhookIsIgnored(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	event := ts.deliver("customer.source.created", time.Now(), map[string]interface{}{"id": "src_123", "object": "source"})
+	ts.processWebhooks()
+
+	if e := webhookEvent(t, ts, event.ID); e.Outcome != models.WebhookIgnored {
+		t.Fatalf("got outcome %s, want ignored", e.Outcome)
+	}
+}
+
+// lockingStorage notes the object locks and stale checks made through it and
+// fails locks while fail is above zero.
+type lockingStorage struct {
+	models.Storage
+	calls *[]string
+	fail  *int
+}
+
+func newLockingStorage() lockingStorage {
+	return lockingStorage{Storage: models.NewMemoryStorage(), calls: new([]string), fail: new(int)}
+}
+
+func (s lockingStorage) WithTx(ctx context.Context, fn func(tx models.Storage) error) error {
+	return s.Storage.WithTx(ctx, func(tx models.Storage) error {
+		return fn(lockingStorage{Storage: tx, calls: s.calls, fail: s.fail})
+	})
+}
+
+func (s lockingStorage) LockWebhookObject(ctx context.Context, objectID string) error {
+	*s.calls = append(*s.calls, "lock "+objectID)
+	if *s.fail > 0 {
+		*s.fail--
+		return errDatabaseDown
+	}
+	return s.Storage.LockWebhookObject(ctx, objectID)
+}
+
+func (s lockingStorage) LastAppliedWebhookEvent(ctx context.Context, objectID string) (*models.WebhookEvent, error) {
+	*s.calls = append(*s.calls, "last "+objectID)
+	return s.Storage.LastAppliedWebhookEvent(ctx, objectID)
+}
+
+func TestWebhookObjectIsLockedBeforeStaleCheck(t *testing.T) {
+	st := newLockingStorage()
+	ts := newTestServerWith(t, st, provider.NewMemoryProvider())
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+
+	ts.deliver("payment_intent.succeeded", time.Now(), intentObject(id, "succeeded", 1000))
+	ts.processWebhooks()
+
+	want := []string{"lock " + id, "last " + id}
+	if !slices.Equal(*st.calls, want) {
+		t.Fatalf("got calls %v, want %v", *st.calls, want)
+	}
+}
+
+func TestFailedWebhookIsRetriedThenDeadLettered(t *testing.T) {
+	st := newLockingStorage()
+	ts := newTestServerWith(t, st, provider.NewMemoryProvider())
+	ctx := context.Background()
+	id, _ := ts.createPayment("ada@example.com", 1000, "")
+	*st.fail = webhookMaxAttempts
+
+	event := ts.deliver("payment_intent.succeeded", time.Now(), intentObject(id, "succeeded", 1000))
+	start := time.Now()
+	ts.processWebhooks()
+
+	e := webhookEvent(t, ts, event.ID)
+	if e.Outcome != models.WebhookPending || e.Attempts != 1 || !strings.Contains(e.Error, errDatabaseDown.Error()) {
+		t.Fatalf("got event %+v, want it pending a retry", e)
+	}
+	if e.NextAttemptAt.Before(start.Add(webhookBaseBackoff)) {
+		t.Fatalf("retry due at %v, want a backoff of at least %v", e.NextAttemptAt, webhookBaseBackoff)
+	}
+
+	// Make every retry due straight away until the attempts run out.
+	for e.Outcome == models.WebhookPending {
+		if err := ts.storage.RetryWebhookEvent(ctx, event.ID, e.Error, 0); err != nil {
+			t.Fatal(err)
+		}
+		ts.processWebhooks()
+		e = webhookEvent(t, ts, event.ID)
+	}
+	if e.Outcome != models.WebhookDeadLettered || e.Attempts != webhookMaxAttempts {
+		t.Fatalf("got event %+v, want it dead lettered after %d attempts", e, webhookMaxAttempts)
+	}
+
+	dead, err := ts.storage.GetWebhookDeadLetters(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].EventID != event.ID || dead[0].Attempts != webhookMaxAttempts {
+		t.Fatalf("got dead letters %+v", dead)
+	}
+	if p := ts.payment(id); p.Status != models.PaymentPending {
+		t.Fatalf("got status %s, want the failed event not applied", p.Status)
+	}
+}
+
+func TestInvalidWebhookPayloadIsDeadLettered(t *testing.T) {
+	ts, _ := newMemoryTestServer(t)
+
+	event := ts.deliver("payment_intent.succeeded", time.Now(), map[string]interface{}{"id": "pi_123", "amount": "lots"})
+	ts.processWebhooks()
+
+	if e := webhookEvent(t, ts, event.ID); e.Outcome != models.WebhookDeadLettered || e.Attempts != 1 {
+		t.Fatalf("got event %+v, want it dead lettered on the first attempt", e)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, webhookBaseBackoff},
+		{2, 2 * webhookBaseBackoff},
+		{4, 8 * webhookBaseBackoff},
+		{webhookMaxAttempts * 4, webhookMaxBackoff},
+	}
+	for _, c := range cases {
+		if got := webhookBackoff(c.attempts); got != c.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+func (s *Server) createProduct(r *http.Request, form url.Values) (interface{}, error) {
+	name := form.Get("name")
+	if name == "" {
+		return nil, missingParam("name")
+	}
+
+	prod := s.newProduct(name)
+	prod.Description = form.Get("description")
+	prod.Metadata = formMap(form, "metadata")
+	s.emit("product.created", prod)
+	return prod, nil
+}
+
+func (s *Server) newProduct(name string) *stripe.Product {
+	prod := &stripe.Product{
+		ID:      s.newID("prod"),
+		Object:  "product",
+		Active:  true,
+		Created: s.now(),
+		Name:    name,
+		Updated: s.now(),
+	}
+	s.products[prod.ID] = prod
+	return prod
+}
+
+func (s *Server) getProduct(r *http.Request, form url.Values) (interface{}, error) {
+	prod, ok := s.products[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("product", r.PathValue("id"))
+	}
+	return prod, nil
+}
+
+func (s *Server) updateProduct(r *http.Request, form url.Values) (interface{}, error) {
+	prod, ok := s.products[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("product", r.PathValue("id"))
+	}
+	if _, ok := form["name"]; ok {
+		if form.Get("name") == "" {
+			return nil, invalidRequest("name", "You cannot unset the name of a product.")
+		}
+		prod.Name = form.Get("name")
+	}
+	if _, ok := form["description"]; ok {
+		prod.Description = form.Get("description")
+	}
+	if _, ok := form["active"]; ok {
+		prod.Active = formBool(form, "active")
+	}
+	prod.Updated = s.now()
+	s.emit("product.updated", prod)
+	return prod, nil
+}
+
+func (s *Server) createPrice(r *http.Request, form url.Values) (interface{}, error) {
+	currency := form.Get("currency")
+	if currency == "" {
+		return nil, missingParam("currency")
+	}
+	unitAmount, ok, err := formInt(form, "unit_amount")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, missingParam("unit_amount")
+	}
+	var prod *stripe.Product
+	if id := form.Get("product"); id != "" {
+		if prod, ok = s.products[id]; !ok {
+			return nil, notFound("product", id)
+		}
+	} else if name := form.Get("product_data[name]"); name != "" {
+		prod = s.newProduct(name)
+		s.emit("product.created", prod)
+	} else {
+		return nil, missingParam("product")
+	}
+
+	pr := &stripe.Price{
+		ID:         s.newID("price"),
+		Object:     "price",
+		Active:     true,
+		Created:    s.now(),
+		Currency:   stripe.Currency(currency),
+		LookupKey:  form.Get("lookup_key"),
+		Metadata:   formMap(form, "metadata"),
+		Nickname:   form.Get("nickname"),
+		Product:    &stripe.Product{ID: prod.ID},
+		Type:       stripe.PriceTypeOneTime,
+		UnitAmount: unitAmount,
+	}
+	if interval := form.Get("recurring[interval]"); interval != "" {
+		switch stripe.PriceRecurringInterval(interval) {
+		case stripe.PriceRecurringIntervalDay, stripe.PriceRecurringIntervalWeek,
+			stripe.PriceRecurringIntervalMonth, stripe.PriceRecurringIntervalYear:
+		default:
+			return nil, invalidRequest("recurring[interval]", "Invalid recurring[interval]: must be one of day, week, month, or year")
+		}
+		count, ok, err := formInt(form, "recurring[interval_count]")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			count = 1
+		}
+		if count < 1 {
+			return nil, invalidRequest("recurring[interval_count]", "Invalid recurring[interval_count]: must be at least 1")
+		}
+		pr.Type = stripe.PriceTypeRecurring
+		pr.Recurring = &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringInterval(interval),
+			IntervalCount: count,
+			UsageType:     stripe.PriceRecurringUsageTypeLicensed,
+		}
+	}
+	if pr.LookupKey != "" {
+		if err := s.claimLookupKey(pr.LookupKey, formBool(form, "transfer_lookup_key")); err != nil {
+			return nil, err
+		}
+	}
+	s.prices[pr.ID] = pr
+	s.emit("price.created", pr)
+	return pr, nil
+}
+
+// claimLookupKey frees key for a price. Another price holding it is an error
+// unless transfer is set, in which case the key moves.
+func (s *Server) claimLookupKey(key string, transfer bool) error {
+	for _, other := range s.prices {
+		if other.LookupKey != key {
+			continue
+		}
+		if !transfer {
+			return invalidRequest("lookup_key", fmt.Sprintf("A price (`%s`) already uses that lookup key.", other.ID))
+		}
+		other.LookupKey = ""
+		s.emit("price.updated", other)
+	}
+	return nil
+}
+
+func (s *Server) getPrice(r *http.Request, form url.Values) (interface{}, error) {
+	pr, ok := s.prices[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("price", r.PathValue("id"))
+	}
+	return pr, nil
+}
+
+// updatePrice changes the mutable fields of a price. Like Stripe, amounts and
+// intervals are fixed once created.
+func (s *Server) updatePrice(r *http.Request, form url.Values) (interface{}, error) {
+	pr, ok := s.prices[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("price", r.PathValue("id"))
+	}
+	for _, key := range []string{"unit_amount", "currency", "recurring[interval]"} {
+		if _, ok := form[key]; ok {
+			return nil, invalidRequest(key, fmt.Sprintf("Received unknown parameter: %s", key))
+		}
+	}
+	if _, ok := form["lookup_key"]; ok && form.Get("lookup_key") != pr.LookupKey {
+		if err := s.claimLookupKey(form.Get("lookup_key"), formBool(form, "transfer_lookup_key")); err != nil {
+			return nil, err
+		}
+		pr.LookupKey = form.Get("lookup_key")
+	}
+	if _, ok := form["nickname"]; ok {
+		pr.Nickname = form.Get("nickname")
+	}
+	if _, ok := form["active"]; ok {
+		pr.Active = formBool(form, "active")
+	}
+	s.emit("price.updated", pr)
+	return pr, nil
+}
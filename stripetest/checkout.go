@@ -0,0 +1,236 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+// checkoutSessionLifetime is how long a Checkout Session stays open when
+// expires_at is not given.
+const checkoutSessionLifetime = 24 * time.Hour
+
+func (s *Server) createCheckoutSession(r *http.Request, form url.Values) (interface{}, error) {
+	successURL := form.Get("success_url")
+	if successURL == "" {
+		return nil, missingParam("success_url")
+	}
+	mode := form.Get("mode")
+	if mode == "" {
+		return nil, missingParam("mode")
+	}
+
+	id := s.newID("cs")
+	cs := &stripe.CheckoutSession{
+		ID:                 id,
+		Object:             "checkout.session",
+		CancelURL:          form.Get("cancel_url"),
+		ClientReferenceID:  form.Get("client_reference_id"),
+		Created:            s.now(),
+		ExpiresAt:          s.now() + int64(checkoutSessionLifetime/time.Second),
+		Metadata:           formMap(form, "metadata"),
+		Mode:               stripe.CheckoutSessionMode(mode),
+		PaymentMethodTypes: formList(form, "payment_method_types"),
+		PaymentStatus:      stripe.CheckoutSessionPaymentStatusUnpaid,
+		Status:             stripe.CheckoutSessionStatusOpen,
+		SuccessURL:         successURL,
+		URL:                fmt.Sprintf("%s/c/pay/%s", s.URL, id),
+	}
+	if len(cs.PaymentMethodTypes) == 0 {
+		cs.PaymentMethodTypes = []string{"card"}
+	}
+	if expiresAt, ok, err := formInt(form, "expires_at"); err != nil {
+		return nil, err
+	} else if ok {
+		cs.ExpiresAt = expiresAt
+	}
+	if cus := form.Get("customer"); cus != "" {
+		if _, ok := s.customers[cus]; !ok {
+			return nil, notFound("customer", cus)
+		}
+		cs.Customer = &stripe.Customer{ID: cus}
+	}
+
+	// Like Stripe, the line items are not part of the session object itself.
+	items := 0
+	for ; ; items++ {
+		key := fmt.Sprintf("line_items[%d]", items)
+		if _, ok := form[key+"[quantity]"]; !ok {
+			break
+		}
+		li, err := s.lineItem(form, key)
+		if err != nil {
+			return nil, err
+		}
+		if cs.Currency != "" && li.Currency != cs.Currency {
+			return nil, invalidRequest(key+"[price_data][currency]", "All line items must use the same currency.")
+		}
+		cs.Currency = li.Currency
+		cs.AmountSubtotal += li.AmountSubtotal
+	}
+	if items == 0 {
+		return nil, missingParam("line_items")
+	}
+	cs.AmountTotal = cs.AmountSubtotal
+
+	s.sessions[id] = cs
+	return cs, nil
+}
+
+// lineItem reads the line item under key, which must carry inline
+// price_data.
+func (s *Server) lineItem(form url.Values, key string) (*stripe.LineItem, error) {
+	quantity, _, err := formInt(form, key+"[quantity]")
+	if err != nil {
+		return nil, err
+	}
+	if quantity < 1 {
+		return nil, invalidRequest(key+"[quantity]", "Quantity must be at least 1.")
+	}
+	unitAmount, ok, err := formInt(form, key+"[price_data][unit_amount]")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, missingParam(key + "[price_data][unit_amount]")
+	}
+	currency := form.Get(key + "[price_data][currency]")
+	if currency == "" {
+		return nil, missingParam(key + "[price_data][currency]")
+	}
+
+	return &stripe.LineItem{
+		ID:             s.newID("li"),
+		Object:         "item",
+		AmountSubtotal: unitAmount * quantity,
+		AmountTotal:    unitAmount * quantity,
+		Currency:       stripe.Currency(currency),
+		Description:    form.Get(key + "[price_data][product_data][name]"),
+		Price:          &stripe.Price{UnitAmount: unitAmount, Currency: stripe.Currency(currency)},
+		Quantity:       quantity,
+	}, nil
+}
+
+func (s *Server) getCheckoutSession(r *http.Request, form url.Values) (interface{}, error) {
+	cs, ok := s.sessions[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("checkout.session", r.PathValue("id"))
+	}
+	return cs, nil
+}
+
+func (s *Server) expireCheckoutSession(r *http.Request, form url.Values) (interface{}, error) {
+	cs, ok := s.sessions[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("checkout.session", r.PathValue("id"))
+	}
+	if err := s.expire(cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// expire closes an open session. A PaymentIntent left behind by a declined
+// attempt is canceled with it.
+func (s *Server) expire(cs *stripe.CheckoutSession) error {
+	if cs.Status != stripe.CheckoutSessionStatusOpen {
+		return invalidRequest("", fmt.Sprintf("Only Checkout Sessions with a status in [\"open\"] can be expired. This Checkout Session has a status of %q.", cs.Status))
+	}
+
+	if cs.PaymentIntent != nil {
+		if pi := s.intents[cs.PaymentIntent.ID]; pi != nil && pi.Status != stripe.PaymentIntentStatusSucceeded {
+			pi.Status = stripe.PaymentIntentStatusCanceled
+			pi.CanceledAt = s.now()
+			pi.CancellationReason = stripe.PaymentIntentCancellationReasonAbandoned
+			s.emit("payment_intent.canceled", pi)
+		}
+	}
+	cs.Status = stripe.CheckoutSessionStatusExpired
+	cs.URL = ""
+	s.emit("checkout.session.expired", cs)
+	return nil
+}
+
+// CompleteCheckoutSession plays the customer paying on the hosted Checkout
+// page with the test card paymentMethod. A declined card leaves the session
+// open, with the PaymentIntent of the failed attempt attached, and returns the
+// card error; 3-D Secure challenges are passed. On success the PaymentIntent
+// events are followed by checkout.session.completed.
+func (s *Server) CompleteCheckoutSession(id, paymentMethod string) (*stripe.CheckoutSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs, ok := s.sessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	if cs.Status != stripe.CheckoutSessionStatusOpen {
+		return nil, invalidRequest("", fmt.Sprintf("This Checkout Session has a status of %s.", cs.Status))
+	}
+	if err := s.complete(cs, paymentMethod); err != nil {
+		return nil, err
+	}
+
+	out := *cs
+	return &out, nil
+}
+
+// complete pays the open session cs with paymentMethod, reusing the
+// PaymentIntent of an earlier declined attempt.
+func (s *Server) complete(cs *stripe.CheckoutSession, paymentMethod string) error {
+	var pi *stripe.PaymentIntent
+	if cs.PaymentIntent != nil {
+		pi = s.intents[cs.PaymentIntent.ID]
+	} else {
+		piID := s.newID("pi")
+		pi = &stripe.PaymentIntent{
+			ID:                 piID,
+			Object:             "payment_intent",
+			Amount:             cs.AmountTotal,
+			Currency:           cs.Currency,
+			CaptureMethod:      stripe.PaymentIntentCaptureMethodAutomatic,
+			ClientSecret:       piID + "_secret_test",
+			Created:            s.now(),
+			Customer:           cs.Customer,
+			Metadata:           cs.Metadata,
+			PaymentMethodTypes: cs.PaymentMethodTypes,
+			Status:             stripe.PaymentIntentStatusRequiresPaymentMethod,
+		}
+		s.intents[piID] = pi
+		cs.PaymentIntent = &stripe.PaymentIntent{ID: piID}
+		s.emit("payment_intent.created", pi)
+	}
+
+	if err := s.confirm(pi, url.Values{"payment_method": {paymentMethod}}); err != nil {
+		return err
+	}
+	if pi.Status == stripe.PaymentIntentStatusRequiresAction {
+		s.authorize(pi)
+	}
+
+	cs.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	cs.Status = stripe.CheckoutSessionStatusComplete
+	cs.URL = ""
+	s.emit("checkout.session.completed", cs)
+	return nil
+}
+
+// ExpireCheckoutSession lets an open session run out, as if its expires_at
+// had passed.
+func (s *Server) ExpireCheckoutSession(id string) (*stripe.CheckoutSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs, ok := s.sessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	if err := s.expire(cs); err != nil {
+		return nil, err
+	}
+	out := *cs
+	return &out, nil
+}
@@ -0,0 +1,201 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+func (s *Server) createCoupon(r *http.Request, form url.Values) (interface{}, error) {
+	_, hasPercent := form["percent_off"]
+	_, hasAmount := form["amount_off"]
+	if hasPercent == hasAmount {
+		return nil, invalidRequest("", "You must pass exactly one of percent_off or amount_off.")
+	}
+
+	c := &stripe.Coupon{
+		ID:       form.Get("id"),
+		Object:   "coupon",
+		Created:  s.now(),
+		Duration: stripe.CouponDuration(form.Get("duration")),
+		Metadata: formMap(form, "metadata"),
+		Name:     form.Get("name"),
+		Valid:    true,
+	}
+	if c.ID == "" {
+		c.ID = s.newID("coupon")
+	}
+	if _, ok := s.coupons[c.ID]; ok {
+		return nil, invalidRequest("id", "Coupon already exists.")
+	}
+	if hasPercent {
+		pct, err := strconv.ParseFloat(form.Get("percent_off"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, invalidRequest("percent_off", "Invalid percent_off: must be greater than 0 and at most 100")
+		}
+		c.PercentOff = pct
+	} else {
+		amount, _, err := formInt(form, "amount_off")
+		if err != nil {
+			return nil, err
+		}
+		if form.Get("currency") == "" {
+			return nil, missingParam("currency")
+		}
+		c.AmountOff, c.Currency = amount, stripe.Currency(form.Get("currency"))
+	}
+	switch c.Duration {
+	case "":
+		c.Duration = stripe.CouponDurationOnce
+	case stripe.CouponDurationRepeating:
+		months, ok, err := formInt(form, "duration_in_months")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, missingParam("duration_in_months")
+		}
+		c.DurationInMonths = months
+	case stripe.CouponDurationOnce, stripe.CouponDurationForever:
+	default:
+		return nil, invalidRequest("duration", "Invalid duration: must be one of forever, once, or repeating")
+	}
+	var err error
+	if c.MaxRedemptions, _, err = formInt(form, "max_redemptions"); err != nil {
+		return nil, err
+	}
+	if c.RedeemBy, _, err = formInt(form, "redeem_by"); err != nil {
+		return nil, err
+	}
+
+	s.coupons[c.ID] = c
+	s.emit("coupon.created", c)
+	return c, nil
+}
+
+func (s *Server) getCoupon(r *http.Request, form url.Values) (interface{}, error) {
+	c, ok := s.coupons[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("coupon", r.PathValue("id"))
+	}
+	return c, nil
+}
+
+func (s *Server) createPromotionCode(r *http.Request, form url.Values) (interface{}, error) {
+	couponID := form.Get("coupon")
+	if couponID == "" {
+		return nil, missingParam("coupon")
+	}
+	coupon, ok := s.coupons[couponID]
+	if !ok {
+		return nil, notFound("coupon", couponID)
+	}
+
+	promo := &stripe.PromotionCode{
+		ID:       s.newID("promo"),
+		Object:   "promotion_code",
+		Active:   true,
+		Code:     form.Get("code"),
+		Coupon:   coupon,
+		Created:  s.now(),
+		Metadata: formMap(form, "metadata"),
+	}
+	if _, ok := form["active"]; ok {
+		promo.Active = formBool(form, "active")
+	}
+	if promo.Code == "" {
+		promo.Code = strings.ToUpper(promo.ID)
+	}
+	for _, other := range s.promoCodes {
+		if other.Active && other.Code == promo.Code {
+			return nil, invalidRequest("code", "An active promotion code with `code: "+promo.Code+"` already exists.")
+		}
+	}
+	var err error
+	if promo.ExpiresAt, _, err = formInt(form, "expires_at"); err != nil {
+		return nil, err
+	}
+	if promo.MaxRedemptions, _, err = formInt(form, "max_redemptions"); err != nil {
+		return nil, err
+	}
+
+	s.promoCodes[promo.ID] = promo
+	s.emit("promotion_code.created", promo)
+	return promo, nil
+}
+
+// listPromotionCodes supports the code and active filters. Everything fits
+// on one page.
+func (s *Server) listPromotionCodes(r *http.Request, form url.Values) (interface{}, error) {
+	query := r.URL.Query()
+	list := &stripe.PromotionCodeList{Data: []*stripe.PromotionCode{}}
+	list.URL = "/v1/promotion_codes"
+	for _, promo := range s.promoCodes {
+		if code := query.Get("code"); code != "" && promo.Code != code {
+			continue
+		}
+		if _, ok := query["active"]; ok && promo.Active != (query.Get("active") == "true") {
+			continue
+		}
+		list.Data = append(list.Data, promo)
+	}
+	return list, nil
+}
+
+// discount redeems a coupon, given directly or through a promotion code, for
+// subscription subID.
+func (s *Server) discount(subID, couponID, promoID string) (*stripe.Discount, error) {
+	if couponID != "" && promoID != "" {
+		return nil, invalidRequest("", "You may only specify one of these parameters: coupon, promotion_code.")
+	}
+
+	now := s.now()
+	var promo *stripe.PromotionCode
+	if promoID != "" {
+		var ok bool
+		if promo, ok = s.promoCodes[promoID]; !ok {
+			return nil, notFound("promotion_code", promoID)
+		}
+		if !promo.Active || (promo.ExpiresAt != 0 && promo.ExpiresAt <= now) {
+			return nil, invalidRequest("promotion_code", fmt.Sprintf("This promotion code cannot be redeemed: %s", promoID))
+		}
+		couponID = promo.Coupon.ID
+	}
+	coupon, ok := s.coupons[couponID]
+	if !ok {
+		return nil, notFound("coupon", couponID)
+	}
+	if coupon.RedeemBy != 0 && coupon.RedeemBy <= now {
+		coupon.Valid = false
+	}
+	if !coupon.Valid {
+		return nil, invalidRequest("coupon", fmt.Sprintf("Coupon expired: %s", couponID))
+	}
+
+	d := &stripe.Discount{
+		ID:            s.newID("di"),
+		Object:        "discount",
+		Coupon:        coupon,
+		PromotionCode: promo,
+		Start:         now,
+		Subscription:  subID,
+	}
+	if coupon.Duration == stripe.CouponDurationRepeating {
+		d.End = periodEnd(now, &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: coupon.DurationInMonths})
+	}
+	coupon.TimesRedeemed++
+	if coupon.MaxRedemptions > 0 && coupon.TimesRedeemed >= coupon.MaxRedemptions {
+		coupon.Valid = false
+	}
+	if promo != nil {
+		promo.TimesRedeemed++
+		if promo.MaxRedemptions > 0 && promo.TimesRedeemed >= promo.MaxRedemptions {
+			promo.Active = false
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,163 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+func (s *Server) createPaymentLink(r *http.Request, form url.Values) (interface{}, error) {
+	id := s.newID("plink")
+	pl := &stripe.PaymentLink{
+		ID:               id,
+		Object:           "payment_link",
+		Active:           true,
+		CustomerCreation: stripe.PaymentLinkCustomerCreation(form.Get("customer_creation")),
+		InactiveMessage:  form.Get("inactive_message"),
+		LineItems:        &stripe.LineItemList{},
+		Metadata:         formMap(form, "metadata"),
+		URL:              fmt.Sprintf("%s/b/%s", s.URL, id),
+	}
+	if pl.CustomerCreation == "" {
+		pl.CustomerCreation = stripe.PaymentLinkCustomerCreationIfRequired
+	}
+
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("line_items[%d]", i)
+		priceID := form.Get(key + "[price]")
+		if priceID == "" {
+			if i == 0 {
+				return nil, missingParam("line_items")
+			}
+			break
+		}
+		pr, ok := s.prices[priceID]
+		if !ok {
+			return nil, notFound("price", priceID)
+		}
+		quantity, _, err := formInt(form, key+"[quantity]")
+		if err != nil {
+			return nil, err
+		}
+		if quantity < 1 {
+			return nil, invalidRequest(key+"[quantity]", "Quantity must be at least 1.")
+		}
+		if pl.Currency != "" && pr.Currency != pl.Currency {
+			return nil, invalidRequest(key+"[price]", "All prices on a payment link must use the same currency.")
+		}
+		pl.Currency = pr.Currency
+		pl.LineItems.Data = append(pl.LineItems.Data, &stripe.LineItem{
+			ID:             s.newID("li"),
+			Object:         "item",
+			AmountSubtotal: pr.UnitAmount * quantity,
+			AmountTotal:    pr.UnitAmount * quantity,
+			Currency:       pr.Currency,
+			Price:          pr,
+			Quantity:       quantity,
+		})
+	}
+
+	if limit, ok, err := formInt(form, "restrictions[completed_sessions][limit]"); err != nil {
+		return nil, err
+	} else if ok {
+		if limit < 1 {
+			return nil, invalidRequest("restrictions[completed_sessions][limit]", "The limit must be at least 1.")
+		}
+		pl.Restrictions = &stripe.PaymentLinkRestrictions{
+			CompletedSessions: &stripe.PaymentLinkRestrictionsCompletedSessions{Limit: limit},
+		}
+	}
+
+	s.links[id] = pl
+	s.emit("payment_link.created", pl)
+	return pl, nil
+}
+
+func (s *Server) getPaymentLink(r *http.Request, form url.Values) (interface{}, error) {
+	pl, ok := s.links[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_link", r.PathValue("id"))
+	}
+	return pl, nil
+}
+
+func (s *Server) updatePaymentLink(r *http.Request, form url.Values) (interface{}, error) {
+	pl, ok := s.links[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_link", r.PathValue("id"))
+	}
+	if _, ok := form["active"]; ok {
+		pl.Active = formBool(form, "active")
+	}
+	if _, ok := form["inactive_message"]; ok {
+		pl.InactiveMessage = form.Get("inactive_message")
+	}
+	s.emit("payment_link.updated", pl)
+	return pl, nil
+}
+
+// PayPaymentLink plays a new customer opening the payment link id and paying
+// with the test card paymentMethod, as in CompleteCheckoutSession. Stripe
+// creates a customer from the details they enter and a Checkout Session
+// pointing back at the link. Once the link's completed-sessions limit is
+// reached it is deactivated and payment_link.updated is sent.
+func (s *Server) PayPaymentLink(id, name, email, paymentMethod string) (*stripe.CheckoutSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pl, ok := s.links[id]
+	if !ok {
+		return nil, notFound("payment_link", id)
+	}
+	if !pl.Active {
+		msg := pl.InactiveMessage
+		if msg == "" {
+			msg = "This link is no longer active."
+		}
+		return nil, invalidRequest("", msg)
+	}
+
+	cus := &stripe.Customer{ID: s.newID("cus"), Object: "customer", Created: s.now(), Name: name, Email: email}
+	s.customers[cus.ID] = cus
+	s.emit("customer.created", cus)
+
+	csID := s.newID("cs")
+	cs := &stripe.CheckoutSession{
+		ID:                 csID,
+		Object:             "checkout.session",
+		Created:            s.now(),
+		Currency:           pl.Currency,
+		Customer:           &stripe.Customer{ID: cus.ID},
+		CustomerDetails:    &stripe.CheckoutSessionCustomerDetails{Name: name, Email: email},
+		ExpiresAt:          s.now() + int64(checkoutSessionLifetime/time.Second),
+		Metadata:           pl.Metadata,
+		Mode:               stripe.CheckoutSessionModePayment,
+		PaymentLink:        &stripe.PaymentLink{ID: id},
+		PaymentMethodTypes: []string{"card"},
+		PaymentStatus:      stripe.CheckoutSessionPaymentStatusUnpaid,
+		Status:             stripe.CheckoutSessionStatusOpen,
+	}
+	for _, li := range pl.LineItems.Data {
+		cs.AmountSubtotal += li.AmountSubtotal
+	}
+	cs.AmountTotal = cs.AmountSubtotal
+	s.sessions[csID] = cs
+
+	if err := s.complete(cs, paymentMethod); err != nil {
+		return nil, err
+	}
+
+	if limit := pl.Restrictions; limit != nil && limit.CompletedSessions != nil {
+		limit.CompletedSessions.Count++
+		if limit.CompletedSessions.Count >= limit.CompletedSessions.Limit {
+			pl.Active = false
+			s.emit("payment_link.updated", pl)
+		}
+	}
+
+	out := *cs
+	return &out, nil
+}
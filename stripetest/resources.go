@@ -0,0 +1,708 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+func unexpectedState(pi *stripe.PaymentIntent, action string) *stripe.Error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodePaymentIntentUnexpectedState,
+		HTTPStatusCode: http.StatusBadRequest,
+		Msg:            fmt.Sprintf("You cannot %s this PaymentIntent because it has a status of %s.", action, pi.Status),
+		PaymentIntent:  pi,
+	}
+}
+
+func (s *Server) createPaymentIntent(r *http.Request, form url.Values) (interface{}, error) {
+	amount, ok, err := formInt(form, "amount")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, missingParam("amount")
+	}
+	if amount < 1 {
+		return nil, invalidRequest("amount", "Amount must be at least 1.")
+	}
+	currency := form.Get("currency")
+	if currency == "" {
+		return nil, missingParam("currency")
+	}
+
+	id := s.newID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:                 id,
+		Object:             "payment_intent",
+		Amount:             amount,
+		Currency:           stripe.Currency(currency),
+		CaptureMethod:      stripe.PaymentIntentCaptureMethodAutomatic,
+		ClientSecret:       id + "_secret_test",
+		Created:            s.now(),
+		Description:        form.Get("description"),
+		Metadata:           formMap(form, "metadata"),
+		PaymentMethodTypes: formList(form, "payment_method_types"),
+		Status:             stripe.PaymentIntentStatusRequiresPaymentMethod,
+	}
+	if len(pi.PaymentMethodTypes) == 0 {
+		pi.PaymentMethodTypes = []string{"card"}
+	}
+	if form.Get("capture_method") == string(stripe.PaymentIntentCaptureMethodManual) {
+		pi.CaptureMethod = stripe.PaymentIntentCaptureMethodManual
+	}
+	if cus := form.Get("customer"); cus != "" {
+		if _, ok := s.customers[cus]; !ok {
+			return nil, notFound("customer", cus)
+		}
+		pi.Customer = &stripe.Customer{ID: cus}
+	}
+	if pm := form.Get("payment_method"); pm != "" {
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: pm}
+		pi.Status = stripe.PaymentIntentStatusRequiresConfirmation
+	}
+
+	s.intents[id] = pi
+	s.emit("payment_intent.created", pi)
+
+	if formBool(form, "confirm") {
+		if err := s.confirm(pi, form); err != nil {
+			return nil, err
+		}
+	}
+	return pi, nil
+}
+
+func (s *Server) getPaymentIntent(r *http.Request, form url.Values) (interface{}, error) {
+	pi, ok := s.intents[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_intent", r.PathValue("id"))
+	}
+	return pi, nil
+}
+
+func (s *Server) confirmPaymentIntent(r *http.Request, form url.Values) (interface{}, error) {
+	pi, ok := s.intents[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_intent", r.PathValue("id"))
+	}
+	if err := s.confirm(pi, form); err != nil {
+		return nil, err
+	}
+	return pi, nil
+}
+
+// confirm moves a PaymentIntent through confirmation. Test cards whose name
+// contains "fail" are declined, ones containing "threeDSecure" or
+// "authenticationRequired" wait for the customer to authenticate, or are
+// declined with authentication_required when the customer is off session.
+// Everything else succeeds.
+func (s *Server) confirm(pi *stripe.PaymentIntent, form url.Values) error {
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation,
+		stripe.PaymentIntentStatusRequiresAction:
+	default:
+		return unexpectedState(pi, "confirm")
+	}
+	if pm := form.Get("payment_method"); pm != "" {
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: pm}
+	}
+	if pi.PaymentMethod == nil {
+		return invalidRequest("payment_method", "You cannot confirm this PaymentIntent because it's missing a payment method.")
+	}
+
+	card := s.cardName(pi.PaymentMethod.ID)
+	if strings.Contains(card, "fail") {
+		s.decline(pi)
+		return &stripe.Error{
+			Type:           stripe.ErrorTypeCard,
+			Code:           stripe.ErrorCodeCardDeclined,
+			DeclineCode:    stripe.DeclineCodeGenericDecline,
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Msg:            "Your card was declined.",
+			PaymentIntent:  pi,
+		}
+	}
+
+	if requiresAuthentication(card) && formBool(form, "off_session") {
+		s.declineAuthentication(pi)
+		return &stripe.Error{
+			Type:           stripe.ErrorTypeCard,
+			Code:           stripe.ErrorCodeAuthenticationRequired,
+			DeclineCode:    stripe.DeclineCodeAuthenticationRequired,
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Msg:            "Your card was declined. This transaction requires authentication.",
+			PaymentIntent:  pi,
+			PaymentMethod:  &stripe.PaymentMethod{ID: pi.PaymentMethod.ID},
+		}
+	}
+	if requiresAuthentication(card) {
+		s.requireAction(pi, form)
+		return nil
+	}
+
+	s.authorize(pi)
+	return nil
+}
+
+// requireAction leaves a PaymentIntent waiting for 3-D Secure. Stripe
+// redirects when given a return_url and otherwise leaves the challenge to
+// its SDKs.
+func (s *Server) requireAction(pi *stripe.PaymentIntent, form url.Values) {
+	pi.Status = stripe.PaymentIntentStatusRequiresAction
+	pi.LastPaymentError = nil
+	pi.NextAction = &stripe.PaymentIntentNextAction{
+		Type:         stripe.PaymentIntentNextActionTypeUseStripeSDK,
+		UseStripeSDK: &stripe.PaymentIntentNextActionUseStripeSDK{},
+	}
+	if returnURL := form.Get("return_url"); returnURL != "" && !formBool(form, "use_stripe_sdk") {
+		pi.NextAction = &stripe.PaymentIntentNextAction{
+			Type: stripe.PaymentIntentNextActionTypeRedirectToURL,
+			RedirectToURL: &stripe.PaymentIntentNextActionRedirectToURL{
+				URL:       fmt.Sprintf("%s/3d_secure_2/authenticate/%s", s.URL, pi.ID),
+				ReturnURL: returnURL,
+			},
+		}
+	}
+	s.emit("payment_intent.requires_action", pi)
+}
+
+// authorize creates the charge and either captures it straight away or
+// leaves it waiting for a manual capture.
+func (s *Server) authorize(pi *stripe.PaymentIntent) {
+	ch := &stripe.Charge{
+		ID:            s.newID("ch"),
+		Object:        "charge",
+		Amount:        pi.Amount,
+		Currency:      pi.Currency,
+		Created:       s.now(),
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Status:        stripe.ChargeStatusSucceeded,
+		Paid:          true,
+		Refunds:       &stripe.RefundList{},
+	}
+	s.charges[ch.ID] = ch
+	pi.LatestCharge = &stripe.Charge{ID: ch.ID}
+	pi.LastPaymentError = nil
+	pi.NextAction = nil
+
+	if pi.CaptureMethod == stripe.PaymentIntentCaptureMethodManual {
+		pi.Status = stripe.PaymentIntentStatusRequiresCapture
+		pi.AmountCapturable = pi.Amount
+		s.emit("payment_intent.amount_capturable_updated", pi)
+		return
+	}
+
+	ch.Captured = true
+	ch.AmountCaptured = pi.Amount
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = pi.Amount
+	s.emit("charge.succeeded", ch)
+	s.emit("payment_intent.succeeded", pi)
+}
+
+func (s *Server) decline(pi *stripe.PaymentIntent) {
+	pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+	pi.NextAction = nil
+	pi.LastPaymentError = &stripe.Error{
+		Type:        stripe.ErrorTypeCard,
+		Code:        stripe.ErrorCodeCardDeclined,
+		DeclineCode: stripe.DeclineCodeGenericDecline,
+		Msg:         "Your card was declined.",
+	}
+	s.emit("payment_intent.payment_failed", pi)
+}
+
+// declineAuthentication fails an off-session attempt on a card that needs
+// 3-D Secure. The customer has to come back and confirm it themselves.
+func (s *Server) declineAuthentication(pi *stripe.PaymentIntent) {
+	pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+	pi.NextAction = nil
+	pi.LastPaymentError = &stripe.Error{
+		Type:          stripe.ErrorTypeCard,
+		Code:          stripe.ErrorCodeAuthenticationRequired,
+		DeclineCode:   stripe.DeclineCodeAuthenticationRequired,
+		Msg:           "Your card was declined. This transaction requires authentication.",
+		PaymentMethod: &stripe.PaymentMethod{ID: pi.PaymentMethod.ID},
+	}
+	s.emit("payment_intent.payment_failed", pi)
+}
+
+func (s *Server) capturePaymentIntent(r *http.Request, form url.Values) (interface{}, error) {
+	pi, ok := s.intents[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_intent", r.PathValue("id"))
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		return nil, unexpectedState(pi, "capture")
+	}
+
+	amount, ok, err := formInt(form, "amount_to_capture")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		amount = pi.AmountCapturable
+	}
+	if amount < 1 || amount > pi.AmountCapturable {
+		return nil, invalidRequest("amount_to_capture", "The amount to capture must be positive and not exceed the capturable amount.")
+	}
+
+	ch := s.charges[pi.LatestCharge.ID]
+	ch.Captured = true
+	ch.AmountCaptured = amount
+	pi.AmountCapturable = 0
+	pi.AmountReceived = amount
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	s.emit("charge.captured", ch)
+	s.emit("payment_intent.succeeded", pi)
+	return pi, nil
+}
+
+func (s *Server) cancelPaymentIntent(r *http.Request, form url.Values) (interface{}, error) {
+	pi, ok := s.intents[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_intent", r.PathValue("id"))
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod,
+		stripe.PaymentIntentStatusRequiresConfirmation,
+		stripe.PaymentIntentStatusRequiresAction,
+		stripe.PaymentIntentStatusRequiresCapture:
+	default:
+		return nil, unexpectedState(pi, "cancel")
+	}
+
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	pi.AmountCapturable = 0
+	pi.CanceledAt = s.now()
+	if reason := form.Get("cancellation_reason"); reason != "" {
+		pi.CancellationReason = stripe.PaymentIntentCancellationReason(reason)
+	}
+	s.emit("payment_intent.canceled", pi)
+	return pi, nil
+}
+
+func (s *Server) createRefund(r *http.Request, form url.Values) (interface{}, error) {
+	piID := form.Get("payment_intent")
+	if piID == "" {
+		return nil, missingParam("payment_intent")
+	}
+	pi, ok := s.intents[piID]
+	if !ok {
+		return nil, notFound("payment_intent", piID)
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, invalidRequest("payment_intent", fmt.Sprintf("This PaymentIntent (%s) does not have a successful charge to refund.", pi.ID))
+	}
+
+	ch := s.charges[pi.LatestCharge.ID]
+	remaining := ch.AmountCaptured - ch.AmountRefunded
+
+	amount, ok, err := formInt(form, "amount")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		amount = remaining
+	}
+	if remaining <= 0 {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeChargeAlreadyRefunded,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("Charge %s has already been refunded.", ch.ID),
+		}
+	}
+	if amount < 1 || amount > remaining {
+		return nil, invalidRequest("amount", fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, remaining))
+	}
+
+	re := &stripe.Refund{
+		ID:            s.newID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Charge:        &stripe.Charge{ID: ch.ID},
+		Currency:      pi.Currency,
+		Created:       s.now(),
+		Metadata:      formMap(form, "metadata"),
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Reason:        stripe.RefundReason(form.Get("reason")),
+		Status:        stripe.RefundStatusSucceeded,
+	}
+	s.refunds[re.ID] = re
+
+	ch.AmountRefunded += amount
+	ch.Refunded = ch.AmountRefunded == ch.AmountCaptured
+	ch.Refunds.Data = append(ch.Refunds.Data, re)
+	ch.Refunds.TotalCount = uint32(len(ch.Refunds.Data))
+
+	s.emit("refund.created", re)
+	s.emit("charge.refunded", ch)
+	return re, nil
+}
+
+func (s *Server) getRefund(r *http.Request, form url.Values) (interface{}, error) {
+	re, ok := s.refunds[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("refund", r.PathValue("id"))
+	}
+	return re, nil
+}
+
+// cancelRefund only succeeds for refunds still waiting on the customer, as
+// card refunds complete immediately and cannot be canceled.
+func (s *Server) cancelRefund(r *http.Request, form url.Values) (interface{}, error) {
+	re, ok := s.refunds[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("refund", r.PathValue("id"))
+	}
+	if re.Status != stripe.RefundStatusRequiresAction {
+		return nil, invalidRequest("", fmt.Sprintf("Refund %s has a status of %s and cannot be canceled.", re.ID, re.Status))
+	}
+
+	re.Status = stripe.RefundStatusCanceled
+	ch := s.charges[re.Charge.ID]
+	ch.AmountRefunded -= re.Amount
+	ch.Refunded = false
+	s.emit("refund.updated", re)
+	return re, nil
+}
+
+func (s *Server) createCustomer(r *http.Request, form url.Values) (interface{}, error) {
+	cus := &stripe.Customer{
+		ID:       s.newID("cus"),
+		Object:   "customer",
+		Created:  s.now(),
+		Email:    form.Get("email"),
+		Name:     form.Get("name"),
+		Metadata: formMap(form, "metadata"),
+	}
+	s.customers[cus.ID] = cus
+	s.emit("customer.created", cus)
+	return cus, nil
+}
+
+func (s *Server) getCustomer(r *http.Request, form url.Values) (interface{}, error) {
+	cus, ok := s.customers[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("customer", r.PathValue("id"))
+	}
+	return cus, nil
+}
+
+func (s *Server) createSubscription(r *http.Request, form url.Values) (interface{}, error) {
+	cusID := form.Get("customer")
+	if cusID == "" {
+		return nil, missingParam("customer")
+	}
+	if _, ok := s.customers[cusID]; !ok {
+		return nil, notFound("customer", cusID)
+	}
+
+	now := s.now()
+	sub := &stripe.Subscription{
+		ID:                 s.newID("sub"),
+		Object:             "subscription",
+		Created:            now,
+		Customer:           &stripe.Customer{ID: cusID},
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   now,
+		Metadata:           formMap(form, "metadata"),
+		StartDate:          now,
+		Status:             stripe.SubscriptionStatusActive,
+		Items:              &stripe.SubscriptionItemList{},
+	}
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("items[%d]", i)
+		id := form.Get(key + "[price]")
+		if id == "" {
+			break
+		}
+		price, ok := s.prices[id]
+		if !ok {
+			return nil, notFound("price", id)
+		}
+		if price.Recurring == nil {
+			return nil, invalidRequest(key+"[price]", fmt.Sprintf("The price specified is set to `type=one_time` but this field only accepts prices with `type=recurring`: %s", id))
+		}
+		if !price.Active {
+			return nil, invalidRequest(key+"[price]", fmt.Sprintf("The price specified is inactive. This field only accepts active prices: %s", id))
+		}
+		quantity, ok, err := formInt(form, key+"[quantity]")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			quantity = 1
+		}
+		item := *price
+		sub.Items.Data = append(sub.Items.Data, &stripe.SubscriptionItem{
+			ID:           s.newID("si"),
+			Object:       "subscription_item",
+			Price:        &item,
+			Quantity:     quantity,
+			Subscription: sub.ID,
+		})
+		sub.CurrentPeriodEnd = periodEnd(now, price.Recurring)
+	}
+	if len(sub.Items.Data) == 0 {
+		return nil, missingParam("items")
+	}
+	sub.Items.TotalCount = uint32(len(sub.Items.Data))
+	if form.Get("payment_behavior") == "default_incomplete" {
+		sub.Status = stripe.SubscriptionStatusIncomplete
+	}
+
+	days, hasDays, err := formInt(form, "trial_period_days")
+	if err != nil {
+		return nil, err
+	}
+	trialEnd, hasEnd, err := formInt(form, "trial_end")
+	if err != nil {
+		return nil, err
+	}
+	if hasDays && hasEnd {
+		return nil, invalidRequest("trial_end", "You may only specify one of these parameters: trial_end, trial_period_days.")
+	}
+	if hasDays {
+		trialEnd = time.Unix(now, 0).AddDate(0, 0, int(days)).Unix()
+	} else if hasEnd && trialEnd <= now {
+		return nil, invalidRequest("trial_end", "Invalid timestamp: must be in the future.")
+	}
+	if trialEnd > now {
+		sub.Status = stripe.SubscriptionStatusTrialing
+		sub.TrialStart = now
+		sub.TrialEnd = trialEnd
+		sub.CurrentPeriodEnd = trialEnd
+	}
+
+	if form.Get("coupon") != "" || form.Get("promotion_code") != "" {
+		if sub.Discount, err = s.discount(sub.ID, form.Get("coupon"), form.Get("promotion_code")); err != nil {
+			return nil, err
+		}
+	}
+
+	s.subscriptions[sub.ID] = sub
+	s.emit("customer.subscription.created", sub)
+	// Like Stripe, a trial opens with a $0 invoice that is paid at once.
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		s.emit("invoice.paid", &stripe.Invoice{
+			ID:            s.newID("in"),
+			Object:        "invoice",
+			BillingReason: stripe.InvoiceBillingReasonSubscriptionCreate,
+			Currency:      sub.Items.Data[0].Price.Currency,
+			Customer:      sub.Customer,
+			Paid:          true,
+			PeriodStart:   now,
+			PeriodEnd:     now,
+			Status:        stripe.InvoiceStatusPaid,
+			Subscription:  sub,
+		})
+	}
+	return sub, nil
+}
+
+// periodEnd is when a billing period of r starting at start ends.
+func periodEnd(start int64, r *stripe.PriceRecurring) int64 {
+	t := time.Unix(start, 0).UTC()
+	n := int(r.IntervalCount)
+	switch r.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		t = t.AddDate(0, 0, n)
+	case stripe.PriceRecurringIntervalWeek:
+		t = t.AddDate(0, 0, 7*n)
+	case stripe.PriceRecurringIntervalYear:
+		t = t.AddDate(n, 0, 0)
+	default:
+		t = t.AddDate(0, n, 0)
+	}
+	return t.Unix()
+}
+
+func (s *Server) getSubscription(r *http.Request, form url.Values) (interface{}, error) {
+	sub, ok := s.subscriptions[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("subscription", r.PathValue("id"))
+	}
+	return sub, nil
+}
+
+func (s *Server) cancelSubscription(r *http.Request, form url.Values) (interface{}, error) {
+	sub, ok := s.subscriptions[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("subscription", r.PathValue("id"))
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest("", fmt.Sprintf("A canceled subscription can only update its cancellation_details. (%s)", sub.ID))
+	}
+
+	now := s.now()
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = now
+	sub.EndedAt = now
+	s.emit("customer.subscription.deleted", sub)
+	return sub, nil
+}
+
+// ConfirmPaymentIntent confirms id with paymentMethod the way a customer's
+// browser would. Use a payment method ID containing "fail" to get a decline.
+func (s *Server) ConfirmPaymentIntent(id, paymentMethod string) (*stripe.PaymentIntent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	form := url.Values{}
+	if paymentMethod != "" {
+		form.Set("payment_method", paymentMethod)
+	}
+	if err := s.confirm(pi, form); err != nil {
+		return nil, err
+	}
+	out := *pi
+	return &out, nil
+}
+
+// AuthenticatePaymentIntent completes the 3-D Secure challenge of a
+// PaymentIntent in requires_action, the way the customer's bank would. A
+// failed challenge sends the PaymentIntent back to requires_payment_method.
+func (s *Server) AuthenticatePaymentIntent(id string, approve bool) (*stripe.PaymentIntent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return nil, unexpectedState(pi, "authenticate")
+	}
+
+	if approve {
+		s.authorize(pi)
+	} else {
+		pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		pi.NextAction = nil
+		pi.LastPaymentError = &stripe.Error{
+			Type: stripe.ErrorTypeInvalidRequest,
+			Code: stripe.ErrorCodePaymentIntentAuthenticationFailure,
+			Msg:  "We are unable to authenticate your payment method. Please choose a different payment method and try again.",
+		}
+		s.emit("payment_intent.payment_failed", pi)
+	}
+	out := *pi
+	return &out, nil
+}
+
+// FailRefund fails a refund the way a bank bouncing it would, for example
+// when the card has been closed, and gives the amount back to the charge.
+func (s *Server) FailRefund(id string, reason stripe.RefundFailureReason) (*stripe.Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	re, ok := s.refunds[id]
+	if !ok {
+		return nil, notFound("refund", id)
+	}
+	if re.Status == stripe.RefundStatusFailed || re.Status == stripe.RefundStatusCanceled {
+		return nil, invalidRequest("", fmt.Sprintf("Refund %s has a status of %s.", re.ID, re.Status))
+	}
+
+	re.Status = stripe.RefundStatusFailed
+	re.FailureReason = reason
+	ch := s.charges[re.Charge.ID]
+	ch.AmountRefunded -= re.Amount
+	ch.Refunded = false
+	s.emit("refund.updated", re)
+	s.emit("charge.refund.updated", re)
+	out := *re
+	return &out, nil
+}
+
+// PaymentIntent returns a snapshot of a stored PaymentIntent.
+func (s *Server) PaymentIntent(id string) (*stripe.PaymentIntent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.intents[id]
+	if !ok {
+		return nil, false
+	}
+	out := *pi
+	return &out, true
+}
+
+// Refund returns a snapshot of a stored Refund.
+func (s *Server) Refund(id string) (*stripe.Refund, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	re, ok := s.refunds[id]
+	if !ok {
+		return nil, false
+	}
+	out := *re
+	return &out, true
+}
+
+// Subscription returns a snapshot of a stored Subscription.
+func (s *Server) Subscription(id string) (*stripe.Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, false
+	}
+	out := *sub
+	return &out, true
+}
+
+// TrialWillEnd plays Stripe's reminder, three days before a trial ends, by
+// emitting customer.subscription.trial_will_end for a trialing subscription.
+func (s *Server) TrialWillEnd(id string) (*stripe.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		return nil, invalidRequest("", fmt.Sprintf("Subscription %s is not trialing.", id))
+	}
+	s.emit("customer.subscription.trial_will_end", sub)
+	out := *sub
+	return &out, nil
+}
+
+// EndTrial lets a trial run out: the subscription becomes active and its
+// first paid period starts.
+func (s *Server) EndTrial(id string) (*stripe.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		return nil, invalidRequest("", fmt.Sprintf("Subscription %s is not trialing.", id))
+	}
+	sub.Status = stripe.SubscriptionStatusActive
+	sub.CurrentPeriodStart = sub.TrialEnd
+	if len(sub.Items.Data) > 0 {
+		sub.CurrentPeriodEnd = periodEnd(sub.TrialEnd, sub.Items.Data[0].Price.Recurring)
+	}
+	s.emit("customer.subscription.updated", sub)
+	out := *sub
+	return &out, nil
+}
@@ -0,0 +1,301 @@
+// Package stripetest runs a local stand-in for the parts of the Stripe API the
+// gateway uses, so end-to-end flows can run in CI without network access.
+//
+// Install the server as the stripe-go API backend, drive the gateway as usual
+// and use the helper methods to play the part of the customer (confirming or
+// failing a PaymentIntent, answering its 3-D Secure challenge, or paying on a
+// Checkout page or through a payment link). Every state change queues a
+// signed webhook event that DeliverWebhooks posts to the gateway's webhook
+// endpoint.
+package stripetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+type Server struct {
+	URL string
+
+	srv     *httptest.Server
+	secret  string
+	webhook string
+	do      func(*http.Request) (*http.Response, error)
+
+	mu            sync.Mutex
+	seq           int
+	now           func() int64
+	intents       map[string]*stripe.PaymentIntent
+	charges       map[string]*stripe.Charge
+	refunds       map[string]*stripe.Refund
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	setupIntents  map[string]*stripe.SetupIntent
+	methods       map[string]*stripe.PaymentMethod
+	sessions      map[string]*stripe.CheckoutSession
+	products      map[string]*stripe.Product
+	prices        map[string]*stripe.Price
+	links         map[string]*stripe.PaymentLink
+	coupons       map[string]*stripe.Coupon
+	promoCodes    map[string]*stripe.PromotionCode
+	// testCards maps saved payment methods to the test card they were
+	// created from, which decides how they behave.
+	testCards  map[string]string
+	idempotent map[string]idempotentResponse
+	events     []*stripe.Event
+	delivered  int
+}
+
+type idempotentResponse struct {
+	status int
+	body   []byte
+}
+
+// NewServer starts a stand-in server. Webhook events it emits are signed with
+// webhookSecret, which should match STRIPE_WEBHOOK_SECRET on the gateway.
+func NewServer(webhookSecret string) *Server {
+	s := &Server{
+		secret:        webhookSecret,
+		now:           unixNow,
+		intents:       make(map[string]*stripe.PaymentIntent),
+		charges:       make(map[string]*stripe.Charge),
+		refunds:       make(map[string]*stripe.Refund),
+		customers:     make(map[string]*stripe.Customer),
+		subscriptions: make(map[string]*stripe.Subscription),
+		setupIntents:  make(map[string]*stripe.SetupIntent),
+		methods:       make(map[string]*stripe.PaymentMethod),
+		sessions:      make(map[string]*stripe.CheckoutSession),
+		products:      make(map[string]*stripe.Product),
+		prices:        make(map[string]*stripe.Price),
+		links:         make(map[string]*stripe.PaymentLink),
+		coupons:       make(map[string]*stripe.Coupon),
+		promoCodes:    make(map[string]*stripe.PromotionCode),
+		testCards:     make(map[string]string),
+		idempotent:    make(map[string]idempotentResponse),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/payment_intents", s.handle(s.createPaymentIntent))
+	mux.HandleFunc("GET /v1/payment_intents/{id}", s.handle(s.getPaymentIntent))
+	mux.HandleFunc("POST /v1/payment_intents/{id}/confirm", s.handle(s.confirmPaymentIntent))
+	mux.HandleFunc("POST /v1/payment_intents/{id}/capture", s.handle(s.capturePaymentIntent))
+	mux.HandleFunc("POST /v1/payment_intents/{id}/cancel", s.handle(s.cancelPaymentIntent))
+	mux.HandleFunc("POST /v1/refunds", s.handle(s.createRefund))
+	mux.HandleFunc("GET /v1/refunds/{id}", s.handle(s.getRefund))
+	mux.HandleFunc("POST /v1/refunds/{id}/cancel", s.handle(s.cancelRefund))
+	mux.HandleFunc("POST /v1/customers", s.handle(s.createCustomer))
+	mux.HandleFunc("GET /v1/customers/{id}", s.handle(s.getCustomer))
+	mux.HandleFunc("POST /v1/customers/{id}", s.handle(s.updateCustomer))
+	mux.HandleFunc("POST /v1/setup_intents", s.handle(s.createSetupIntent))
+	mux.HandleFunc("GET /v1/setup_intents/{id}", s.handle(s.getSetupIntent))
+	mux.HandleFunc("GET /v1/payment_methods/{id}", s.handle(s.getPaymentMethod))
+	mux.HandleFunc("POST /v1/payment_methods/{id}/detach", s.handle(s.detachPaymentMethod))
+	mux.HandleFunc("POST /v1/checkout/sessions", s.handle(s.createCheckoutSession))
+	mux.HandleFunc("GET /v1/checkout/sessions/{id}", s.handle(s.getCheckoutSession))
+	mux.HandleFunc("POST /v1/checkout/sessions/{id}/expire", s.handle(s.expireCheckoutSession))
+	mux.HandleFunc("POST /v1/products", s.handle(s.createProduct))
+	mux.HandleFunc("GET /v1/products/{id}", s.handle(s.getProduct))
+	mux.HandleFunc("POST /v1/products/{id}", s.handle(s.updateProduct))
+	mux.HandleFunc("POST /v1/prices", s.handle(s.createPrice))
+	mux.HandleFunc("GET /v1/prices/{id}", s.handle(s.getPrice))
+	mux.HandleFunc("POST /v1/prices/{id}", s.handle(s.updatePrice))
+	mux.HandleFunc("POST /v1/coupons", s.handle(s.createCoupon))
+	mux.HandleFunc("GET /v1/coupons/{id}", s.handle(s.getCoupon))
+	mux.HandleFunc("POST /v1/promotion_codes", s.handle(s.createPromotionCode))
+	mux.HandleFunc("GET /v1/promotion_codes", s.handle(s.listPromotionCodes))
+	mux.HandleFunc("POST /v1/payment_links", s.handle(s.createPaymentLink))
+	mux.HandleFunc("GET /v1/payment_links/{id}", s.handle(s.getPaymentLink))
+	mux.HandleFunc("POST /v1/payment_links/{id}", s.handle(s.updatePaymentLink))
+	mux.HandleFunc("POST /v1/subscriptions", s.handle(s.createSubscription))
+	mux.HandleFunc("GET /v1/subscriptions/{id}", s.handle(s.getSubscription))
+	mux.HandleFunc("POST /v1/subscriptions/{id}", s.handle(s.updateSubscription))
+	mux.HandleFunc("DELETE /v1/subscriptions/{id}", s.handle(s.cancelSubscription))
+	mux.HandleFunc("GET /v1/invoices/upcoming", s.handle(s.upcomingInvoice))
+
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Backend returns a stripe-go backend that talks to this server.
+func (s *Server) Backend() stripe.Backend {
+	return stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(s.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelError},
+	})
+}
+
+// Install makes this server the global stripe-go API backend and returns a
+// function that puts the previous backend back.
+func (s *Server) Install() (restore func()) {
+	prev := stripe.GetBackend(stripe.APIBackend)
+	stripe.SetBackend(stripe.APIBackend, s.Backend())
+	return func() {
+		stripe.SetBackend(stripe.APIBackend, prev)
+	}
+}
+
+// SetWebhookTarget sets where DeliverWebhooks posts events. do sends the
+// request; pass http.DefaultClient.Do for a live server or a wrapper around
+// fiber's app.Test to stay in process.
+func (s *Server) SetWebhookTarget(url string, do func(*http.Request) (*http.Response, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.webhook = url
+	s.do = do
+}
+
+// SetClock overrides the Unix timestamp source used for created/updated
+// fields and event timestamps.
+func (s *Server) SetClock(now func() int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = now
+}
+
+type apiFunc func(r *http.Request, form url.Values) (interface{}, error)
+
+// handle decodes the form body, replays idempotent POSTs and encodes either
+// the resulting object or a Stripe-shaped error.
+func (s *Server) handle(fn apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorBody(invalidRequest("", "Invalid form body.")))
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		key := r.Header.Get("Idempotency-Key")
+		if key != "" && r.Method == http.MethodPost {
+			key = r.URL.Path + "|" + key
+			if prev, ok := s.idempotent[key]; ok {
+				w.Header().Set("Idempotent-Replayed", "true")
+				writeRaw(w, prev.status, prev.body)
+				return
+			}
+		}
+
+		status := http.StatusOK
+		obj, err := fn(r, r.PostForm)
+		var body []byte
+		if err != nil {
+			stripeErr := toStripeError(err)
+			status = stripeErr.HTTPStatusCode
+			body, _ = json.Marshal(errorBody(stripeErr))
+		} else {
+			body, _ = json.Marshal(obj)
+		}
+
+		if key != "" && r.Method == http.MethodPost {
+			s.idempotent[key] = idempotentResponse{status: status, body: body}
+		}
+		writeRaw(w, status, body)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	writeRaw(w, status, body)
+}
+
+func writeRaw(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func errorBody(err *stripe.Error) map[string]interface{} {
+	return map[string]interface{}{"error": err}
+}
+
+func toStripeError(err error) *stripe.Error {
+	if stripeErr, ok := err.(*stripe.Error); ok {
+		return stripeErr
+	}
+	return &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusInternalServerError, Msg: err.Error()}
+}
+
+func invalidRequest(param, msg string) *stripe.Error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		HTTPStatusCode: http.StatusBadRequest,
+		Param:          param,
+		Msg:            msg,
+	}
+}
+
+func missingParam(param string) *stripe.Error {
+	return invalidRequest(param, fmt.Sprintf("Missing required param: %s.", param))
+}
+
+func notFound(resource, id string) *stripe.Error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Param:          "id",
+		Msg:            fmt.Sprintf("No such %s: '%s'", resource, id),
+	}
+}
+
+func (s *Server) newID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s_test%06d", prefix, s.seq)
+}
+
+func formInt(form url.Values, key string) (int64, bool, error) {
+	v := form.Get(key)
+	if v == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, invalidRequest(key, fmt.Sprintf("Invalid integer: %s", v))
+	}
+	return n, true, nil
+}
+
+func formBool(form url.Values, key string) bool {
+	return form.Get(key) == "true"
+}
+
+// formList collects indexed values such as payment_method_types[0].
+func formList(form url.Values, key string) []string {
+	var out []string
+	for i := 0; ; i++ {
+		v, ok := form[fmt.Sprintf("%s[%d]", key, i)]
+		if !ok {
+			return out
+		}
+		out = append(out, v[0])
+	}
+}
+
+// formMap collects keyed values such as metadata[order_id].
+func formMap(form url.Values, key string) map[string]string {
+	out := make(map[string]string)
+	prefix := key + "["
+	for k, v := range form {
+		if strings.HasPrefix(k, prefix) && strings.HasSuffix(k, "]") && !strings.Contains(k[len(prefix):], "[") {
+			out[k[len(prefix):len(k)-1]] = v[0]
+		}
+	}
+	return out
+}
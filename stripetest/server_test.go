@@ -0,0 +1,195 @@
+package stripetest_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Faizan2005/payment-gateway-stripe/stripetest"
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/paymentintent"
+	"github.com/stripe/stripe-go/v78/refund"
+	"github.com/stripe/stripe-go/v78/webhook"
+)
+
+const secret = "whsec_test"
+
+func newServer(t *testing.T) (*stripetest.Server, *paymentintent.Client, *refund.Client) {
+	t.Helper()
+
+	s := stripetest.NewServer(secret)
+	t.Cleanup(s.Close)
+	b := s.Backend()
+	return s, &paymentintent.Client{B: b, Key: "sk_test_123"}, &refund.Client{B: b, Key: "sk_test_123"}
+}
+
+// eventTypes returns the types of the events s has emitted, oldest first.
+func eventTypes(s *stripetest.Server) []stripe.EventType {
+	var types []stripe.EventType
+	for _, e := range s.Events() {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// hasInOrder reports whether want appears in got in the same order, possibly
+// with other events in between.
+func hasInOrder(got, want []stripe.EventType) bool {
+	for _, g := range got {
+		if len(want) > 0 && g == want[0] {
+			want = want[1:]
+		}
+	}
+	return len(want) == 0
+}
+
+func TestPaymentAndRefund(t *testing.T) {
+	s, intents, refunds := newServer(t)
+
+	pi, err := intents.New(&stripe.PaymentIntentParams{Amount: stripe.Int64(1000), Currency: stripe.String("usd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresPaymentMethod {
+		t.Fatalf("got status %s, want requires_payment_method", pi.Status)
+	}
+
+	if _, err := s.ConfirmPaymentIntent(pi.ID, "pm_card_visa"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := intents.Get(pi.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != stripe.PaymentIntentStatusSucceeded || got.AmountReceived != 1000 {
+		t.Fatalf("got %s with %d received, want succeeded with 1000", got.Status, got.AmountReceived)
+	}
+
+	re, err := refunds.New(&stripe.RefundParams{PaymentIntent: stripe.String(pi.ID), Amount: stripe.Int64(600)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.Amount != 600 || re.Status != stripe.RefundStatusSucceeded {
+		t.Fatalf("got refund %+v, want 600 succeeded", re)
+	}
+	if stored, ok := s.Refund(re.ID); !ok || stored.Amount != 600 {
+		t.Fatalf("stored refund %+v, %v", stored, ok)
+	}
+
+	_, err = refunds.New(&stripe.RefundParams{PaymentIntent: stripe.String(pi.ID), Amount: stripe.Int64(500)})
+	var se *stripe.Error
+	if !errors.As(err, &se) || se.HTTPStatusCode != http.StatusBadRequest || se.Param != "amount" {
+		t.Fatalf("over-refund: got %v, want a 400 on amount", err)
+	}
+
+	want := []stripe.EventType{"payment_intent.created", "charge.succeeded", "payment_intent.succeeded", "refund.created", "charge.refunded"}
+	if got := eventTypes(s); !hasInOrder(got, want) {
+		t.Fatalf("got events %v, want %v in that order", got, want)
+	}
+}
+
+func TestDeclinedConfirmation(t *testing.T) {
+	s, intents, _ := newServer(t)
+
+	pi, err := intents.New(&stripe.PaymentIntentParams{Amount: stripe.Int64(1000), Currency: stripe.String("usd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ConfirmPaymentIntent(pi.ID, "pm_card_fail"); err == nil {
+		t.Fatal("confirming with a failing payment method succeeded")
+	}
+
+	got, ok := s.PaymentIntent(pi.ID)
+	if !ok {
+		t.Fatalf("intent %s not stored", pi.ID)
+	}
+	if got.Status != stripe.PaymentIntentStatusRequiresPaymentMethod || got.LastPaymentError == nil {
+		t.Fatalf("got %s with last error %v, want requires_payment_method with an error", got.Status, got.LastPaymentError)
+	}
+	if types := eventTypes(s); !hasInOrder(types, []stripe.EventType{"payment_intent.payment_failed"}) {
+		t.Fatalf("got events %v, want payment_intent.payment_failed", types)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	s, intents, _ := newServer(t)
+
+	params := func() *stripe.PaymentIntentParams {
+		p := &stripe.PaymentIntentParams{Amount: stripe.Int64(1000), Currency: stripe.String("usd")}
+		p.SetIdempotencyKey("order-1")
+		return p
+	}
+	first, err := intents.New(params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := intents.New(params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Fatalf("same idempotency key created %s and %s", first.ID, second.ID)
+	}
+	if n := len(s.Events()); n != 1 {
+		t.Fatalf("got %d events, want the replay to emit none", n)
+	}
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	s, intents, _ := newServer(t)
+
+	var (
+		delivered []stripe.EventType
+		failNext  = true
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), secret)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if failNext {
+			failNext = false
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		delivered = append(delivered, event.Type)
+	}))
+	t.Cleanup(target.Close)
+
+	if err := s.DeliverWebhooks(); err == nil {
+		t.Fatal("delivering without a target succeeded")
+	}
+	s.SetWebhookTarget(target.URL, nil)
+
+	pi, err := intents.New(&stripe.PaymentIntentParams{Amount: stripe.Int64(1000), Currency: stripe.String("usd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ConfirmPaymentIntent(pi.ID, "pm_card_visa"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeliverWebhooks(); err == nil {
+		t.Fatal("a 500 from the target was not reported")
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("delivered %v past a failed event", delivered)
+	}
+	if err := s.DeliverWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if want := eventTypes(s); len(delivered) != len(want) || !hasInOrder(delivered, want) {
+		t.Fatalf("delivered %v, want %v", delivered, want)
+	}
+
+	if err := s.DeliverWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Events()); len(delivered) != n {
+		t.Fatalf("delivered %d events of %d, want each exactly once", len(delivered), n)
+	}
+}
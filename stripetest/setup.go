@@ -0,0 +1,175 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+func (s *Server) updateCustomer(r *http.Request, form url.Values) (interface{}, error) {
+	cus, ok := s.customers[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("customer", r.PathValue("id"))
+	}
+
+	if v, ok := form["name"]; ok {
+		cus.Name = v[0]
+	}
+	if v, ok := form["email"]; ok {
+		cus.Email = v[0]
+	}
+	if v, ok := form["invoice_settings[default_payment_method]"]; ok {
+		cus.InvoiceSettings = &stripe.CustomerInvoiceSettings{}
+		if v[0] != "" {
+			pm, ok := s.methods[v[0]]
+			if !ok || pm.Customer == nil || pm.Customer.ID != cus.ID {
+				return nil, invalidRequest("invoice_settings[default_payment_method]",
+					fmt.Sprintf("No such PaymentMethod: '%s'; it does not belong to customer %s.", v[0], cus.ID))
+			}
+			cus.InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm.ID}
+		}
+	}
+
+	s.emit("customer.updated", cus)
+	return cus, nil
+}
+
+func (s *Server) createSetupIntent(r *http.Request, form url.Values) (interface{}, error) {
+	id := s.newID("seti")
+	si := &stripe.SetupIntent{
+		ID:                 id,
+		Object:             "setup_intent",
+		ClientSecret:       id + "_secret_test",
+		Created:            s.now(),
+		Metadata:           formMap(form, "metadata"),
+		PaymentMethodTypes: formList(form, "payment_method_types"),
+		Status:             stripe.SetupIntentStatusRequiresPaymentMethod,
+		Usage:              stripe.SetupIntentUsageOffSession,
+	}
+	if len(si.PaymentMethodTypes) == 0 {
+		si.PaymentMethodTypes = []string{"card"}
+	}
+	if usage := form.Get("usage"); usage != "" {
+		si.Usage = stripe.SetupIntentUsage(usage)
+	}
+	if cus := form.Get("customer"); cus != "" {
+		if _, ok := s.customers[cus]; !ok {
+			return nil, notFound("customer", cus)
+		}
+		si.Customer = &stripe.Customer{ID: cus}
+	}
+
+	s.setupIntents[id] = si
+	s.emit("setup_intent.created", si)
+	return si, nil
+}
+
+func (s *Server) getSetupIntent(r *http.Request, form url.Values) (interface{}, error) {
+	si, ok := s.setupIntents[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("setup_intent", r.PathValue("id"))
+	}
+	return si, nil
+}
+
+func (s *Server) getPaymentMethod(r *http.Request, form url.Values) (interface{}, error) {
+	pm, ok := s.methods[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_method", r.PathValue("id"))
+	}
+	return pm, nil
+}
+
+func (s *Server) detachPaymentMethod(r *http.Request, form url.Values) (interface{}, error) {
+	pm, ok := s.methods[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("payment_method", r.PathValue("id"))
+	}
+	if pm.Customer == nil {
+		return nil, invalidRequest("", "The payment method you provided is not attached to a customer so detachment is impossible.")
+	}
+
+	if cus := s.customers[pm.Customer.ID]; cus != nil && cus.InvoiceSettings != nil &&
+		cus.InvoiceSettings.DefaultPaymentMethod != nil && cus.InvoiceSettings.DefaultPaymentMethod.ID == pm.ID {
+		cus.InvoiceSettings.DefaultPaymentMethod = nil
+		s.emit("customer.updated", cus)
+	}
+	pm.Customer = nil
+	s.emit("payment_method.detached", pm)
+	return pm, nil
+}
+
+// ConfirmSetupIntent saves a card the way a customer completing a SetupIntent
+// in the browser would. paymentMethod names a test card such as
+// pm_card_visa or pm_card_mastercard; the same name always yields the same
+// fingerprint. The new PaymentMethod is attached to the SetupIntent's
+// customer.
+func (s *Server) ConfirmSetupIntent(id, paymentMethod string) (*stripe.PaymentMethod, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	si, ok := s.setupIntents[id]
+	if !ok {
+		return nil, notFound("setup_intent", id)
+	}
+	if si.Status != stripe.SetupIntentStatusRequiresPaymentMethod {
+		return nil, invalidRequest("", fmt.Sprintf("You cannot confirm this SetupIntent because it has a status of %s.", si.Status))
+	}
+
+	pm := s.testCard(paymentMethod)
+	s.methods[pm.ID] = pm
+	s.testCards[pm.ID] = paymentMethod
+	si.PaymentMethod = &stripe.PaymentMethod{ID: pm.ID}
+	si.Status = stripe.SetupIntentStatusSucceeded
+	if si.Customer != nil {
+		pm.Customer = &stripe.Customer{ID: si.Customer.ID}
+		s.emit("payment_method.attached", pm)
+	}
+	s.emit("setup_intent.succeeded", si)
+
+	out := *pm
+	return &out, nil
+}
+
+// cardName is the test card name behind a payment method ID: the ID itself
+// for test tokens such as pm_card_visa, or the name a saved card was created
+// from.
+func (s *Server) cardName(id string) string {
+	if name, ok := s.testCards[id]; ok {
+		return name
+	}
+	return id
+}
+
+// requiresAuthentication reports whether a test card asks for 3-D Secure.
+func requiresAuthentication(name string) bool {
+	return strings.Contains(name, "threeDSecure") || strings.Contains(name, "authenticationRequired")
+}
+
+func (s *Server) testCard(name string) *stripe.PaymentMethod {
+	card := &stripe.PaymentMethodCard{
+		Brand:       stripe.PaymentMethodCardBrandVisa,
+		Last4:       "4242",
+		ExpMonth:    12,
+		ExpYear:     int64(time.Unix(s.now(), 0).Year() + 3),
+		Fingerprint: "fp_" + name,
+	}
+	switch {
+	case strings.Contains(name, "mastercard"):
+		card.Brand, card.Last4 = stripe.PaymentMethodCardBrandMastercard, "4444"
+	case strings.Contains(name, "amex"):
+		card.Brand, card.Last4 = stripe.PaymentMethodCardBrandAmex, "8431"
+	}
+
+	return &stripe.PaymentMethod{
+		ID:      s.newID("pm"),
+		Object:  "payment_method",
+		Created: s.now(),
+		Type:    stripe.PaymentMethodTypeCard,
+		Card:    card,
+	}
+}
@@ -0,0 +1,304 @@
+package stripetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+)
+
+// planChange is a price swap on one subscription item, as given to a
+// subscription update or an upcoming invoice preview.
+type planChange struct {
+	item      *stripe.SubscriptionItem
+	price     *stripe.Price
+	behavior  string
+	at        int64
+	newPeriod bool
+}
+
+// parsePlanChange reads items[0][id] and items[0][price] under prefix, along
+// with the proration settings, and checks them against sub.
+func (s *Server) parsePlanChange(sub *stripe.Subscription, form url.Values, prefix string) (*planChange, error) {
+	key := prefix + "items[0]"
+	if prefix != "" {
+		key = prefix + "[items][0]"
+	}
+	itemID, priceID := form.Get(key+"[id]"), form.Get(key+"[price]")
+	if priceID == "" {
+		return nil, nil
+	}
+
+	change := &planChange{behavior: "create_prorations", at: s.now()}
+	for _, it := range sub.Items.Data {
+		if it.ID == itemID {
+			change.item = it
+		}
+	}
+	if change.item == nil {
+		return nil, invalidRequest(key+"[id]", fmt.Sprintf("Subscription item %s does not belong to subscription %s.", itemID, sub.ID))
+	}
+	price, ok := s.prices[priceID]
+	if !ok {
+		return nil, notFound("price", priceID)
+	}
+	if price.Recurring == nil {
+		return nil, invalidRequest(key+"[price]", fmt.Sprintf("The price specified is set to `type=one_time` but this field only accepts prices with `type=recurring`: %s", priceID))
+	}
+	if !price.Active {
+		return nil, invalidRequest(key+"[price]", fmt.Sprintf("The price specified is inactive. This field only accepts active prices: %s", priceID))
+	}
+	if price.Currency != change.item.Price.Currency {
+		return nil, invalidRequest(key+"[price]", "The price specified does not match the currency of the subscription.")
+	}
+	change.price = price
+
+	param := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "[" + name + "]"
+	}
+	if b := form.Get(param("proration_behavior")); b != "" {
+		if b != "create_prorations" && b != "always_invoice" && b != "none" {
+			return nil, invalidRequest(param("proration_behavior"), fmt.Sprintf("Invalid proration_behavior: %s", b))
+		}
+		change.behavior = b
+	}
+	at, hasAt, err := formInt(form, param("proration_date"))
+	if err != nil {
+		return nil, err
+	}
+	if hasAt {
+		if at < sub.CurrentPeriodStart || at > sub.CurrentPeriodEnd {
+			return nil, invalidRequest(param("proration_date"), "The proration date must fall within the current billing period.")
+		}
+		change.at = at
+	}
+	old := change.item.Price.Recurring
+	change.newPeriod = old.Interval != price.Recurring.Interval || old.IntervalCount != price.Recurring.IntervalCount
+	return change, nil
+}
+
+// prorations are the invoice lines a plan change bills for the rest of the
+// current period: a credit for the old price and, unless the billing period
+// restarts, a charge for the new one. Trials are not prorated.
+func prorations(sub *stripe.Subscription, change *planChange) []*stripe.InvoiceLineItem {
+	if change.behavior == "none" || sub.Status == stripe.SubscriptionStatusTrialing {
+		return nil
+	}
+	period := sub.CurrentPeriodEnd - sub.CurrentPeriodStart
+	remaining := sub.CurrentPeriodEnd - change.at
+	if period <= 0 || remaining <= 0 {
+		return nil
+	}
+
+	qty := change.item.Quantity
+	unused := change.item.Price.UnitAmount * qty * remaining / period
+	lines := []*stripe.InvoiceLineItem{{
+		Object:      "line_item",
+		Amount:      -unused,
+		Currency:    change.item.Price.Currency,
+		Description: fmt.Sprintf("Unused time on %s after %s", change.item.Price.ID, time.Unix(change.at, 0).UTC().Format("02 Jan 2006")),
+		Period:      &stripe.Period{Start: change.at, End: sub.CurrentPeriodEnd},
+		Price:       change.item.Price,
+		Proration:   true,
+		Quantity:    qty,
+		Type:        stripe.InvoiceLineItemTypeInvoiceItem,
+	}}
+	if !change.newPeriod {
+		lines = append(lines, &stripe.InvoiceLineItem{
+			Object:      "line_item",
+			Amount:      change.price.UnitAmount * qty * remaining / period,
+			Currency:    change.price.Currency,
+			Description: fmt.Sprintf("Remaining time on %s after %s", change.price.ID, time.Unix(change.at, 0).UTC().Format("02 Jan 2006")),
+			Period:      &stripe.Period{Start: change.at, End: sub.CurrentPeriodEnd},
+			Price:       change.price,
+			Proration:   true,
+			Quantity:    qty,
+			Type:        stripe.InvoiceLineItemTypeInvoiceItem,
+		})
+	}
+	return lines
+}
+
+func (s *Server) updateSubscription(r *http.Request, form url.Values) (interface{}, error) {
+	sub, ok := s.subscriptions[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("subscription", r.PathValue("id"))
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest("", fmt.Sprintf("A canceled subscription can only update its cancellation_details. (%s)", sub.ID))
+	}
+
+	change, err := s.parsePlanChange(sub, form, "")
+	if err != nil {
+		return nil, err
+	}
+	if change != nil {
+		price := *change.price
+		change.item.Price = &price
+		if change.newPeriod && sub.Status != stripe.SubscriptionStatusTrialing {
+			sub.CurrentPeriodStart = change.at
+			sub.CurrentPeriodEnd = periodEnd(change.at, price.Recurring)
+		}
+	}
+	if _, ok := form["cancel_at_period_end"]; ok {
+		sub.CancelAtPeriodEnd = formBool(form, "cancel_at_period_end")
+		sub.CancelAt, sub.CanceledAt = 0, 0
+		if sub.CancelAtPeriodEnd {
+			sub.CancelAt, sub.CanceledAt = sub.CurrentPeriodEnd, s.now()
+		}
+	}
+	if err := s.setPauseCollection(sub, form); err != nil {
+		return nil, err
+	}
+	if pm := form.Get("default_payment_method"); pm != "" {
+		sub.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+	}
+	for k, v := range formMap(form, "metadata") {
+		if sub.Metadata == nil {
+			sub.Metadata = map[string]string{}
+		}
+		sub.Metadata[k] = v
+	}
+
+	s.emit("customer.subscription.updated", sub)
+	return sub, nil
+}
+
+// setPauseCollection pauses collection as given in pause_collection, or
+// resumes it when pause_collection is sent empty.
+func (s *Server) setPauseCollection(sub *stripe.Subscription, form url.Values) error {
+	if v, ok := form["pause_collection"]; ok && len(v) > 0 && v[0] == "" {
+		sub.PauseCollection = nil
+		return nil
+	}
+	behavior := form.Get("pause_collection[behavior]")
+	resumesAt, hasResume, err := formInt(form, "pause_collection[resumes_at]")
+	if err != nil {
+		return err
+	}
+	if behavior == "" {
+		if hasResume {
+			return missingParam("pause_collection[behavior]")
+		}
+		return nil
+	}
+	switch stripe.SubscriptionPauseCollectionBehavior(behavior) {
+	case stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft, stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible, stripe.SubscriptionPauseCollectionBehaviorVoid:
+	default:
+		return invalidRequest("pause_collection[behavior]", fmt.Sprintf("Invalid pause_collection[behavior]: %s", behavior))
+	}
+	if hasResume && resumesAt <= s.now() {
+		return invalidRequest("pause_collection[resumes_at]", "Invalid timestamp: must be in the future.")
+	}
+	sub.PauseCollection = &stripe.SubscriptionPauseCollection{
+		Behavior:  stripe.SubscriptionPauseCollectionBehavior(behavior),
+		ResumesAt: resumesAt,
+	}
+	return nil
+}
+
+// EndBillingPeriod runs a subscription to the end of its current period the
+// way Stripe's billing cycle would: one set to cancel at period end is
+// canceled, any other renews, resuming collection if its pause is over.
+func (s *Server) EndBillingPeriod(id string) (*stripe.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest("", fmt.Sprintf("Subscription %s is canceled.", id))
+	}
+
+	end := sub.CurrentPeriodEnd
+	if sub.CancelAtPeriodEnd {
+		sub.Status = stripe.SubscriptionStatusCanceled
+		sub.EndedAt = end
+		s.emit("customer.subscription.deleted", sub)
+		out := *sub
+		return &out, nil
+	}
+
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		sub.Status = stripe.SubscriptionStatusActive
+	}
+	sub.CurrentPeriodStart = end
+	if len(sub.Items.Data) > 0 {
+		sub.CurrentPeriodEnd = periodEnd(end, sub.Items.Data[0].Price.Recurring)
+	}
+	if p := sub.PauseCollection; p != nil && p.ResumesAt != 0 && p.ResumesAt <= end {
+		sub.PauseCollection = nil
+	}
+	s.emit("customer.subscription.updated", sub)
+	out := *sub
+	return &out, nil
+}
+
+// upcomingInvoice previews the next invoice of a subscription, including the
+// prorations of a plan change given in subscription_details.
+func (s *Server) upcomingInvoice(r *http.Request, form url.Values) (interface{}, error) {
+	query := r.URL.Query()
+	subID := query.Get("subscription")
+	if subID == "" {
+		return nil, missingParam("subscription")
+	}
+	sub, ok := s.subscriptions[subID]
+	if !ok {
+		return nil, notFound("subscription", subID)
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, invalidRequest("subscription", fmt.Sprintf("No upcoming invoices for customer: %s", sub.Customer.ID))
+	}
+
+	change, err := s.parsePlanChange(sub, query, "subscription_details")
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &stripe.Invoice{
+		Object:       "invoice",
+		Customer:     sub.Customer,
+		Subscription: sub,
+		Lines:        &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{}},
+		PeriodStart:  sub.CurrentPeriodStart,
+		PeriodEnd:    sub.CurrentPeriodEnd,
+		Status:       stripe.InvoiceStatusDraft,
+	}
+	next := sub.CurrentPeriodEnd
+	for _, it := range sub.Items.Data {
+		price := it.Price
+		if change != nil && it == change.item {
+			inv.Lines.Data = append(inv.Lines.Data, prorations(sub, change)...)
+			price = change.price
+			if change.newPeriod && sub.Status != stripe.SubscriptionStatusTrialing {
+				next = change.at
+			}
+		}
+		inv.Lines.Data = append(inv.Lines.Data, &stripe.InvoiceLineItem{
+			Object:      "line_item",
+			Amount:      price.UnitAmount * it.Quantity,
+			Currency:    price.Currency,
+			Description: fmt.Sprintf("%d × %s", it.Quantity, price.ID),
+			Period:      &stripe.Period{Start: next, End: periodEnd(next, price.Recurring)},
+			Price:       price,
+			Quantity:    it.Quantity,
+			Type:        stripe.InvoiceLineItemTypeSubscription,
+		})
+		inv.Currency = price.Currency
+	}
+	for _, line := range inv.Lines.Data {
+		inv.Subtotal += line.Amount
+	}
+	inv.Lines.TotalCount = uint32(len(inv.Lines.Data))
+	inv.Total = inv.Subtotal
+	inv.AmountDue = max(inv.Total, 0)
+	inv.NextPaymentAttempt = next
+	return inv, nil
+}
@@ -0,0 +1,104 @@
+package stripetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/webhook"
+)
+
+func unixNow() int64 {
+	return time.Now().Unix()
+}
+
+// emit queues an event carrying a snapshot of obj as it is right now.
+func (s *Server) emit(eventType string, obj interface{}) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		panic(fmt.Sprintf("stripetest: marshal %s: %v", eventType, err))
+	}
+
+	s.events = append(s.events, &stripe.Event{
+		ID:              s.newID("evt"),
+		Object:          "event",
+		APIVersion:      stripe.APIVersion,
+		Created:         s.now(),
+		Data:            &stripe.EventData{Raw: raw},
+		PendingWebhooks: 1,
+		Type:            stripe.EventType(eventType),
+	})
+}
+
+// Events returns every event emitted so far, oldest first.
+func (s *Server) Events() []*stripe.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*stripe.Event(nil), s.events...)
+}
+
+// SignedPayload encodes event and returns the body together with a valid
+// Stripe-Signature header for it.
+func (s *Server) SignedPayload(event *stripe.Event) ([]byte, string, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  s.secret,
+	})
+	return signed.Payload, signed.Header, nil
+}
+
+// DeliverWebhooks posts every event that has not been delivered yet to the
+// webhook target, in the order they were emitted. It stops at the first
+// delivery that fails or is answered with a non-2xx status; that event is
+// retried on the next call.
+func (s *Server) DeliverWebhooks() error {
+	s.mu.Lock()
+	target, do := s.webhook, s.do
+	pending := append([]*stripe.Event(nil), s.events[s.delivered:]...)
+	s.mu.Unlock()
+
+	if target == "" {
+		return fmt.Errorf("stripetest: no webhook target set")
+	}
+	if do == nil {
+		do = http.DefaultClient.Do
+	}
+
+	for _, event := range pending {
+		payload, header, err := s.SignedPayload(event)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Stripe-Signature", header)
+
+		resp, err := do(req)
+		if err != nil {
+			return fmt.Errorf("stripetest: deliver %s (%s): %w", event.ID, event.Type, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("stripetest: deliver %s (%s): status %d: %s", event.ID, event.Type, resp.StatusCode, body)
+		}
+
+		s.mu.Lock()
+		s.delivered++
+		s.mu.Unlock()
+	}
+	return nil
+}